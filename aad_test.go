@@ -0,0 +1,120 @@
+// aad_test.go
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// aadHeaders devuelve la cabecera X-Signature-AAD con aad, o nil sin AAD
+func aadHeaders(aad string) http.Header {
+	if aad == "" {
+		return nil
+	}
+	h := http.Header{}
+	h.Set(aadHeader, aad)
+	return h
+}
+
+// envelopeWith copia el sobre de /sign?echo=true cambiando (o quitando, con
+// nil) los campos dados
+func envelopeWith(env map[string]interface{}, fields map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(env))
+	for k, v := range env {
+		out[k] = v
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(out, k)
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func TestAADRoundTrip(t *testing.T) {
+	doc := map[string]interface{}{"pedido": "AAD-1", "importe": 10.0}
+	bound := testSign(t, "?echo=true", doc, aadHeaders("pagos:acme"))
+	if bound["aad"] != true {
+		t.Fatalf("el sobre debe llevar aad: true: %v", bound)
+	}
+	plain := testSign(t, "?echo=true", doc, nil)
+	if _, ok := plain["aad"]; ok {
+		t.Fatalf("sin AAD el sobre no lleva aad: %v", plain)
+	}
+
+	tests := []struct {
+		name  string
+		env   map[string]interface{}
+		aad   string
+		valid bool
+	}{
+		{"con el mismo AAD", bound, "pagos:acme", true},
+		{"sin AAD", bound, "", false},
+		{"con otro AAD", bound, "pagos:otro", false},
+		{"con un prefijo del AAD", bound, "pagos:acm", false},
+		{"quitando aad del sobre", envelopeWith(bound, map[string]interface{}{"aad": nil}), "", false},
+		{"sin AAD, firma normal", plain, "", true},
+		// Una firma normal no vale como firma con AAD ni al revés
+		{"firma normal con AAD", plain, "pagos:acme", false},
+		{"firma normal marcada con aad", envelopeWith(plain, map[string]interface{}{"aad": true}), "pagos:acme", false},
+		{"firma con AAD en el sobre normal", envelopeWith(plain, map[string]interface{}{"signature": bound["signature"]}), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVerify(t, tt.env, aadHeaders(tt.aad))
+			if v["valid"] != tt.valid {
+				t.Fatalf("valid = %v, se esperaba %v: %v", v["valid"], tt.valid, v)
+			}
+			if !tt.valid && v["code"] != string(errSignatureMismatch) {
+				t.Fatalf("code = %v", v["code"])
+			}
+		})
+	}
+}
+
+// Lo firmado con AAD lleva el dominio y la longitud del AAD delante: sin
+// AAD son los bytes canónicos, y mover bytes entre el AAD y el documento
+// cambia lo firmado
+func TestWithAAD(t *testing.T) {
+	data := []byte(`{"a":1}`)
+	if got := withAAD(data, nil); !bytes.Equal(got, data) {
+		t.Fatalf("sin AAD: %q", got)
+	}
+	got := withAAD(data, []byte("t"))
+	if !bytes.HasPrefix(got, []byte(aadDomain)) || !bytes.HasSuffix(got, data) {
+		t.Fatalf("con AAD: %q", got)
+	}
+	if bytes.Equal(withAAD([]byte(`b{"a":1}`), []byte("a")), withAAD(data, []byte("ab"))) {
+		t.Fatal("AAD y documento no deben poder intercambiar bytes")
+	}
+}
+
+func TestValidateAAD(t *testing.T) {
+	t.Setenv("AAD_MAX_BYTES", "8")
+	tests := []struct {
+		target, aad string
+		ok          bool
+	}{
+		{"/sign", "tenant", true},
+		{"/sign", "", true},
+		{"/sign/manifest", "tenant", false},
+		{"/sign", "demasiado-largo", false},
+		{"/sign?format=jws", "tenant", false},
+		{"/sign?defer=true", "tenant", false},
+		{"/verify", "tenant", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		r.Header = aadHeaders(tt.aad)
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if problems := validateAAD(r); (len(problems) == 0) != tt.ok {
+			t.Errorf("%s con %q: %v", tt.target, tt.aad, problems)
+		}
+	}
+}
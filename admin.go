@@ -0,0 +1,31 @@
+// admin.go
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin comprueba el token de ADMIN_TOKEN en "Authorization: Bearer".
+// Sin ADMIN_TOKEN configurado los endpoints de administración quedan
+// deshabilitados. Si no autoriza, ya ha respondido.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := getEnv("ADMIN_TOKEN", "")
+	if token == "" {
+		writeError(w, http.StatusForbidden, errAdminDisabled, "Administración deshabilitada (ADMIN_TOKEN no definido)")
+		return false
+	}
+	if !isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, errUnauthorized, "No autorizado")
+		return false
+	}
+	return true
+}
+
+// isAdmin indica si la petición trae el token de ADMIN_TOKEN, sin responder
+func isAdmin(r *http.Request) bool {
+	token := getEnv("ADMIN_TOKEN", "")
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
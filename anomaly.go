@@ -0,0 +1,193 @@
+// anomaly.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// callerBaseline es el comportamiento habitual de un caller al firmar
+type callerBaseline struct {
+	minute      time.Time      // minuto en curso
+	minuteCount float64        // firmas en el minuto en curso
+	rate        float64        // media móvil exponencial de firmas por minuto
+	total       int            // firmas observadas desde el arranque
+	docTypes    map[string]int // firmas por doc_type
+	hours       [24]int        // firmas por hora del día (UTC)
+	throttled   time.Time      // hasta cuándo está frenado
+}
+
+// anomalyAlert es una desviación detectada
+type anomalyAlert struct {
+	Time   time.Time `json:"time"`
+	Caller string    `json:"caller"`
+	Kind   string    `json:"kind"` // "rate", "doc_type", "hour"
+	Detail string    `json:"detail"`
+}
+
+var (
+	baselinesMu sync.Mutex
+	baselines   = map[string]*callerBaseline{}
+	alerts      []anomalyAlert
+	alertCount  = map[string]int{} // por tipo, para métricas
+)
+
+// Umbrales. Antes de ANOMALY_WARMUP firmas no se juzga a un caller.
+func anomalyWarmup() int         { return envInt("ANOMALY_WARMUP", 200) }
+func anomalyRateFactor() float64 { return float64(envInt("ANOMALY_RATE_FACTOR", 20)) }
+
+// guardCaller registra la firma en la línea base del caller (ver
+// callerThrottle). Si no deja firmar, ya ha respondido.
+func guardCaller(w http.ResponseWriter, r *http.Request) bool {
+	if wait := callerThrottle(r); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, errCallerThrottled, "Firma frenada por comportamiento anómalo")
+		return false
+	}
+	return true
+}
+
+// callerThrottle registra la firma en la línea base del caller y comprueba
+// si se desvía de ella (volumen, doc_type nuevo, hora inusual). Con
+// ANOMALY_ACTION=throttle, una desviación frena al caller durante
+// ANOMALY_THROTTLE_FOR. Devuelve cuánto le queda frenado (0 si puede
+// firmar).
+func callerThrottle(r *http.Request) time.Duration {
+	caller := callerID(r)
+	now := time.Now().UTC()
+	found := observeSigning(caller, requestDocType(r), now)
+
+	baselinesMu.Lock()
+	b := baselines[caller]
+	if len(found) > 0 && getEnv("ANOMALY_ACTION", "alert") == "throttle" {
+		d, err := time.ParseDuration(getEnv("ANOMALY_THROTTLE_FOR", "15m"))
+		if err != nil {
+			d = 15 * time.Minute
+		}
+		b.throttled = now.Add(d)
+	}
+	throttledUntil := b.throttled
+	baselinesMu.Unlock()
+
+	for _, a := range found {
+		log.Printf("🚨 Anomalía de firma (%s) caller=%s: %s", a.Kind, a.Caller, a.Detail)
+		e := newAuditEntry(r, "anomaly."+a.Kind, "", nil)
+		e.Outcome, e.Detail = "alert", a.Detail
+		recordAudit(r.Context(), e)
+	}
+
+	if now.Before(throttledUntil) {
+		return throttledUntil.Sub(now)
+	}
+	return 0
+}
+
+// observeSigning actualiza la línea base y devuelve las anomalías detectadas
+func observeSigning(caller, docType string, now time.Time) []anomalyAlert {
+	baselinesMu.Lock()
+	defer baselinesMu.Unlock()
+
+	b := baselines[caller]
+	if b == nil {
+		b = &callerBaseline{docTypes: map[string]int{}}
+		baselines[caller] = b
+	}
+	var found []anomalyAlert
+	warm := b.total >= anomalyWarmup()
+
+	// Volumen: al cambiar de minuto se incorpora el anterior a la media
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(b.minute) {
+		if !b.minute.IsZero() {
+			// Los minutos sin actividad también cuentan para la media
+			idle := int(minute.Sub(b.minute)/time.Minute) - 1
+			b.rate = 0.9*b.rate + 0.1*b.minuteCount
+			for i := 0; i < idle && i < 60; i++ {
+				b.rate *= 0.9
+			}
+		}
+		b.minute, b.minuteCount = minute, 0
+	}
+	b.minuteCount++
+	limit := anomalyRateFactor() * b.rate
+	if warm && b.minuteCount > limit && b.minuteCount > 10 && b.minuteCount-1 <= limit {
+		found = append(found, anomalyAlert{Kind: "rate", Detail: fmt.Sprintf("%.0f firmas/min frente a una media de %.2f", b.minuteCount, b.rate)})
+	}
+
+	// doc_type nunca visto
+	if warm && docType != "" && b.docTypes[docType] == 0 {
+		found = append(found, anomalyAlert{Kind: "doc_type", Detail: fmt.Sprintf("primer doc_type %q tras %d firmas", docType, b.total)})
+	}
+	b.docTypes[docType]++
+
+	// Hora del día en la que casi nunca firma (<1% del histórico)
+	hour := now.Hour()
+	if warm && b.hours[hour]*100 < b.total {
+		found = append(found, anomalyAlert{Kind: "hour", Detail: fmt.Sprintf("firma a las %02d UTC, hora inusual para este caller", hour)})
+	}
+	b.hours[hour]++
+	b.total++
+
+	for i := range found {
+		found[i].Time, found[i].Caller = now, caller
+		alertCount[found[i].Kind]++
+		alerts = append(alerts, found[i])
+	}
+	if len(alerts) > 100 {
+		alerts = alerts[len(alerts)-100:]
+	}
+	return found
+}
+
+// anomaliesHandler expone las últimas alertas y su recuento por tipo
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	baselinesMu.Lock()
+	defer baselinesMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alerts": alerts,
+		"counts": alertCount,
+	})
+}
+
+// envInt lee una variable de entorno entera con valor por defecto
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envDuration lee una variable de entorno con una duración (30s, 1m) con
+// valor por defecto
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
+}
+
+// envList devuelve los elementos no vacíos de una variable separada por
+// comas
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(getEnv(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+// approvals.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// approvalCollection guarda las aprobaciones reforzadas (step-up)
+const approvalCollection = "approvals"
+
+// approval es una autorización de un solo uso, concedida por un
+// administrador, para firmar con una clave saltándose su política (p.ej.
+// fuera de su ventana horaria)
+type approval struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"key"`
+	Reason    string     `json:"reason"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// approvalRequest es el cuerpo de POST /admin/approvals
+type approvalRequest struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl,omitempty"` // 1h por defecto
+}
+
+// authorizeSigning aplica la política de la clave (ver
+// signingAuthorization). Si no autoriza, ya ha respondido.
+func authorizeSigning(w http.ResponseWriter, r *http.Request, alias string) bool {
+	if f := signingAuthorization(r, alias); f != nil {
+		f.write(w)
+		return false
+	}
+	return true
+}
+
+// signingAuthorization aplica la política de la clave. Si la firma no está
+// permitida ahora, sólo se acepta con una aprobación vigente en
+// X-Approval-Id, que queda consumida. Una clave comprometida o borrada no
+// firma nunca.
+func signingAuthorization(r *http.Request, alias string) *signFailure {
+	if _, compromised := keyCompromised(r.Context(), alias); compromised {
+		return &signFailure{http.StatusForbidden, errKeyCompromised, fmt.Sprintf("La clave %q está desactivada por compromiso", alias)}
+	}
+	if _, deleted := keyDeleted(r.Context(), alias); deleted {
+		return &signFailure{http.StatusForbidden, errKeyDeleted, fmt.Sprintf("La clave %q está borrada (sólo verificación)", alias)}
+	}
+	if signingAllowedAt(alias, time.Now()) {
+		return nil
+	}
+	id := r.Header.Get("X-Approval-Id")
+	if id == "" {
+		return &signFailure{http.StatusForbidden, errSigningWindowClosed, fmt.Sprintf("La clave %q no permite firmar en este momento", alias)}
+	}
+	if err := consumeApproval(r.Context(), id, alias); err != nil {
+		return &signFailure{http.StatusForbidden, errApprovalRejected, fmt.Sprintf("Aprobación rechazada: %v", err)}
+	}
+	return nil
+}
+
+func consumeApproval(ctx context.Context, id, alias string) error {
+	raw, err := db.Get(ctx, approvalCollection, id)
+	if errors.Is(err, errNotFound) {
+		return errors.New("aprobación desconocida")
+	}
+	if err != nil {
+		return err
+	}
+	var a approval
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	switch {
+	case a.Key != alias:
+		return errors.New("la aprobación es para otra clave")
+	case a.UsedAt != nil:
+		return errors.New("la aprobación ya se ha usado")
+	case now.After(a.ExpiresAt):
+		return errors.New("la aprobación ha caducado")
+	}
+	a.UsedAt = &now
+	raw, _ = json.Marshal(a)
+	return db.Put(ctx, approvalCollection, id, raw)
+}
+
+// approvalsHandler permite a un administrador conceder aprobaciones (POST)
+// y consultarlas (GET)
+func approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := pageRequest(w, r)
+		if !ok {
+			return
+		}
+		records, ids, err := db.List(ctx, approvalCollection)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+			return
+		}
+		list, next := paginate(p, ids, func(id string) (a approval, ok bool) {
+			return a, json.Unmarshal(records[id], &a) == nil
+		})
+		writePage(w, "approvals", list, next)
+
+	case http.MethodPost:
+		var req approvalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+			return
+		}
+		if req.Key == "" || req.Reason == "" {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "key y reason son obligatorios")
+			return
+		}
+		if req.TTL == "" {
+			req.TTL = "1h"
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "ttl inválido")
+			return
+		}
+		id, err := randomID()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, "No se pudo generar el id")
+			return
+		}
+		now := time.Now().UTC()
+		a := approval{ID: id, Key: req.Key, Reason: req.Reason, ExpiresAt: now.Add(ttl), CreatedAt: now}
+		raw, _ := json.Marshal(a)
+		if err := db.Put(ctx, approvalCollection, id, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error guardando: %v", err))
+			return
+		}
+		recordAdminAudit(r, "approval_granted", fmt.Sprintf("%s key=%s reason=%s", a.ID, a.Key, a.Reason))
+		writeJSON(w, http.StatusCreated, a)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET o POST permitido")
+	}
+}
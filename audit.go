@@ -0,0 +1,190 @@
+// audit.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// auditCollection guarda una entrada por operación de firma o verificación
+const auditCollection = "audit"
+
+// auditEntry es el registro de auditoría de una operación. Nunca incluye el
+// payload, sólo su hash.
+type auditEntry struct {
+	ID            string    `json:"id"`
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"` // "sign", "verify", ...
+	Caller        string    `json:"caller,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	DocType       string    `json:"doc_type,omitempty"`
+	Key           string    `json:"key,omitempty"`
+	PayloadSHA256 string    `json:"payload_sha256,omitempty"`
+	Bytes         int       `json:"bytes,omitempty"` // tamaño canónico del payload
+	Outcome       string    `json:"outcome"`         // "ok", "invalid", "error"
+	Detail        string    `json:"detail,omitempty"`
+}
+
+// requestMeta es quién pide la operación y para qué tenant y tipo de
+// documento. Se separa de la petición para poder firmar fuera de ella (ver
+// deferred.go).
+type requestMeta struct {
+	Caller  string `json:"caller,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	DocType string `json:"doc_type,omitempty"`
+}
+
+func metaOf(r *http.Request) requestMeta {
+	return requestMeta{Caller: callerID(r), Tenant: requestTenant(r), DocType: requestDocType(r)}
+}
+
+// newAuditEntry prepara una entrada con los datos comunes de la petición
+func newAuditEntry(r *http.Request, event, alias string, data []byte) auditEntry {
+	return newAuditEntryFor(metaOf(r), event, alias, data)
+}
+
+// newAuditEntryFor es newAuditEntry para operaciones sin petición en curso
+func newAuditEntryFor(m requestMeta, event, alias string, data []byte) auditEntry {
+	e := auditEntry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Caller:  m.Caller,
+		Tenant:  m.Tenant,
+		DocType: m.DocType,
+		Key:     alias,
+	}
+	if data != nil {
+		sum := sha256.Sum256(data)
+		e.PayloadSHA256 = hex.EncodeToString(sum[:])
+		e.Bytes = len(data)
+	}
+	return e
+}
+
+// recordAudit persiste la entrada y la reenvía a los sinks configurados. Los ids empiezan por el instante en
+// nanosegundos, así que el orden por id es el orden cronológico. Un fallo
+// al auditar se registra en el log pero no tumba la operación.
+func recordAudit(ctx context.Context, e auditEntry) {
+	operations.inc(e.Event, e.Outcome)
+	// La auditoría se guarda aunque el cliente ya se haya ido
+	ctx, end := startSpan(context.WithoutCancel(ctx), "audit", attribute.String("event", e.Event))
+	var err error
+	defer func() { end(err) }()
+	if e.ID, err = timeOrderedID(e.Time); err != nil {
+		log.Printf("⚠️  Auditoría: %v", err)
+		return
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("⚠️  Auditoría: %v", err)
+		return
+	}
+	if err := db.Put(ctx, auditCollection, e.ID, raw); err != nil {
+		log.Printf("⚠️  Auditoría: no se pudo guardar %s: %v", e.ID, err)
+	}
+	for _, sink := range auditSinks {
+		sink.Emit(e)
+	}
+}
+
+// recordAdminAudit deja constancia de un cambio administrativo
+func recordAdminAudit(r *http.Request, event, detail string) {
+	e := newAuditEntry(r, "admin."+event, "", nil)
+	e.Outcome, e.Detail = "ok", detail
+	recordAudit(r.Context(), e)
+}
+
+// timeOrderedID genera un id que ordena lexicográficamente por instante
+func timeOrderedID(t time.Time) (string, error) {
+	suffix, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", t.UnixNano(), suffix[:8]), nil
+}
+
+// contentHash identifica entradas duplicadas (mismo contenido salvo el id)
+func (e auditEntry) contentHash() string {
+	e.ID = ""
+	raw, _ := json.Marshal(e)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// outcomeOf traduce el resultado de una verificación a su valor de auditoría
+func outcomeOf(valid bool) string {
+	if valid {
+		return "ok"
+	}
+	return "invalid"
+}
+
+// auditQueryHandler (GET /admin/audit) consulta la auditoría, paginada
+// (ver pagination.go) y en orden cronológico. Filtros opcionales: event,
+// caller, tenant, key, outcome y el rango [from, to) en RFC 3339.
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	p, ok := pageRequest(w, r)
+	if !ok {
+		return
+	}
+	from, to, err := requestTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	filters := map[string]string{"event": q.Get("event"), "caller": q.Get("caller"), "tenant": q.Get("tenant"), "key": q.Get("key"), "outcome": q.Get("outcome")}
+
+	records, ids, err := db.List(r.Context(), auditCollection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+		return
+	}
+	entries, next := paginate(p, ids, func(id string) (e auditEntry, ok bool) {
+		if json.Unmarshal(records[id], &e) != nil || !inTimeRange(e.Time, from, to) {
+			return e, false
+		}
+		for field, want := range map[string]string{"event": e.Event, "caller": e.Caller, "tenant": e.Tenant, "key": e.Key, "outcome": e.Outcome} {
+			if filters[field] != "" && filters[field] != want {
+				return e, false
+			}
+		}
+		return e, true
+	})
+	writePage(w, "entries", entries, next)
+}
+
+// requestTimeRange lee ?from= y ?to= (RFC 3339, opcionales)
+func requestTimeRange(r *http.Request) (from, to time.Time, err error) {
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := r.URL.Query().Get(f.name); v != "" {
+			if *f.dst, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return from, to, fmt.Errorf("%s debe ser un instante RFC 3339", f.name)
+			}
+		}
+	}
+	return from, to, nil
+}
+
+// inTimeRange indica si t está en [from, to); los extremos cero no limitan
+func inTimeRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
@@ -0,0 +1,179 @@
+// backends.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	kms "cloud.google.com/go/kms/apiv1"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Backends de firma, elegidos con SIGNER_BACKEND. La API (/sign, /verify,
+// JWS, JWKS...) es la misma con cualquiera de ellos; lo que cambia es dónde
+// vive la clave.
+//
+//	gcp-kms        Cloud KMS (por defecto): GOOGLE_CLOUD_PROJECT, KMS_KEY_RING,
+//	               KMS_KEY, KMS_KEY_VERSION...
+//	vault-transit  HashiCorp Vault Transit: VAULT_ADDR, VAULT_TOKEN,
+//	               VAULT_NAMESPACE, VAULT_TRANSIT_MOUNT (transit),
+//	               VAULT_TRANSIT_KEY y VAULT_TRANSIT_KEY_VERSION (1)
+//	local          HMAC-SHA256 con un secreto de LOCAL_HMAC_SECRET o del
+//	               fichero LOCAL_HMAC_SECRET_FILE; LOCAL_KEY_ID (local:dev)
+//	               es el key_version de los sobres. Sólo para desarrollo y
+//	               tests: funciona sin red ni credenciales. LOCAL_BLS=true
+//	               añade firmas BLS agregables (ver bls.go).
+//
+// El cifrado de campos (KMS_ENCRYPTION_KEY) y la firma en sombra siguen
+// necesitando Cloud KMS.
+const (
+	backendGCPKMS       = "gcp-kms"
+	backendVaultTransit = "vault-transit"
+	backendLocal        = "local"
+)
+
+var signerBackend = backendGCPKMS
+
+// configureSignerBackend lee SIGNER_BACKEND y la configuración del backend
+// elegido. Es configuración: si falta algo se sale con exitConfig.
+func configureSignerBackend() {
+	signerBackend = getEnv("SIGNER_BACKEND", backendGCPKMS)
+	switch signerBackend {
+	case backendGCPKMS:
+		configureKMSNames()
+	case backendVaultTransit:
+		v, err := vaultTransitFromEnv()
+		if err != nil {
+			exitWith(exitConfig, "%v", err)
+		}
+		nameVersion = v.KeyVersion()
+	case backendLocal:
+		l, err := localFromEnv()
+		if err != nil {
+			exitWith(exitConfig, "%v", err)
+		}
+		nameVersion = l.KeyVersion()
+		log.Printf("⚠️  SIGNER_BACKEND=local: la clave HMAC no está protegida, sólo para desarrollo")
+	default:
+		exitWith(exitConfig, "SIGNER_BACKEND desconocido: %q (gcp-kms, vault-transit, local)", signerBackend)
+	}
+}
+
+// vaultTransitFromEnv construye el backend de Vault a partir del entorno
+func vaultTransitFromEnv() (*firmajson.VaultTransit, error) {
+	v := &firmajson.VaultTransit{
+		Addr:      os.Getenv("VAULT_ADDR"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Mount:     getEnv("VAULT_TRANSIT_MOUNT", "transit"),
+		KeyName:   os.Getenv("VAULT_TRANSIT_KEY"),
+	}
+	switch {
+	case v.Addr == "":
+		return nil, fmt.Errorf("VAULT_ADDR no está definido")
+	case v.Token == "":
+		return nil, fmt.Errorf("VAULT_TOKEN no está definido")
+	case v.KeyName == "":
+		return nil, fmt.Errorf("VAULT_TRANSIT_KEY no está definido")
+	}
+	version, err := strconv.Atoi(getEnv("VAULT_TRANSIT_KEY_VERSION", "1"))
+	if err != nil || version < 1 {
+		return nil, fmt.Errorf("VAULT_TRANSIT_KEY_VERSION inválido: %q", getEnv("VAULT_TRANSIT_KEY_VERSION", "1"))
+	}
+	v.Version = version
+	return v, nil
+}
+
+// localFromEnv construye el backend local con el secreto de
+// LOCAL_HMAC_SECRET o, si no está, del fichero LOCAL_HMAC_SECRET_FILE
+func localFromEnv() (*firmajson.Local, error) {
+	secret, err := localSecretFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return firmajson.NewLocal(secret, getEnv("LOCAL_KEY_ID", "local:dev"))
+}
+
+// localSecretFromEnv lee LOCAL_HMAC_SECRET o el fichero
+// LOCAL_HMAC_SECRET_FILE
+func localSecretFromEnv() ([]byte, error) {
+	if secret := os.Getenv("LOCAL_HMAC_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	path := os.Getenv("LOCAL_HMAC_SECRET_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("SIGNER_BACKEND=local necesita LOCAL_HMAC_SECRET o LOCAL_HMAC_SECRET_FILE")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("leyendo LOCAL_HMAC_SECRET_FILE: %w", err)
+	}
+	return bytes.TrimRight(raw, "\r\n"), nil
+}
+
+// backendForKeyVersion crea un backend del mismo tipo que signer para otra
+// versión de clave: una CryptoKeyVersion con gcp-kms o
+// vault:<mount>/<clave>/<versión> con vault-transit. El backend local sólo
+// tiene una clave.
+func backendForKeyVersion(kv string) (firmajson.Backend, error) {
+	switch signerBackend {
+	case backendGCPKMS:
+		if kmsClient == nil {
+			return nil, fmt.Errorf("KMS no está listo")
+		}
+		return firmajson.NewKMS(kmsClient, kv), nil
+	case backendVaultTransit:
+		v, err := vaultTransitFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.TrimSuffix(v.KeyVersion(), strconv.Itoa(v.Version))
+		n, err := strconv.Atoi(strings.TrimPrefix(kv, prefix))
+		if !strings.HasPrefix(kv, prefix) || err != nil || n < 1 {
+			return nil, fmt.Errorf("%s no es una versión de %s", kv, v.KeyName)
+		}
+		v.Version = n
+		return v, nil
+	}
+	return nil, fmt.Errorf("el backend %s sólo tiene la versión %s", signerBackend, nameVersion)
+}
+
+// newSignerBackend crea el backend elegido y comprueba que la clave es
+// accesible. Con gcp-kms devuelve también el cliente de KMS; con otros
+// backends es nil.
+func newSignerBackend(ctx context.Context) (firmajson.Backend, *kms.KeyManagementClient, error) {
+	switch signerBackend {
+	case backendLocal:
+		l, err := localFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, nil, nil
+	case backendVaultTransit:
+		v, err := vaultTransitFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := v.Key(ctx); err != nil {
+			return nil, nil, err
+		}
+		return v, nil, nil
+	}
+	client, err := kms.NewKeyManagementClient(ctx, kmsClientOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	disableGAXRetries(client)
+	s := firmajson.NewKMS(client, nameVersion)
+	if _, err := s.Key(ctx); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return s, client, nil
+}
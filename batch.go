@@ -0,0 +1,335 @@
+// batch.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// signBatchMaxItems es el máximo de documentos por lote (SIGN_BATCH_MAX_ITEMS)
+func signBatchMaxItems() int {
+	return envInt("SIGN_BATCH_MAX_ITEMS", 500)
+}
+
+// validateSignBatchRequest comprueba {"payloads": [...]} de /sign/batch.
+// Las opciones de query son las de /sign salvo las que sólo tienen sentido
+// con un documento (salida JWS, compresión, detached, firma diferida,
+// acuse); cada documento se valida como en /sign.
+func validateSignBatchRequest(r *http.Request, body []byte) []validationProblem {
+	var problems []validationProblem
+	if !validEscapeMode(requestEscape(r)) {
+		problems = append(problems, validationProblem{"escape", errInvalidRequest, "escape debe ser html, minimal, ascii o jcs"})
+	}
+	for _, param := range []string{"format", "compress", "detached", "defer", "notify"} {
+		if r.URL.Query().Get(param) != "" {
+			problems = append(problems, validationProblem{param, errInvalidRequest, fmt.Sprintf("/sign/batch no admite %s", param)})
+		}
+	}
+	problems = append(problems, validateBatchDeadline(r)...)
+	problems = append(problems, validateAAD(r)...)
+	problems = append(problems, validateDigest(r)...)
+	var req struct {
+		Payloads []json.RawMessage `json:"payloads"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return append(problems, validationProblem{"body", errInvalidJSON, `El cuerpo debe ser {"payloads": [...]}`})
+	}
+	if max := signBatchMaxItems(); len(req.Payloads) == 0 || len(req.Payloads) > max {
+		return append(problems, validationProblem{"payloads", errInvalidRequest, fmt.Sprintf("payloads debe tener entre 1 y %d documentos", max)})
+	}
+	for i, raw := range req.Payloads {
+		for _, p := range validateSignDocument(r, raw) {
+			if p.Field == "body" {
+				p.Field = fmt.Sprintf("payloads[%d]", i)
+			} else {
+				p.Field = fmt.Sprintf("payloads[%d].%s", i, p.Field)
+			}
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// signBatchRequest es el cuerpo de /sign/batch
+type signBatchRequest struct {
+	Payloads     []json.RawMessage `json:"payloads"`
+	Continuation string            `json:"continuation,omitempty"`
+}
+
+// verifyBatchRequest es el cuerpo de /verify/batch
+type verifyBatchRequest struct {
+	Envelopes    []json.RawMessage `json:"envelopes"`
+	Continuation string            `json:"continuation,omitempty"`
+}
+
+// signBatchHandler firma un lote de documentos (POST /sign/batch) con la
+// misma clave y las mismas opciones. Las llamadas a KMS se hacen en
+// paralelo, como mucho SIGN_BATCH_CONCURRENCY a la vez (8), y siguen
+// pasando por el pacer de la clave. Un documento que falla no tumba el
+// lote: su resultado lleva error y code, y la respuesta cuenta los
+// firmados y los fallidos. Con ?deadline= devuelve lo firmado a tiempo y un
+// token para el resto (ver batchdeadline.go).
+func signBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
+		return
+	}
+	var req signBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	todo, err := batchTodo(req.Continuation, "sign", alias, req.Payloads)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errContinuationInvalid, err.Error())
+		return
+	}
+	deadline, _ := requestBatchDeadline(r, time.Now())
+
+	results, pending := runBatch(r, todo, envInt("SIGN_BATCH_CONCURRENCY", 8), deadline, func(ctx context.Context, i int) map[string]interface{} {
+		return signBatchItem(ctx, r, alias, req.Payloads[i])
+	})
+	failed := 0
+	for _, res := range results {
+		if _, isErr := res["error"]; isErr {
+			failed++
+		}
+	}
+	resp := map[string]interface{}{
+		"results":     results,
+		"signed":      len(results) - failed,
+		"failed":      failed,
+		"key":         alias,
+		"key_version": aliasKeyVersion(alias),
+	}
+	addContinuation(resp, "sign", alias, req.Payloads, pending)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// signBatchItem firma un documento del lote como lo haría /sign. Devuelve
+// nil si venció el plazo de ctx antes de firmarlo.
+func signBatchItem(ctx context.Context, r *http.Request, alias string, raw json.RawMessage) map[string]interface{} {
+	var payloadMap map[string]interface{}
+	if err := firmajson.DecodeJSON(raw, &payloadMap); err != nil || payloadMap == nil {
+		return errorBody(errInvalidJSON, "JSON inválido", nil)
+	}
+	data, f := signablePayload(r, alias, payloadMap, requestEscape(r))
+	if f != nil {
+		return errorBody(f.code, f.msg, nil)
+	}
+
+	signCtx := withKeyPriority(ctx, alias)
+	audit := newAuditEntry(r, "sign_batch", alias, data)
+	start := time.Now()
+	aad, digest := requestAAD(r), requestDigest(r)
+	signature, err := kmsSign(signCtx, withAAD(withDigest(data, digest), aad))
+	if err != nil && signCtx.Err() != nil {
+		return nil
+	}
+	// Lo que sigue a la firma no se corta con el plazo
+	ctx = context.WithoutCancel(signCtx)
+	if err != nil {
+		audit.Outcome, audit.Detail = "error", err.Error()
+		recordAudit(ctx, audit)
+		_, code := kmsErrorStatus(err, errKMSSignFailed)
+		return errorBody(code, fmt.Sprintf("Error firmando: %v", err), nil)
+	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+	maybeShadowSign(withDigest(data, digest), time.Since(start))
+
+	resp := map[string]interface{}{
+		"payload":   payloadMap,
+		"signature": signature,
+	}
+	addSignatureInfo(ctx, resp, signature)
+	if aad != nil {
+		resp["aad"] = true
+	}
+	if digest != "" {
+		resp["digest"] = digest
+	}
+	escape := requestEscape(r)
+	if escape != "" && escape != escapeHTML {
+		resp["escape"] = escape
+	}
+	if envelopeStorageEnabled() {
+		id, err := storeEnvelope(ctx, metaOf(r), alias, payloadMap, signature, escape, digest)
+		if err != nil {
+			return errorBody(errStoreFailed, fmt.Sprintf("Firmado pero no guardado: %v", err), nil)
+		}
+		resp["envelope_id"] = id
+	}
+	documentSigned(alias, resp, payloadMap, escape)
+	if !echoPayload(r) {
+		omitPayload(resp, injectedFields(r, alias, payloadMap))
+	}
+	return resp
+}
+
+// verifyBatchMaxItems es el máximo de sobres por lote (VERIFY_BATCH_MAX_ITEMS)
+func verifyBatchMaxItems() int {
+	return envInt("VERIFY_BATCH_MAX_ITEMS", 500)
+}
+
+// validateVerifyBatchRequest comprueba {"envelopes": [...]} de
+// /verify/batch; cada sobre se valida como en /verify
+func validateVerifyBatchRequest(r *http.Request, body []byte) []validationProblem {
+	var req struct {
+		Envelopes []json.RawMessage `json:"envelopes"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return []validationProblem{{"body", errInvalidJSON, `El cuerpo debe ser {"envelopes": [...]}`}}
+	}
+	if max := verifyBatchMaxItems(); len(req.Envelopes) == 0 || len(req.Envelopes) > max {
+		return []validationProblem{{"envelopes", errInvalidRequest, fmt.Sprintf("envelopes debe tener entre 1 y %d sobres", max)}}
+	}
+	problems := append(validateMaxAge(r), validateBatchDeadline(r)...)
+	problems = append(problems, validateAAD(r)...)
+	for i, raw := range req.Envelopes {
+		for _, p := range validateEnvelopeRequest(r, raw) {
+			p.Field = fmt.Sprintf("envelopes[%d].%s", i, p.Field)
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// verifyBatchHandler verifica un lote de sobres (POST /verify/batch). Se
+// verifican en paralelo, como mucho VERIFY_BATCH_CONCURRENCY a la vez (8).
+// Cada resultado es el de /verify para ese sobre; "valid" es true sólo si
+// lo son todos. Admite ?deadline= como /sign/batch.
+func verifyBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	var req verifyBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	todo, err := batchTodo(req.Continuation, "verify", "", req.Envelopes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errContinuationInvalid, err.Error())
+		return
+	}
+	deadline, _ := requestBatchDeadline(r, time.Now())
+
+	results, pending := runBatch(r, todo, envInt("VERIFY_BATCH_CONCURRENCY", 8), deadline, func(ctx context.Context, i int) map[string]interface{} {
+		return verifyBatchItem(ctx, r, req.Envelopes[i])
+	})
+
+	valid, invalid, failed := 0, 0, 0
+	for _, res := range results {
+		switch {
+		case res["error"] != nil:
+			failed++
+		case res["valid"] == true:
+			valid++
+		default:
+			invalid++
+		}
+	}
+	resp := map[string]interface{}{
+		"valid":   valid == len(results) && len(pending) == 0,
+		"results": results,
+		"counts":  map[string]int{"valid": valid, "invalid": invalid, "errors": failed},
+	}
+	addContinuation(resp, "verify", "", req.Envelopes, pending)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// invalidItem es el resultado de un sobre del lote que no se pudo verificar
+func invalidItem(code errCode, msg string) map[string]interface{} {
+	out := errorBody(code, msg, nil)
+	out["valid"] = false
+	return out
+}
+
+// verifyBatchItem verifica un sobre del lote como lo haría /verify.
+// Devuelve nil si venció el plazo de ctx antes de verificarlo.
+func verifyBatchItem(ctx context.Context, r *http.Request, raw json.RawMessage) map[string]interface{} {
+	req, err := decodeVerifyRequest(r, raw)
+	if err != nil {
+		return invalidItem(errInvalidJSON, "JSON inválido")
+	}
+	res, err := verifyEnvelope(ctx, &req)
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+	ctx = context.WithoutCancel(ctx)
+	var f *verifyFailure
+	if res.Data == nil {
+		errors.As(err, &f)
+		return invalidItem(f.code, f.msg)
+	}
+	audit := newAuditEntry(r, "verify_batch", res.Key, res.Data)
+	if res.External {
+		audit.Detail = "iss=" + req.Iss
+	}
+	if err != nil {
+		errors.As(err, &f)
+		audit.Outcome = "error"
+		if !res.External {
+			audit.Detail = err.Error()
+		}
+		recordAudit(ctx, audit)
+		return invalidItem(f.code, f.msg)
+	}
+	if res.Valid {
+		if reason := checkCertBinding(r, res.Obj); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errCertBinding
+		}
+	}
+	// Antigüedad máxima (?maxAge=) y, después, reenvíos: el nonce de un
+	// sobre válido sólo se acepta una vez
+	if res.Valid {
+		if reason := checkFreshness(r, res.Obj, time.Now()); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errEnvelopeStale
+		}
+	}
+	if res.Valid {
+		if reason := checkReplay(ctx, res.Obj); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errEnvelopeReplayed
+		}
+	}
+	audit.Outcome = outcomeOf(res.Valid)
+	if res.Reason != "" && !res.External {
+		audit.Detail = res.Reason
+	}
+	recordAudit(ctx, audit)
+
+	out := map[string]interface{}{"valid": res.Valid}
+	if res.External {
+		out["issuer"] = req.Iss
+	}
+	if res.KeyHint != "" {
+		out["key_hint"] = res.KeyHint
+		out["trusted_key"] = res.Key
+	}
+	if !res.Valid {
+		out["code"] = res.invalidCode()
+	}
+	if res.Reason != "" {
+		out["reason"] = res.Reason
+	}
+	if res.Verification != nil {
+		out["verification"] = res.Verification
+	}
+	if c, flagged := requiresSecondaryValidation(ctx, res.Key, payloadTimestamp(res.Obj)); res.Valid && !res.External && flagged {
+		out["requires_secondary_validation"] = true
+		out["compromise_reason"] = c.Reason
+	}
+	return out
+}
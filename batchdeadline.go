@@ -0,0 +1,185 @@
+// batchdeadline.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lotes con plazo. /sign/batch y /verify/batch admiten ?deadline=, como
+// duración (1500ms, 5s; un entero son segundos) o como instante RFC 3339.
+// Al vencer el plazo no se empiezan más documentos y los que esperaban a
+// KMS (p.ej. en el pacer) se cancelan; la respuesta trae los terminados y,
+// si queda alguno, "pending" con sus índices y "continuation", un token
+// para retomarlos:
+//
+//	{"payloads": [...], "continuation": "..."}
+//
+// con el mismo lote (los mismos documentos en el mismo orden) procesa sólo
+// los pendientes. El token no caduca ni guarda estado en el servidor:
+// lleva los índices que faltan y el hash del lote, y se rechaza si el lote
+// reenviado no es el mismo.
+//
+// En /verify/batch, "valid" es false mientras quede algo pendiente, y en
+// la respuesta a una continuación se refiere sólo a los sobres retomados.
+
+// batchContinuation es el contenido del token de continuación
+type batchContinuation struct {
+	Op      string `json:"op"`            // "sign" o "verify"
+	Key     string `json:"key,omitempty"` // alias, en /sign/batch
+	Hash    string `json:"hash"`          // ver batchHash
+	Pending []int  `json:"pending"`
+}
+
+// requestBatchDeadline devuelve el plazo pedido con ?deadline=, o el
+// instante cero si no hay
+func requestBatchDeadline(r *http.Request, now time.Time) (time.Time, error) {
+	v := r.URL.Query().Get("deadline")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		v = strconv.Itoa(n) + "s"
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("deadline debe ser una duración (p.ej. 5s) o un instante RFC 3339")
+}
+
+// validateBatchDeadline comprueba ?deadline=
+func validateBatchDeadline(r *http.Request) []validationProblem {
+	if _, err := requestBatchDeadline(r, time.Now()); err != nil {
+		return []validationProblem{{"deadline", errInvalidRequest, err.Error()}}
+	}
+	return nil
+}
+
+// batchHash identifica el lote: el SHA-256 de sus elementos compactados,
+// así que reenviarlo con otro formato no cambia el hash
+func batchHash(items []json.RawMessage) string {
+	h := sha256.New()
+	var buf bytes.Buffer
+	for _, raw := range items {
+		buf.Reset()
+		if json.Compact(&buf, raw) != nil {
+			buf.Write(raw)
+		}
+		h.Write(buf.Bytes())
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// batchTodo devuelve los índices a procesar: todos, o los pendientes del
+// token de continuación si lo hay
+func batchTodo(token, op, key string, items []json.RawMessage) ([]int, error) {
+	if token == "" {
+		todo := make([]int, len(items))
+		for i := range todo {
+			todo[i] = i
+		}
+		return todo, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("continuation no es un token válido")
+	}
+	var c batchContinuation
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("continuation no es un token válido")
+	}
+	switch {
+	case c.Op != op:
+		return nil, fmt.Errorf("continuation es de otra operación (%s)", c.Op)
+	case c.Key != key:
+		return nil, fmt.Errorf("continuation es de otra clave (%s)", c.Key)
+	case c.Hash != batchHash(items):
+		return nil, fmt.Errorf("El lote no es el mismo que el de continuation")
+	}
+	for _, i := range c.Pending {
+		if i < 0 || i >= len(items) {
+			return nil, fmt.Errorf("continuation tiene un índice fuera del lote: %d", i)
+		}
+	}
+	return c.Pending, nil
+}
+
+// encodeContinuation compone el token para los índices pendientes
+func encodeContinuation(op, key string, items []json.RawMessage, pending []int) string {
+	raw, _ := json.Marshal(batchContinuation{Op: op, Key: key, Hash: batchHash(items), Pending: pending})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// runBatch procesa los índices de todo en paralelo, como mucho concurrency
+// a la vez. Con plazo, item recibe un contexto que vence con él y debe
+// devolver nil si no terminó por eso; lo que no se empezó o devolvió nil
+// queda en pending. results sigue el orden de todo.
+func runBatch(r *http.Request, todo []int, concurrency int, deadline time.Time, item func(ctx context.Context, i int) map[string]interface{}) (results []map[string]interface{}, pending []int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx := r.Context()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	out := make([]map[string]interface{}, len(todo))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+dispatch:
+	for n, i := range todo {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(n, i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if res := item(ctx, i); res != nil {
+				res["index"] = i
+				out[n] = res
+			}
+		}(n, i)
+	}
+	wg.Wait()
+
+	for n, res := range out {
+		if res == nil {
+			pending = append(pending, todo[n])
+		} else {
+			results = append(results, res)
+		}
+	}
+	sort.Ints(pending)
+	return results, pending
+}
+
+// addContinuation añade a la respuesta de un lote lo que quedó pendiente
+func addContinuation(resp map[string]interface{}, op, key string, items []json.RawMessage, pending []int) {
+	if len(pending) == 0 {
+		return
+	}
+	resp["pending"] = pending
+	resp["continuation"] = encodeContinuation(op, key, items, pending)
+}
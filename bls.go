@@ -0,0 +1,260 @@
+// bls.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Firmas BLS agregables (ver firmajson.BLS), sólo con SIGNER_BACKEND=local y
+// LOCAL_BLS=true. La clave BLS se deriva del secreto local y su key_version
+// es LOCAL_KEY_ID con el sufijo "/bls".
+//
+//	POST /sign/bls          {"payloads": [...]} como /sign/batch; cada
+//	                        registro lleva su firma y la respuesta, además,
+//	                        el agregado de todas
+//	POST /bls/aggregate     {"signatures": [...]} → {"aggregate": ...}
+//	POST /verify/aggregate  {"payloads": [...], "aggregate": ...}: los
+//	                        registros firmados tal como los devolvió
+//	                        /sign/bls, en cualquier orden
+//
+// Para archivar miles de registros basta guardar el agregado (48 bytes) y
+// los registros; verificarlos todos cuesta dos emparejamientos.
+// BLS_AGGREGATE_MAX_ITEMS (10000) limita las firmas por petición.
+
+// blsKey es la clave BLS; nil si no está habilitada
+var blsKey *firmajson.BLS
+
+// configureBLS crea la clave BLS si LOCAL_BLS=true
+func configureBLS() error {
+	if getEnv("LOCAL_BLS", "false") != "true" {
+		return nil
+	}
+	if signerBackend != backendLocal {
+		return fmt.Errorf("LOCAL_BLS requiere SIGNER_BACKEND=local")
+	}
+	secret, err := localSecretFromEnv()
+	if err != nil {
+		return err
+	}
+	blsKey, err = firmajson.NewBLS(secret, getEnv("LOCAL_KEY_ID", "local:dev")+"/bls")
+	return err
+}
+
+// blsMaxItems es el máximo de firmas de /bls/aggregate y /verify/aggregate
+func blsMaxItems() int {
+	return envInt("BLS_AGGREGATE_MAX_ITEMS", 10000)
+}
+
+// requireBLS responde 404 si BLS no está habilitado
+func requireBLS(w http.ResponseWriter) bool {
+	if blsKey == nil {
+		writeError(w, http.StatusNotFound, errNotConfigured, "Las firmas BLS no están habilitadas (LOCAL_BLS)")
+		return false
+	}
+	return true
+}
+
+// signBLSRequest es el cuerpo de /sign/bls
+type signBLSRequest struct {
+	Payloads []json.RawMessage `json:"payloads"`
+}
+
+// blsAggregateRequest es el cuerpo de /bls/aggregate: firmas en Base64
+type blsAggregateRequest struct {
+	Signatures []string `json:"signatures"`
+}
+
+// verifyAggregateRequest es el cuerpo de /verify/aggregate
+type verifyAggregateRequest struct {
+	Payloads  []json.RawMessage `json:"payloads"`
+	Aggregate string            `json:"aggregate"` // Base64
+}
+
+// signBLSHandler firma un lote con BLS y devuelve además el agregado
+func signBLSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !requireBLS(w) {
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
+		return
+	}
+	var req signBLSRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+
+	ctx := r.Context()
+	escape := unrecordedEscape(r)
+	results := make([]map[string]interface{}, len(req.Payloads))
+	var sigs [][]byte
+	for i, raw := range req.Payloads {
+		results[i] = map[string]interface{}{"index": i}
+		var payloadMap map[string]interface{}
+		if err := firmajson.DecodeJSON(raw, &payloadMap); err != nil || payloadMap == nil {
+			results[i]["error"], results[i]["code"] = "JSON inválido", errInvalidJSON
+			continue
+		}
+		data, f := signablePayload(r, alias, payloadMap, escape)
+		if f != nil {
+			results[i]["error"], results[i]["code"] = f.msg, f.code
+			continue
+		}
+		sig, _ := blsKey.Sign(ctx, data)
+		audit := newAuditEntry(r, "sign_bls", alias, data)
+		audit.Outcome = "ok"
+		recordAudit(ctx, audit)
+		sigs = append(sigs, sig)
+		results[i]["payload"] = payloadMap
+		results[i]["signature"] = base64.StdEncoding.EncodeToString(sig)
+		if escape != "" && escape != escapeHTML {
+			results[i]["escape"] = escape
+		}
+	}
+
+	resp := map[string]interface{}{
+		"results":     results,
+		"signed":      len(sigs),
+		"failed":      len(results) - len(sigs),
+		"key_version": blsKey.KeyVersion(),
+		"algorithm":   firmajson.BLSAlgorithm,
+		"public_key":  base64.StdEncoding.EncodeToString(blsKey.PublicKey()),
+	}
+	if len(sigs) > 0 {
+		agg, err := firmajson.AggregateBLS(sigs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error agregando firmas: %v", err))
+			return
+		}
+		resp["aggregate"] = base64.StdEncoding.EncodeToString(agg)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// blsAggregateHandler agrega firmas BLS ya emitidas
+func blsAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !requireBLS(w) {
+		return
+	}
+	var req blsAggregateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	if max := blsMaxItems(); len(req.Signatures) == 0 || len(req.Signatures) > max {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("signatures debe tener entre 1 y %d firmas", max))
+		return
+	}
+	sigs := make([][]byte, len(req.Signatures))
+	for i, s := range req.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidSigEncoding, fmt.Sprintf("signatures[%d] no es Base64 válido", i))
+			return
+		}
+		sigs[i] = sig
+	}
+	agg, err := firmajson.AggregateBLS(sigs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidSigEncoding, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"aggregate":   base64.StdEncoding.EncodeToString(agg),
+		"count":       len(sigs),
+		"key_version": blsKey.KeyVersion(),
+	})
+}
+
+// verifyAggregateHandler verifica un agregado contra el conjunto de
+// registros firmados. ?maxAge= se aplica a cada registro.
+func verifyAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !requireBLS(w) {
+		return
+	}
+	if !validEscapeMode(unrecordedEscape(r)) {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "escape debe ser html, minimal, ascii o jcs")
+		return
+	}
+	if _, err := requestMaxAge(r); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	var req verifyAggregateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	if max := blsMaxItems(); len(req.Payloads) == 0 || len(req.Payloads) > max {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("payloads debe tener entre 1 y %d registros", max))
+		return
+	}
+	agg, err := base64.StdEncoding.DecodeString(req.Aggregate)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidSigEncoding, "aggregate no es Base64 válido")
+		return
+	}
+
+	now := time.Now()
+	msgs := make([][]byte, len(req.Payloads))
+	reason := ""
+	for i, raw := range req.Payloads {
+		var obj interface{}
+		if err := firmajson.DecodeJSON(raw, &obj); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidPayload, fmt.Sprintf("payloads[%d] no es JSON válido", i))
+			return
+		}
+		if msgs[i], err = canonicalJSONEscaped(obj, unrecordedEscape(r)); err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+			return
+		}
+		if why := checkFreshness(r, obj, now); why != "" && reason == "" {
+			reason = fmt.Sprintf("payloads[%d]: %s", i, why)
+		}
+	}
+
+	ctx := r.Context()
+	audit := newAuditEntry(r, "verify_aggregate", defaultKeyAlias, agg)
+	valid, err := blsKey.VerifyAggregate(msgs, agg)
+	if err != nil {
+		valid, reason = false, err.Error()
+	} else if !valid {
+		reason = "El agregado no corresponde al conjunto de registros"
+	} else if reason != "" {
+		valid = false
+	}
+	audit.Outcome, audit.Detail = outcomeOf(valid), fmt.Sprintf("%d registros", len(msgs))
+	if reason != "" {
+		audit.Detail += ": " + reason
+	}
+	recordAudit(ctx, audit)
+
+	resp := map[string]interface{}{
+		"valid":       valid,
+		"count":       len(msgs),
+		"key_version": blsKey.KeyVersion(),
+	}
+	if reason != "" {
+		resp["reason"] = reason
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
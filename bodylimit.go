@@ -0,0 +1,102 @@
+// bodylimit.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Límite del cuerpo de las peticiones. MAX_BODY_BYTES (32 MiB, lo mismo
+// que JSON_MAX_BYTES; 0 = sin límite) se aplica a todas las rutas antes de
+// que ningún handler lea nada: con Content-Length mayor se responde 413 sin
+// leer el cuerpo, y si no lo declara (chunked) http.MaxBytesReader corta la
+// lectura al pasarse. En ese caso el handler ve un error de lectura y
+// respondería 400 con un mensaje confuso, así que la respuesta se sustituye
+// por el mismo 413.
+//
+// El documento que se firma tiene además su propio límite,
+// MAX_PAYLOAD_BYTES (64 KiB, lo que admite MacSign) salvo si se firma su
+// resumen (ver digest.go); éste es el de la petición entera, lotes
+// incluidos.
+
+// maxBodyBytes es el tamaño máximo del cuerpo; 0 es sin límite
+func maxBodyBytes() int64 {
+	return int64(envInt("MAX_BODY_BYTES", 32<<20))
+}
+
+// writeBodyTooLarge responde 413 por un cuerpo de más de max bytes
+func writeBodyTooLarge(w http.ResponseWriter, max int64) {
+	w.Header().Set("Connection", "close")
+	writeError(w, http.StatusRequestEntityTooLarge, errBodyTooLarge, fmt.Sprintf("El cuerpo de la petición supera MAX_BODY_BYTES (%d bytes)", max))
+}
+
+// bodyLimitMiddleware aplica MAX_BODY_BYTES
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := maxBodyBytes()
+		if max <= 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > max {
+			writeBodyTooLarge(w, max)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max)}
+		r.Body = body
+		next.ServeHTTP(&bodyLimitWriter{ResponseWriter: w, body: body, max: max}, r)
+	})
+}
+
+// limitedBody recuerda si la lectura se cortó por el límite
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitWriter sustituye la respuesta del handler por el 413 si el
+// cuerpo se cortó antes de que empezara a responder
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	body     *limitedBody
+	max      int64
+	started  bool
+	replaced bool
+}
+
+func (w *bodyLimitWriter) WriteHeader(status int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	if w.body.exceeded {
+		w.replaced = true
+		writeBodyTooLarge(w.ResponseWriter, w.max)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap deja a http.ResponseController llegar al writer original
+func (w *bodyLimitWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,130 @@
+// breakglass.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// compromisedCollection guarda las claves desactivadas por compromiso. Con
+// un store compartido (STORE=file sobre un volumen común) el bloqueo se
+// aplica en todas las réplicas en la siguiente petición, sin redesplegar
+// configuración. Con STORE=memory la marca sólo existe en la réplica que
+// atendió el POST y se pierde al reiniciar: el resto sigue firmando con la
+// clave, así que con varias réplicas hay que repetir la llamada en cada una
+// o, mejor, usar un store compartido.
+const compromisedCollection = "compromised_keys"
+
+// warnBreakglassStore avisa al arrancar si las marcas de compromiso no se
+// comparten entre réplicas
+func warnBreakglassStore() {
+	if getEnv("STORE", "memory") == "memory" {
+		log.Printf("⚠️  STORE=memory: marcar una clave como comprometida (/admin/keys/{alias}/compromise) sólo la bloquea en esta réplica y hasta que se reinicie")
+	}
+}
+
+// keyCompromise es la marca de "break glass" de un alias
+type keyCompromise struct {
+	Key    string    `json:"key"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"` // firmas desde aquí, sospechosas
+	At     time.Time `json:"at"`
+}
+
+// keyCompromiseRequest es el cuerpo de POST /admin/keys/{alias}/compromise
+type keyCompromiseRequest struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since,omitempty"`
+}
+
+// keyCompromised devuelve la marca de compromiso del alias, si la hay
+func keyCompromised(ctx context.Context, alias string) (keyCompromise, bool) {
+	var c keyCompromise
+	raw, err := db.Get(ctx, compromisedCollection, alias)
+	if err != nil {
+		return c, false
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		// Ante la duda, la clave sigue desactivada
+		log.Printf("⚠️  Marca de compromiso ilegible para %s: %v", alias, err)
+		return keyCompromise{Key: alias}, true
+	}
+	return c, true
+}
+
+// requiresSecondaryValidation indica si una firma con el alias, hecha en
+// signedAt, debe validarse por otra vía por haberse comprometido la clave.
+// Sin fecha de firma conocida se marca siempre.
+func requiresSecondaryValidation(ctx context.Context, alias string, signedAt time.Time) (keyCompromise, bool) {
+	c, ok := keyCompromised(ctx, alias)
+	if !ok {
+		return c, false
+	}
+	return c, signedAt.IsZero() || !signedAt.Before(c.Since)
+}
+
+// keyCompromiseHandler activa (POST) o levanta (DELETE) el modo de
+// emergencia de una clave: /admin/keys/{alias}/compromise
+//
+// POST acepta {"reason": "...", "since": RFC3339}; sin since se consideran
+// sospechosas todas las firmas anteriores de la clave.
+func keyCompromiseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	alias := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/keys/"), "/compromise")
+	if alias == "" || strings.Contains(alias, "/") {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPost:
+		var req keyCompromiseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Reason == "" {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "Se espera {reason, since?}")
+			return
+		}
+		c := keyCompromise{Key: alias, Reason: req.Reason, Since: req.Since.UTC(), At: time.Now().UTC()}
+		raw, _ := json.Marshal(c)
+		if err := db.Put(ctx, compromisedCollection, alias, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		log.Printf("🚨 Clave %q marcada como comprometida: %s", alias, req.Reason)
+		warnBreakglassStore()
+		e := newAuditEntry(r, "key_compromised", alias, nil)
+		e.Outcome, e.Detail = "alert", req.Reason
+		recordAudit(ctx, e)
+		recordAdminAudit(r, "key_compromised", alias)
+		writeJSON(w, http.StatusOK, c)
+	case http.MethodDelete:
+		err := db.Delete(ctx, compromisedCollection, alias)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "La clave no está marcada como comprometida")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		log.Printf("Clave %q rehabilitada", alias)
+		recordAdminAudit(r, "key_restored", alias)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST o DELETE permitido")
+	}
+}
+
+// payloadTimestamp devuelve el "timestamp" inyectado al firmar, o cero
+func payloadTimestamp(obj interface{}) time.Time {
+	m, _ := obj.(map[string]interface{})
+	s, _ := m["timestamp"].(string)
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
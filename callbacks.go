@@ -0,0 +1,82 @@
+// callbacks.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Callbacks que registra el cliente: el "callback" de /subscriptions y el
+// ?callback= de la firma diferida. La URL la elige quien llama, así que el
+// servicio no puede convertirse en un proxy hacia la red interna:
+//
+//	CALLBACK_HOSTS  hosts a los que se admiten callbacks, separados por
+//	                comas; vacío = sin callbacks
+//
+// La entrega va siempre por https, sólo a direcciones públicas (se
+// comprueba la IP a la que se conecta, como en did:web) y sin seguir
+// redirecciones: un 3xx cuenta como entrega fallida.
+
+// callbackHTTPClient entrega los callbacks
+var callbackHTTPClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: publicTransport("callback"),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicTransport sólo conecta con direcciones públicas; what nombra el uso
+// en el error
+func publicTransport(what string) *http.Transport {
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !publicIP(ip) {
+					return fmt.Errorf("%s: %s no es una dirección pública", what, host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// validateCallbackURL comprueba que raw es una URL https de CALLBACK_HOSTS
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return errors.New("callback debe ser una URL https://")
+	}
+	hosts := envList("CALLBACK_HOSTS")
+	if len(hosts) == 0 {
+		return errors.New("los callbacks no están habilitados (CALLBACK_HOSTS)")
+	}
+	if !contains(hosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("el host %q no está en CALLBACK_HOSTS", u.Hostname())
+	}
+	return nil
+}
+
+// postCallback entrega body al callback, con los reintentos de los recibos.
+// Se vuelve a comprobar la URL por si CALLBACK_HOSTS cambió desde el alta.
+func postCallback(ctx context.Context, callback string, body []byte) error {
+	if err := validateCallbackURL(callback); err != nil {
+		return err
+	}
+	return postWebhook(ctx, callbackHTTPClient, callback, body)
+}
@@ -0,0 +1,88 @@
+// callbacks_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateCallbackURL(t *testing.T) {
+	t.Setenv("CALLBACK_HOSTS", "hooks.example.com, api.example.org")
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example.com/firma", true},
+		{"https://HOOKS.example.com:8443/x", true},
+		{"http://hooks.example.com/firma", false},
+		{"https://otro.example.com/firma", false},
+		{"https://hooks.example.com.evil.test/", false},
+		{"https://user:pw@hooks.example.com/", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"hooks.example.com", false},
+	}
+	for _, tt := range tests {
+		if err := validateCallbackURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.url, err)
+		}
+	}
+
+	t.Setenv("CALLBACK_HOSTS", "")
+	if err := validateCallbackURL("https://hooks.example.com/"); err == nil {
+		t.Error("sin CALLBACK_HOSTS no se admiten callbacks")
+	}
+}
+
+// Aunque el host esté en la lista, la entrega no conecta con direcciones
+// internas
+func TestPostCallbackPrivateAddress(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+	t.Setenv("CALLBACK_HOSTS", "127.0.0.1")
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, nil)
+	_, err := callbackHTTPClient.Do(req)
+	if err == nil || !strings.Contains(err.Error(), "no es una dirección pública") {
+		t.Fatalf("callback a loopback: %v", err)
+	}
+	if hits.Load() != 0 {
+		t.Fatal("el callback llegó a una dirección interna")
+	}
+}
+
+func TestSubscriptionCallbackAllowlist(t *testing.T) {
+	t.Setenv("SUBSCRIPTIONS_ENABLED", "true")
+	t.Setenv("CALLBACK_HOSTS", "hooks.example.com")
+	hash := strings.Repeat("cd", 32)
+	for callback, want := range map[string]int{
+		"https://hooks.example.com/s": http.StatusCreated,
+		"https://10.0.0.1/s":          http.StatusBadRequest,
+		"https://metadata.internal/":  http.StatusBadRequest,
+	} {
+		code, resp := doJSON(t, subscriptionsHandler, http.MethodPost, "/subscriptions",
+			map[string]interface{}{"payload_sha256": hash, "callback": callback}, nil)
+		if code != want {
+			t.Errorf("%s: %d %v", callback, code, resp)
+		}
+	}
+}
+
+func TestDeferredCallbackAllowlist(t *testing.T) {
+	t.Setenv("CALLBACK_HOSTS", "hooks.example.com")
+	for target, ok := range map[string]bool{
+		"/sign?defer=true": true,
+		"/sign?defer=true&callback=https://hooks.example.com/": true,
+		"/sign?defer=true&callback=https://10.0.0.1/":          false,
+		"/sign?defer=true&callback=http://hooks.example.com/":  false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		if err := validateDeferParams(r); (err == nil) != ok {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+}
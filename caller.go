@@ -0,0 +1,62 @@
+// caller.go
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// callerID identifica a quien hace la petición: el nombre asociado a su
+// X-API-Key en API_KEYS ("clave:nombre,...") o, si no la presenta, su IP
+func callerID(r *http.Request) string {
+	if name := apiKeyCaller(r); name != "" {
+		return name
+	}
+	return "ip:" + clientIP(r)
+}
+
+// apiKeyCaller devuelve el nombre asociado a la X-API-Key de la petición, o
+// "" si no presenta una de API_KEYS
+func apiKeyCaller(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return ""
+	}
+	for _, pair := range strings.Split(getEnv("API_KEYS", ""), ",") {
+		k, name, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// clientIP devuelve la IP del cliente. X-Forwarded-For lo escribe quien
+// quiera, así que sólo cuentan las entradas que añaden los proxies de
+// confianza, contadas desde la derecha: con TRUSTED_PROXY_HOPS=n (0 por
+// defecto) la IP es la n-ésima empezando por el final. Detrás del
+// balanceador de Cloud Run es 1. Si no, la de RemoteAddr.
+func clientIP(r *http.Request) string {
+	if hops := envInt("TRUSTED_PROXY_HOPS", 0); hops > 0 {
+		var entries []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, e := range strings.Split(v, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					entries = append(entries, e)
+				}
+			}
+		}
+		// Con menos entradas que proxies la petición no ha pasado por
+		// todos: no hay ninguna de fiar
+		if len(entries) >= hops {
+			return entries[len(entries)-hops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,34 @@
+// caller_test.go
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPTrustedProxyHops(t *testing.T) {
+	cases := []struct {
+		hops string
+		xff  []string
+		want string
+	}{
+		{"0", []string{"1.1.1.1"}, "10.0.0.9"},
+		{"1", nil, "10.0.0.9"},
+		{"1", []string{"1.1.1.1"}, "1.1.1.1"},
+		{"1", []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{"1", []string{"6.6.6.6", "1.1.1.1"}, "1.1.1.1"},
+		{"2", []string{"6.6.6.6, 1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{"2", []string{"1.1.1.1"}, "10.0.0.9"},
+	}
+	for _, c := range cases {
+		t.Setenv("TRUSTED_PROXY_HOPS", c.hops)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.9:5555"
+		for _, v := range c.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != c.want {
+			t.Errorf("TRUSTED_PROXY_HOPS=%s X-Forwarded-For=%q: %s, se esperaba %s", c.hops, c.xff, got, c.want)
+		}
+	}
+}
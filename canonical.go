@@ -0,0 +1,61 @@
+// canonical.go
+package main
+
+import (
+	"net/http"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// La forma canónica (los bytes que se firman) la implementa
+// pkg/firmajson; aquí sólo se elige la forma de cada petición.
+
+// Modos de escape de la forma canónica (ver firmajson.Canonicalize)
+const (
+	escapeHTML    = firmajson.FormHTML
+	escapeMinimal = firmajson.FormMinimal
+	escapeASCII   = firmajson.FormASCII
+	canonJCS      = firmajson.FormJCS
+)
+
+// defaultCanonicalForm es la forma de las firmas nuevas: CANONICAL_FORM,
+// jcs por defecto para interoperar. Los sobres llevan la forma en "escape"
+// salvo con html, así que los firmados antes con html (sin "escape") se
+// siguen verificando igual.
+func defaultCanonicalForm() string {
+	return getEnv("CANONICAL_FORM", canonJCS)
+}
+
+// requestEscape devuelve el modo pedido con ?escape= o, si no se pide, la
+// forma por defecto
+func requestEscape(r *http.Request) string {
+	if mode := r.URL.Query().Get("escape"); mode != "" {
+		return mode
+	}
+	return defaultCanonicalForm()
+}
+
+// unrecordedEscape es el modo de los formatos que no guardan la forma en
+// el sobre (compacto y agregados BLS): ?escape= o html, el de siempre, ya
+// que al verificar no hay otro sitio del que sacarla
+func unrecordedEscape(r *http.Request) string {
+	if mode := r.URL.Query().Get("escape"); mode != "" {
+		return mode
+	}
+	return escapeHTML
+}
+
+// validEscapeMode indica si mode es un modo de escape conocido ("" = html)
+func validEscapeMode(mode string) bool {
+	return firmajson.ValidForm(mode)
+}
+
+// canonicalJSON serializa el payload en la forma canónica por defecto
+func canonicalJSON(v interface{}) ([]byte, error) {
+	return firmajson.Canonicalize(v, escapeHTML)
+}
+
+// canonicalJSONEscaped serializa con el modo de escape indicado
+func canonicalJSONEscaped(v interface{}, mode string) ([]byte, error) {
+	return firmajson.Canonicalize(v, mode)
+}
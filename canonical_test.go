@@ -0,0 +1,27 @@
+// canonical_test.go
+package main
+
+import "testing"
+
+// Las firmas nuevas van en JCS y lo dicen en el sobre; las de antes (html,
+// sin "escape") se siguen verificando
+func TestDefaultCanonicalForm(t *testing.T) {
+	doc := map[string]interface{}{"pedido": "JCS-1", "nota": "<b>&</b>", "importe": 1e21}
+	signed := testSign(t, "?echo=true", doc, nil)
+	if signed["escape"] != canonJCS {
+		t.Fatalf("escape = %v, se esperaba %s", signed["escape"], canonJCS)
+	}
+	legacy := testSign(t, "?echo=true&escape=html", doc, nil)
+	if _, ok := legacy["escape"]; ok {
+		t.Fatalf("un sobre html no lleva escape: %v", legacy)
+	}
+	for name, env := range map[string]map[string]interface{}{"jcs": signed, "html": legacy} {
+		if v := testVerify(t, env, nil); v["valid"] != true {
+			t.Fatalf("%s: %v", name, v)
+		}
+	}
+	// Sin "escape" el sobre se lee como html: la firma JCS no vale así
+	if v := testVerify(t, envelopeWith(signed, map[string]interface{}{"escape": nil}), nil); v["valid"] != false {
+		t.Fatalf("firma JCS verificada como html: %v", v)
+	}
+}
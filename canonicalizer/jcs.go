@@ -0,0 +1,204 @@
+// Package canonicalizer implementa el JSON Canonicalization Scheme (JCS,
+// RFC 8785): la forma canónica de JSON que cualquier lenguaje puede
+// reproducir, a diferencia de la de json.Marshal, que depende de cómo
+// escapa y formatea números Go.
+//
+// Las reglas son:
+//   - claves de objeto ordenadas por sus unidades UTF-16;
+//   - sin espacios;
+//   - strings con el escape mínimo (\" \\ \b \f \n \r \t y \u00XX para el
+//     resto de controles), todo lo demás literal en UTF-8;
+//   - números serializados como Number.prototype.toString de ECMAScript.
+package canonicalizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Transform canonicaliza un documento JSON
+func Transform(raw []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return Canonicalize(v)
+}
+
+// Canonicalize serializa un valor ya decodificado de JSON (maps, slices,
+// strings, float64, json.Number, bool y nil) o cualquier otro que admita
+// encoding/json
+func Canonicalize(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := appendValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendValue(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if t {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case string:
+		appendString(buf, t)
+	case float64:
+		s, err := FormatNumber(t)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case json.Number:
+		f, err := strconv.ParseFloat(string(t), 64)
+		if err != nil {
+			return fmt.Errorf("canonicalizer: número inválido %q", t)
+		}
+		s, err := FormatNumber(f)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := appendValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			appendString(buf, k)
+			buf.WriteByte(':')
+			if err := appendValue(buf, t[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		// Otros tipos de Go (enteros, structs, maps tipados) se serializan
+		// como los serializaría encoding/json y se canonicaliza el resultado
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("canonicalizer: tipo no JSON %T", v)
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var decoded interface{}
+		if err := dec.Decode(&decoded); err != nil {
+			return err
+		}
+		return appendValue(buf, decoded)
+	}
+	return nil
+}
+
+// lessUTF16 compara dos strings por sus unidades UTF-16, como exige JCS
+// (difiere del orden de bytes UTF-8 fuera del BMP)
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+func appendString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+			} else {
+				buf.WriteRune(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// FormatNumber serializa un float64 como Number.prototype.toString de
+// ECMAScript (RFC 8785, sección 3.2.2.3). NaN e infinitos no son JSON.
+func FormatNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("canonicalizer: %v no es representable en JSON", f)
+	}
+	if f == 0 {
+		return "0", nil // también -0
+	}
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+	// Dígitos mínimos que identifican el número y su exponente decimal:
+	// f = 0.digits × 10^n
+	mant, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mant, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	k, n := len(digits), e+1
+
+	var out string
+	switch {
+	case k <= n && n <= 21:
+		out = digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		out = digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		out = "0." + strings.Repeat("0", -n) + digits
+	default:
+		out = digits[:1]
+		if k > 1 {
+			out += "." + digits[1:]
+		}
+		if n-1 >= 0 {
+			out += "e+" + strconv.Itoa(n-1)
+		} else {
+			out += "e" + strconv.Itoa(n-1)
+		}
+	}
+	return sign + out, nil
+}
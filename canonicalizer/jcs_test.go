@@ -0,0 +1,121 @@
+// jcs_test.go
+package canonicalizer
+
+import (
+	"math"
+	"testing"
+)
+
+// Ejemplos de RFC 8785: sección 3.2.2 (serialización) y 3.2.3 (orden)
+func TestTransformRFC8785(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"3.2.2",
+			`{
+  "numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+  "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+  "literals": [null, true, false]
+}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`},
+		{"3.2.3",
+			`{
+  "\u20ac": "Euro Sign",
+  "\r": "Carriage Return",
+  "\ufb33": "Hebrew Letter Dalet With Dagesh",
+  "1": "One",
+  "\ud83d\ude00": "Emoji: Grinning Face",
+  "\u0080": "Control",
+  "\u00f6": "Latin Small Letter O With Diaeresis"
+}`,
+			"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001F600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}"},
+		{"anidados", `{"b":[{"z":1,"a":2}],"a":{"y":{},"x":[]}}`, `{"a":{"x":[],"y":{}},"b":[{"a":2,"z":1}]}`},
+		{"escalar", ` "a\tb" `, `"a\tb"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Transform([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Apéndice B de RFC 8785: bits IEEE 754 y su serialización
+func TestFormatNumberRFC8785(t *testing.T) {
+	tests := []struct {
+		bits uint64
+		want string
+	}{
+		{0x0000000000000000, "0"},
+		{0x8000000000000000, "0"},
+		{0x0000000000000001, "5e-324"},
+		{0x8000000000000001, "-5e-324"},
+		{0x7fefffffffffffff, "1.7976931348623157e+308"},
+		{0xffefffffffffffff, "-1.7976931348623157e+308"},
+		{0x4340000000000000, "9007199254740992"},
+		{0xc340000000000000, "-9007199254740992"},
+		{0x4430000000000000, "295147905179352830000"},
+		{0x44b52d02c7e14af5, "9.999999999999997e+22"},
+		{0x44b52d02c7e14af6, "1e+23"},
+		{0x44b52d02c7e14af7, "1.0000000000000001e+23"},
+		{0x444b1ae4d6e2ef4e, "999999999999999700000"},
+		{0x444b1ae4d6e2ef4f, "999999999999999900000"},
+		{0x444b1ae4d6e2ef50, "1e+21"},
+		{0x3eb0c6f7a0b5ed8c, "9.999999999999997e-7"},
+		{0x3eb0c6f7a0b5ed8d, "0.000001"},
+		{0x41b3de4355555553, "333333333.3333332"},
+		{0x41b3de4355555554, "333333333.33333325"},
+		{0x41b3de4355555555, "333333333.3333333"},
+		{0x41b3de4355555556, "333333333.3333334"},
+		{0x41b3de4355555557, "333333333.33333343"},
+		{0xbecbf647612f3696, "-0.0000033333333333333333"},
+		{0x43143ff3c1cb0959, "1424953923781206.2"},
+	}
+	for _, tt := range tests {
+		got, err := FormatNumber(math.Float64frombits(tt.bits))
+		if err != nil || got != tt.want {
+			t.Errorf("%016x: got %q, %v; want %q", tt.bits, got, err, tt.want)
+		}
+	}
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := FormatNumber(f); err == nil {
+			t.Errorf("%v debe rechazarse", f)
+		}
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	for _, in := range []string{``, `{"a":}`, `[1,]`, `{"a":1}x`, `1e400`} {
+		if got, err := Transform([]byte(in)); err == nil {
+			t.Errorf("Transform(%q) = %s, se esperaba error", in, got)
+		}
+	}
+	if _, err := Canonicalize(map[string]interface{}{"f": func() {}}); err == nil {
+		t.Error("un valor no JSON debe rechazarse")
+	}
+}
+
+// Los valores que no vienen de decodificar JSON (enteros, structs, maps
+// tipados) se canonicalizan como su JSON
+func TestCanonicalizeGoValues(t *testing.T) {
+	v := map[string]interface{}{
+		"n": 3,
+		"s": struct {
+			B int    `json:"b"`
+			A string `json:"a"`
+		}{1, "x"},
+		"m": map[string]string{"z": "1", "a": "2"},
+	}
+	got, err := Canonicalize(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"m":{"a":"2","z":"1"},"n":3,"s":{"a":"x","b":1}}`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
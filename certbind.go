@@ -0,0 +1,97 @@
+// certbind.go
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Un sobre ligado a certificado lleva en el payload, bajo la firma,
+// "cnf": {"x5t#S256": huella} (RFC 8705) con la huella SHA-256 del
+// certificado mTLS del cliente que lo pidió. Al verificar, si el sobre
+// está ligado, el cliente que lo presenta debe usar ese mismo certificado:
+// un sobre robado no sirve a otro cliente.
+
+// confirmationClaim es el campo reservado con la confirmación
+const confirmationClaim = "cnf"
+
+// clientCertThumbprint devuelve la huella x5t#S256 del certificado del
+// cliente. Con TLS propio (TLS_CERT_FILE) sale de la conexión; detrás de un
+// balanceador que termina el mTLS, de la cabecera CLIENT_CERT_HEADER (el
+// certificado PEM, URL-encoded), que sólo se lee si está configurada.
+func clientCertThumbprint(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return certThumbprint(r.TLS.PeerCertificates[0].Raw), nil
+	}
+	header := getEnv("CLIENT_CERT_HEADER", "")
+	if header == "" || r.Header.Get(header) == "" {
+		return "", errors.New("la petición no trae certificado de cliente")
+	}
+	raw, err := url.QueryUnescape(r.Header.Get(header))
+	if err != nil {
+		return "", fmt.Errorf("cabecera %s inválida: %w", header, err)
+	}
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		return "", fmt.Errorf("cabecera %s no contiene un certificado PEM", header)
+	}
+	return certThumbprint(block.Bytes), nil
+}
+
+func certThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// boundThumbprint devuelve la huella a la que está ligado el payload, o ""
+func boundThumbprint(obj interface{}) string {
+	m, _ := obj.(map[string]interface{})
+	cnf, _ := m[confirmationClaim].(map[string]interface{})
+	t, _ := cnf["x5t#S256"].(string)
+	return t
+}
+
+// checkCertBinding comprueba que quien presenta un sobre ligado usa el
+// certificado al que se ligó. Devuelve el motivo si no, o "".
+func checkCertBinding(r *http.Request, obj interface{}) string {
+	want := boundThumbprint(obj)
+	if want == "" {
+		return ""
+	}
+	got, err := clientCertThumbprint(r)
+	if err != nil {
+		return "El sobre está ligado a un certificado de cliente: " + err.Error()
+	}
+	if got != want {
+		return "El certificado del cliente no es al que está ligado el sobre"
+	}
+	return ""
+}
+
+// serverTLSConfig prepara el TLS propio cuando hay TLS_CERT_FILE: pide (sin
+// exigir) certificado de cliente y, con TLS_CLIENT_CA_FILE, lo valida
+// contra esas CAs
+func serverTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{ClientAuth: tls.RequestClientCert}
+	if path := getEnv("TLS_CLIENT_CA_FILE", ""); path != "" {
+		pemData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("%s no contiene certificados", path)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
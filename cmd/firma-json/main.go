@@ -0,0 +1,164 @@
+// Command firma-json firma y verifica documentos JSON desde la línea de
+// comandos, sin el servidor HTTP: usa la librería (pkg/firmajson) con el
+// mismo backend y la misma configuración que el servicio, así que un sobre
+// firmado aquí verifica en /verify y al revés.
+//
+//	firma-json sign [-escape modo] [-digest sha256] [-o salida] [fichero|-]
+//	firma-json verify [-jwks fichero] [-q] [fichero|-]
+//	firma-json watch [-interval 2s] [-escape modo] [-digest sha256] [-once] <directorio>
+//
+// El backend se elige con SIGNER_BACKEND y las mismas variables que el
+// servicio (ver backends.go): gcp-kms (GOOGLE_CLOUD_PROJECT, KMS_LOCATION,
+// KMS_KEY_RING, KMS_KEY, KMS_KEY_VERSION), vault-transit (VAULT_*) o local
+// (LOCAL_HMAC_SECRET o LOCAL_HMAC_SECRET_FILE, LOCAL_KEY_ID). También lee
+// un .env del directorio actual. verify -jwks verifica con claves públicas
+// sin backend.
+//
+// Sale con 0 si todo va bien, 1 si la firma no es válida, 2 si la
+// configuración o los argumentos no lo son y 3 si falla el backend.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/joho/godotenv"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Códigos de salida
+const (
+	exitOK      = 0
+	exitInvalid = 1 // la firma no es válida
+	exitUsage   = 2 // argumentos o configuración inválidos
+	exitBackend = 3 // error del backend o de E/S
+)
+
+// command es un subcomando
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) int
+}
+
+var commands = []command{
+	{"sign", "firma un documento JSON y escribe el sobre", runSign},
+	{"verify", "verifica un sobre", runVerify},
+	{"watch", "vigila un directorio y firma cada .json nuevo en un .sig.json", runWatch},
+}
+
+func main() {
+	godotenv.Load()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(context.Background(), os.Args[2:]))
+		}
+	}
+	if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+		fmt.Fprintf(os.Stderr, "firma-json: subcomando desconocido %q\n", os.Args[1])
+	}
+	usage()
+	os.Exit(exitUsage)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Uso: firma-json <subcomando> [opciones] [fichero|-]")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "firma-json <subcomando> -h muestra sus opciones")
+}
+
+// fail escribe el error en stderr y devuelve el código de salida
+func fail(code int, format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "firma-json: "+format+"\n", args...)
+	return code
+}
+
+// errDocument indica que la entrada no es un objeto JSON
+var errDocument = errors.New("la entrada debe ser un objeto JSON")
+
+// readInput lee el fichero indicado, o stdin si es "-" o no hay ninguno
+func readInput(args []string) ([]byte, error) {
+	switch {
+	case len(args) > 1:
+		return nil, errors.New("sólo se admite un fichero")
+	case len(args) == 0 || args[0] == "-":
+		return io.ReadAll(os.Stdin)
+	default:
+		return os.ReadFile(args[0])
+	}
+}
+
+// backendFromEnv construye el backend de SIGNER_BACKEND. Con gcp-kms, kv
+// sustituye a la versión de KMS_KEY_VERSION si no es "" (la del sobre al
+// verificar). release libera el cliente de KMS.
+func backendFromEnv(ctx context.Context, kv string) (b firmajson.Backend, release func(), err error) {
+	release = func() {}
+	switch backend := getEnv("SIGNER_BACKEND", "gcp-kms"); backend {
+	case "gcp-kms":
+		project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+		if project == "" && kv == "" {
+			return nil, release, errors.New("GOOGLE_CLOUD_PROJECT no está definido")
+		}
+		if kv == "" {
+			kv = fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s", project,
+				getEnv("KMS_LOCATION", "global"), getEnv("KMS_KEY_RING", "EzeKeyRing"), getEnv("KMS_KEY", "EzeKey"), getEnv("KMS_KEY_VERSION", "1"))
+		}
+		client, err := kms.NewKeyManagementClient(ctx)
+		if err != nil {
+			return nil, release, fmt.Errorf("cliente de KMS: %w", err)
+		}
+		return firmajson.NewKMS(client, kv), func() { client.Close() }, nil
+	case "vault-transit":
+		v := &firmajson.VaultTransit{
+			Addr:      os.Getenv("VAULT_ADDR"),
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Namespace: os.Getenv("VAULT_NAMESPACE"),
+			Mount:     getEnv("VAULT_TRANSIT_MOUNT", "transit"),
+			KeyName:   os.Getenv("VAULT_TRANSIT_KEY"),
+		}
+		if v.Addr == "" || v.Token == "" || v.KeyName == "" {
+			return nil, release, errors.New("vault-transit necesita VAULT_ADDR, VAULT_TOKEN y VAULT_TRANSIT_KEY")
+		}
+		if v.Version, err = strconv.Atoi(getEnv("VAULT_TRANSIT_KEY_VERSION", "1")); err != nil || v.Version < 1 {
+			return nil, release, fmt.Errorf("VAULT_TRANSIT_KEY_VERSION inválido: %q", getEnv("VAULT_TRANSIT_KEY_VERSION", "1"))
+		}
+		return v, release, nil
+	case "local":
+		secret := []byte(os.Getenv("LOCAL_HMAC_SECRET"))
+		if len(secret) == 0 {
+			path := os.Getenv("LOCAL_HMAC_SECRET_FILE")
+			if path == "" {
+				return nil, release, errors.New("local necesita LOCAL_HMAC_SECRET o LOCAL_HMAC_SECRET_FILE")
+			}
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return nil, release, fmt.Errorf("leyendo LOCAL_HMAC_SECRET_FILE: %w", err)
+			}
+			secret = bytes.TrimRight(raw, "\r\n")
+		}
+		l, err := firmajson.NewLocal(secret, getEnv("LOCAL_KEY_ID", "local:dev"))
+		return l, release, err
+	default:
+		return nil, release, fmt.Errorf("SIGNER_BACKEND desconocido: %q (gcp-kms, vault-transit, local)", backend)
+	}
+}
+
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,95 @@
+// sign.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// runSign firma el documento de un fichero o de stdin y escribe el sobre
+// ({payload, signature, key_version...}, como /sign con ?echo=true)
+func runSign(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	escape := fs.String("escape", firmajson.FormJCS, "forma canónica: jcs (por defecto), html, minimal o ascii")
+	digest := fs.String("digest", "", "firma el resumen en vez del documento: sha256 (documentos de más de 64 KiB)")
+	out := fs.String("o", "-", "fichero del sobre; - es stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if !firmajson.ValidForm(*escape) {
+		return fail(exitUsage, "escape debe ser html, minimal, ascii o jcs")
+	}
+	if *digest != "" && *digest != firmajson.DigestSHA256 {
+		return fail(exitUsage, "digest debe ser sha256")
+	}
+	raw, err := readInput(fs.Args())
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	b, closeBackend, err := backendFromEnv(ctx, "")
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	defer closeBackend()
+	env, code, err := signDocument(ctx, b, raw, firmajson.SignOptions{Form: *escape, Digest: *digest})
+	if err != nil {
+		return fail(code, "%v", err)
+	}
+	if err := writeEnvelope(*out, env); err != nil {
+		return fail(exitBackend, "%v", err)
+	}
+	return exitOK
+}
+
+// signDocument firma un documento JSON con b. Si falla devuelve además el
+// código de salida.
+func signDocument(ctx context.Context, b firmajson.Signer, raw []byte, opts firmajson.SignOptions) (*firmajson.Envelope, int, error) {
+	var doc map[string]interface{}
+	if err := firmajson.DecodeJSON(raw, &doc); err != nil || doc == nil {
+		return nil, exitUsage, errDocument
+	}
+	env, err := firmajson.Sign(ctx, b, doc, opts)
+	if err == firmajson.ErrReservedField {
+		return nil, exitUsage, err
+	}
+	if err != nil {
+		return nil, exitBackend, err
+	}
+	return env, exitOK, nil
+}
+
+// writeEnvelope escribe el sobre en path ("-" es stdout). El fichero se
+// escribe aparte y se renombra, así que quien lo lea nunca ve uno a medias.
+func writeEnvelope(path string, env *firmajson.Envelope) error {
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,73 @@
+// verify.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// runVerify verifica el sobre de un fichero o de stdin y escribe el
+// resultado ({"valid": ..., "verification": {...}})
+func runVerify(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	jwks := fs.String("jwks", "", "verifica con las claves públicas de este JWKS (p.ej. /.well-known/jwks.json) en vez del backend")
+	quiet := fs.Bool("q", false, "no escribe el resultado; sólo el código de salida")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	raw, err := readInput(fs.Args())
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	var env firmajson.Envelope
+	if err := json.Unmarshal(raw, &env); err != nil || len(env.Payload) == 0 || env.Signature == "" {
+		return fail(exitUsage, "la entrada debe ser un sobre {payload, signature, ...}")
+	}
+
+	var v firmajson.Verification
+	if *jwks != "" {
+		data, err := os.ReadFile(*jwks)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		keys, err := firmajson.NewOfflineJWKS(data)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		v, err = keys.VerifyOffline(ctx, &env)
+		if err != nil {
+			return fail(exitInvalid, "%v", err)
+		}
+	} else {
+		// Con KMS se verifica con la versión que firmó el sobre
+		kv := ""
+		if getEnv("SIGNER_BACKEND", "gcp-kms") == "gcp-kms" {
+			kv = env.KeyVersion
+		}
+		b, closeBackend, err := backendFromEnv(ctx, kv)
+		if err != nil {
+			return fail(exitUsage, "%v", err)
+		}
+		defer closeBackend()
+		if v, err = firmajson.Verify(ctx, b, &env); errors.Is(err, firmajson.ErrInvalidPayload) {
+			return fail(exitUsage, "%v", err)
+		} else if err != nil {
+			return fail(exitBackend, "%v", err)
+		}
+	}
+
+	if !*quiet {
+		out, _ := json.MarshalIndent(map[string]interface{}{"valid": v.Valid, "verification": v}, "", "  ")
+		fmt.Println(string(out))
+	}
+	if !v.Valid {
+		return exitInvalid
+	}
+	return exitOK
+}
@@ -0,0 +1,197 @@
+// watch.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// watch vigila un directorio y firma cada .json nuevo en un .sig.json al
+// lado (factura.json → factura.sig.json). El directorio se recorre cada
+// -interval; un fichero se firma cuando su tamaño y su fecha no han
+// cambiado entre dos pasadas, para no firmar uno que se está copiando. Los
+// que ya tienen .sig.json no se vuelven a firmar, así que se puede parar y
+// arrancar sin duplicar nada; uno que no se puede firmar (JSON inválido,
+// "timestamp" propio) se registra y no se reintenta hasta que cambie.
+// Ficheros ocultos, subdirectorios y los propios .sig.json se ignoran.
+//
+// Los errores del backend no paran la vigilancia: el fichero se reintenta
+// en la siguiente pasada. -once firma lo que haya y sale (1 si alguno
+// falló).
+
+// sigSuffix es la extensión de los sobres
+const sigSuffix = ".sig.json"
+
+// watchedFile es lo que se sabe de un fichero entre pasadas
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// failed indica que no se pudo firmar tal y como está
+	failed bool
+}
+
+// watcher firma los ficheros de dir
+type watcher struct {
+	dir    string
+	signer firmajson.Signer
+	opts   firmajson.SignOptions
+	seen   map[string]*watchedFile
+}
+
+// runWatch atiende firma-json watch <dir>
+func runWatch(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", 2*time.Second, "cada cuánto se recorre el directorio")
+	escape := fs.String("escape", firmajson.FormJCS, "forma canónica: jcs (por defecto), html, minimal o ascii")
+	digest := fs.String("digest", "", "firma el resumen en vez del documento: sha256 (documentos de más de 64 KiB)")
+	once := fs.Bool("once", false, "firma lo que haya y sale")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		return fail(exitUsage, "uso: firma-json watch [opciones] <directorio>")
+	}
+	if !firmajson.ValidForm(*escape) {
+		return fail(exitUsage, "escape debe ser html, minimal, ascii o jcs")
+	}
+	if *digest != "" && *digest != firmajson.DigestSHA256 {
+		return fail(exitUsage, "digest debe ser sha256")
+	}
+	if *interval <= 0 {
+		return fail(exitUsage, "interval debe ser positivo")
+	}
+	dir := fs.Arg(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fail(exitUsage, "%s no es un directorio", dir)
+	}
+	b, closeBackend, err := backendFromEnv(ctx, "")
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+	defer closeBackend()
+
+	w := &watcher{dir: dir, signer: b, opts: firmajson.SignOptions{Form: *escape, Digest: *digest}, seen: map[string]*watchedFile{}}
+	if *once {
+		// Sin esperar a que se estabilicen: se da por hecho que no se
+		// están escribiendo
+		if w.scan(ctx, true) > 0 {
+			return exitInvalid
+		}
+		return exitOK
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Vigilando %s cada %s (key_version %s)", dir, *interval, b.KeyVersion())
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		w.scan(ctx, false)
+		select {
+		case <-ctx.Done():
+			log.Printf("Parando")
+			return exitOK
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan recorre el directorio una vez y firma lo que esté listo. Con all
+// firma sin esperar a que los ficheros se estabilicen. Devuelve cuántos
+// fallaron.
+func (w *watcher) scan(ctx context.Context, all bool) int {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("⚠️  %s: %v", w.dir, err)
+		return 1
+	}
+	present := map[string]bool{}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	var pending []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, sigSuffix) {
+			continue
+		}
+		if names[sigName(name)] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+		f, ok := w.seen[name]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			w.seen[name] = &watchedFile{size: info.Size(), modTime: info.ModTime()}
+			if !all {
+				continue
+			}
+			f = w.seen[name]
+		}
+		if !f.failed {
+			pending = append(pending, name)
+		}
+	}
+	// Lo que desapareció o ya tiene sobre se olvida
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+	sort.Strings(pending)
+	failed := 0
+	for _, name := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := w.sign(ctx, name); err != nil {
+			failed++
+			log.Printf("❌ %s: %v", name, err)
+			continue
+		}
+		log.Printf("✅ %s → %s", name, sigName(name))
+	}
+	return failed
+}
+
+// sign firma un fichero y escribe su sobre. Si el documento no se puede
+// firmar tal y como está, lo marca para no reintentarlo hasta que cambie.
+func (w *watcher) sign(ctx context.Context, name string) error {
+	raw, err := os.ReadFile(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	env, code, err := signDocument(ctx, w.signer, raw, w.opts)
+	if err != nil {
+		if code == exitUsage {
+			w.seen[name].failed = true
+			return fmt.Errorf("%w (no se reintenta hasta que cambie)", err)
+		}
+		return err
+	}
+	out := filepath.Join(w.dir, sigName(name))
+	if _, err := os.Stat(out); err == nil {
+		return errors.New(sigName(name) + " ya existe")
+	}
+	return writeEnvelope(out, env)
+}
+
+// sigName es el nombre del sobre de un documento
+func sigName(name string) string {
+	return strings.TrimSuffix(name, ".json") + sigSuffix
+}
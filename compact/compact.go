@@ -0,0 +1,238 @@
+// Package compact define el sobre binario compacto de firma-json, pensado
+// para dispositivos con muy poco ancho de banda: en vez del payload y la
+// firma en Base64 dentro de JSON, un mapa CBOR (RFC 8949) con claves enteras
+// que lleva sólo el hash del payload.
+//
+//	{1: versión, 2: kid, 3: ts, 4: firma, 5: hash}
+//
+//	1 versión  uint, hoy 1
+//	2 kid      bstr de 8 bytes: los primeros bytes del SHA-256 del nombre
+//	           de la versión de clave (ver KeyID)
+//	3 ts       uint, segundos Unix del momento de la firma
+//	4 firma    bstr, la firma tal cual la devuelve KMS
+//	5 hash     bstr de 32 bytes, SHA-256 del payload canónico
+//
+// Lo que se firma no es el mapa sino SigningInput: el array CBOR
+// ["firma-json/compact", versión, kid, ts, hash], de modo que la firma
+// cubre todos los campos salvo ella misma. Un sobre de una firma HMAC ocupa
+// unos 90 bytes. La codificación es determinista (RFC 8949 §4.2): mismos
+// campos, mismos bytes.
+package compact
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version es la versión del formato que se emite
+const Version = 1
+
+// KeyIDSize es la longitud de kid
+const KeyIDSize = 8
+
+// domain separa las firmas de este formato de cualquier otra
+const domain = "firma-json/compact"
+
+// ErrMalformed lo devuelve Unmarshal si los bytes no son un sobre válido
+var ErrMalformed = errors.New("sobre compacto mal formado")
+
+// Envelope es un sobre compacto
+type Envelope struct {
+	Version   uint64
+	KeyID     []byte
+	Timestamp uint64
+	Signature []byte
+	Hash      []byte
+}
+
+// KeyID devuelve el kid de una versión de clave
+func KeyID(keyVersion string) []byte {
+	sum := sha256.Sum256([]byte(keyVersion))
+	return sum[:KeyIDSize]
+}
+
+// SigningInput son los bytes que se firman
+func (e *Envelope) SigningInput() []byte {
+	var b []byte
+	b = appendHead(b, majorArray, 5)
+	b = appendText(b, domain)
+	b = appendHead(b, majorUint, e.Version)
+	b = appendBytes(b, e.KeyID)
+	b = appendHead(b, majorUint, e.Timestamp)
+	b = appendBytes(b, e.Hash)
+	return b
+}
+
+// Marshal codifica el sobre
+func (e *Envelope) Marshal() []byte {
+	var b []byte
+	b = appendHead(b, majorMap, 5)
+	b = appendHead(b, majorUint, 1)
+	b = appendHead(b, majorUint, e.Version)
+	b = appendHead(b, majorUint, 2)
+	b = appendBytes(b, e.KeyID)
+	b = appendHead(b, majorUint, 3)
+	b = appendHead(b, majorUint, e.Timestamp)
+	b = appendHead(b, majorUint, 4)
+	b = appendBytes(b, e.Signature)
+	b = appendHead(b, majorUint, 5)
+	b = appendBytes(b, e.Hash)
+	return b
+}
+
+// Unmarshal decodifica un sobre. Exige los cinco campos, una versión
+// conocida y los tamaños de kid y hash; las claves desconocidas se rechazan
+// para que un mismo sobre no tenga dos codificaciones.
+func Unmarshal(data []byte) (*Envelope, error) {
+	d := decoder{data: data}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != majorMap || n != 5 {
+		return nil, fmt.Errorf("%w: se esperaba un mapa de 5 campos", ErrMalformed)
+	}
+	var e Envelope
+	for want := uint64(1); want <= 5; want++ {
+		major, key, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != majorUint || key != want {
+			return nil, fmt.Errorf("%w: se esperaba la clave %d", ErrMalformed, want)
+		}
+		switch key {
+		case 1:
+			e.Version, err = d.uint()
+		case 2:
+			e.KeyID, err = d.bytes()
+		case 3:
+			e.Timestamp, err = d.uint()
+		case 4:
+			e.Signature, err = d.bytes()
+		case 5:
+			e.Hash, err = d.bytes()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%w: %d bytes sobrantes", ErrMalformed, len(d.data)-d.pos)
+	}
+	switch {
+	case e.Version != Version:
+		return nil, fmt.Errorf("%w: versión %d desconocida", ErrMalformed, e.Version)
+	case len(e.KeyID) != KeyIDSize:
+		return nil, fmt.Errorf("%w: kid debe tener %d bytes", ErrMalformed, KeyIDSize)
+	case len(e.Hash) != sha256.Size:
+		return nil, fmt.Errorf("%w: hash debe tener %d bytes", ErrMalformed, sha256.Size)
+	case len(e.Signature) == 0:
+		return nil, fmt.Errorf("%w: falta la firma", ErrMalformed)
+	}
+	return &e, nil
+}
+
+// Tipos mayores de CBOR que usa el formato
+const (
+	majorUint  = 0
+	majorBytes = 2
+	majorText  = 3
+	majorArray = 4
+	majorMap   = 5
+)
+
+// appendHead añade la cabecera de un elemento con la longitud mínima
+func appendHead(b []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(b, m|byte(n))
+	case n <= 0xff:
+		return append(b, m|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, m|27), n)
+}
+
+func appendBytes(b, v []byte) []byte {
+	return append(appendHead(b, majorBytes, uint64(len(v))), v...)
+}
+
+func appendText(b []byte, s string) []byte {
+	return append(appendHead(b, majorText, uint64(len(s))), s...)
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// head lee una cabecera y rechaza las longitudes indefinidas y las que no
+// usan la forma mínima
+func (d *decoder) head() (major byte, n uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, fmt.Errorf("%w: fin inesperado", ErrMalformed)
+	}
+	ib := d.data[d.pos]
+	d.pos++
+	major, info := ib>>5, ib&0x1f
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("%w: longitud indefinida o reservada", ErrMalformed)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, fmt.Errorf("%w: fin inesperado", ErrMalformed)
+	}
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	if minimal := appendHead(nil, major, n); len(minimal) != size+1 {
+		return 0, 0, fmt.Errorf("%w: codificación no mínima", ErrMalformed)
+	}
+	return major, n, nil
+}
+
+func (d *decoder) uint() (uint64, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != majorUint {
+		return 0, fmt.Errorf("%w: se esperaba un entero", ErrMalformed)
+	}
+	return n, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != majorBytes {
+		return nil, fmt.Errorf("%w: se esperaba un bstr", ErrMalformed)
+	}
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, fmt.Errorf("%w: fin inesperado", ErrMalformed)
+	}
+	v := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return append([]byte(nil), v...), nil
+}
@@ -0,0 +1,238 @@
+// compactenvelope.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"example.com/firmajson/compact"
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Sobre compacto (ver el paquete compact): POST /sign/compact firma el
+// hash del payload canónico, sin inyectarle nada, y devuelve el sobre en
+// CBOR (application/cbor). POST /verify/compact acepta el sobre en crudo
+// (sólo comprueba la firma sobre el hash y lo devuelve) o
+// {"envelope": "<base64>", "payload": {...}} (comprueba además el hash). El
+// timestamp va en el sobre, así que ?maxAge= se aplica igual que en /verify.
+
+// compactMediaType es el Content-Type del sobre compacto
+const compactMediaType = "application/cbor"
+
+// compactMaxBytes limita el sobre en /verify/compact: una firma RSA-4096
+// cabe de sobra
+const compactMaxBytes = 4096
+
+// validateSignCompactRequest comprueba el documento de /sign/compact
+func validateSignCompactRequest(r *http.Request, body []byte) []validationProblem {
+	problems := validateAAD(r)
+	if !validEscapeMode(unrecordedEscape(r)) {
+		problems = append(problems, validationProblem{"escape", errInvalidRequest, "escape debe ser html, minimal, ascii o jcs"})
+	}
+	if len(body) > maxPayloadBytes() {
+		problems = append(problems, validationProblem{"body", errPayloadTooLarge,
+			fmt.Sprintf("El documento ocupa %d bytes y el máximo es %d", len(body), maxPayloadBytes())})
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload == nil {
+		problems = append(problems, validationProblem{"body", errInvalidJSON, "El documento debe ser un objeto JSON"})
+	}
+	return problems
+}
+
+// signCompactHandler firma un documento como sobre compacto
+func signCompactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return
+	}
+	var payload map[string]interface{}
+	if err := firmajson.DecodeJSON(body, &payload); err != nil || payload == nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	data, err := canonicalJSONEscaped(payload, unrecordedEscape(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	now, err := signingClock.Now()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errTimeSourceUnavailable, err.Error())
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	env := &compact.Envelope{
+		Version:   compact.Version,
+		KeyID:     compact.KeyID(aliasKeyVersion(alias)),
+		Timestamp: uint64(now.Unix()),
+		Hash:      sum[:],
+	}
+	ctx := withKeyPriority(r.Context(), alias)
+	audit := newAuditEntry(r, "sign_compact", alias, data)
+	if env.Signature, err = kmsSignRaw(ctx, env.SigningInput()); err != nil {
+		audit.Outcome, audit.Detail = "error", err.Error()
+		recordAudit(ctx, audit)
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+
+	w.Header().Set("Content-Type", compactMediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(env.Marshal())
+}
+
+// keyVersionForKID devuelve la versión de clave aceptada cuyo kid compacto
+// es kid
+func keyVersionForKID(kid []byte) (string, bool) {
+	candidates := acceptedKeyVersions()
+	for _, kc := range keyConfigs {
+		if kc.KeyVersion != "" {
+			candidates = append(candidates, kc.KeyVersion)
+		}
+	}
+	for _, kv := range candidates {
+		if bytes.Equal(compact.KeyID(kv), kid) {
+			return kv, true
+		}
+	}
+	return "", false
+}
+
+// verifyCompactRequest es el cuerpo JSON de /verify/compact; también se
+// acepta el sobre CBOR tal cual con Content-Type application/cbor
+type verifyCompactRequest struct {
+	Envelope string          `json:"envelope"` // sobre CBOR en Base64
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// verifyCompactHandler verifica un sobre compacto
+func verifyCompactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !validEscapeMode(unrecordedEscape(r)) {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "escape debe ser html, minimal, ascii o jcs")
+		return
+	}
+	if _, err := requestMaxAge(r); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxPayloadBytes())+compactMaxBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return
+	}
+
+	raw, payload := body, json.RawMessage(nil)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != compactMediaType {
+		var req verifyCompactRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, `El cuerpo debe ser el sobre CBOR (application/cbor) o {"envelope": "...", "payload": {...}}`)
+			return
+		}
+		if raw, err = base64.StdEncoding.DecodeString(req.Envelope); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidSigEncoding, "envelope no es Base64 válido")
+			return
+		}
+		payload = req.Payload
+	}
+	if len(raw) > compactMaxBytes {
+		writeError(w, http.StatusBadRequest, errPayloadTooLarge, fmt.Sprintf("El sobre compacto no puede pasar de %d bytes", compactMaxBytes))
+		return
+	}
+	env, err := compact.Unmarshal(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidPayload, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	ts := time.Unix(int64(env.Timestamp), 0).UTC()
+	audit := newAuditEntry(r, "verify_compact", defaultKeyAlias, nil)
+	audit.PayloadSHA256 = hex.EncodeToString(env.Hash)
+	resp := map[string]interface{}{
+		"payload_sha256": audit.PayloadSHA256,
+		"timestamp":      ts.Format(time.RFC3339),
+	}
+	valid, reason := false, ""
+	kv, known := keyVersionForKID(env.KeyID)
+	if known {
+		resp["key_version"] = kv
+		reason = compactPayloadMismatch(r, payload, env.Hash)
+	} else {
+		reason = "kid no corresponde a ninguna versión de clave aceptada"
+	}
+	if reason == "" {
+		s, err := signerForKeyVersion(kv)
+		if err != nil {
+			audit.Outcome, audit.Detail = "error", err.Error()
+			recordAudit(ctx, audit)
+			writeKMSError(w, err, errKMSVerifyFailed, fmt.Sprintf("Error verificando: %v", err))
+			return
+		}
+		v, err := s.Verify(ctx, env.SigningInput(), env.Signature)
+		if err != nil {
+			audit.Outcome, audit.Detail = "error", err.Error()
+			recordAudit(ctx, audit)
+			writeKMSError(w, err, errKMSVerifyFailed, fmt.Sprintf("Error verificando: %v", err))
+			return
+		}
+		if valid = v.Valid; valid {
+			claims := map[string]interface{}{"timestamp": ts.Format(time.RFC3339Nano)}
+			if reason = checkFreshness(r, claims, time.Now()); reason != "" {
+				valid = false
+			}
+		}
+	}
+	audit.Outcome, audit.Detail = outcomeOf(valid), reason
+	recordAudit(ctx, audit)
+
+	resp["valid"] = valid
+	if reason != "" {
+		resp["reason"] = reason
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// compactPayloadMismatch comprueba, si se envió el payload, que su hash
+// canónico es el del sobre. Devuelve el motivo si no, o "".
+func compactPayloadMismatch(r *http.Request, payload json.RawMessage, hash []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+	var obj interface{}
+	if err := firmajson.DecodeJSON(payload, &obj); err != nil {
+		return "payload no es JSON válido"
+	}
+	data, err := canonicalJSONEscaped(obj, unrecordedEscape(r))
+	if err != nil {
+		return err.Error()
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], hash) {
+		return "El hash del payload no coincide con el del sobre"
+	}
+	return ""
+}
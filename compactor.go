@@ -0,0 +1,169 @@
+// compactor.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// auditHourlyCollection guarda los agregados por hora y tenant
+	auditHourlyCollection = "audit_hourly"
+	// auditMetaCollection guarda el estado del compactador
+	auditMetaCollection = "audit_meta"
+	rollupWatermarkID   = "rollup_watermark"
+)
+
+// hourlyAggregate resume las entradas de auditoría de una hora y un tenant
+type hourlyAggregate struct {
+	Hour   string         `json:"hour"` // "2006-01-02T15"
+	Tenant string         `json:"tenant"`
+	Counts map[string]int `json:"counts"` // "evento:resultado" → número
+}
+
+// startAuditCompactor lanza la compactación cada AUDIT_COMPACT_INTERVAL
+// (0 la desactiva)
+func startAuditCompactor() {
+	interval, _ := auditCompactInterval() // ya validado al arrancar
+	if interval <= 0 {
+		return
+	}
+	lifecycle.Go("audit-compactor", func(ctx context.Context) {
+		for sleepCtx(ctx, interval) {
+			if err := compactAudit(ctx, time.Now().UTC()); err != nil {
+				log.Printf("⚠️  Compactación de auditoría: %v", err)
+			}
+		}
+	})
+}
+
+// auditCompactInterval lee AUDIT_COMPACT_INTERVAL (1h)
+func auditCompactInterval() (time.Duration, error) {
+	interval, err := time.ParseDuration(getEnv("AUDIT_COMPACT_INTERVAL", "1h"))
+	if err != nil {
+		return 0, fmt.Errorf("AUDIT_COMPACT_INTERVAL inválido: %v", err)
+	}
+	return interval, nil
+}
+
+// compactAudit agrega por hora las entradas de las horas ya cerradas y
+// saca del store las que superan la retención de su tenant: se archivan en
+// AUDIT_ARCHIVE_BUCKET (sin duplicados) y después se borran. Sin bucket
+// configurado se borran directamente; los agregados se conservan siempre.
+func compactAudit(ctx context.Context, now time.Time) error {
+	records, ids, err := db.List(ctx, auditCollection)
+	if err != nil {
+		return err
+	}
+
+	watermark := ""
+	if raw, err := db.Get(ctx, auditMetaCollection, rollupWatermarkID); err == nil {
+		watermark = string(raw)
+	}
+	currentHour := now.Format("2006-01-02T15")
+
+	aggregates := map[string]*hourlyAggregate{}
+	var expired []auditEntry
+	seen := map[string]bool{}
+	for _, id := range ids {
+		var e auditEntry
+		if err := json.Unmarshal(records[id], &e); err != nil {
+			continue
+		}
+		hour := e.Time.UTC().Format("2006-01-02T15")
+		if hour >= watermark && hour < currentHour {
+			aggID := hour + "|" + e.Tenant
+			agg := aggregates[aggID]
+			if agg == nil {
+				agg = &hourlyAggregate{Hour: hour, Tenant: e.Tenant, Counts: map[string]int{}}
+				aggregates[aggID] = agg
+			}
+			agg.Counts[e.Event+":"+e.Outcome]++
+		}
+		if now.Sub(e.Time) > auditRetention(e.Tenant) && hour < currentHour {
+			if h := e.contentHash(); !seen[h] {
+				seen[h] = true
+				expired = append(expired, e)
+			} else if err := db.Delete(ctx, auditCollection, e.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for aggID, agg := range aggregates {
+		raw, _ := json.Marshal(agg)
+		if err := db.Put(ctx, auditHourlyCollection, aggID, raw); err != nil {
+			return err
+		}
+	}
+	if err := db.Put(ctx, auditMetaCollection, rollupWatermarkID, []byte(currentHour)); err != nil {
+		return err
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+	if bucket := getEnv("AUDIT_ARCHIVE_BUCKET", ""); bucket != "" {
+		object := fmt.Sprintf("audit/%s/%s.ndjson", now.Format("2006/01/02"), expired[0].ID)
+		if err := archiveToGCS(ctx, bucket, object, expired); err != nil {
+			return fmt.Errorf("archivando en gs://%s/%s: %w", bucket, object, err)
+		}
+	}
+	for _, e := range expired {
+		if err := db.Delete(ctx, auditCollection, e.ID); err != nil {
+			return err
+		}
+	}
+	log.Printf("Compactación de auditoría: %d horas agregadas, %d entradas retiradas", len(aggregates), len(expired))
+	return nil
+}
+
+// auditRetention devuelve cuánto se guardan las entradas completas de un
+// tenant: AUDIT_TENANT_RETENTION ("tenant=días,...") o AUDIT_RETENTION_DAYS
+func auditRetention(tenant string) time.Duration {
+	days, err := strconv.Atoi(getEnv("AUDIT_RETENTION_DAYS", "30"))
+	if err != nil {
+		days = 30
+	}
+	for _, pair := range strings.Split(getEnv("AUDIT_TENANT_RETENTION", ""), ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(name) == tenant {
+			if d, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				days = d
+			}
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// archiveToGCS escribe las entradas como NDJSON en un objeto de GCS
+func archiveToGCS(ctx context.Context, bucket, object string, entries []auditEntry) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,107 @@
+// compress.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Los sobres comprimidos llevan "payload_z" (bytes canónicos comprimidos, en
+// Base64) y "content_encoding" en lugar de "payload". La firma sigue
+// cubriendo los bytes canónicos sin comprimir, así que se verifica igual
+// una vez descomprimido.
+
+// compressPayload comprime los bytes canónicos con gzip o zstd
+func compressPayload(encoding string, data []byte) (string, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return "", err
+		}
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return "", err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return "", err
+		}
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("content_encoding %q no soportado (gzip, zstd)", encoding)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decompressPayload deshace compressPayload. Para evitar bombas de
+// descompresión se corta en MAX_DECOMPRESSED_BYTES (64 MiB por defecto).
+func decompressPayload(encoding, payloadZ string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(payloadZ)
+	if err != nil {
+		return nil, fmt.Errorf("payload_z no es Base64 válido")
+	}
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("content_encoding %q no soportado (gzip, zstd)", encoding)
+	}
+	limit := int64(envInt("MAX_DECOMPRESSED_BYTES", 64<<20))
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("el payload descomprimido supera %d bytes", limit)
+	}
+	return data, nil
+}
+
+// compressEnvelope sustituye "payload" por su variante comprimida en la
+// respuesta de firma
+func compressEnvelope(resp map[string]interface{}, encoding string, data []byte) error {
+	z, err := compressPayload(encoding, data)
+	if err != nil {
+		return err
+	}
+	delete(resp, "payload")
+	resp["payload_z"] = z
+	resp["content_encoding"] = encoding
+	return nil
+}
+
+// requestCompression devuelve el content-encoding pedido con ?compress=
+func requestCompression(r *http.Request) (string, error) {
+	switch enc := r.URL.Query().Get("compress"); enc {
+	case "", "gzip", "zstd":
+		return enc, nil
+	default:
+		return "", fmt.Errorf("compress %q no soportado (gzip, zstd)", enc)
+	}
+}
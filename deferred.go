@@ -0,0 +1,305 @@
+// deferred.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Con ?defer=true, si KMS no está disponible al firmar, /sign no falla:
+// guarda el documento ya preparado (con su timestamp de aceptación),
+// responde 202 con un id de seguimiento y lo firma en cuanto KMS se
+// recupera. Al firmarlo avisa al webhook de ?callback= (sólo a
+// CALLBACK_HOSTS, ver callbacks.go) y, con ?notify=, envía el recibo al
+// dueño. Hay pipelines que prefieren una firma tardía a un error.
+
+// deferredCollection guarda las firmas pendientes y su resultado
+const deferredCollection = "deferred_signatures"
+
+const (
+	deferredQueued = "queued"
+	deferredSigned = "signed"
+	deferredFailed = "failed"
+)
+
+type deferredSignature struct {
+	ID          string                 `json:"id"`
+	Status      string                 `json:"status"`
+	Key         string                 `json:"key"`
+	Meta        requestMeta            `json:"meta"`
+	Payload     map[string]interface{} `json:"payload"`
+	Escape      string                 `json:"escape,omitempty"`
+	Owner       string                 `json:"owner,omitempty"`
+	Callback    string                 `json:"callback,omitempty"`
+	Attempts    int                    `json:"attempts"`
+	LastError   string                 `json:"last_error,omitempty"`
+	AcceptedAt  time.Time              `json:"accepted_at"`
+	SignedAt    *time.Time             `json:"signed_at,omitempty"`
+	Signature   string                 `json:"signature,omitempty"`
+	KeyVersion  string                 `json:"key_version,omitempty"`
+	EnvelopeID  string                 `json:"envelope_id,omitempty"`
+	PayloadHash string                 `json:"payload_sha256"`
+}
+
+// deferRequested indica si el cliente acepta una firma diferida
+func deferRequested(r *http.Request) bool {
+	return r.URL.Query().Get("defer") == "true"
+}
+
+// kmsUnavailable distingue una caída o saturación de KMS (se puede diferir)
+// de un rechazo definitivo (clave deshabilitada, permisos...)
+func kmsUnavailable(err error) bool {
+	if errors.Is(err, errPacerSaturated) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// validateDeferParams revisa defer y callback
+func validateDeferParams(r *http.Request) error {
+	switch r.URL.Query().Get("defer") {
+	case "", "true", "false":
+	default:
+		return errors.New("defer debe ser true o false")
+	}
+	if cb := r.URL.Query().Get("callback"); cb != "" {
+		return validateCallbackURL(cb)
+	}
+	return nil
+}
+
+// queueDeferred guarda el documento preparado y responde 202
+func queueDeferred(w http.ResponseWriter, r *http.Request, alias string, payload map[string]interface{}, data []byte) {
+	id, err := randomID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "No se pudo generar el id")
+		return
+	}
+	sum := sha256.Sum256(data)
+	d := deferredSignature{
+		ID:          id,
+		Status:      deferredQueued,
+		Key:         alias,
+		Meta:        metaOf(r),
+		Payload:     payload,
+		Escape:      requestEscape(r),
+		Callback:    r.URL.Query().Get("callback"),
+		AcceptedAt:  time.Now().UTC(),
+		PayloadHash: hex.EncodeToString(sum[:]),
+	}
+	d.Owner, _ = requestNotifyOwner(r)
+	if err := saveDeferred(r.Context(), d); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("No se pudo encolar: %v", err))
+		return
+	}
+	log.Printf("⏳ KMS no disponible: firma %s diferida", id)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"tracking_id":    id,
+		"status":         d.Status,
+		"status_url":     "/sign/deferred/" + id,
+		"payload_sha256": d.PayloadHash,
+	})
+}
+
+func saveDeferred(ctx context.Context, d deferredSignature) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return db.Put(ctx, deferredCollection, d.ID, raw)
+}
+
+// startDeferredSigner reintenta las firmas pendientes cada
+// DEFER_RETRY_INTERVAL (30s por defecto)
+func startDeferredSigner() {
+	interval, _ := deferRetryInterval() // ya validado al arrancar
+	lifecycle.Go("deferred-signer", func(ctx context.Context) {
+		for sleepCtx(ctx, interval) {
+			if err := signDeferred(ctx); err != nil {
+				log.Printf("⚠️  Firmas diferidas: %v", err)
+			}
+		}
+	})
+}
+
+// deferRetryInterval lee DEFER_RETRY_INTERVAL (30s, mayor que cero)
+func deferRetryInterval() (time.Duration, error) {
+	interval, err := time.ParseDuration(getEnv("DEFER_RETRY_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("DEFER_RETRY_INTERVAL inválido: %q", getEnv("DEFER_RETRY_INTERVAL", "30s"))
+	}
+	return interval, nil
+}
+
+// signDeferred firma las pendientes en orden de llegada. Si KMS sigue
+// caído se deja para la siguiente pasada; un error definitivo o agotar
+// DEFER_MAX_ATTEMPTS (100) la marca como fallida.
+func signDeferred(ctx context.Context) error {
+	records, ids, err := db.List(ctx, deferredCollection)
+	if err != nil {
+		return err
+	}
+	var pending []deferredSignature
+	for _, id := range ids {
+		var d deferredSignature
+		if err := firmajson.DecodeJSON(records[id], &d); err == nil && d.Status == deferredQueued {
+			firmajson.PreciseNumbers(d.Payload)
+			pending = append(pending, d)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// Orden de llegada: los ids son aleatorios
+	sort.Slice(pending, func(i, j int) bool { return pending[i].AcceptedAt.Before(pending[j].AcceptedAt) })
+
+	for _, d := range pending {
+		data, err := canonicalJSONEscaped(d.Payload, d.Escape)
+		if err != nil {
+			d.Status, d.LastError = deferredFailed, err.Error()
+			saveDeferred(ctx, d)
+			continue
+		}
+		// La clave pudo comprometerse o borrarse mientras esperaba
+		_, compromised := keyCompromised(ctx, d.Key)
+		if _, deleted := keyDeleted(ctx, d.Key); compromised || deleted {
+			d.Status, d.LastError = deferredFailed, "la clave ya no admite firmas"
+			saveDeferred(ctx, d)
+			notifyDeferred(d)
+			continue
+		}
+		kctx := withKeyPriority(ctx, d.Key)
+		audit := newAuditEntryFor(d.Meta, "sign_deferred", d.Key, data)
+		audit.Detail = "tracking_id=" + d.ID
+		d.Attempts++
+		signature, err := kmsSign(kctx, data)
+		if err != nil {
+			d.LastError = err.Error()
+			if !kmsUnavailable(err) || d.Attempts >= envInt("DEFER_MAX_ATTEMPTS", 100) {
+				d.Status = deferredFailed
+				audit.Outcome = "error"
+				recordAudit(ctx, audit)
+				notifyDeferred(d)
+			}
+			if err := saveDeferred(ctx, d); err != nil {
+				return err
+			}
+			if kmsUnavailable(err) {
+				// KMS sigue sin responder: no tiene sentido seguir con el resto
+				return nil
+			}
+			continue
+		}
+		audit.Outcome = "ok"
+		recordAudit(ctx, audit)
+
+		now := time.Now().UTC()
+		d.Status, d.Signature, d.KeyVersion, d.SignedAt, d.LastError = deferredSigned, signature, aliasKeyVersion(d.Key), &now, ""
+		if envelopeStorageEnabled() {
+			if d.EnvelopeID, err = storeEnvelope(kctx, d.Meta, d.Key, d.Payload, signature, d.Escape, ""); err != nil {
+				log.Printf("⚠️  Firma diferida %s firmada pero no guardada: %v", d.ID, err)
+			}
+		}
+		if err := saveDeferred(ctx, d); err != nil {
+			return err
+		}
+		if d.Owner != "" {
+			sendReceipt(d.Meta, d.Owner, d.Key, data, signature, d.EnvelopeID)
+		}
+		env := map[string]interface{}{"payload": d.Payload, "signature": signature, "key": d.Key, "key_version": d.KeyVersion}
+		if d.Escape != "" && d.Escape != escapeHTML {
+			env["escape"] = d.Escape
+		}
+		if d.EnvelopeID != "" {
+			env["envelope_id"] = d.EnvelopeID
+		}
+		documentSigned(d.Key, env, d.Payload, d.Escape)
+		notifyDeferred(d)
+	}
+	return nil
+}
+
+// notifyDeferred avisa al callback del resultado, en segundo plano
+func notifyDeferred(d deferredSignature) {
+	if d.Callback == "" {
+		return
+	}
+	body, _ := json.Marshal(deferredView(d))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := postCallback(ctx, d.Callback, body); err != nil {
+			log.Printf("⚠️  Callback de la firma diferida %s no entregado: %v", d.ID, err)
+		}
+	}()
+}
+
+// deferredView es lo que ve el cliente: el sobre completo cuando ya está
+// firmado
+func deferredView(d deferredSignature) map[string]interface{} {
+	out := map[string]interface{}{
+		"tracking_id":    d.ID,
+		"status":         d.Status,
+		"accepted_at":    d.AcceptedAt,
+		"payload_sha256": d.PayloadHash,
+	}
+	switch d.Status {
+	case deferredSigned:
+		out["signed_at"] = d.SignedAt
+		out["payload"] = d.Payload
+		out["signature"] = d.Signature
+		out["key_version"] = d.KeyVersion
+		if d.Escape != "" && d.Escape != escapeHTML {
+			out["escape"] = d.Escape
+		}
+		if d.EnvelopeID != "" {
+			out["envelope_id"] = d.EnvelopeID
+		}
+	case deferredFailed:
+		out["error"] = d.LastError
+	}
+	return out
+}
+
+// deferredHandler devuelve el estado de una firma diferida:
+// GET /sign/deferred/{id}. Sólo la ve quien la pidió.
+func deferredHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/sign/deferred/")
+	raw, err := db.Get(r.Context(), deferredCollection, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Firma diferida desconocida")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	var d deferredSignature
+	if err := json.Unmarshal(raw, &d); err != nil || d.Meta.Caller != callerID(r) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Firma diferida desconocida")
+		return
+	}
+	writeJSON(w, http.StatusOK, deferredView(d))
+}
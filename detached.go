@@ -0,0 +1,107 @@
+// detached.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Firma separada: con POST /sign?detached=true la respuesta no lleva el
+// documento, sólo la firma, los campos inyectados y el SHA-256 de los bytes
+// canónicos firmados. El cliente guarda el documento donde quiera y el
+// sobre queda en unos cientos de bytes.
+//
+// Para verificar se manda a /verify el documento original junto a la firma:
+//
+//	{"document": {...}, "injected": {...}, "signature": "...",
+//	 "payload_sha256": "..."}
+//
+// El servicio vuelve a montar el documento firmado con los campos
+// inyectados (los cifrados se sustituyen por su JSON Pointer) y, si viene
+// payload_sha256, lo compara antes de llamar a KMS.
+
+// detachedRequested indica si se ha pedido la firma separada
+func detachedRequested(r *http.Request) bool {
+	return r.URL.Query().Get("detached") == "true"
+}
+
+// validateDetachedParams comprueba ?detached= y sus incompatibilidades
+func validateDetachedParams(r *http.Request) error {
+	switch r.URL.Query().Get("detached") {
+	case "", "false":
+		return nil
+	case "true":
+	default:
+		return errors.New("detached debe ser true o false")
+	}
+	if enc, _ := requestCompression(r); enc != "" {
+		return errors.New("detached no se combina con compress")
+	}
+	if format, _ := requestSignFormat(r); format != "" {
+		return errors.New("detached no se combina con la salida JWS")
+	}
+	if r.URL.Query().Get("echo") == "true" {
+		return errors.New("detached no se combina con echo=true")
+	}
+	return nil
+}
+
+// detachPayload deja en la respuesta de /sign sólo lo necesario para
+// verificar con el documento original
+func detachPayload(resp map[string]interface{}, injected map[string]interface{}, data []byte) {
+	sum := sha256.Sum256(data)
+	omitPayload(resp, injected)
+	resp["detached"] = true
+	resp["payload_sha256"] = hex.EncodeToString(sum[:])
+}
+
+// attachDocument monta en req.Payload el documento firmado a partir del
+// original y los campos inyectados
+func attachDocument(req *verifyRequest) error {
+	var doc map[string]interface{}
+	if err := firmajson.DecodeJSON(req.Document, &doc); err != nil || doc == nil {
+		return errors.New("el documento debe ser un objeto JSON")
+	}
+	var injected map[string]interface{}
+	if len(req.Injected) > 0 {
+		if err := firmajson.DecodeJSON(req.Injected, &injected); err != nil {
+			return errors.New("injected debe ser un objeto JSON")
+		}
+	}
+	for k, v := range injected {
+		if k != "encrypted_fields" {
+			doc[k] = v
+		}
+	}
+	if enc, ok := injected["encrypted_fields"].(map[string]interface{}); ok {
+		for ptr, v := range enc {
+			if err := pointerSet(doc, ptr, v); err != nil {
+				return err
+			}
+		}
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req.Payload = raw
+	return nil
+}
+
+// checkPayloadDigest compara el SHA-256 declarado con los bytes canónicos
+// reconstruidos; devuelve el motivo si no coinciden
+func checkPayloadDigest(declared string, data []byte) string {
+	if declared == "" {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != declared {
+		return "El documento no coincide con payload_sha256"
+	}
+	return ""
+}
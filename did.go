@@ -0,0 +1,313 @@
+// did.go
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefijos multicodec (varint) de las claves públicas que entendemos en
+// did:key y publicKeyMultibase
+var (
+	multicodecEd25519 = []byte{0xed, 0x01}
+	multicodecP256    = []byte{0x80, 0x24}
+)
+
+// Los DID llegan en el kid de sobres que cualquiera puede mandar a /verify,
+// así que resolverlos no puede costar memoria ni abrir conexiones a
+// discreción:
+//
+//	DID_METHODS     métodos admitidos (key, web); vacío por defecto
+//	DID_ALLOWLIST   DID (sin fragmento) aceptados, separados por comas;
+//	                obligatorio con cualquier método
+//	DID_WEB_HOSTS   hosts de los que se aceptan documentos did:web,
+//	                separados por comas; obligatorio con web
+//	DID_CACHE_TTL   vida de una clave resuelta (1h)
+//	DID_CACHE_SIZE  claves resueltas en memoria, LRU (1000)
+//
+// Un did:key lleva la propia clave pública, así que no es un ancla de
+// confianza: sin la lista cualquiera firmaría con su clave y el sobre
+// verificaría. Por lo mismo un kid DID exige un iss de otro emisor (ver
+// verifyFederated). did:web sólo descarga de los hosts de DID_WEB_HOSTS,
+// nunca de una dirección privada, de loopback o link-local (se comprueba
+// la IP a la que se conecta, no el nombre) y sin seguir redirecciones.
+
+// maxDIDKeyLength es la longitud máxima del identificador de un did:key: el
+// de una clave P-256 ronda los 50 caracteres y decodificar base58 cuesta
+// el cuadrado de la longitud
+const maxDIDKeyLength = 128
+
+// didCache es un LRU con caducidad de las claves resueltas
+type didCache struct {
+	mu      sync.Mutex
+	order   *list.List // más reciente delante
+	entries map[string]*list.Element
+}
+
+type cachedDIDKey struct {
+	did       string
+	key       crypto.PublicKey
+	fetchedAt time.Time
+}
+
+var didKeys = &didCache{order: list.New(), entries: map[string]*list.Element{}}
+
+func (c *didCache) get(did string, ttl time.Duration) (crypto.PublicKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[did]
+	if !ok {
+		return nil, false
+	}
+	cached := el.Value.(*cachedDIDKey)
+	if time.Since(cached.fetchedAt) >= ttl {
+		c.order.Remove(el)
+		delete(c.entries, did)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return cached.key, true
+}
+
+func (c *didCache) put(did string, key crypto.PublicKey, limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[did]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[did] = c.order.PushFront(&cachedDIDKey{did: did, key: key, fetchedAt: time.Now()})
+	for c.order.Len() > limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedDIDKey).did)
+	}
+}
+
+// didMethodAllowed comprueba el método contra DID_METHODS (por defecto
+// ninguno)
+func didMethodAllowed(method string) bool {
+	return contains(envList("DID_METHODS"), method)
+}
+
+// didAllowed indica si el DID (sin fragmento) está en DID_ALLOWLIST
+func didAllowed(did string) bool {
+	return contains(envList("DID_ALLOWLIST"), did)
+}
+
+// configureDID comprueba la configuración de los DID al arrancar
+func configureDID() error {
+	if len(envList("DID_METHODS")) > 0 && len(envList("DID_ALLOWLIST")) == 0 {
+		return errors.New("DID_METHODS requiere DID_ALLOWLIST")
+	}
+	if didMethodAllowed("web") && len(didWebHosts()) == 0 {
+		return errors.New("DID_METHODS incluye web pero DID_WEB_HOSTS está vacío")
+	}
+	return nil
+}
+
+// didWebHosts son los hosts de DID_WEB_HOSTS
+func didWebHosts() []string {
+	hosts := envList("DID_WEB_HOSTS")
+	for i, h := range hosts {
+		hosts[i] = strings.ToLower(h)
+	}
+	return hosts
+}
+
+// didWebHTTPClient descarga documentos did:web: sólo a direcciones públicas
+// y sin redirecciones
+var didWebHTTPClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: publicTransport("did:web"),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return errors.New("did:web: no se siguen redirecciones")
+	},
+}
+
+// publicIP indica si ip es una dirección pública: ni privada, ni de
+// loopback, ni link-local, ni sin especificar
+func publicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// resolveDIDKey resuelve un DID URL (did:key:… o did:web:…#fragmento) a la
+// clave pública de su método de verificación, cacheando el resultado
+// DID_CACHE_TTL
+func resolveDIDKey(ctx context.Context, didURL string) (crypto.PublicKey, error) {
+	parts := strings.SplitN(didURL, ":", 3)
+	if len(parts) != 3 || parts[0] != "did" {
+		return nil, fmt.Errorf("DID inválido: %q", didURL)
+	}
+	method := parts[1]
+	if !didMethodAllowed(method) {
+		return nil, fmt.Errorf("método DID no permitido: %q", method)
+	}
+	did, _, _ := strings.Cut(didURL, "#")
+	if method == "key" && len(did) > len("did:key:")+maxDIDKeyLength {
+		return nil, fmt.Errorf("did:key de más de %d caracteres", maxDIDKeyLength)
+	}
+	if !didAllowed(did) {
+		return nil, fmt.Errorf("DID no permitido: %q", did)
+	}
+
+	ttl, err := time.ParseDuration(getEnv("DID_CACHE_TTL", "1h"))
+	if err != nil {
+		ttl = time.Hour
+	}
+	if key, ok := didKeys.get(didURL, ttl); ok {
+		return key, nil
+	}
+
+	var key crypto.PublicKey
+	switch method {
+	case "key":
+		// did:key:z… — el fragmento, si lo hay, repite el identificador
+		id, _, _ := strings.Cut(parts[2], "#")
+		key, err = decodeMultibaseKey(id)
+	case "web":
+		key, err = resolveDIDWeb(ctx, didURL, parts[2])
+	default:
+		err = fmt.Errorf("método DID no soportado: %q", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	didKeys.put(didURL, key, max(envInt("DID_CACHE_SIZE", 1000), 1))
+	return key, nil
+}
+
+// resolveDIDWeb descarga el documento DID de did:web y devuelve la clave del
+// método de verificación indicado en el fragmento (o el primero si no hay)
+func resolveDIDWeb(ctx context.Context, didURL, specific string) (crypto.PublicKey, error) {
+	id, fragment, _ := strings.Cut(specific, "#")
+	segments := strings.Split(id, ":")
+	for i, s := range segments {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, fmt.Errorf("did:web inválido: %w", err)
+		}
+		segments[i] = u
+	}
+	// El host puede llevar puerto (did:web:ejemplo.com%3A8443)
+	host := strings.ToLower(segments[0])
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !contains(didWebHosts(), host) {
+		return nil, fmt.Errorf("did:web: el host %q no está en DID_WEB_HOSTS", host)
+	}
+	docURL := "https://" + segments[0] + "/.well-known/did.json"
+	if len(segments) > 1 {
+		docURL = "https://" + strings.Join(segments, "/") + "/did.json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := didWebHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("descargando documento DID: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("descargando documento DID: HTTP %d", resp.StatusCode)
+	}
+	var doc struct {
+		ID                 string `json:"id"`
+		VerificationMethod []struct {
+			ID                 string `json:"id"`
+			PublicKeyJwk       *jwk   `json:"publicKeyJwk"`
+			PublicKeyMultibase string `json:"publicKeyMultibase"`
+		} `json:"verificationMethod"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("documento DID inválido: %w", err)
+	}
+
+	for _, vm := range doc.VerificationMethod {
+		if fragment != "" && vm.ID != didURL && vm.ID != "#"+fragment {
+			continue
+		}
+		if vm.PublicKeyJwk != nil {
+			return vm.PublicKeyJwk.publicKey()
+		}
+		return decodeMultibaseKey(vm.PublicKeyMultibase)
+	}
+	return nil, fmt.Errorf("método de verificación no encontrado en %s", docURL)
+}
+
+// decodeMultibaseKey decodifica una clave "z…" (base58btc + multicodec)
+func decodeMultibaseKey(s string) (crypto.PublicKey, error) {
+	if !strings.HasPrefix(s, "z") {
+		return nil, errors.New("sólo se admite multibase base58btc (z…)")
+	}
+	raw, err := base58Decode(s[1:])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(raw) == 2+ed25519.PublicKeySize && raw[0] == multicodecEd25519[0] && raw[1] == multicodecEd25519[1]:
+		return ed25519.PublicKey(raw[2:]), nil
+	case len(raw) == 2+33 && raw[0] == multicodecP256[0] && raw[1] == multicodecP256[1]:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), raw[2:])
+		if x == nil {
+			return nil, errors.New("clave P-256 inválida")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, errors.New("tipo de clave multicodec no soportado")
+}
+
+// defaultAlgFor deduce el algoritmo JOSE cuando el sobre no lo indica
+func defaultAlgFor(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return "EdDSA"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return "ES384"
+		}
+		return "ES256"
+	}
+	return "RS256"
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("carácter base58 inválido: %q", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	out := n.Bytes()
+	// Cada '1' inicial representa un byte cero
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), out...), nil
+}
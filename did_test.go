@@ -0,0 +1,83 @@
+// did_test.go
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testDIDKey genera una clave Ed25519 y su did:key
+func testDIDKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(big.Int).SetBytes(append(append([]byte{}, multicodecEd25519...), pub...))
+	var enc []byte
+	for mod := new(big.Int); n.Sign() > 0; {
+		n.DivMod(n, big.NewInt(58), mod)
+		enc = append([]byte{base58Alphabet[mod.Int64()]}, enc...)
+	}
+	return "did:key:z" + string(enc), priv
+}
+
+// Un did:key lleva su propia clave: sólo vale si está en DID_ALLOWLIST y el
+// sobre viene de otro emisor
+func TestDIDKeyTrust(t *testing.T) {
+	t.Setenv("ISSUER_ID", "https://firma.test")
+	did, priv := testDIDKey(t)
+	payload := map[string]interface{}{"pedido": "DID-1"}
+	data, _ := json.Marshal(payload)
+	env := func(iss string) map[string]interface{} {
+		return map[string]interface{}{
+			"payload": payload, "iss": iss, "kid": did, "alg": "EdDSA",
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)),
+		}
+	}
+
+	tests := []struct {
+		name, methods, allow, iss string
+		valid                     bool
+	}{
+		{"sin DID_METHODS", "", "", "https://otro.test", false},
+		{"fuera de la lista", "key", "did:key:zOtra", "https://otro.test", false},
+		{"en la lista", "key", did, "https://otro.test", true},
+		{"con nuestro iss", "key", did, "https://firma.test", false},
+		{"sin iss", "key", did, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DID_METHODS", tt.methods)
+			t.Setenv("DID_ALLOWLIST", tt.allow)
+			didKeys = &didCache{order: list.New(), entries: map[string]*list.Element{}}
+			if v := testVerify(t, env(tt.iss), nil); v["valid"] != tt.valid {
+				t.Fatalf("valid = %v, se esperaba %v: %v", v["valid"], tt.valid, v)
+			}
+		})
+	}
+}
+
+// Los identificadores largos se rechazan antes de decodificar base58
+func TestDIDKeyLength(t *testing.T) {
+	t.Setenv("DID_METHODS", "key")
+	long := "did:key:z" + strings.Repeat("2", 200_000)
+	t.Setenv("DID_ALLOWLIST", long)
+	if _, err := resolveDIDKey(context.Background(), long); err == nil || !strings.Contains(err.Error(), "caracteres") {
+		t.Fatalf("did:key largo: %v", err)
+	}
+
+	code, resp := doJSON(t, validated(validateVerifyRequest, verifyHandler), http.MethodPost, "/verify",
+		map[string]interface{}{"payload": map[string]interface{}{"a": 1}, "signature": "AAAA", "iss": "x", "kid": long}, nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("kid largo: %d %v", code, resp)
+	}
+}
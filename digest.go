@@ -0,0 +1,61 @@
+// digest.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"example.com/firmajson/pkg/firmajson"
+	firmajsonv1 "example.com/firmajson/proto/firmajson/v1"
+)
+
+// Firma del resumen. MacSign de Cloud KMS no admite más de 64 KiB, así que
+// con ?digest=sha256 se firma el SHA-256 de los bytes canónicos en lugar de
+// los bytes (ver firmajson.Digested) y el documento puede ocupar hasta
+// MAX_BODY_BYTES en vez de MAX_PAYLOAD_BYTES. El sobre lleva
+// "digest": "sha256" y quien verifica lo devuelve tal cual: sin él se
+// comprobarían los bytes canónicos y la firma no casaría.
+//
+// Lo admiten /sign (sin JWS ni firma diferida), /sign/batch, /sign/patch y
+// Sign en gRPC; al verificar, cualquier sobre de este servicio con
+// "digest".
+
+// digestPaths son las rutas que admiten ?digest=
+var digestPaths = map[string]bool{"/sign": true, "/sign/batch": true, "/sign/patch": true, firmajsonv1.Signer_Sign_FullMethodName: true}
+
+// requestDigest devuelve el resumen pedido en ?digest=, o "" si no hay
+func requestDigest(r *http.Request) string {
+	return r.URL.Query().Get("digest")
+}
+
+// validateDigest comprueba ?digest=
+func validateDigest(r *http.Request) []validationProblem {
+	digest := requestDigest(r)
+	if digest == "" {
+		return nil
+	}
+	var problems []validationProblem
+	if digest != firmajson.DigestSHA256 {
+		problems = append(problems, validationProblem{"digest", errInvalidRequest, "digest debe ser sha256"})
+	}
+	if !digestPaths[r.URL.Path] {
+		problems = append(problems, validationProblem{"digest", errInvalidRequest, fmt.Sprintf("%s no admite digest", r.URL.Path)})
+	}
+	if format, _ := requestSignFormat(r); format != "" {
+		problems = append(problems, validationProblem{"digest", errInvalidRequest, "La salida JWS no admite digest"})
+	}
+	if deferRequested(r) {
+		problems = append(problems, validationProblem{"digest", errInvalidRequest, "La firma diferida no admite digest"})
+	}
+	return problems
+}
+
+// withDigest devuelve lo que se firma para data con el resumen alg, que ya
+// se ha validado
+func withDigest(data []byte, alg string) []byte {
+	signed, err := firmajson.Digested(data, alg)
+	if err != nil {
+		return data
+	}
+	return signed
+}
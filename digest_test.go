@@ -0,0 +1,72 @@
+// digest_test.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"testing"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+func TestDigestRoundTrip(t *testing.T) {
+	doc := map[string]interface{}{"pedido": "DIG-1", "lineas": []interface{}{"a", "b"}}
+	digested := testSign(t, "?echo=true&digest=sha256", doc, nil)
+	if digested["digest"] != firmajson.DigestSHA256 {
+		t.Fatalf("el sobre debe llevar digest: %v", digested)
+	}
+	plain := testSign(t, "?echo=true", doc, nil)
+	both := testSign(t, "?echo=true&digest=sha256", doc, aadHeaders("pagos:acme"))
+
+	tests := []struct {
+		name  string
+		env   map[string]interface{}
+		aad   string
+		valid bool
+	}{
+		{"resumen", digested, "", true},
+		{"resumen y AAD", both, "pagos:acme", true},
+		{"resumen y AAD sin AAD", both, "", false},
+		{"quitando digest del sobre", envelopeWith(digested, map[string]interface{}{"digest": nil}), "", false},
+		// Una firma normal no vale como firma del resumen ni al revés
+		{"firma normal marcada con digest", envelopeWith(plain, map[string]interface{}{"digest": firmajson.DigestSHA256}), "", false},
+		{"firma del resumen en el sobre normal", envelopeWith(plain, map[string]interface{}{"signature": digested["signature"]}), "", false},
+		// Ni la del resumen con AAD como la del resumen sin él
+		{"resumen y AAD como sólo resumen", envelopeWith(digested, map[string]interface{}{"signature": both["signature"]}), "", false},
+		{"resumen como resumen y AAD", envelopeWith(both, map[string]interface{}{"signature": digested["signature"]}), "pagos:acme", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVerify(t, tt.env, aadHeaders(tt.aad))
+			if v["valid"] != tt.valid {
+				t.Fatalf("valid = %v, se esperaba %v: %v", v["valid"], tt.valid, v)
+			}
+		})
+	}
+
+	// Un digest desconocido no se firma ni se verifica
+	code, resp := doJSON(t, validated(validateSignRequest, signHandler), http.MethodPost, "/sign?digest=md5", doc, nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("/sign?digest=md5: %d %v", code, resp)
+	}
+	code, resp = doJSON(t, validated(validateVerifyRequest, verifyHandler), http.MethodPost, "/verify",
+		envelopeWith(digested, map[string]interface{}{"digest": "md5"}), nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("/verify con digest md5: %d %v", code, resp)
+	}
+}
+
+// Lo firmado con resumen lleva su dominio delante del SHA-256, así que no
+// coincide ni con los bytes canónicos ni con su hash a secas
+func TestWithDigest(t *testing.T) {
+	data := []byte(`{"a":1}`)
+	if got := withDigest(data, ""); !bytes.Equal(got, data) {
+		t.Fatalf("sin resumen: %q", got)
+	}
+	sum := sha256.Sum256(data)
+	got := withDigest(data, firmajson.DigestSHA256)
+	if bytes.Equal(got, data) || bytes.Equal(got, sum[:]) || !bytes.HasSuffix(got, sum[:]) {
+		t.Fatalf("con resumen: %x", got)
+	}
+}
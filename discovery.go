@@ -0,0 +1,99 @@
+// discovery.go
+package main
+
+import (
+	"net/http"
+
+	"example.com/firmajson/pkg/firmajson"
+	firmajsonv1 "example.com/firmajson/proto/firmajson/v1"
+)
+
+// discoveryHandler publica en /.well-known/firma-json lo que un SDK cliente
+// necesita para configurarse contra este despliegue: endpoints, formatos de
+// salida, algoritmos, formas canónicas y dónde están las claves públicas.
+// No lleva nada secreto; si KMS no responde se omite el algoritmo de firma
+// en vez de fallar.
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	base := publicBaseURL(r)
+	endpoints := map[string]string{
+		"sign":            base + "/sign",
+		"sign_prepare":    base + "/sign/prepare",
+		"sign_commit":     base + "/sign/commit",
+		"sign_batch":      base + "/sign/batch",
+		"verify":          base + "/verify",
+		"verify_batch":    base + "/verify/batch",
+		"verify_report":   base + "/verify/report",
+		"verify_jobs":     base + "/verify/jobs",
+		"sign_manifest":   base + "/sign/manifest",
+		"sign_patch":      base + "/sign/patch",
+		"verify_manifest": base + "/verify/manifest",
+		"sign_compact":    base + "/sign/compact",
+		"verify_compact":  base + "/verify/compact",
+		"hash":            base + "/hash",
+		"introspect":      base + "/introspect",
+		"decrypt":         base + "/decrypt",
+		"errors":          base + "/errors",
+		"openapi":         base + "/openapi.json",
+		"keys":            base + "/keys/{alias}",
+		"health":          base + "/healthz",
+	}
+	if getEnv("PUBLIC_VERIFY_ENABLED", "false") == "true" {
+		endpoints["public_verify"] = base + "/public/verify"
+	}
+	if subscriptionsEnabled() {
+		endpoints["subscriptions"] = base + "/subscriptions"
+	}
+	if blsKey != nil {
+		endpoints["sign_bls"] = base + "/sign/bls"
+		endpoints["bls_aggregate"] = base + "/bls/aggregate"
+		endpoints["verify_aggregate"] = base + "/verify/aggregate"
+	}
+
+	signing := map[string]interface{}{"key_version": nameVersion, "accepted_key_versions": acceptedKeyVersions(), "backend": signerBackend}
+	if k, err := signer.Key(r.Context()); err == nil {
+		signing["kms_algorithm"] = k.KMSAlgorithm
+		if alg := jwsAlgForKey(k); alg != "" {
+			signing["alg"] = alg
+		}
+		signing["public_key"] = k.Asymmetric()
+	}
+
+	doc := map[string]interface{}{
+		"service":          "firma-json",
+		"endpoints":        endpoints,
+		"jwks_uri":         base + "/.well-known/jwks.json",
+		"key_rotation_uri": base + "/.well-known/firma-json/keys",
+		"signing":          signing,
+		"formats": map[string]interface{}{
+			"output": []string{"envelope", formatJWS, formatJWSJSON, "compact"},
+			"media_types": map[string]string{
+				formatJWS:     "application/jose",
+				formatJWSJSON: "application/jose+json",
+				"compact":     compactMediaType,
+			},
+			"detached":    true,
+			"compression": []string{"gzip", "zstd"},
+		},
+		"canonicalization": map[string]interface{}{
+			"default":  defaultCanonicalForm(),
+			"profiles": []string{firmajson.FormHTML, firmajson.FormMinimal, firmajson.FormASCII, firmajson.FormJCS},
+		},
+		"verification_algs": []string{"ES256", "ES384", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"},
+		"key_hints":         []string{"kid", "x5t#S256", "x5t", "x5c"},
+		"time_source":       signingClock.Name(),
+		"entropy_source":    entropySourceName,
+	}
+	if iss := issuerID(); iss != "" {
+		doc["issuer"] = iss
+		doc["issuer_metadata_uri"] = base + "/.well-known/openid-federation"
+	}
+	if port := getEnv("GRPC_PORT", ""); port != "" {
+		doc["grpc"] = map[string]interface{}{"port": port, "service": firmajsonv1.Signer_ServiceDesc.ServiceName, "reflection": getEnv("GRPC_REFLECTION", "true") == "true"}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, doc)
+}
@@ -0,0 +1,250 @@
+// dpop.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Prueba de posesión al estilo DPoP (RFC 9449) para los endpoints de firma
+// y descifrado. Cada cliente registra su clave pública (admin) y firma cada
+// petición con un JWS compacto en la cabecera "DPoP" cuyos claims ligan la
+// prueba a esa petición concreta: htm (método), htu (URL sin query), iat y
+// un jti de un solo uso. Así una API key robada no basta para firmar.
+//
+// La prueba es obligatoria para los callers con clave registrada y, con
+// DPOP_REQUIRED=true, para todos. El alg de la prueba debe ser el de la
+// clave: el "alg" de la JWK o, si no lo lleva, el que fija su curva (una
+// clave RSA debe registrarse con alg). Con NONCE_STORE los jti se anotan
+// ahí y valen una sola vez entre todas las réplicas; sin él, por réplica.
+
+// dpopKeyCollection guarda la clave pública de cada caller
+const dpopKeyCollection = "dpop_keys"
+
+var (
+	dpopSeenMu sync.Mutex
+	dpopSeen   = map[string]time.Time{} // jti → caducidad, sin NONCE_STORE
+)
+
+// dpopAlg devuelve el alg con el que debe firmar la clave
+func dpopAlg(key jwk) (string, error) {
+	if key.Alg != "" {
+		return key.Alg, nil
+	}
+	switch {
+	case key.Kty == "OKP" && key.Crv == "Ed25519":
+		return "EdDSA", nil
+	case key.Kty == "EC" && key.Crv == "P-256":
+		return "ES256", nil
+	case key.Kty == "EC" && key.Crv == "P-384":
+		return "ES384", nil
+	case key.Kty == "EC" && key.Crv == "P-521":
+		return "ES512", nil
+	}
+	return "", fmt.Errorf("la clave %s no fija el alg: regístrala con \"alg\"", key.Kty)
+}
+
+// requireDPoP comprueba la prueba de posesión (ver dpopFailure). Si no la
+// acepta, ya ha respondido.
+func requireDPoP(w http.ResponseWriter, r *http.Request) bool {
+	if f := dpopFailure(r); f != nil {
+		f.write(w)
+		return false
+	}
+	return true
+}
+
+// dpopFailure comprueba la prueba de posesión del caller, si tiene clave
+// registrada o DPOP_REQUIRED=true. htu es la URL base seguida de la ruta de
+// r: en gRPC, el método completo (ver grpc.go).
+func dpopFailure(r *http.Request) *signFailure {
+	ctx := r.Context()
+	caller := callerID(r)
+	raw, err := db.Get(ctx, dpopKeyCollection, caller)
+	if errors.Is(err, errNotFound) {
+		if getEnv("DPOP_REQUIRED", "false") != "true" {
+			return nil
+		}
+		return &signFailure{http.StatusUnauthorized, errDPoPInvalid, "El caller no tiene clave DPoP registrada"}
+	}
+	if err != nil {
+		return &signFailure{http.StatusInternalServerError, errStoreFailed, err.Error()}
+	}
+	var key jwk
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return &signFailure{http.StatusInternalServerError, errStoreFailed, "Clave DPoP guardada ilegible"}
+	}
+	if err := checkDPoPProof(r, key); err != nil {
+		return &signFailure{http.StatusUnauthorized, errDPoPInvalid, fmt.Sprintf("Prueba DPoP inválida: %v", err)}
+	}
+	return nil
+}
+
+func checkDPoPProof(r *http.Request, key jwk) error {
+	proof := r.Header.Get("DPoP")
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return errors.New("falta la cabecera DPoP o no es un JWS compacto")
+	}
+	var header struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		HTM string `json:"htm"`
+		HTU string `json:"htu"`
+		IAT int64  `json:"iat"`
+		JTI string `json:"jti"`
+	}
+	if err := decodeJWSPart(parts[0], &header); err != nil {
+		return err
+	}
+	if err := decodeJWSPart(parts[1], &claims); err != nil {
+		return err
+	}
+	if header.Typ != "dpop+jwt" {
+		return errors.New(`typ debe ser "dpop+jwt"`)
+	}
+	alg, err := dpopAlg(key)
+	if err != nil {
+		return err
+	}
+	if header.Alg != alg {
+		return fmt.Errorf("alg %s no es el de la clave registrada", header.Alg)
+	}
+
+	pub, err := key.publicKey()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("firma no es Base64url")
+	}
+	ok, err := firmajson.VerifyAsymmetric(pub, alg, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("la firma no corresponde a la clave registrada")
+	}
+
+	if claims.HTM != r.Method {
+		return errors.New("htm no coincide con el método")
+	}
+	if claims.HTU != publicBaseURL(r)+r.URL.Path {
+		return errors.New("htu no coincide con la URL")
+	}
+	maxAge, err := time.ParseDuration(getEnv("DPOP_MAX_AGE", "60s"))
+	if err != nil {
+		maxAge = time.Minute
+	}
+	iat := time.Unix(claims.IAT, 0)
+	if d := time.Since(iat); d > maxAge || d < -maxAge {
+		return errors.New("iat fuera de la ventana permitida")
+	}
+	if claims.JTI == "" {
+		return errors.New("falta jti")
+	}
+
+	// Cada prueba sólo vale una vez mientras esté dentro de la ventana
+	fresh, err := claimDPoPJTI(r.Context(), claims.JTI, iat.Add(2*maxAge))
+	if err != nil {
+		return fmt.Errorf("no se pudo anotar el jti: %v", err)
+	}
+	if !fresh {
+		return errors.New("prueba ya usada (jti repetido)")
+	}
+	return nil
+}
+
+// claimDPoPJTI anota jti hasta exp; false si ya estaba anotado
+func claimDPoPJTI(ctx context.Context, jti string, exp time.Time) (bool, error) {
+	if replayStore != nil {
+		return replayStore.Claim(ctx, "dpop:"+jti, time.Until(exp))
+	}
+	dpopSeenMu.Lock()
+	defer dpopSeenMu.Unlock()
+	now := time.Now()
+	for jti, exp := range dpopSeen {
+		if now.After(exp) {
+			delete(dpopSeen, jti)
+		}
+	}
+	if _, seen := dpopSeen[jti]; seen {
+		return false, nil
+	}
+	dpopSeen[jti] = exp
+	return true, nil
+}
+
+func decodeJWSPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("JWS mal codificado")
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errors.New("JWS con JSON inválido")
+	}
+	return nil
+}
+
+// dpopKeyHandler registra (PUT, con la JWK en el body) o borra (DELETE) la
+// clave DPoP de un caller: /admin/dpop/keys/{caller}
+func dpopKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	caller := strings.TrimPrefix(r.URL.Path, "/admin/dpop/keys/")
+	if caller == "" {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Falta el caller")
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPut:
+		var key jwk
+		if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+			return
+		}
+		if _, err := key.publicKey(); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("JWK inválida: %v", err))
+			return
+		}
+		if _, err := dpopAlg(key); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("JWK inválida: %v", err))
+			return
+		}
+		raw, _ := json.Marshal(key)
+		if err := db.Put(ctx, dpopKeyCollection, caller, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "dpop_key_registered", caller)
+		writeJSON(w, http.StatusOK, key)
+	case http.MethodDelete:
+		err := db.Delete(ctx, dpopKeyCollection, caller)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "El caller no tiene clave DPoP")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "dpop_key_removed", caller)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo PUT o DELETE permitido")
+	}
+}
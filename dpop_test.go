@@ -0,0 +1,63 @@
+// dpop_test.go
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDPoPProof firma con priv una prueba para POST /sign con el alg y el
+// jti dados
+func testDPoPProof(t *testing.T, priv ed25519.PrivateKey, alg, jti string) *http.Request {
+	t.Helper()
+	b64 := func(v interface{}) string {
+		raw, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signing := b64(map[string]string{"typ": "dpop+jwt", "alg": alg}) + "." +
+		b64(map[string]interface{}{"htm": http.MethodPost, "htu": "https://example.com/sign", "iat": time.Now().Unix(), "jti": jti})
+	r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+	r.Header.Set("DPoP", signing+"."+base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, []byte(signing))))
+	return r
+}
+
+func TestDPoPProof(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sin "alg" en la JWK manda la curva, no la cabecera de la prueba
+	key := jwk{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)}
+
+	if err := checkDPoPProof(testDPoPProof(t, priv, "ES256", "jti-alg"), key); err == nil || !strings.Contains(err.Error(), "alg") {
+		t.Fatalf("alg distinto del de la clave: %v", err)
+	}
+	if err := checkDPoPProof(testDPoPProof(t, priv, "EdDSA", "jti-1"), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDPoPProof(testDPoPProof(t, priv, "EdDSA", "jti-1"), key); err == nil {
+		t.Fatal("un jti repetido no debe valer")
+	}
+
+	// Con NONCE_STORE el jti se anota en el almacén compartido
+	replayStore = newMemoryNonceStore(100)
+	t.Cleanup(func() { replayStore = nil })
+	if err := checkDPoPProof(testDPoPProof(t, priv, "EdDSA", "jti-2"), key); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, _ := replayStore.Claim(context.Background(), "dpop:jti-2", time.Minute); fresh {
+		t.Fatal("el jti no se anotó en NONCE_STORE")
+	}
+
+	if _, err := dpopAlg(jwk{Kty: "RSA"}); err == nil {
+		t.Fatal("una clave RSA sin alg no debe admitirse")
+	}
+}
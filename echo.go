@@ -0,0 +1,62 @@
+// echo.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"example.com/firmajson/enrich"
+)
+
+// echoPayload indica si la respuesta de firma devuelve el payload completo.
+// Se elige por petición con ?echo=true|false; por defecto SIGN_ECHO_PAYLOAD
+// (false): con documentos grandes el eco duplica el tráfico y acaba copiado
+// en logs intermedios.
+func echoPayload(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("echo")); err == nil {
+		return v
+	}
+	return getEnv("SIGN_ECHO_PAYLOAD", "false") == "true"
+}
+
+// injectedFields son los campos que el servicio añadió al documento del
+// cliente al firmarlo. Con ellos el cliente reconstruye localmente el
+// documento firmado sin que se le devuelva entero; los campos cifrados se
+// devuelven por su JSON Pointer.
+func injectedFields(r *http.Request, alias string, payload map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{"timestamp": payload["timestamp"]}
+	if src, ok := payload[timeSourceClaim]; ok {
+		out[timeSourceClaim] = src
+	}
+	if nonceRequested(r) {
+		out["nonce"] = payload["nonce"]
+	}
+	if r.URL.Query().Get("bind") == "cert" {
+		out[confirmationClaim] = payload[confirmationClaim]
+	}
+	for _, field := range enrich.Fields() {
+		if v, ok := payload[field]; ok {
+			out[field] = v
+		}
+	}
+	if keyConfigs[alias].Region != "" {
+		out["signed_in"] = payload["signed_in"]
+	}
+	if paths := queryList(r, "encrypt"); len(paths) > 0 {
+		out["encryption"] = payload["encryption"]
+		encrypted := map[string]interface{}{}
+		for _, p := range paths {
+			if v, err := pointerGet(payload, p); err == nil {
+				encrypted[p] = v
+			}
+		}
+		out["encrypted_fields"] = encrypted
+	}
+	return out
+}
+
+// omitPayload sustituye en la respuesta el payload por los campos inyectados
+func omitPayload(resp map[string]interface{}, injected map[string]interface{}) {
+	delete(resp, "payload")
+	resp["injected"] = injected
+}
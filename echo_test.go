@@ -0,0 +1,31 @@
+// echo_test.go
+package main
+
+import (
+	"testing"
+)
+
+// Con NONCE_INJECT=always el nonce va en los campos inyectados aunque no se
+// pida, y el documento original más esos campos verifica
+func TestDetachedRoundTripNonceInjectAlways(t *testing.T) {
+	for _, mode := range []string{"always", "never"} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("NONCE_INJECT", mode)
+			doc := map[string]interface{}{"pedido": "A-1", "importe": 12.5}
+			resp := testSign(t, "?detached=true", doc, nil)
+			injected, _ := resp["injected"].(map[string]interface{})
+			if _, ok := injected["nonce"]; ok != (mode == "always") {
+				t.Fatalf("nonce en injected = %v con NONCE_INJECT=%s: %v", ok, mode, injected)
+			}
+			env := map[string]interface{}{
+				"document":       doc,
+				"injected":       injected,
+				"signature":      resp["signature"],
+				"payload_sha256": resp["payload_sha256"],
+			}
+			if v := testVerify(t, env, nil); v["valid"] != true {
+				t.Fatalf("la firma separada no verifica: %v", v)
+			}
+		})
+	}
+}
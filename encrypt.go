@@ -0,0 +1,238 @@
+// encrypt.go
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// encryptionAlg es el algoritmo con el que se cifran los campos; la clave de
+// datos (DEK) se envuelve con la clave KMS_ENCRYPTION_KEY del key ring
+const encryptionAlg = "A256GCM"
+
+// encryptionKeyName devuelve la CryptoKey ENCRYPT_DECRYPT que envuelve las
+// claves de datos, o "" si el cifrado de campos no está configurado
+func encryptionKeyName() string {
+	keyID := getEnv("KMS_ENCRYPTION_KEY", "")
+	if keyID == "" {
+		return ""
+	}
+	return keyRingName + "/cryptoKeys/" + keyID
+}
+
+// encryptFields cifra con AES-GCM los valores de payload indicados por los
+// JSON Pointers y deja en payload["encryption"] lo necesario para revertirlo.
+// Como esto ocurre antes de canonicalizar, la firma cubre el texto cifrado.
+func encryptFields(ctx context.Context, payload map[string]interface{}, paths []string) error {
+	if kmsClient == nil {
+		return errors.New("el cifrado de campos necesita SIGNER_BACKEND=gcp-kms")
+	}
+	kek := encryptionKeyName()
+	if kek == "" {
+		return errors.New("KMS_ENCRYPTION_KEY no está definido")
+	}
+	if _, exists := payload["encryption"]; exists {
+		return fmt.Errorf(`%w: el campo "encryption" está reservado`, errInvalidPointer)
+	}
+	// Validar todas las rutas antes de gastar una llamada a KMS
+	for _, p := range paths {
+		if _, err := pointerGet(payload, p); err != nil {
+			return err
+		}
+	}
+
+	dek, err := randomBytes(32)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		v, _ := pointerGet(payload, p)
+		plaintext, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		iv, err := randomBytes(gcm.NonceSize())
+		if err != nil {
+			return err
+		}
+		// La ruta va como AAD para que un campo cifrado no se pueda mover a otro sitio
+		ct := gcm.Seal(nil, iv, plaintext, []byte(p))
+		if err := pointerSet(payload, p, map[string]interface{}{
+			"enc": encryptionAlg,
+			"iv":  base64.StdEncoding.EncodeToString(iv),
+			"ct":  base64.StdEncoding.EncodeToString(ct),
+		}); err != nil {
+			return err
+		}
+	}
+
+	wrappedKey, err := firmajson.Encrypt(ctx, kmsClient, kek, dek)
+	if err != nil {
+		return fmt.Errorf("envolviendo la clave de datos: %w", err)
+	}
+	pathList := make([]interface{}, len(paths))
+	for i, p := range paths {
+		pathList[i] = p
+	}
+	payload["encryption"] = map[string]interface{}{
+		"alg":         encryptionAlg,
+		"kek":         kek,
+		"wrapped_key": base64.StdEncoding.EncodeToString(wrappedKey),
+		"paths":       pathList,
+	}
+	return nil
+}
+
+// decryptFields revierte encryptFields: desenvuelve la DEK con KMS y
+// sustituye cada campo cifrado por su valor original
+func decryptFields(ctx context.Context, payload map[string]interface{}) error {
+	var meta struct {
+		Alg        string   `json:"alg"`
+		KEK        string   `json:"kek"`
+		WrappedKey string   `json:"wrapped_key"`
+		Paths      []string `json:"paths"`
+	}
+	raw, err := json.Marshal(payload["encryption"])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil || meta.Alg != encryptionAlg {
+		return errors.New("metadatos de cifrado inválidos")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(meta.WrappedKey)
+	if err != nil {
+		return errors.New("wrapped_key inválida")
+	}
+	if kmsClient == nil {
+		return errors.New("el descifrado de campos necesita SIGNER_BACKEND=gcp-kms")
+	}
+	dek, err := firmajson.Decrypt(ctx, kmsClient, meta.KEK, wrapped)
+	if err != nil {
+		return fmt.Errorf("desenvolviendo la clave de datos: %w", err)
+	}
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range meta.Paths {
+		v, err := pointerGet(payload, p)
+		if err != nil {
+			return err
+		}
+		field, _ := v.(map[string]interface{})
+		ivB64, _ := field["iv"].(string)
+		ctB64, _ := field["ct"].(string)
+		iv, err1 := base64.StdEncoding.DecodeString(ivB64)
+		ct, err2 := base64.StdEncoding.DecodeString(ctB64)
+		if err1 != nil || err2 != nil || len(iv) != gcm.NonceSize() {
+			return fmt.Errorf("campo cifrado %q inválido", p)
+		}
+		plaintext, err := gcm.Open(nil, iv, ct, []byte(p))
+		if err != nil {
+			return fmt.Errorf("no se pudo descifrar %q", p)
+		}
+		var value interface{}
+		if err := json.Unmarshal(plaintext, &value); err != nil {
+			return err
+		}
+		if err := pointerSet(payload, p, value); err != nil {
+			return err
+		}
+	}
+	delete(payload, "encryption")
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptRequest es el cuerpo de /decrypt
+type decryptRequest struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+	Escape    string          `json:"escape,omitempty"`
+	Digest    string          `json:"digest,omitempty"`
+}
+
+// decryptHandler verifica la firma de un sobre con campos cifrados y, sólo si
+// es válida, devuelve el payload con los campos descifrados, redactado
+// según el perfil del doc_type (ver redaction.go)
+func decryptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !requireDPoP(w, r) {
+		return
+	}
+	var req decryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	var payload map[string]interface{}
+	if err := firmajson.DecodeJSON(req.Payload, &payload); err != nil || payload == nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	if _, ok := payload["encryption"]; !ok {
+		writeError(w, http.StatusBadRequest, errNotEncrypted, "El payload no tiene campos cifrados")
+		return
+	}
+	canonicalData, err := canonicalJSONEscaped(payload, req.Escape)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	mac, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidSigEncoding, "Firma Base64 inválida")
+		return
+	}
+
+	ctx := r.Context()
+	valid, err := kmsVerify(ctx, withPurpose(withAAD(withDigest(canonicalData, req.Digest), requestAAD(r)), documentPurpose(payload)), mac)
+	if err != nil {
+		writeKMSError(w, err, errKMSVerifyFailed, fmt.Sprintf("Error verificando: %v", err))
+		return
+	}
+	if !valid {
+		writeJSON(w, http.StatusOK, map[string]bool{"valid": false})
+		return
+	}
+	if err := decryptFields(ctx, payload); err != nil {
+		writeError(w, http.StatusBadRequest, errDecryptionFailed, fmt.Sprintf("No se pudo descifrar: %v", err))
+		return
+	}
+	redactedPayload, redacted, err := redactPayload(r, payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+		return
+	}
+	resp := map[string]interface{}{"valid": true}
+	if redactedPayload != nil {
+		resp["payload"] = redactedPayload
+	}
+	if redacted != nil {
+		resp["redacted"] = redacted
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,89 @@
+// Package enrich es el punto de registro de los enriquecedores de sobres:
+// campos propios de cada despliegue (ids de expediente internos, etiquetas
+// de entorno...) que el servicio añade al documento antes de firmarlo, de
+// modo que quedan cubiertos por la firma.
+//
+// Los enriquecedores se registran en tiempo de compilación desde un init():
+//
+//	func init() {
+//		enrich.Register(enrich.Func("case_id", func(r *http.Request, doc map[string]interface{}) (interface{}, bool, error) {
+//			id := r.Header.Get("X-Case-Id")
+//			return id, id != "", nil
+//		}))
+//	}
+//
+// y basta con importar el paquete que los registra desde el binario, sin
+// tocar los handlers.
+package enrich
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Enricher añade un campo al documento que se va a firmar
+type Enricher interface {
+	// Field es el nombre del campo que añade; queda reservado para el
+	// cliente
+	Field() string
+	// Value calcula el valor para esta petición. Si ok es false no se
+	// añade nada; un error aborta la firma.
+	Value(r *http.Request, doc map[string]interface{}) (v interface{}, ok bool, err error)
+}
+
+var (
+	mu        sync.RWMutex
+	enrichers = map[string]Enricher{}
+)
+
+// Register añade un enriquecedor. Registrar dos veces el mismo campo es un
+// error de programación y provoca panic.
+func Register(e Enricher) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := enrichers[e.Field()]; dup {
+		panic(fmt.Sprintf("enrich: el campo %q ya está registrado", e.Field()))
+	}
+	enrichers[e.Field()] = e
+}
+
+// All devuelve los enriquecedores registrados ordenados por campo, para que
+// se apliquen siempre en el mismo orden
+func All() []Enricher {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]Enricher, 0, len(enrichers))
+	for _, e := range enrichers {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Field() < out[j].Field() })
+	return out
+}
+
+// Fields devuelve los nombres de campo reservados por los enriquecedores
+func Fields() []string {
+	all := All()
+	out := make([]string, len(all))
+	for i, e := range all {
+		out[i] = e.Field()
+	}
+	return out
+}
+
+// Func adapta una función a Enricher
+func Func(field string, fn func(r *http.Request, doc map[string]interface{}) (interface{}, bool, error)) Enricher {
+	return funcEnricher{field, fn}
+}
+
+type funcEnricher struct {
+	field string
+	fn    func(r *http.Request, doc map[string]interface{}) (interface{}, bool, error)
+}
+
+func (f funcEnricher) Field() string { return f.field }
+
+func (f funcEnricher) Value(r *http.Request, doc map[string]interface{}) (interface{}, bool, error) {
+	return f.fn(r, doc)
+}
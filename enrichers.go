@@ -0,0 +1,44 @@
+// enrichers.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"example.com/firmajson/enrich"
+)
+
+// Enriquecedores propios del servicio. Los de cada despliegue se registran
+// igual, desde el init() de su propio fichero o paquete (ver enrich).
+func init() {
+	// ENVELOPE_ENVIRONMENT etiqueta cada sobre con el entorno que lo firmó.
+	// Sin ella el campo "environment" no se reserva.
+	if env := getEnv("ENVELOPE_ENVIRONMENT", ""); env != "" {
+		enrich.Register(enrich.Func("environment", func(r *http.Request, doc map[string]interface{}) (interface{}, bool, error) {
+			return env, true, nil
+		}))
+	}
+}
+
+// errEnrichedFieldReserved indica que el documento trae un campo que añade
+// un enriquecedor
+var errEnrichedFieldReserved = errors.New("campo reservado por un enriquecedor")
+
+// applyEnrichers añade al documento los campos de los enriquecedores
+// registrados. El cliente no puede traer esos campos: están reservados.
+func applyEnrichers(r *http.Request, payload map[string]interface{}) error {
+	for _, e := range enrich.All() {
+		if _, exists := payload[e.Field()]; exists {
+			return fmt.Errorf("%w: %q", errEnrichedFieldReserved, e.Field())
+		}
+		v, ok, err := e.Value(r, payload)
+		if err != nil {
+			return fmt.Errorf("enriquecedor %q: %w", e.Field(), err)
+		}
+		if ok {
+			payload[e.Field()] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// entropy.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Fuente de aleatoriedad. Todo lo que el servicio saca de crypto/rand pasa
+// por entropy: nonces, ids de sobres, tokens de /sign/prepare, la DEK y los
+// IV del cifrado de campos, el nonce de las peticiones a la TSA y el
+// marcador de sincronización de Avro. Una revisión de seguridad sólo tiene
+// que mirar este fichero. math/rand se usa a propósito para lo que no es
+// secreto (muestreo de shadow y mirror, jitter de los reintentos).
+//
+//	ENTROPY_SOURCE=crypto         crypto/rand (por defecto)
+//	ENTROPY_SOURCE=deterministic  SHA-256 en modo contador sobre
+//	                              ENTROPY_SEED: la misma semilla da los
+//	                              mismos nonces e ids en el mismo orden
+//
+// El modo determinista es para tests de sobres contra ficheros golden,
+// junto con TIME_SOURCE=fixed (ver timesource.go). Ninguno de los dos
+// arranca con otro backend que no sea SIGNER_BACKEND=local.
+
+// entropy es la fuente de los bytes aleatorios
+var entropy io.Reader = rand.Reader
+
+// entropySourceName es el nombre de la fuente, para discovery
+var entropySourceName = "crypto"
+
+// randomBytes devuelve n bytes de entropy
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(entropy, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// deterministicReader genera SHA-256(semilla || contador) bloque a bloque
+type deterministicReader struct {
+	mu      sync.Mutex
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (d *deterministicReader) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		if len(d.buf) == 0 {
+			block := sha256.Sum256(binary.BigEndian.AppendUint64(append([]byte(nil), d.seed...), d.counter))
+			d.counter++
+			d.buf = block[:]
+		}
+		c := copy(p[n:], d.buf)
+		d.buf = d.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// configureEntropy elige la fuente según ENTROPY_SOURCE
+func configureEntropy() error {
+	switch source := getEnv("ENTROPY_SOURCE", "crypto"); source {
+	case "crypto":
+		entropy, entropySourceName = rand.Reader, source
+	case "deterministic":
+		if err := requireTestBackend("ENTROPY_SOURCE=deterministic"); err != nil {
+			return err
+		}
+		seed := getEnv("ENTROPY_SEED", "")
+		if seed == "" {
+			return errors.New("ENTROPY_SOURCE=deterministic necesita ENTROPY_SEED")
+		}
+		entropy, entropySourceName = &deterministicReader{seed: []byte(seed)}, source
+		log.Printf("⚠️  ENTROPY_SOURCE=deterministic: nonces e ids predecibles, sólo para tests")
+	default:
+		return fmt.Errorf("ENTROPY_SOURCE desconocido: %q (crypto, deterministic)", source)
+	}
+	return nil
+}
+
+// requireTestBackend rechaza un modo de test con una clave de verdad
+func requireTestBackend(mode string) error {
+	if signerBackend != backendLocal {
+		return fmt.Errorf("%s sólo se admite con SIGNER_BACKEND=local", mode)
+	}
+	return nil
+}
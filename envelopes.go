@@ -0,0 +1,133 @@
+// envelopes.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// envelopeCollection guarda los sobres firmados cuando STORE_ENVELOPES=true
+const envelopeCollection = "envelopes"
+
+// storedEnvelope es un sobre firmado tal y como se devolvió al cliente, con
+// los metadatos necesarios para localizarlo después
+type storedEnvelope struct {
+	ID        string                 `json:"id"`
+	Time      time.Time              `json:"time"`
+	Tenant    string                 `json:"tenant,omitempty"`
+	DocType   string                 `json:"doc_type,omitempty"`
+	Key       string                 `json:"key"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+	Signature string                 `json:"signature"`
+	// KeyVersion es la versión de clave que firmó (vacía en sobres antiguos:
+	// la de entonces)
+	KeyVersion string `json:"key_version,omitempty"`
+	// Con STORE_COMPRESSION (gzip o zstd) se guarda comprimido
+	PayloadZ        string `json:"payload_z,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// Escape es el modo de escape de la forma canónica si no es "html"
+	Escape string `json:"escape,omitempty"`
+	// Digest es el resumen firmado en lugar de los bytes (ver digest.go)
+	Digest string `json:"digest,omitempty"`
+}
+
+// envelopeStorageEnabled indica si se persisten los sobres firmados
+func envelopeStorageEnabled() bool {
+	return getEnv("STORE_ENVELOPES", "false") == "true"
+}
+
+// storeEnvelope guarda el sobre y devuelve su id
+func storeEnvelope(ctx context.Context, m requestMeta, alias string, payload map[string]interface{}, signature, escape, digest string) (string, error) {
+	now := recordTime()
+	id, err := timeOrderedID(now)
+	if err != nil {
+		return "", err
+	}
+	env := storedEnvelope{
+		ID:         id,
+		Time:       now,
+		Tenant:     m.Tenant,
+		DocType:    m.DocType,
+		Key:        alias,
+		Payload:    payload,
+		Signature:  signature,
+		KeyVersion: aliasKeyVersion(alias),
+		Digest:     digest,
+	}
+	if escape != escapeHTML {
+		env.Escape = escape
+	}
+	if enc := getEnv("STORE_COMPRESSION", ""); enc != "" {
+		data, err := canonicalJSONEscaped(payload, escape)
+		if err != nil {
+			return "", err
+		}
+		if env.PayloadZ, err = compressPayload(enc, data); err != nil {
+			return "", err
+		}
+		env.Payload, env.ContentEncoding = nil, enc
+	}
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return id, db.Put(ctx, envelopeCollection, id, raw)
+}
+
+// envelopeSummary es un sobre en el listado: sin el payload, que se
+// recupera aparte
+type envelopeSummary struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Tenant     string    `json:"tenant,omitempty"`
+	DocType    string    `json:"doc_type,omitempty"`
+	Key        string    `json:"key"`
+	KeyVersion string    `json:"key_version,omitempty"`
+	Signature  string    `json:"signature"`
+}
+
+// envelopesListHandler (GET /admin/envelopes) busca sobres guardados,
+// paginado (ver pagination.go) y en orden cronológico. Filtros opcionales:
+// signature (la firma en Base64, para localizar el sobre de una firma),
+// tenant, doc_type, key y el rango [from, to) en RFC 3339.
+func envelopesListHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	p, ok := pageRequest(w, r)
+	if !ok {
+		return
+	}
+	from, to, err := requestTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	signature, tenant, docType, key := q.Get("signature"), q.Get("tenant"), q.Get("doc_type"), q.Get("key")
+
+	records, ids, err := db.List(r.Context(), envelopeCollection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+		return
+	}
+	list, next := paginate(p, ids, func(id string) (envelopeSummary, bool) {
+		var e storedEnvelope
+		if json.Unmarshal(records[id], &e) != nil || !inTimeRange(e.Time, from, to) ||
+			signature != "" && e.Signature != signature ||
+			tenant != "" && e.Tenant != tenant ||
+			docType != "" && e.DocType != docType ||
+			key != "" && e.Key != key {
+			return envelopeSummary{}, false
+		}
+		return envelopeSummary{e.ID, e.Time, e.Tenant, e.DocType, e.Key, e.KeyVersion, e.Signature}, true
+	})
+	writePage(w, "envelopes", list, next)
+}
@@ -0,0 +1,291 @@
+// errcodes.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// errCode es un código de error estable que los clientes pueden usar para
+// decidir qué hacer, independientemente del texto del mensaje
+type errCode string
+
+// Todos los códigos que puede devolver el servicio. Cada uno debe tener su
+// entrada en errorCatalog: es lo que publica GET /errors.
+const (
+	errMethodNotAllowed      errCode = "METHOD_NOT_ALLOWED"
+	errInvalidJSON           errCode = "INVALID_JSON"
+	errBodyUnreadable        errCode = "BODY_UNREADABLE"
+	errInvalidPayload        errCode = "INVALID_PAYLOAD"
+	errInvalidRequest        errCode = "INVALID_REQUEST"
+	errReservedField         errCode = "RESERVED_FIELD"
+	errInvalidSigEncoding    errCode = "INVALID_SIGNATURE_ENCODING"
+	errPayloadTooLarge       errCode = "PAYLOAD_TOO_LARGE"
+	errBodyTooLarge          errCode = "BODY_TOO_LARGE"
+	errValidationFailed      errCode = "VALIDATION_FAILED"
+	errUnknownKey            errCode = "UNKNOWN_KEY"
+	errKeyCompromised        errCode = "KEY_COMPROMISED"
+	errKeyDeleted            errCode = "KEY_DELETED"
+	errSigningWindowClosed   errCode = "SIGNING_WINDOW_CLOSED"
+	errApprovalRejected      errCode = "APPROVAL_REJECTED"
+	errResidencyViolation    errCode = "RESIDENCY_VIOLATION"
+	errCallerBlocked         errCode = "CALLER_BLOCKED"
+	errCallerThrottled       errCode = "CALLER_THROTTLED"
+	errRateLimited           errCode = "RATE_LIMITED"
+	errUnauthorized          errCode = "UNAUTHORIZED"
+	errDPoPInvalid           errCode = "DPOP_INVALID"
+	errAdminDisabled         errCode = "ADMIN_DISABLED"
+	errPrepareTokenInvalid   errCode = "PREPARE_TOKEN_INVALID"
+	errPrepareHashMismatch   errCode = "PREPARE_HASH_MISMATCH"
+	errContinuationInvalid   errCode = "CONTINUATION_INVALID"
+	errEncryptionFailed      errCode = "ENCRYPTION_FAILED"
+	errNotEncrypted          errCode = "NOT_ENCRYPTED"
+	errDecryptionFailed      errCode = "DECRYPTION_FAILED"
+	errTimeSourceUnavailable errCode = "TIME_SOURCE_UNAVAILABLE"
+	errKMSSignFailed         errCode = "KMS_SIGN_FAILED"
+	errKMSVerifyFailed       errCode = "KMS_VERIFY_FAILED"
+	errKMSError              errCode = "KMS_ERROR"
+	errKMSUnavailable        errCode = "KMS_UNAVAILABLE"
+	errKMSTimeout            errCode = "KMS_TIMEOUT"
+	errKMSBusy               errCode = "KMS_BUSY"
+	errKMSPermissionDenied   errCode = "KMS_PERMISSION_DENIED"
+	errKMSKeyNotFound        errCode = "KMS_KEY_NOT_FOUND"
+	errIssuerKeyFailed       errCode = "ISSUER_KEY_UNAVAILABLE"
+	errStoreFailed           errCode = "STORE_FAILED"
+	errExportFailed          errCode = "EXPORT_FAILED"
+	errNotFoundCode          errCode = "NOT_FOUND"
+	errLegalHold             errCode = "LEGAL_HOLD"
+	errNotConfigured         errCode = "NOT_CONFIGURED"
+	errInternal              errCode = "INTERNAL"
+	errPatchFailed           errCode = "PATCH_FAILED"
+	errPreviousInvalid       errCode = "PREVIOUS_ENVELOPE_INVALID"
+
+	// Códigos de una verificación que responde 200 con valid=false
+	errSignatureMismatch errCode = "SIGNATURE_MISMATCH"
+	errEnvelopeStale     errCode = "ENVELOPE_STALE"
+	errEnvelopeReplayed  errCode = "ENVELOPE_REPLAYED"
+	errCertBinding       errCode = "CERT_BINDING_MISMATCH"
+)
+
+// errorInfo documenta un código en español e inglés
+type errorInfo struct {
+	Code   errCode           `json:"code"`
+	Status int               `json:"status"`
+	Desc   map[string]string `json:"description"`
+	Hint   map[string]string `json:"remediation"`
+}
+
+var errorCatalog = []errorInfo{
+	{errMethodNotAllowed, http.StatusMethodNotAllowed,
+		map[string]string{"es": "Método HTTP no admitido en este endpoint.", "en": "HTTP method not allowed on this endpoint."},
+		map[string]string{"es": "Usa el método indicado en el mensaje de error.", "en": "Use the method named in the error message."}},
+	{errInvalidJSON, http.StatusBadRequest,
+		map[string]string{"es": "El cuerpo no es JSON válido o no tiene la forma esperada.", "en": "The body is not valid JSON or does not have the expected shape."},
+		map[string]string{"es": "Valida el JSON antes de enviarlo y revisa los nombres de los campos.", "en": "Validate the JSON before sending it and check field names."}},
+	{errBodyUnreadable, http.StatusBadRequest,
+		map[string]string{"es": "No se pudo leer el cuerpo de la petición.", "en": "The request body could not be read."},
+		map[string]string{"es": "Reintenta; comprueba que la conexión no se corta durante el envío.", "en": "Retry; check the connection is not dropped while uploading."}},
+	{errInvalidPayload, http.StatusBadRequest,
+		map[string]string{"es": "El payload del sobre no es JSON válido.", "en": "The envelope payload is not valid JSON."},
+		map[string]string{"es": "Envía el payload exactamente como lo devolvió /sign.", "en": "Send the payload exactly as returned by /sign."}},
+	{errInvalidRequest, http.StatusBadRequest,
+		map[string]string{"es": "Faltan parámetros obligatorios o tienen un valor no válido.", "en": "Required parameters are missing or invalid."},
+		map[string]string{"es": "Revisa el detalle del mensaje y corrige el parámetro indicado.", "en": "Read the message detail and fix the named parameter."}},
+	{errReservedField, http.StatusBadRequest,
+		map[string]string{"es": "El documento usa un campo que el servicio reserva (nonce, encryption...).", "en": "The document uses a field reserved by the service (nonce, encryption...)."},
+		map[string]string{"es": "Renombra el campo en tu documento.", "en": "Rename the field in your document."}},
+	{errInvalidSigEncoding, http.StatusBadRequest,
+		map[string]string{"es": "La firma no es Base64 válido.", "en": "The signature is not valid Base64."},
+		map[string]string{"es": "Envía la firma tal cual la devolvió /sign, sin recodificarla.", "en": "Send the signature as returned by /sign, without re-encoding it."}},
+	{errPayloadTooLarge, http.StatusBadRequest,
+		map[string]string{"es": "El documento supera MAX_PAYLOAD_BYTES.", "en": "The document exceeds MAX_PAYLOAD_BYTES."},
+		map[string]string{"es": "Firma el resumen con ?digest=sha256 o divide el documento en partes más pequeñas.", "en": "Sign the digest with ?digest=sha256 or split the document into smaller parts."}},
+	{errBodyTooLarge, http.StatusRequestEntityTooLarge,
+		map[string]string{"es": "El cuerpo de la petición supera MAX_BODY_BYTES.", "en": "The request body exceeds MAX_BODY_BYTES."},
+		map[string]string{"es": "Divide el lote en peticiones más pequeñas o firma un resumen del documento.", "en": "Split the batch into smaller requests or sign a digest of the document."}},
+	{errValidationFailed, http.StatusBadRequest,
+		map[string]string{"es": "La petición tiene uno o más problemas, listados en problems.", "en": "The request has one or more problems, listed in problems."},
+		map[string]string{"es": "Corrige todos los problemas de la lista y reintenta.", "en": "Fix every problem in the list and retry."}},
+	{errUnknownKey, http.StatusBadRequest,
+		map[string]string{"es": "El alias de clave pedido no existe.", "en": "The requested key alias does not exist."},
+		map[string]string{"es": "Usa uno de los alias configurados o omite el parámetro key.", "en": "Use a configured alias or omit the key parameter."}},
+	{errKeyCompromised, http.StatusForbidden,
+		map[string]string{"es": "La clave está desactivada de emergencia por posible compromiso.", "en": "The key has been disabled in emergency mode after a suspected compromise."},
+		map[string]string{"es": "Firma con otra clave y contacta con el equipo de seguridad.", "en": "Sign with another key and contact the security team."}},
+	{errKeyDeleted, http.StatusForbidden,
+		map[string]string{"es": "La clave está borrada: sólo verifica hasta que termine su periodo de gracia.", "en": "The key has been deleted: it only verifies until its grace period ends."},
+		map[string]string{"es": "Firma con otra clave o pide a un administrador que la restaure.", "en": "Sign with another key or ask an administrator to restore it."}},
+	{errSigningWindowClosed, http.StatusForbidden,
+		map[string]string{"es": "La política de la clave no permite firmar en este momento.", "en": "The key policy does not allow signing right now."},
+		map[string]string{"es": "Firma dentro de la ventana permitida o pide una aprobación (X-Approval-Id).", "en": "Sign within the allowed window or request an approval (X-Approval-Id)."}},
+	{errApprovalRejected, http.StatusForbidden,
+		map[string]string{"es": "La aprobación indicada no es válida, ya se usó o ha caducado.", "en": "The given approval is invalid, already used or expired."},
+		map[string]string{"es": "Pide una nueva aprobación a un administrador.", "en": "Ask an administrator for a new approval."}},
+	{errResidencyViolation, http.StatusForbidden,
+		map[string]string{"es": "El tenant o el tipo de documento exigen una región distinta a la de la clave.", "en": "The tenant or document type requires a region other than the key's."},
+		map[string]string{"es": "Firma con una clave residente en la región exigida.", "en": "Sign with a key resident in the required region."}},
+	{errCallerBlocked, http.StatusForbidden,
+		map[string]string{"es": "El cliente está bloqueado.", "en": "The caller is blocked."},
+		map[string]string{"es": "Contacta con el equipo de seguridad.", "en": "Contact the security team."}},
+	{errCallerThrottled, http.StatusTooManyRequests,
+		map[string]string{"es": "El cliente está frenado temporalmente.", "en": "The caller is temporarily throttled."},
+		map[string]string{"es": "Espera el tiempo indicado en Retry-After.", "en": "Wait for the time given in Retry-After."}},
+	{errRateLimited, http.StatusTooManyRequests,
+		map[string]string{"es": "Se ha superado el límite de peticiones de un endpoint público.", "en": "The request limit of a public endpoint was exceeded."},
+		map[string]string{"es": "Espera el tiempo indicado en Retry-After o usa la API autenticada.", "en": "Wait for the time given in Retry-After or use the authenticated API."}},
+	{errUnauthorized, http.StatusUnauthorized,
+		map[string]string{"es": "Credenciales ausentes o incorrectas.", "en": "Missing or invalid credentials."},
+		map[string]string{"es": "Envía el token correcto en la cabecera Authorization.", "en": "Send the correct token in the Authorization header."}},
+	{errDPoPInvalid, http.StatusUnauthorized,
+		map[string]string{"es": "Falta la prueba de posesión DPoP o no es válida.", "en": "The DPoP proof-of-possession is missing or invalid."},
+		map[string]string{"es": "Firma cada petición con tu clave registrada: cabecera DPoP con htm, htu, iat y un jti nuevo.", "en": "Sign every request with your registered key: DPoP header with htm, htu, iat and a fresh jti."}},
+	{errAdminDisabled, http.StatusForbidden,
+		map[string]string{"es": "La administración no está habilitada en este despliegue.", "en": "Administration is not enabled on this deployment."},
+		map[string]string{"es": "Define ADMIN_TOKEN para habilitarla.", "en": "Set ADMIN_TOKEN to enable it."}},
+	{errPrepareTokenInvalid, http.StatusNotFound,
+		map[string]string{"es": "El token de /sign/prepare no existe, ya se usó o ha caducado.", "en": "The /sign/prepare token does not exist, was used or expired."},
+		map[string]string{"es": "Vuelve a llamar a /sign/prepare.", "en": "Call /sign/prepare again."}},
+	{errPrepareHashMismatch, http.StatusConflict,
+		map[string]string{"es": "El hash confirmado no coincide con el contenido preparado.", "en": "The confirmed hash does not match the prepared content."},
+		map[string]string{"es": "Revisa que confirmas el documento correcto.", "en": "Check you are confirming the right document."}},
+	{errContinuationInvalid, http.StatusBadRequest,
+		map[string]string{"es": "El token de continuación no es válido o no corresponde al lote enviado.", "en": "The continuation token is invalid or does not match the submitted batch."},
+		map[string]string{"es": "Reenvía el mismo lote, en el mismo orden, con el token que devolvió la respuesta parcial.", "en": "Resend the same batch, in the same order, with the token from the partial response."}},
+	{errEncryptionFailed, http.StatusBadRequest,
+		map[string]string{"es": "No se pudieron cifrar los campos pedidos.", "en": "The requested fields could not be encrypted."},
+		map[string]string{"es": "Comprueba los JSON Pointer de ?encrypt= y KMS_ENCRYPTION_KEY.", "en": "Check the ?encrypt= JSON Pointers and KMS_ENCRYPTION_KEY."}},
+	{errNotEncrypted, http.StatusBadRequest,
+		map[string]string{"es": "El payload no tiene campos cifrados.", "en": "The payload has no encrypted fields."},
+		map[string]string{"es": "Usa /verify para sobres sin cifrar.", "en": "Use /verify for unencrypted envelopes."}},
+	{errDecryptionFailed, http.StatusBadRequest,
+		map[string]string{"es": "No se pudieron descifrar los campos.", "en": "The fields could not be decrypted."},
+		map[string]string{"es": "Comprueba que el sobre no se ha modificado y que tienes acceso a la clave.", "en": "Check the envelope is unmodified and you can use the key."}},
+	{errTimeSourceUnavailable, http.StatusServiceUnavailable,
+		map[string]string{"es": "No hay una hora verificada para sellar la firma.", "en": "No verified time is available to stamp the signature."},
+		map[string]string{"es": "Reintenta en unos minutos; el servicio no firma con una hora sin verificar.", "en": "Retry in a few minutes; the service does not sign with unverified time."}},
+	{errKMSSignFailed, http.StatusInternalServerError,
+		map[string]string{"es": "Cloud KMS no pudo firmar.", "en": "Cloud KMS failed to sign."},
+		map[string]string{"es": "Reintenta más tarde; si persiste, revisa permisos y estado de la clave.", "en": "Retry later; if it persists, check permissions and key state."}},
+	{errKMSVerifyFailed, http.StatusInternalServerError,
+		map[string]string{"es": "Cloud KMS no pudo verificar.", "en": "Cloud KMS failed to verify."},
+		map[string]string{"es": "Reintenta más tarde; si persiste, revisa permisos y estado de la clave.", "en": "Retry later; if it persists, check permissions and key state."}},
+	{errKMSError, http.StatusInternalServerError,
+		map[string]string{"es": "Error consultando Cloud KMS.", "en": "Error querying Cloud KMS."},
+		map[string]string{"es": "Reintenta más tarde.", "en": "Retry later."}},
+	{errKMSUnavailable, http.StatusServiceUnavailable,
+		map[string]string{"es": "El servicio ha arrancado sin acceso a Cloud KMS (modo degradado).", "en": "The service started without access to Cloud KMS (degraded mode)."},
+		map[string]string{"es": "Reintenta tras Retry-After; /healthz muestra el último error de KMS.", "en": "Retry after Retry-After; /healthz shows the last KMS error."}},
+	{errKMSTimeout, http.StatusGatewayTimeout,
+		map[string]string{"es": "Cloud KMS no respondió dentro de KMS_CALL_TIMEOUT.", "en": "Cloud KMS did not answer within KMS_CALL_TIMEOUT."},
+		map[string]string{"es": "Reintenta con backoff; si se repite, revisa la latencia de KMS en /metrics.", "en": "Retry with backoff; if it persists, check KMS latency in /metrics."}},
+	{errKMSBusy, http.StatusServiceUnavailable,
+		map[string]string{"es": "Cloud KMS está caído o limitando la cuota y se agotaron los reintentos.", "en": "Cloud KMS is unavailable or throttling and retries were exhausted."},
+		map[string]string{"es": "Reintenta tras Retry-After.", "en": "Retry after Retry-After."}},
+	{errKMSPermissionDenied, http.StatusInternalServerError,
+		map[string]string{"es": "La cuenta de servicio no tiene permiso sobre la clave de KMS.", "en": "The service account lacks permission on the KMS key."},
+		map[string]string{"es": "Avisa al operador con el bloque diagnostic; GET /admin/diagnose lo comprueba.", "en": "Report it to the operator with the diagnostic block; GET /admin/diagnose checks it."}},
+	{errKMSKeyNotFound, http.StatusInternalServerError,
+		map[string]string{"es": "La clave de KMS configurada no existe.", "en": "The configured KMS key does not exist."},
+		map[string]string{"es": "Avisa al operador con el bloque diagnostic; GET /admin/diagnose lo comprueba.", "en": "Report it to the operator with the diagnostic block; GET /admin/diagnose checks it."}},
+	{errIssuerKeyFailed, http.StatusBadGateway,
+		map[string]string{"es": "No se pudo obtener la clave del emisor externo.", "en": "The external issuer key could not be retrieved."},
+		map[string]string{"es": "Comprueba que el JWKS o el DID del emisor están accesibles.", "en": "Check the issuer JWKS or DID is reachable."}},
+	{errStoreFailed, http.StatusInternalServerError,
+		map[string]string{"es": "Error de persistencia.", "en": "Persistence error."},
+		map[string]string{"es": "Reintenta; si persiste, revisa el store configurado.", "en": "Retry; if it persists, check the configured store."}},
+	{errExportFailed, http.StatusBadGateway,
+		map[string]string{"es": "No se pudo escribir la exportación en GCS.", "en": "The export could not be written to GCS."},
+		map[string]string{"es": "Comprueba el bucket y los permisos de la cuenta de servicio.", "en": "Check the bucket and the service account permissions."}},
+	{errNotFoundCode, http.StatusNotFound,
+		map[string]string{"es": "El recurso pedido no existe.", "en": "The requested resource does not exist."},
+		map[string]string{"es": "Revisa el identificador.", "en": "Check the identifier."}},
+	{errLegalHold, http.StatusConflict,
+		map[string]string{"es": "El sobre está bajo retención legal y no se puede borrar.", "en": "The envelope is under legal hold and cannot be deleted."},
+		map[string]string{"es": "Pide a gestión documental que libere la retención (/admin/holds).", "en": "Ask records management to release the hold (/admin/holds)."}},
+	{errNotConfigured, http.StatusNotFound,
+		map[string]string{"es": "La funcionalidad no está configurada en este despliegue.", "en": "The feature is not configured on this deployment."},
+		map[string]string{"es": "Pide al operador que la configure.", "en": "Ask the operator to configure it."}},
+	{errInternal, http.StatusInternalServerError,
+		map[string]string{"es": "Error interno.", "en": "Internal error."},
+		map[string]string{"es": "Reintenta; si persiste, avisa al equipo del servicio.", "en": "Retry; if it persists, report it to the service team."}},
+	{errPatchFailed, http.StatusUnprocessableEntity,
+		map[string]string{"es": "El JSON Patch no se puede aplicar al documento anterior.", "en": "The JSON Patch cannot be applied to the previous document."},
+		map[string]string{"es": "Revisa la operación indicada contra el documento firmado (rutas, test).", "en": "Check the named operation against the signed document (paths, test)."}},
+	{errPreviousInvalid, http.StatusUnprocessableEntity,
+		map[string]string{"es": "El sobre que se quiere revisar no verifica.", "en": "The envelope to be revised does not verify."},
+		map[string]string{"es": "Envía el sobre tal cual lo devolvió /sign, con su X-Signature-AAD si lo tenía.", "en": "Send the envelope as returned by /sign, with its X-Signature-AAD if it had one."}},
+	{errSignatureMismatch, http.StatusOK,
+		map[string]string{"es": "La firma no corresponde al payload o a una clave que verifique (valid=false).", "en": "The signature does not match the payload or a verifying key (valid=false)."},
+		map[string]string{"es": "No confíes en el documento; reason explica el motivo.", "en": "Do not trust the document; reason explains why."}},
+	{errEnvelopeStale, http.StatusOK,
+		map[string]string{"es": "La firma es correcta pero el sobre es más antiguo que maxAge (valid=false).", "en": "The signature is correct but the envelope is older than maxAge (valid=false)."},
+		map[string]string{"es": "Pide al emisor un sobre nuevo.", "en": "Ask the issuer for a fresh envelope."}},
+	{errEnvelopeReplayed, http.StatusOK,
+		map[string]string{"es": "La firma es correcta pero el nonce del sobre ya se usó (valid=false).", "en": "The signature is correct but the envelope nonce was already used (valid=false)."},
+		map[string]string{"es": "Trátalo como un reenvío; el emisor debe firmar otro sobre.", "en": "Treat it as a replay; the issuer must sign a new envelope."}},
+	{errCertBinding, http.StatusOK,
+		map[string]string{"es": "El sobre está ligado a otro certificado de cliente (valid=false).", "en": "The envelope is bound to another client certificate (valid=false)."},
+		map[string]string{"es": "Verifica con el certificado al que se ligó el sobre.", "en": "Verify with the certificate the envelope is bound to."}},
+}
+
+// errorBody es el cuerpo de una respuesta de error:
+//
+//	{"code": "INVALID_JSON", "message": "...", "details": {...}}
+//
+// code es estable y es lo que deben comparar los clientes; message es para
+// personas y puede cambiar; details sólo aparece en algunos códigos
+// (problems en VALIDATION_FAILED, diagnostic en los de KMS). Mientras los
+// clientes migran, "error" repite message y las claves de details se
+// repiten en la raíz, como antes; ERROR_LEGACY_FIELDS=false las quita.
+func errorBody(code errCode, msg string, details map[string]interface{}) map[string]interface{} {
+	body := map[string]interface{}{"code": code, "message": msg}
+	if len(details) > 0 {
+		body["details"] = details
+	}
+	if getEnv("ERROR_LEGACY_FIELDS", "true") == "true" {
+		body["error"] = msg
+		for k, v := range details {
+			body[k] = v
+		}
+	}
+	return body
+}
+
+// writeError emite un error con su código estable
+func writeError(w http.ResponseWriter, status int, code errCode, msg string) {
+	writeErrorDetails(w, status, code, msg, nil)
+}
+
+// writeErrorDetails es writeError con details
+func writeErrorDetails(w http.ResponseWriter, status int, code errCode, msg string, details map[string]interface{}) {
+	errorResponses.inc(string(code))
+	if code == errKMSBusy {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(kmsRetryAfter().Seconds()))))
+	}
+	writeJSON(w, status, errorBody(code, msg, details))
+}
+
+// errorsHandler publica el catálogo de códigos de error. Con ?lang=es o
+// ?lang=en devuelve sólo ese idioma.
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"errors": errorCatalog})
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(errorCatalog))
+	for _, e := range errorCatalog {
+		out = append(out, map[string]interface{}{
+			"code":        e.Code,
+			"status":      e.Status,
+			"description": e.Desc[lang],
+			"remediation": e.Hint[lang],
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errors": out})
+}
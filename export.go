@@ -0,0 +1,225 @@
+// export.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// exportKinds son las colecciones exportables y los campos de su esquema Avro
+var exportKinds = map[string]struct {
+	collection string
+	fields     []string
+}{
+	"audit":     {auditCollection, []string{"id", "time", "event", "caller", "tenant", "doc_type", "key", "payload_sha256", "outcome", "detail"}},
+	"envelopes": {envelopeCollection, []string{"id", "time", "tenant", "doc_type", "key", "payload", "signature"}},
+}
+
+// exportPart describe un fichero (página) del volcado
+type exportPart struct {
+	Object  string `json:"object"`
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+// exportRequest es el cuerpo de /admin/export
+type exportRequest struct {
+	Kind     string    `json:"kind"` // audit o envelopes
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Format   string    `json:"format,omitempty"`
+	Bucket   string    `json:"bucket"`
+	Prefix   string    `json:"prefix"`
+	PageSize int       `json:"page_size,omitempty"`
+}
+
+// exportHandler vuelca en GCS los registros de auditoría o los sobres
+// guardados de un rango temporal [from, to), en páginas NDJSON o Avro, y
+// escribe un manifiesto firmado con el hash de cada página
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	kind, ok := exportKinds[req.Kind]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, `kind debe ser "audit" o "envelopes"`)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "ndjson"
+	}
+	if req.Format != "ndjson" && req.Format != "avro" {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, `format debe ser "ndjson" o "avro"`)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = getEnv("EXPORT_BUCKET", "")
+	}
+	if req.Bucket == "" || req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "bucket, from y to (from < to) son obligatorios")
+		return
+	}
+	if req.PageSize <= 0 || req.PageSize > 100000 {
+		req.PageSize = 10000
+	}
+	if req.Prefix == "" {
+		req.Prefix = fmt.Sprintf("exports/%s/%s", req.Kind, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	req.Prefix = strings.TrimSuffix(req.Prefix, "/")
+
+	ctx := r.Context()
+	records, ids, err := db.List(ctx, kind.collection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+		return
+	}
+	var selected [][]byte
+	for _, id := range ids {
+		var rec struct {
+			Time time.Time `json:"time"`
+		}
+		if err := json.Unmarshal(records[id], &rec); err != nil {
+			continue
+		}
+		if !rec.Time.Before(req.From) && rec.Time.Before(req.To) {
+			selected = append(selected, records[id])
+		}
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errExportFailed, fmt.Sprintf("Error conectando con GCS: %v", err))
+		return
+	}
+	defer client.Close()
+	bucket := client.Bucket(req.Bucket)
+
+	parts := []exportPart{}
+	for start := 0; start < len(selected); start += req.PageSize {
+		end := start + req.PageSize
+		if end > len(selected) {
+			end = len(selected)
+		}
+		object := fmt.Sprintf("%s/part-%05d.%s", req.Prefix, len(parts), req.Format)
+		sum, err := writeExportPart(ctx, bucket.Object(object), req.Format, req.Kind, kind.fields, selected[start:end])
+		if err != nil {
+			writeError(w, http.StatusBadGateway, errExportFailed, fmt.Sprintf("Error escribiendo gs://%s/%s: %v", req.Bucket, object, err))
+			return
+		}
+		parts = append(parts, exportPart{Object: object, Records: end - start, SHA256: sum})
+	}
+
+	// Manifiesto firmado: mismo formato que /sign, verificable con /verify
+	manifest := map[string]interface{}{
+		"type":      "export_manifest",
+		"kind":      req.Kind,
+		"from":      req.From.UTC().Format(time.RFC3339Nano),
+		"to":        req.To.UTC().Format(time.RFC3339Nano),
+		"format":    req.Format,
+		"bucket":    req.Bucket,
+		"parts":     parts,
+		"records":   len(selected),
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	signature, err := kmsSign(ctx, data)
+	if err != nil {
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+	envelope := map[string]interface{}{"payload": manifest, "signature": signature}
+	mw := bucket.Object(req.Prefix + "/manifest.json").NewWriter(ctx)
+	mw.ContentType = "application/json"
+	if err := json.NewEncoder(mw).Encode(envelope); err != nil {
+		mw.Close()
+		writeError(w, http.StatusBadGateway, errExportFailed, fmt.Sprintf("Error escribiendo el manifiesto: %v", err))
+		return
+	}
+	if err := mw.Close(); err != nil {
+		writeError(w, http.StatusBadGateway, errExportFailed, fmt.Sprintf("Error escribiendo el manifiesto: %v", err))
+		return
+	}
+	recordAdminAudit(r, "export", fmt.Sprintf("gs://%s/%s", req.Bucket, req.Prefix))
+	writeJSON(w, http.StatusOK, envelope)
+}
+
+// writeExportPart escribe una página directamente en el objeto de GCS y
+// devuelve el SHA-256 de su contenido
+func writeExportPart(ctx context.Context, obj *storage.ObjectHandle, format, kind string, fields []string, records [][]byte) (string, error) {
+	gw := obj.NewWriter(ctx)
+	h := sha256.New()
+	out := io.MultiWriter(gw, h)
+
+	var err error
+	if format == "avro" {
+		gw.ContentType = "application/avro"
+		err = writeAvroRecords(out, kind, fields, records)
+	} else {
+		gw.ContentType = "application/x-ndjson"
+		for _, rec := range records {
+			if _, err = out.Write(append(rec, '\n')); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		gw.Close()
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeAvroRecords aplana cada registro JSON a campos string: los valores
+// que no son string (p.ej. el payload) se guardan como JSON
+func writeAvroRecords(out io.Writer, kind string, fields []string, records [][]byte) error {
+	aw, err := newAvroWriter(out, kind, fields)
+	if err != nil {
+		return err
+	}
+	for _, raw := range records {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return err
+		}
+		flat := make(map[string]string, len(fields))
+		for _, f := range fields {
+			switch v := obj[f].(type) {
+			case nil:
+			case string:
+				flat[f] = v
+			default:
+				b, _ := json.Marshal(v)
+				flat[f] = string(b)
+			}
+		}
+		if err := aw.Write(flat); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
@@ -0,0 +1,223 @@
+// federation.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// trustedIssuer es otro despliegue de firma-json (o un tercero) cuyas firmas
+// asimétricas aceptamos en /verify, con su propia política
+type trustedIssuer struct {
+	Issuer  string   `json:"issuer"`
+	JWKSURI string   `json:"jwks_uri"`
+	Algs    []string `json:"algs,omitempty"`    // algoritmos permitidos; vacío = cualquiera soportado
+	MaxAge  string   `json:"max_age,omitempty"` // antigüedad máxima del "timestamp" firmado
+}
+
+var (
+	trustedIssuers = map[string]trustedIssuer{}
+
+	jwksCacheMu sync.Mutex
+	jwksCache   = map[string]cachedJWKS{}
+
+	jwksHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type cachedJWKS struct {
+	set       jwkSet
+	fetchedAt time.Time
+}
+
+// issuerID es el identificador con el que este despliegue firma sus sobres
+func issuerID() string {
+	return getEnv("ISSUER_ID", "")
+}
+
+// loadTrustedIssuers lee FEDERATION_ISSUERS_FILE (un array JSON de
+// trustedIssuer). Si no está definido, la federación queda desactivada.
+func loadTrustedIssuers() error {
+	path := getEnv("FEDERATION_ISSUERS_FILE", "")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []trustedIssuer
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return err
+	}
+	for _, ti := range list {
+		if ti.Issuer == "" || ti.JWKSURI == "" {
+			return errors.New("cada emisor necesita issuer y jwks_uri")
+		}
+		if ti.MaxAge != "" {
+			if _, err := time.ParseDuration(ti.MaxAge); err != nil {
+				return fmt.Errorf("max_age de %s: %w", ti.Issuer, err)
+			}
+		}
+		trustedIssuers[ti.Issuer] = ti
+	}
+	log.Printf("Federación: %d emisores de confianza", len(trustedIssuers))
+	return nil
+}
+
+// verifyFederated verifica la firma de un sobre emitido por un emisor
+// externo: por DID si el kid es un DID, si no con el almacén de confianza
+// (por kid) y en último caso con el JWKS del emisor. Devuelve la razón del rechazo cuando la firma no es válida.
+func verifyFederated(ctx context.Context, iss, kid, alg string, payload interface{}, data []byte, signature string) (bool, string, error) {
+	sig, err := decodeSignature(signature)
+	if err != nil {
+		return false, "firma Base64 inválida", nil
+	}
+
+	// Claves referenciadas por DID. Sólo de otros emisores: un sobre que
+	// dice venir de este servicio se verifica con nuestras claves
+	if strings.HasPrefix(kid, "did:") {
+		if iss == "" || iss == issuerID() {
+			return false, "un kid DID requiere el iss de otro emisor", nil
+		}
+		pub, err := resolveDIDKey(ctx, kid)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		if alg == "" {
+			alg = defaultAlgFor(pub)
+		}
+		valid, err := firmajson.VerifyAsymmetric(pub, alg, data, sig)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		return valid, "", nil
+	}
+
+	if kid != "" {
+		tk, found, err := lookupTrustedKey(ctx, kid)
+		if err != nil {
+			return false, "", err
+		}
+		if found {
+			return verifyTrustedKey(tk, iss, alg, data, sig)
+		}
+	}
+
+	ti, ok := trustedIssuers[iss]
+	if !ok {
+		return false, "emisor no confiable", nil
+	}
+	if len(ti.Algs) > 0 && !contains(ti.Algs, alg) {
+		return false, fmt.Sprintf("algoritmo %q no permitido para %s", alg, iss), nil
+	}
+	if ti.MaxAge != "" {
+		maxAge, _ := time.ParseDuration(ti.MaxAge)
+		obj, _ := payload.(map[string]interface{})
+		tsStr, _ := obj["timestamp"].(string)
+		ts, err := time.Parse(time.RFC3339Nano, tsStr)
+		if err != nil {
+			return false, "el payload no tiene un timestamp válido", nil
+		}
+		if time.Since(ts) > maxAge {
+			return false, "firma demasiado antigua para la política del emisor", nil
+		}
+	}
+
+	key, err := issuerKey(ctx, ti, kid)
+	if err != nil {
+		return false, "", err
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return false, "", err
+	}
+	if alg == "" {
+		alg = key.Alg
+	}
+	valid, err := firmajson.VerifyAsymmetric(pub, alg, data, sig)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+	return valid, "", nil
+}
+
+// issuerKey busca kid en el JWKS del emisor. Si no aparece en la copia
+// cacheada se vuelve a descargar por si el emisor ha rotado claves.
+func issuerKey(ctx context.Context, ti trustedIssuer, kid string) (jwk, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		set, err := fetchJWKS(ctx, ti.JWKSURI, attempt > 0)
+		if err != nil {
+			return jwk{}, err
+		}
+		for _, k := range set.Keys {
+			if kid == "" && len(set.Keys) == 1 || k.Kid == kid {
+				return k, nil
+			}
+		}
+	}
+	return jwk{}, fmt.Errorf("clave %q no encontrada en el JWKS de %s", kid, ti.Issuer)
+}
+
+// fetchJWKS descarga un JWKS y lo cachea durante JWKS_CACHE_TTL
+func fetchJWKS(ctx context.Context, uri string, force bool) (jwkSet, error) {
+	ttl, err := time.ParseDuration(getEnv("JWKS_CACHE_TTL", "10m"))
+	if err != nil {
+		ttl = 10 * time.Minute
+	}
+	jwksCacheMu.Lock()
+	cached, ok := jwksCache[uri]
+	jwksCacheMu.Unlock()
+	if ok && !force && time.Since(cached.fetchedAt) < ttl {
+		return cached.set, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return jwkSet{}, err
+	}
+	resp, err := jwksHTTPClient.Do(req)
+	if err != nil {
+		return jwkSet{}, fmt.Errorf("descargando JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return jwkSet{}, fmt.Errorf("descargando JWKS: HTTP %d", resp.StatusCode)
+	}
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return jwkSet{}, fmt.Errorf("JWKS inválido: %w", err)
+	}
+
+	jwksCacheMu.Lock()
+	jwksCache[uri] = cachedJWKS{set: set, fetchedAt: time.Now()}
+	jwksCacheMu.Unlock()
+	return set, nil
+}
+
+// decodeSignature acepta Base64 estándar (nuestros sobres) o Base64URL (JOSE)
+func decodeSignature(s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+// freshness.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Antigüedad máxima: /verify?maxAge=300s (o VERIFY_MAX_AGE para todas las
+// verificaciones) rechaza los sobres cuyo "timestamp" es más antiguo que
+// eso, o posterior al momento actual más CLOCK_SKEW_TOLERANCE (30s), la
+// desviación admitida entre relojes. maxAge acepta una duración de Go o un
+// número de segundos; 0 desactiva VERIFY_MAX_AGE para la petición.
+
+// parseMaxAge interpreta "300s", "5m" o "300"
+func parseMaxAge(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		s = strconv.Itoa(n) + "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("maxAge debe ser una duración positiva (p.ej. 300s)")
+	}
+	return d, nil
+}
+
+// requestMaxAge devuelve la antigüedad máxima pedida (?maxAge= o ?max_age=,
+// por defecto VERIFY_MAX_AGE); 0 = sin límite
+func requestMaxAge(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("maxAge")
+	if v == "" {
+		v = r.URL.Query().Get("max_age")
+	}
+	if v == "" {
+		v = getEnv("VERIFY_MAX_AGE", "")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	return parseMaxAge(v)
+}
+
+// clockSkewTolerance es la desviación de reloj admitida hacia el futuro
+func clockSkewTolerance() time.Duration {
+	d, err := time.ParseDuration(getEnv("CLOCK_SKEW_TOLERANCE", "30s"))
+	if err != nil || d < 0 {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// validateMaxAge comprueba ?maxAge= en /verify y /verify/batch
+func validateMaxAge(r *http.Request) []validationProblem {
+	if _, err := requestMaxAge(r); err != nil {
+		return []validationProblem{{"maxAge", errInvalidRequest, err.Error()}}
+	}
+	return nil
+}
+
+// validateVerifyRequest es validateEnvelopeRequest más las opciones de query
+// de /verify
+func validateVerifyRequest(r *http.Request, body []byte) []validationProblem {
+	problems := append(validateMaxAge(r), validateAAD(r)...)
+	return append(problems, validateEnvelopeRequest(r, body)...)
+}
+
+// checkFreshness aplica la antigüedad máxima al timestamp del sobre.
+// Devuelve el motivo si no vale, o "".
+func checkFreshness(r *http.Request, obj interface{}, now time.Time) string {
+	maxAge, err := requestMaxAge(r)
+	if err != nil || maxAge == 0 {
+		return ""
+	}
+	ts := payloadTimestamp(obj)
+	if ts.IsZero() {
+		return "El sobre no lleva un timestamp válido y se exige maxAge"
+	}
+	if skew := clockSkewTolerance(); ts.After(now.Add(skew)) {
+		return fmt.Sprintf("El timestamp del sobre está en el futuro (%s, tolerancia %s)", ts.Sub(now).Round(time.Second), skew)
+	}
+	if age := now.Sub(ts); age > maxAge {
+		return fmt.Sprintf("La firma tiene %s y el máximo es %s", age.Round(time.Second), maxAge)
+	}
+	return ""
+}
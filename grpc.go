@@ -0,0 +1,340 @@
+// grpc.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	firmajsonv1 "example.com/firmajson/proto/firmajson/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// API gRPC. Con GRPC_PORT se sirve, además del HTTP, el servicio
+// firmajson.v1.Signer (proto/firmajson/v1/signer.proto, código generado en
+// proto/firmajson/v1) con Sign y Verify, más reflexión (GRPC_REFLECTION=false
+// la quita) y el servicio estándar de health. Con TLS_CERT_FILE usa el mismo
+// certificado y la misma CA de clientes que el HTTP.
+//
+// Sign y Verify llaman directamente al mismo núcleo que POST /sign y POST
+// /verify (keyAliasFor, dpopFailure, signingAuthorization, callerThrottle,
+// signableDocument, signCanonical, recordSigned y checkEnvelope, con los
+// mismos validadores): misma autenticación, mismas políticas, misma
+// auditoría y mismo backend. Esas funciones leen la petición HTTP, así que
+// cada llamada se describe con una (grpcRequest): los metadatos son las
+// cabeceras, los campos del mensaje los parámetros de la URL y la ruta el
+// método completo. De la cadena de middlewares HTTP sólo se aplican aquí
+// los equivalentes del panic, las llamadas en curso y el modo degradado
+// (grpcInterceptor); los de registerMiddleware no.
+
+// grpcErrorCodeTrailer lleva el código de /errors de una llamada fallida
+const grpcErrorCodeTrailer = "firma-json-error-code"
+
+// signerServer implementa firmajson.v1.Signer
+type signerServer struct {
+	firmajsonv1.UnimplementedSignerServer
+}
+
+// Sign firma como POST /sign?echo=true
+func (signerServer) Sign(ctx context.Context, in *firmajsonv1.SignRequest) (*firmajsonv1.SignResponse, error) {
+	q := url.Values{}
+	if in.Key != "" {
+		q.Set("key", in.Key)
+	}
+	if in.Escape != "" {
+		q.Set("escape", in.Escape)
+	}
+	if in.Digest != "" {
+		q.Set("digest", in.Digest)
+	}
+	if in.Nonce {
+		q.Set("nonce", "true")
+	}
+	r, err := grpcRequest(ctx, q, in.Aad, in.Document)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcValidate(ctx, r, in.Document, validateSignRequest); err != nil {
+		return nil, err
+	}
+
+	alias, f := keyAliasFor(r)
+	if f == nil {
+		f = dpopFailure(r)
+	}
+	if f == nil {
+		f = signingAuthorization(r, alias)
+	}
+	if f != nil {
+		return nil, grpcError(ctx, f.status, f.code, f.msg)
+	}
+	if wait := callerThrottle(r); wait > 0 {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(wait.Seconds())+1)))
+		return nil, grpcError(ctx, http.StatusTooManyRequests, errCallerThrottled, "Firma frenada por comportamiento anómalo")
+	}
+	payloadMap, data, f := signableDocument(r, alias, in.Document)
+	if f != nil {
+		return nil, grpcError(ctx, f.status, f.code, f.msg)
+	}
+
+	ctx = withKeyPriority(ctx, alias)
+	resp, err := signCanonical(ctx, r, alias, payloadMap, data)
+	if err != nil {
+		s, code := kmsErrorStatus(err, errKMSSignFailed)
+		if code == errKMSBusy {
+			grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(kmsRetryAfter().Seconds())))))
+		}
+		return nil, grpcError(ctx, s, code, fmt.Sprintf("Error firmando: %v", err))
+	}
+	digest, _ := resp["digest"].(string)
+	if err := recordSigned(ctx, r, alias, resp, payloadMap, data, requestEscape(r), digest); err != nil {
+		return nil, grpcError(ctx, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Firmado pero no guardado: %v", err))
+	}
+
+	envelope, err := json.Marshal(resp)
+	if err != nil {
+		return nil, grpcError(ctx, http.StatusInternalServerError, errInternal, "Error interno al serializar el sobre")
+	}
+	out := &firmajsonv1.SignResponse{Envelope: envelope}
+	out.Signature, _ = resp["signature"].(string)
+	out.Key, _ = resp["key"].(string)
+	out.KeyVersion, _ = resp["key_version"].(string)
+	out.Alg, _ = resp["alg"].(string)
+	out.EnvelopeId, _ = resp["envelope_id"].(string)
+	return out, nil
+}
+
+// Verify verifica como POST /verify
+func (signerServer) Verify(ctx context.Context, in *firmajsonv1.VerifyRequest) (*firmajsonv1.VerifyResponse, error) {
+	q := url.Values{}
+	if in.MaxAge != "" {
+		q.Set("max_age", in.MaxAge)
+	}
+	r, err := grpcRequest(ctx, q, in.Aad, in.Envelope)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcValidate(ctx, r, in.Envelope, validateVerifyRequest); err != nil {
+		return nil, err
+	}
+	resp, res, err := checkEnvelope(r, in.Envelope)
+	if err != nil {
+		var f *verifyFailure
+		errors.As(err, &f)
+		return nil, grpcError(ctx, f.status, f.code, f.msg)
+	}
+	result, err := json.Marshal(resp)
+	if err != nil {
+		return nil, grpcError(ctx, http.StatusInternalServerError, errInternal, "Error interno al serializar el resultado")
+	}
+	out := &firmajsonv1.VerifyResponse{Valid: res.Valid, Reason: res.Reason, Result: result}
+	if !res.Valid {
+		out.Code = string(res.invalidCode())
+	}
+	return out, nil
+}
+
+// grpcRequest describe la llamada en curso como la petición HTTP que leen
+// las funciones de firma y verificación: los metadatos como cabeceras, q
+// como la query, el método completo como ruta (también para el htu de
+// DPoP) y :authority como Host. body es el documento o el sobre.
+func grpcRequest(ctx context.Context, q url.Values, aad string, body []byte) (*http.Request, error) {
+	method, _ := grpc.Method(ctx)
+	target := method
+	if len(q) > 0 {
+		target += "?" + q.Encode()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	r.RequestURI = target
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if authority := md.Get(":authority"); len(authority) > 0 {
+			r.Host = authority[0]
+		}
+		for k, vs := range md {
+			if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") ||
+				k == "content-type" || k == "te" {
+				continue
+			}
+			for _, v := range vs {
+				r.Header.Add(k, v)
+			}
+		}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if aad != "" {
+		r.Header.Set(aadHeader, aad)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r, nil
+}
+
+// grpcValidate pasa body por los mismos límites estructurales y el mismo
+// validador que la ruta HTTP equivalente (ver validated)
+func grpcValidate(ctx context.Context, r *http.Request, body []byte, v requestValidator) error {
+	check := r.Clone(ctx)
+	check.Body = io.NopCloser(bytes.NewReader(body))
+	_, problem, err := readJSONBody(check)
+	if err != nil {
+		return grpcError(ctx, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el documento")
+	}
+	var problems []validationProblem
+	if problem != nil {
+		problems = []validationProblem{*problem}
+	} else {
+		problems = v(r, body)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		msgs[i] = p.Field + ": " + p.Message
+	}
+	return grpcError(ctx, http.StatusBadRequest, errValidationFailed, strings.Join(msgs, "; "))
+}
+
+// grpcError es el error gRPC que corresponde a la respuesta HTTP status
+// con el código de /errors, que va en el trailer
+func grpcError(ctx context.Context, s int, code errCode, msg string) error {
+	errorResponses.inc(string(code))
+	grpc.SetTrailer(ctx, metadata.Pairs(grpcErrorCodeTrailer, string(code)))
+	return status.Error(grpcCodeForHTTP(s), msg)
+}
+
+// grpcCodeForHTTP traduce el estado HTTP de la respuesta a un código gRPC
+func grpcCodeForHTTP(s int) codes.Code {
+	switch s {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+// grpcInterceptor hace en gRPC lo que recoverMiddleware, inFlightMiddleware
+// y kmsReadyMiddleware en HTTP. Sin KMS sólo se atiende el servicio de
+// health.
+func grpcInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("❌ panic en %s: %v\n%s", info.FullMethod, v, debug.Stack())
+			resp, err = nil, grpcError(ctx, http.StatusInternalServerError, errInternal, "Error interno")
+		}
+	}()
+	if !kmsReady.Load() && strings.HasPrefix(info.FullMethod, "/"+firmajsonv1.Signer_ServiceDesc.ServiceName+"/") {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(kmsRetryInterval.Seconds()))))
+		return nil, grpcError(ctx, http.StatusServiceUnavailable, errKMSUnavailable, "El servicio está en modo degradado: KMS no está disponible")
+	}
+	return handler(ctx, req)
+}
+
+// registerGRPCServer registra en lifecycle el servidor gRPC si GRPC_PORT
+// está definido. La parada espera a las llamadas en curso hasta que
+// caduque el plazo y luego corta.
+func registerGRPCServer() error {
+	port := getEnv("GRPC_PORT", "")
+	if port == "" {
+		return nil
+	}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(grpcInterceptor)}
+	if max := maxBodyBytes(); max > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(max)))
+	}
+	if certFile := getEnv("TLS_CERT_FILE", ""); certFile != "" {
+		cfg, err := serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, getEnv("TLS_KEY_FILE", ""))
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	srv := grpc.NewServer(opts...)
+	firmajsonv1.RegisterSignerServer(srv, signerServer{})
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthSrv)
+	if getEnv("GRPC_REFLECTION", "true") == "true" {
+		reflection.Register(srv)
+	}
+
+	start := func(context.Context) error {
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return err
+		}
+		go func() {
+			log.Printf("gRPC en :%s …", port)
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				log.Printf("❌ gRPC: %v", err)
+			}
+		}()
+		return nil
+	}
+	stop := func(ctx context.Context) error {
+		healthSrv.Shutdown()
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			srv.Stop()
+			return fmt.Errorf("llamadas cortadas al parar: %w", ctx.Err())
+		}
+	}
+	return lifecycle.Register("grpc", start, stop)
+}
@@ -0,0 +1,130 @@
+// grpc_test.go
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	firmajsonv1 "example.com/firmajson/proto/firmajson/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testSignerClient arranca el servicio Signer en memoria
+func testSignerClient(t *testing.T) firmajsonv1.SignerClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(grpcInterceptor))
+	firmajsonv1.RegisterSignerServer(srv, signerServer{})
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///firma.test",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return firmajsonv1.NewSignerClient(conn)
+}
+
+func TestGRPCSignVerify(t *testing.T) {
+	client := testSignerClient(t)
+	ctx := context.Background()
+
+	signed, err := client.Sign(ctx, &firmajsonv1.SignRequest{Document: []byte(`{"pedido":42}`), Aad: "tenant-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Signature == "" || signed.KeyVersion == "" {
+		t.Fatalf("respuesta incompleta: %v", signed)
+	}
+	var env map[string]interface{}
+	if err := json.Unmarshal(signed.Envelope, &env); err != nil || env["payload"] == nil {
+		t.Fatalf("el sobre debe llevar el payload: %s", signed.Envelope)
+	}
+
+	res, err := client.Verify(ctx, &firmajsonv1.VerifyRequest{Envelope: signed.Envelope, Aad: "tenant-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Valid {
+		t.Fatalf("la firma debe ser válida: %v", res)
+	}
+
+	// El mismo núcleo que /verify: con otro contexto la firma no vale
+	res, err = client.Verify(ctx, &firmajsonv1.VerifyRequest{Envelope: signed.Envelope, Aad: "tenant-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Valid || res.Code != string(errSignatureMismatch) {
+		t.Fatalf("con otro AAD no debe ser válida: %v", res)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client := testSignerClient(t)
+	ctx := context.Background()
+
+	var trailer metadata.MD
+	_, err := client.Sign(ctx, &firmajsonv1.SignRequest{Document: []byte(`{"a":1}`), Key: "no-existe"}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("clave desconocida: %v", err)
+	}
+	if got := trailer.Get(grpcErrorCodeTrailer); len(got) != 1 || got[0] != string(errUnknownKey) {
+		t.Fatalf("trailer %s = %v", grpcErrorCodeTrailer, got)
+	}
+
+	// Los validadores de /sign también se aplican
+	_, err = client.Sign(ctx, &firmajsonv1.SignRequest{Document: []byte(`[1,2]`)}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.InvalidArgument || trailer.Get(grpcErrorCodeTrailer)[0] != string(errValidationFailed) {
+		t.Fatalf("documento que no es un objeto: %v %v", err, trailer)
+	}
+}
+
+// TestGRPCDPoP comprueba que el htu de la prueba DPoP es la URL base con
+// el método completo, no una URL HTTP
+func TestGRPCDPoP(t *testing.T) {
+	t.Setenv("API_KEYS", "clave-grpc:grpc-dpop")
+	client := testSignerClient(t)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := json.Marshal(jwk{Kty: "OKP", Crv: "Ed25519", Alg: "EdDSA", X: base64.RawURLEncoding.EncodeToString(pub)})
+	if err := db.Put(context.Background(), dpopKeyCollection, "grpc-dpop", key); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Delete(context.Background(), dpopKeyCollection, "grpc-dpop") })
+
+	proof := func(htu string) string {
+		b64 := func(v interface{}) string {
+			raw, _ := json.Marshal(v)
+			return base64.RawURLEncoding.EncodeToString(raw)
+		}
+		jti, _ := randomID()
+		input := b64(map[string]string{"typ": "dpop+jwt", "alg": "EdDSA"}) + "." +
+			b64(map[string]interface{}{"htm": "POST", "htu": htu, "iat": time.Now().Unix(), "jti": jti})
+		return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, []byte(input)))
+	}
+	sign := func(htu string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "clave-grpc", "dpop", proof(htu))
+		_, err := client.Sign(ctx, &firmajsonv1.SignRequest{Document: []byte(`{"a":1}`)})
+		return err
+	}
+
+	if err := sign("https://firma.test" + firmajsonv1.Signer_Sign_FullMethodName); err != nil {
+		t.Fatalf("prueba con el método gRPC: %v", err)
+	}
+	if err := sign("https://grpc/sign"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("prueba con una URL HTTP: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// hash.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// shortIDLength es la longitud (en caracteres hex) del id corto de /hash
+const shortIDLength = 16
+
+// hashHandler devuelve el hash canónico de un documento sin firmarlo, para
+// que los sistemas de deduplicación usen como clave exactamente lo que se
+// firmaría. Pasa por la misma preparación que /sign (nonce derivado de
+// X-Nonce-Seed, cnf, signed_in, modo de escape) salvo el timestamp, que
+// cambia en cada firma y no se incluye. Las opciones no deterministas
+// (?nonce=true, ?encrypt=) no tienen sentido aquí y se rechazan.
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if r.URL.Query().Get("nonce") == "true" || len(queryList(r, "encrypt")) > 0 {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "nonce=true y encrypt no son deterministas y no admiten hash")
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok {
+		return
+	}
+	payloadMap, _, ok := preparePayload(w, r, alias)
+	if !ok {
+		return
+	}
+	escape := requestEscape(r)
+	data, digest, err := documentHash(payloadMap, escape)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	resp := map[string]interface{}{
+		"sha256":          digest,
+		"short_id":        digest[:shortIDLength],
+		"canonical_bytes": len(data),
+		"key":             alias,
+	}
+	if escape != "" && escape != escapeHTML {
+		resp["escape"] = escape
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// documentHash devuelve los bytes canónicos del payload sin el timestamp y
+// su SHA-256 en hexadecimal: lo que devuelve /hash y lo que esperan las
+// suscripciones (ver subscriptions.go)
+func documentHash(payload map[string]interface{}, escape string) ([]byte, string, error) {
+	doc := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if k != "timestamp" {
+			doc[k] = v
+		}
+	}
+	data, err := canonicalJSONEscaped(doc, escape)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:]), nil
+}
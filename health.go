@@ -0,0 +1,91 @@
+// health.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthHandler responde en /healthz. Con ?attest=true devuelve además una
+// atestación firmada, fechada y de vida corta (HEALTH_ATTESTATION_TTL), para
+// que los sistemas que nos llaman puedan demostrar ante sus auditores que el
+// servicio estaba sano en el momento de sus peticiones. El cliente puede
+// pasar ?challenge= para ligar la atestación a su propia petición.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	ctx := r.Context()
+	checks := map[string]string{"store": checkStore(ctx), "kms": kmsStatus()}
+	status := "ok"
+	for _, c := range checks {
+		if c != "ok" {
+			status = "degraded"
+		}
+	}
+	if draining.Load() {
+		status = "draining"
+	}
+
+	if r.URL.Query().Get("attest") != "true" {
+		writeJSON(w, healthStatusCode(status), map[string]interface{}{"status": status, "checks": checks})
+		return
+	}
+	if !kmsReady.Load() {
+		writeError(w, http.StatusServiceUnavailable, errKMSUnavailable, "KMS no está disponible: no hay nada que atestar")
+		return
+	}
+
+	ttl, err := time.ParseDuration(getEnv("HEALTH_ATTESTATION_TTL", "5m"))
+	if err != nil {
+		ttl = 5 * time.Minute
+	}
+	now := time.Now().UTC()
+	payload := map[string]interface{}{
+		"type":      purposeHealthAttestation,
+		"status":    status,
+		"checks":    checks,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+		"timestamp": now.Format(time.RFC3339Nano),
+	}
+	if iss := issuerID(); iss != "" {
+		payload["iss"] = iss
+	}
+	if challenge := r.URL.Query().Get("challenge"); challenge != "" {
+		payload["challenge"] = challenge
+	}
+	data, err := canonicalJSON(payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	// Con el prefijo de su propósito (ver purpose.go), para que no se pueda
+	// obtener una atestación desde /sign. Si KMS no firma, el servicio no
+	// está sano y no hay nada que atestar
+	signature, err := kmsSign(ctx, withPurpose(data, purposeHealthAttestation))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+	writeJSON(w, healthStatusCode(status), map[string]interface{}{"payload": payload, "signature": signature})
+}
+
+// checkStore comprueba que el store responde
+func checkStore(ctx context.Context) string {
+	if _, err := db.Get(ctx, "health", "probe"); err != nil && !errors.Is(err, errNotFound) {
+		return err.Error()
+	}
+	return "ok"
+}
+
+func healthStatusCode(status string) int {
+	if status != "ok" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
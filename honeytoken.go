@@ -0,0 +1,110 @@
+// honeytoken.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// blockedCollection guarda los callers bloqueados, compartidos por todas
+// las réplicas a través del store
+const blockedCollection = "blocked_callers"
+
+// isHoneytoken indica si el alias es un señuelo de HONEYTOKEN_KEYS: ningún
+// cliente legítimo lo usa, así que cualquier intento es una intrusión
+func isHoneytoken(alias string) bool {
+	for _, h := range strings.Split(getEnv("HONEYTOKEN_KEYS", ""), ",") {
+		if h = strings.TrimSpace(h); h != "" && h == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// requestKeyAlias devuelve el alias de clave pedido (ver keyAliasFor). Si
+// no deja continuar, ya ha respondido.
+func requestKeyAlias(w http.ResponseWriter, r *http.Request) (string, bool) {
+	alias, f := keyAliasFor(r)
+	if f != nil {
+		f.write(w)
+		return "", false
+	}
+	return alias, true
+}
+
+// keyAliasFor devuelve el alias de clave pedido (?key= o X-Key, por
+// defecto "default"; los demás son los de KEYS_FILE). Rechaza a los callers bloqueados y, si el alias es un
+// señuelo, lanza la alerta y lo rechaza igual que una clave desconocida.
+func keyAliasFor(r *http.Request) (string, *signFailure) {
+	ctx := r.Context()
+	caller := callerID(r)
+	if callerBlocked(ctx, caller) {
+		return "", &signFailure{http.StatusForbidden, errCallerBlocked, "Acceso bloqueado"}
+	}
+
+	alias := r.URL.Query().Get("key")
+	if alias == "" {
+		alias = r.Header.Get("X-Key")
+	}
+	if alias == "" {
+		alias = defaultKeyAlias
+	}
+	if isHoneytoken(alias) {
+		log.Printf("🚨 Intento de firma con la clave señuelo %q desde %s (%s)", alias, caller, clientIP(r))
+		e := newAuditEntry(r, "honeytoken", alias, nil)
+		e.Outcome, e.Detail = "alert", "ip="+clientIP(r)
+		recordAudit(ctx, e)
+		if getEnv("HONEYTOKEN_BLOCK", "false") == "true" {
+			if err := blockCaller(ctx, caller, "honeytoken "+alias); err != nil {
+				log.Printf("⚠️  No se pudo bloquear a %s: %v", caller, err)
+			}
+		}
+	}
+	if _, known := keyConfigs[alias]; alias != defaultKeyAlias && (!known || isHoneytoken(alias)) {
+		return "", &signFailure{http.StatusBadRequest, errUnknownKey, "Clave desconocida"}
+	}
+	return alias, nil
+}
+
+func callerBlocked(ctx context.Context, caller string) bool {
+	_, err := db.Get(ctx, blockedCollection, caller)
+	return err == nil
+}
+
+func blockCaller(ctx context.Context, caller, reason string) error {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"caller":     caller,
+		"reason":     reason,
+		"blocked_at": time.Now().UTC(),
+	})
+	return db.Put(ctx, blockedCollection, caller, raw)
+}
+
+// blockedCallerHandler permite a un administrador desbloquear un caller
+// (DELETE /admin/blocked/{caller})
+func blockedCallerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo DELETE permitido")
+		return
+	}
+	caller := strings.TrimPrefix(r.URL.Path, "/admin/blocked/")
+	err := db.Delete(r.Context(), blockedCollection, caller)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "El caller no está bloqueado")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	recordAdminAudit(r, "caller_unblocked", caller)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,10 @@
+// Package integration prueba firma-json de punta a punta contra un
+// despliegue real, por defecto el de docker-compose (ver Makefile): firma,
+// verifica, comprueba que se detectan la manipulación y el reenvío, lotes,
+// manifiestos y JWS. Los tests sólo se compilan con la etiqueta
+// integration:
+//
+//	FIRMA_BASE_URL=http://localhost:8080 go test -tags integration ./integration
+//
+// FIRMA_WAIT (90s) es la espera máxima a que el servicio esté listo.
+package integration
@@ -0,0 +1,310 @@
+//go:build integration
+
+// integration_test.go
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	base   = envOr("FIRMA_BASE_URL", "http://localhost:8080")
+	client = &http.Client{Timeout: 30 * time.Second}
+)
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// TestMain espera a que el servicio esté listo (FIRMA_WAIT, 90s) antes de
+// pasar los escenarios
+func TestMain(m *testing.M) {
+	wait, err := time.ParseDuration(envOr("FIRMA_WAIT", "90s"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FIRMA_WAIT: %v\n", err)
+		os.Exit(2)
+	}
+	if err := waitReady(wait); err != nil {
+		fmt.Fprintf(os.Stderr, "el servicio en %s no está listo: %v\n", base, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// TestEndToEnd recorre la API: cada escenario es un subtest
+func TestEndToEnd(t *testing.T) {
+	scenarios := []struct {
+		name string
+		run  func() error
+	}{
+		{"discovery", checkDiscovery},
+		{"sign_verify", checkSignVerify},
+		{"tamper", checkTamper},
+		{"replay", checkReplay},
+		{"batch", checkBatch},
+		{"manifest", checkManifest},
+		{"jws", checkJWS},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// waitReady espera a que /healthz diga que KMS está listo
+func waitReady(wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	var last error
+	for time.Now().Before(deadline) {
+		var health struct {
+			Checks map[string]string `json:"checks"`
+		}
+		status, err := call(http.MethodGet, "/healthz", nil, &health)
+		switch {
+		case err != nil:
+			last = err
+		case health.Checks["kms"] == "ok":
+			return nil
+		default:
+			last = fmt.Errorf("HTTP %d, kms: %s", status, health.Checks["kms"])
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return last
+}
+
+// call hace una petición JSON y decodifica la respuesta en out
+func call(method, path string, body, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("respuesta no JSON (HTTP %d): %.200s", resp.StatusCode, raw)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// expectOK llama y exige un 200
+func expectOK(method, path string, body, out interface{}) error {
+	status, err := call(method, path, body, out)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s %s: HTTP %d", method, path, status)
+	}
+	return nil
+}
+
+func checkDiscovery() error {
+	var doc struct {
+		Signing map[string]interface{} `json:"signing"`
+	}
+	if err := expectOK(http.MethodGet, "/.well-known/firma-json", nil, &doc); err != nil {
+		return err
+	}
+	if doc.Signing["key_version"] == nil {
+		return fmt.Errorf("discovery sin signing.key_version")
+	}
+	return nil
+}
+
+type envelope struct {
+	Payload   map[string]interface{} `json:"payload"`
+	Signature string                 `json:"signature"`
+}
+
+type verdict struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+}
+
+func sampleDocument(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"invoice": fmt.Sprintf("F-2026-%04d", i),
+		"amount":  "1234.56",
+		"lines":   []interface{}{map[string]interface{}{"sku": "A-1", "qty": 2}},
+	}
+}
+
+func signOne(i int) (envelope, error) {
+	var env envelope
+	if err := expectOK(http.MethodPost, "/sign?echo=true", sampleDocument(i), &env); err != nil {
+		return env, err
+	}
+	if env.Signature == "" || env.Payload["timestamp"] == nil {
+		return env, fmt.Errorf("sobre incompleto")
+	}
+	return env, nil
+}
+
+func checkSignVerify() error {
+	env, err := signOne(1)
+	if err != nil {
+		return err
+	}
+	var v verdict
+	if err := expectOK(http.MethodPost, "/verify", env, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("firma recién emitida no válida: %s", v.Reason)
+	}
+	return nil
+}
+
+func checkTamper() error {
+	env, err := signOne(2)
+	if err != nil {
+		return err
+	}
+	env.Payload["amount"] = "9999.99"
+	var v verdict
+	if err := expectOK(http.MethodPost, "/verify", env, &v); err != nil {
+		return err
+	}
+	if v.Valid {
+		return fmt.Errorf("un payload manipulado se dio por válido")
+	}
+	return nil
+}
+
+func checkReplay() error {
+	var env envelope
+	if err := expectOK(http.MethodPost, "/sign?echo=true&nonce=true", sampleDocument(3), &env); err != nil {
+		return err
+	}
+	if env.Payload["nonce"] == nil {
+		return fmt.Errorf("sobre sin nonce")
+	}
+	var v struct {
+		verdict
+		Code string `json:"code"`
+	}
+	if err := expectOK(http.MethodPost, "/verify", env, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("primera verificación no válida: %s", v.Reason)
+	}
+	// El nonce ya está anotado en Redis (NONCE_STORE=redis)
+	if err := expectOK(http.MethodPost, "/verify", env, &v); err != nil {
+		return err
+	}
+	if v.Valid || v.Code != "ENVELOPE_REPLAYED" {
+		return fmt.Errorf("el reenvío no se detectó: valid=%v code=%s", v.Valid, v.Code)
+	}
+	return nil
+}
+
+func checkBatch() error {
+	const n = 25
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = sampleDocument(100 + i)
+	}
+	var signed struct {
+		Signed  int        `json:"signed"`
+		Results []envelope `json:"results"`
+	}
+	if err := expectOK(http.MethodPost, "/sign/batch?echo=true", map[string]interface{}{"payloads": docs}, &signed); err != nil {
+		return err
+	}
+	if signed.Signed != n {
+		return fmt.Errorf("firmados %d de %d", signed.Signed, n)
+	}
+	var v verdict
+	if err := expectOK(http.MethodPost, "/verify/batch", map[string]interface{}{"envelopes": signed.Results}, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("el lote recién firmado no verifica")
+	}
+	return nil
+}
+
+func checkManifest() error {
+	req := map[string]interface{}{
+		"name": "cierre-integracion",
+		"documents": []interface{}{
+			map[string]interface{}{"doc_type": "invoice", "payload": sampleDocument(200)},
+			map[string]interface{}{"doc_type": "ledger", "payload": map[string]interface{}{"total": "1234.56"}},
+		},
+	}
+	var pkg map[string]interface{}
+	if err := expectOK(http.MethodPost, "/sign/manifest", req, &pkg); err != nil {
+		return err
+	}
+	var v verdict
+	if err := expectOK(http.MethodPost, "/verify/manifest", pkg, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("el manifiesto recién firmado no verifica")
+	}
+	return nil
+}
+
+func checkJWS() error {
+	raw, err := json.Marshal(sampleDocument(300))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(strings.TrimSuffix(base, "/")+"/sign?format=jws", "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	compact, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || strings.Count(string(compact), ".") != 2 {
+		return fmt.Errorf("HTTP %d: %.200s", resp.StatusCode, compact)
+	}
+	var v verdict
+	if err := expectOK(http.MethodPost, "/verify", map[string]string{"jws": strings.TrimSpace(string(compact))}, &v); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("JWS no válido: %s", v.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+// introspect.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/firmajson/compact"
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// introspectHandler (POST /introspect) desmonta un sobre en cualquiera de
+// los formatos que acepta /verify, sin verificarlo: no llama a KMS ni a
+// emisores externos, no audita y no anota nonces, así que soporte puede
+// mirar un sobre de un cliente sin efectos secundarios. Devuelve el formato
+// detectado, la clave (kid o key_version y si es una de las nuestras), el
+// algoritmo si el formato lo declara, los timestamps, los claims y el hash
+// del payload, más avisos sobre lo que no cuadra. Los claims se redactan
+// como en /verify (ver redaction.go).
+//
+// Formatos: el sobre JSON (también comprimido, con firma separada o la
+// respuesta de /sign sin eco, que sólo trae los campos inyectados), JWS
+// compacto ({"jws": ...} o en crudo con application/jose), JWS JSON
+// aplanado y el sobre compacto CBOR (en crudo con application/cbor o
+// {"envelope": "<base64>"}).
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxPayloadBytes())*2+compactMaxBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return
+	}
+	out := map[string]interface{}{"verified": false}
+	var warnings []string
+	warn := func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	trimmed := strings.TrimSpace(string(body))
+	var fields map[string]json.RawMessage
+	switch {
+	case mt == compactMediaType:
+		introspectCompact(out, body, warn)
+	case isCompactJWSBody(r) || !strings.HasPrefix(trimmed, "{") && strings.Count(trimmed, ".") == 2:
+		introspectJWS(out, &verifyRequest{JWS: trimmed}, formatJWS, warn)
+	case json.Unmarshal(body, &fields) != nil:
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "No es un sobre reconocible: ni JSON, ni JWS compacto, ni CBOR")
+		return
+	default:
+		var req verifyRequest
+		json.Unmarshal(body, &req)
+		var envelope string
+		json.Unmarshal(fields["envelope"], &envelope)
+		switch {
+		case req.JWS != "":
+			introspectJWS(out, &req, formatJWS, warn)
+		case req.Protected != "":
+			introspectJWS(out, &req, formatJWSJSON, warn)
+		case envelope != "":
+			raw, err := base64.StdEncoding.DecodeString(envelope)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errInvalidSigEncoding, "envelope no es Base64 válido")
+				return
+			}
+			introspectCompact(out, raw, warn)
+		case req.Payload != nil || req.PayloadZ != "" || req.Document != nil || req.Injected != nil:
+			if !introspectEnvelope(w, out, &req, warn) {
+				return
+			}
+		default:
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "No es un sobre reconocible: falta payload, jws, protected o envelope")
+			return
+		}
+	}
+
+	if ts, ok := out["timestamp"].(time.Time); ok {
+		now := time.Now()
+		out["timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+		out["age"] = now.Sub(ts).Round(time.Second).String()
+		if ts.After(now.Add(clockSkewTolerance())) {
+			warn("El timestamp está en el futuro")
+		}
+	}
+	if claims, ok := out["claims"]; ok {
+		claims, redacted, err := redactPayload(r, claims)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+			return
+		}
+		delete(out, "claims")
+		if claims != nil {
+			out["claims"] = claims
+		}
+		if redacted != nil {
+			out["redacted"] = redacted
+		}
+	}
+	if warnings != nil {
+		out["warnings"] = warnings
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// introspectEnvelope rellena out con el sobre JSON. Si no se puede ni leer
+// el payload ya ha respondido.
+func introspectEnvelope(w http.ResponseWriter, out map[string]interface{}, req *verifyRequest, warn func(string, ...interface{})) bool {
+	out["format"] = "envelope"
+	if req.ContentEncoding != "" {
+		out["format"], out["content_encoding"] = "envelope-compressed", req.ContentEncoding
+		raw, err := decompressPayload(req.ContentEncoding, req.PayloadZ)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidPayload, err.Error())
+			return false
+		}
+		req.Payload = raw
+	}
+	if len(req.Document) > 0 {
+		out["format"] = "envelope-detached"
+		if err := attachDocument(req); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidPayload, err.Error())
+			return false
+		}
+	}
+	var obj interface{}
+	switch {
+	case req.Payload == nil:
+		// Respuesta de /sign sin eco: sólo los campos inyectados
+		out["format"] = "signature-only"
+		if err := firmajson.DecodeJSON(req.Injected, &obj); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidPayload, "injected debe ser un objeto JSON")
+			return false
+		}
+		introspectClaims(out, obj, warn)
+		warn("Sin el documento no hay hash del payload: envía document junto a injected")
+	case firmajson.DecodeJSON(req.Payload, &obj) != nil:
+		writeError(w, http.StatusBadRequest, errInvalidPayload, "Payload inválido")
+		return false
+	default:
+		introspectClaims(out, obj, warn)
+		data, err := canonicalJSONEscaped(obj, req.Escape)
+		if err != nil {
+			warn("No se pudo canonicalizar el payload: %v", err)
+			break
+		}
+		sum := sha256.Sum256(data)
+		out["payload_sha256"] = hex.EncodeToString(sum[:])
+		if reason := checkPayloadDigest(req.PayloadSHA256, data); reason != "" {
+			warn("%s", reason)
+		}
+	}
+	if req.Escape != "" {
+		out["escape"] = req.Escape
+	}
+
+	if req.Iss != "" {
+		out["issuer"] = req.Iss
+	}
+	switch {
+	case req.Kid != "":
+		out["key_id"] = req.Kid
+	case req.KeyVersion != "":
+		out["key_id"] = req.KeyVersion
+		out["known_key"] = acceptedKeyVersion(req.KeyVersion)
+	default:
+		warn("El sobre no indica key_version; /verify usará la clave por defecto")
+	}
+	if req.Key != "" {
+		out["key"] = req.Key
+	}
+	if req.Alg != "" {
+		out["algorithm"] = req.Alg
+	}
+	if sig, err := base64.StdEncoding.DecodeString(req.Signature); err != nil || len(sig) == 0 {
+		warn("signature falta o no es Base64 válido")
+	} else {
+		out["signature_bytes"] = len(sig)
+		if req.SignatureLength != 0 && req.SignatureLength != len(sig) {
+			warn("signature_length declara %d bytes y la firma tiene %d", req.SignatureLength, len(sig))
+		}
+	}
+	return true
+}
+
+// introspectJWS rellena out con un JWS, compacto o JSON aplanado
+func introspectJWS(out map[string]interface{}, req *verifyRequest, format string, warn func(string, ...interface{})) {
+	out["format"] = format
+	obj, err := parseJWS(req)
+	if err != nil {
+		warn("%s", err.Error())
+		return
+	}
+	var header map[string]interface{}
+	if raw, err := base64.RawURLEncoding.DecodeString(obj.Protected); err != nil || json.Unmarshal(raw, &header) != nil {
+		warn("Cabecera protegida del JWS inválida")
+	} else {
+		out["header"] = header
+		if alg, _ := header["alg"].(string); alg != "" {
+			out["algorithm"] = alg
+		} else {
+			warn("La cabecera no lleva alg")
+		}
+		if kid, _ := header["kid"].(string); kid != "" {
+			out["key_id"] = kid
+			out["known_key"] = acceptedKeyVersion(kid)
+		}
+		if iss, _ := header["iss"].(string); iss != "" {
+			out["issuer"] = iss
+		}
+		if crit, ok := header["crit"]; ok {
+			warn("Cabeceras crit %v: /verify las rechaza", crit)
+		}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(obj.Payload)
+	if err != nil {
+		warn("Payload base64url inválido")
+		return
+	}
+	sum := sha256.Sum256(data)
+	out["payload_sha256"] = hex.EncodeToString(sum[:])
+	var claims interface{}
+	if err := firmajson.DecodeJSON(data, &claims); err != nil {
+		warn("El payload del JWS no es JSON válido")
+	} else {
+		introspectClaims(out, claims, warn)
+	}
+	if sig, err := base64.RawURLEncoding.DecodeString(obj.Signature); err != nil || len(sig) == 0 {
+		warn("Firma base64url ausente o inválida")
+	} else {
+		out["signature_bytes"] = len(sig)
+	}
+}
+
+// introspectCompact rellena out con un sobre compacto CBOR
+func introspectCompact(out map[string]interface{}, raw []byte, warn func(string, ...interface{})) {
+	out["format"] = "compact"
+	env, err := compact.Unmarshal(raw)
+	if err != nil {
+		warn("%s", err.Error())
+		return
+	}
+	out["version"] = env.Version
+	out["kid"] = hex.EncodeToString(env.KeyID)
+	if kv, known := keyVersionForKID(env.KeyID); known {
+		out["key_id"], out["known_key"] = kv, true
+	} else {
+		out["known_key"] = false
+		warn("kid no corresponde a ninguna versión de clave aceptada")
+	}
+	out["timestamp"] = time.Unix(int64(env.Timestamp), 0)
+	out["payload_sha256"] = hex.EncodeToString(env.Hash)
+	out["signature_bytes"] = len(env.Signature)
+}
+
+// introspectClaims añade los claims y separa los que inyecta la firma
+func introspectClaims(out map[string]interface{}, obj interface{}, warn func(string, ...interface{})) {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		warn("El payload no es un objeto JSON")
+		return
+	}
+	out["claims"] = m
+	injected := []string{}
+	for _, k := range []string{"timestamp", "nonce", timeSourceClaim, "signed_in", confirmationClaim, "encrypted_fields"} {
+		if _, present := m[k]; present {
+			injected = append(injected, k)
+		}
+	}
+	sort.Strings(injected)
+	out["injected_claims"] = injected
+	if _, present := m["timestamp"]; !present {
+		warn("El payload no lleva timestamp")
+	} else if ts := payloadTimestamp(m); ts.IsZero() {
+		warn("timestamp no es RFC 3339")
+	} else {
+		out["timestamp"] = ts
+	}
+}
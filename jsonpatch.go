@@ -0,0 +1,254 @@
+// jsonpatch.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// JSON Patch (RFC 6902) sobre documentos ya decodificados con
+// firmajson.DecodeJSON. Los valores del parche se decodifican igual, así
+// que los números conservan su representación y el documento parcheado
+// tiene la misma forma canónica que si el cliente lo hubiera enviado
+// entero.
+
+// errPatchNotApplicable indica una operación que no se puede aplicar al
+// documento
+var errPatchNotApplicable = errors.New("JSON Patch no aplicable")
+
+// patchOp es una operación de JSON Patch
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchOps son las operaciones válidas y si llevan value o from
+var patchOps = map[string]struct{ value, from bool }{
+	"add":     {value: true},
+	"remove":  {},
+	"replace": {value: true},
+	"move":    {from: true},
+	"copy":    {from: true},
+	"test":    {value: true},
+}
+
+// validatePatch comprueba la forma de cada operación, sin aplicarla
+func validatePatch(ops []patchOp) []validationProblem {
+	var problems []validationProblem
+	for i, op := range ops {
+		field := fmt.Sprintf("patch[%d]", i)
+		want, ok := patchOps[op.Op]
+		if !ok {
+			problems = append(problems, validationProblem{field + ".op", errInvalidRequest, fmt.Sprintf("op desconocida: %q", op.Op)})
+			continue
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			problems = append(problems, validationProblem{field + ".path", errInvalidRequest, err.Error()})
+		}
+		if want.value && len(op.Value) == 0 {
+			problems = append(problems, validationProblem{field + ".value", errInvalidRequest, op.Op + " requiere value"})
+		}
+		if want.from {
+			if _, err := parsePointer(op.From); err != nil || op.From == "" && op.Op == "move" {
+				problems = append(problems, validationProblem{field + ".from", errInvalidRequest, op.Op + " requiere un from válido"})
+			}
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			problems = append(problems, validationProblem{field + ".from", errInvalidRequest, "move no puede mover un valor dentro de sí mismo"})
+		}
+	}
+	return problems
+}
+
+// applyPatch aplica ops en orden sobre doc y devuelve el resultado. doc se
+// modifica; si una operación falla el documento queda a medias y hay que
+// descartarlo.
+func applyPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, fmt.Errorf("%w: operación %d (%s %s): %v", errPatchNotApplicable, i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOp(doc interface{}, op patchOp) (interface{}, error) {
+	var value interface{}
+	if len(op.Value) > 0 {
+		if err := firmajson.DecodeJSON(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("value inválido: %v", err)
+		}
+	}
+	switch op.Op {
+	case "add":
+		return patchAdd(doc, op.Path, value)
+	case "remove":
+		doc, _, err := patchRemove(doc, op.Path)
+		return doc, err
+	case "replace":
+		if _, err := pointerGet(doc, op.Path); err != nil {
+			return nil, err
+		}
+		if op.Path == "" {
+			return value, nil
+		}
+		return doc, pointerSet(doc, op.Path, value)
+	case "move":
+		if op.From == op.Path {
+			return doc, nil
+		}
+		doc, moved, err := patchRemove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, op.Path, moved)
+	case "copy":
+		v, err := pointerGet(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = deepCopyJSON(v); err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, op.Path, v)
+	case "test":
+		v, err := pointerGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		equal, err := jsonEqual(v, value)
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			return nil, fmt.Errorf("el valor de %q no es el esperado", op.Path)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("op desconocida: %q", op.Op)
+}
+
+// patchParent recorre doc hasta el padre de ptr y aplica fn al padre y al
+// último token. fn devuelve el padre nuevo (un array puede cambiar de
+// longitud), que se vuelve a colgar de su propio padre.
+func patchParent(node interface{}, tokens []string, ptr string, fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+	child, err := pointerStep(node, tokens[0], ptr)
+	if err != nil {
+		return nil, err
+	}
+	if child, err = patchParent(child, tokens[1:], ptr, fn); err != nil {
+		return nil, err
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		n[tokens[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(tokens[0])
+		n[i] = child
+	}
+	return node, nil
+}
+
+// patchAdd añade value en ptr: crea o sustituye un miembro, o inserta en
+// un array ("-" es el final)
+func patchAdd(doc interface{}, ptr string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return patchParent(doc, tokens, ptr, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[last] = value
+			return p, nil
+		case []interface{}:
+			i := len(p)
+			if last != "-" {
+				// a diferencia de los demás, add admite el índice len(p)
+				n, err := strconv.Atoi(last)
+				if err != nil || n < 0 || n > len(p) || (len(last) > 1 && last[0] == '0') {
+					return nil, fmt.Errorf("%w: índice %q fuera de rango en %q", errInvalidPointer, last, ptr)
+				}
+				i = n
+			}
+			out := make([]interface{}, 0, len(p)+1)
+			out = append(append(append(out, p[:i]...), value), p[i:]...)
+			return out, nil
+		}
+		return nil, fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+	})
+}
+
+// patchRemove quita el valor de ptr y lo devuelve
+func patchRemove(doc interface{}, ptr string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("%w: no se puede quitar el documento raíz", errInvalidPointer)
+	}
+	var removed interface{}
+	doc, err = patchParent(doc, tokens, ptr, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[last]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+			}
+			removed = v
+			delete(p, last)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(p, last, ptr)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(append([]interface{}{}, p[:i]...), p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+	})
+	return doc, removed, err
+}
+
+// deepCopyJSON copia un valor decodificado
+func deepCopyJSON(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = firmajson.DecodeJSON(raw, &out)
+	return out, err
+}
+
+// jsonEqual compara dos valores por su forma canónica, como pide "test"
+// (el orden de los miembros no cuenta; 1.0 y 1 no son iguales, como en la
+// firma)
+func jsonEqual(a, b interface{}) (bool, error) {
+	ca, err := canonicalJSONEscaped(a, escapeHTML)
+	if err != nil {
+		return false, err
+	}
+	cb, err := canonicalJSONEscaped(b, escapeHTML)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ca, cb), nil
+}
@@ -0,0 +1,112 @@
+// jsonpointer.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errInvalidPointer indica un JSON Pointer mal formado o que no existe en el
+// documento
+var errInvalidPointer = errors.New("JSON Pointer inválido")
+
+// parsePointer divide un JSON Pointer (RFC 6901) en sus tokens ya
+// des-escapados
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("%w: %q debe empezar por /", errInvalidPointer, ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// pointerToken escapa un nombre de campo para usarlo en un JSON Pointer
+func pointerToken(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// pointerGet devuelve el valor al que apunta ptr dentro de doc
+func pointerGet(doc interface{}, ptr string) (interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	cur := doc
+	for _, t := range tokens {
+		cur, err = pointerStep(cur, t, ptr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cur, nil
+}
+
+// pointerSet sustituye el valor al que apunta ptr, que debe existir ya
+func pointerSet(doc interface{}, ptr string, value interface{}) error {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("%w: no se puede sustituir el documento raíz", errInvalidPointer)
+	}
+	parent := doc
+	for _, t := range tokens[:len(tokens)-1] {
+		parent, err = pointerStep(parent, t, ptr)
+		if err != nil {
+			return err
+		}
+	}
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[last]; !ok {
+			return fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+		}
+		p[last] = value
+	case []interface{}:
+		i, err := arrayIndex(p, last, ptr)
+		if err != nil {
+			return err
+		}
+		p[i] = value
+	default:
+		return fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+	}
+	return nil
+}
+
+func pointerStep(cur interface{}, token, ptr string) (interface{}, error) {
+	switch c := cur.(type) {
+	case map[string]interface{}:
+		v, ok := c[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+		}
+		return v, nil
+	case []interface{}:
+		i, err := arrayIndex(c, token, ptr)
+		if err != nil {
+			return nil, err
+		}
+		return c[i], nil
+	default:
+		return nil, fmt.Errorf("%w: %q no existe", errInvalidPointer, ptr)
+	}
+}
+
+func arrayIndex(arr []interface{}, token, ptr string) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= len(arr) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: índice %q fuera de rango en %q", errInvalidPointer, token, ptr)
+	}
+	return i, nil
+}
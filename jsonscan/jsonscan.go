@@ -0,0 +1,404 @@
+// Package jsonscan comprueba la estructura de un documento JSON a medida que
+// se lee, sin construir el árbol de interface{}: que está bien formado, que
+// no anida más de lo permitido y que no pasa de un tamaño. La memoria que
+// usa no depende del documento (sólo de la profundidad máxima), así que un
+// documento enorme o malicioso se rechaza en cuanto se detecta, antes de
+// leerlo entero y de decodificarlo.
+//
+//	s := jsonscan.New(jsonscan.Limits{MaxBytes: 1 << 20, MaxDepth: 64})
+//	_, err := io.Copy(&buf, io.TeeReader(body, s)) // se corta en el primer error
+//	if err == nil {
+//		err = s.Close()
+//	}
+//
+// No comprueba que los strings sean UTF-8 válido ni que las claves de un
+// objeto no se repitan: eso lo resuelve (o lo tolera) quien decodifique
+// después.
+package jsonscan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Clases de error; *Error las envuelve con la posición
+var (
+	ErrSyntax   = errors.New("JSON mal formado")
+	ErrTooDeep  = errors.New("anidamiento excesivo")
+	ErrTooLarge = errors.New("documento demasiado grande")
+)
+
+// Limits son los límites del documento; 0 = sin límite
+type Limits struct {
+	// MaxBytes es el tamaño máximo del documento en bytes
+	MaxBytes int64
+	// MaxDepth es el máximo de objetos y arrays anidados
+	MaxDepth int
+	// MaxStringBytes es la longitud máxima de un string o clave, en bytes
+	// del documento (con los escapes sin resolver)
+	MaxStringBytes int
+}
+
+// Error describe el primer problema encontrado
+type Error struct {
+	Offset int64 // byte del documento en el que se detectó
+	Err    error // ErrSyntax, ErrTooDeep o ErrTooLarge
+	Detail string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v en el byte %d: %s", e.Err, e.Offset, e.Detail)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Estados del autómata
+const (
+	stValue        = iota // se espera un valor
+	stValueOrClose        // primer elemento de un array o ']'
+	stKeyOrClose          // primera clave de un objeto o '}'
+	stKey                 // se espera una clave
+	stColon               // se espera ':'
+	stAfter               // tras un valor: ',' o cierre, o fin
+	stString              // dentro de un string
+	stEscape              // tras '\'
+	stUnicode             // dentro de \uXXXX
+	stNeg                 // tras '-'
+	stZero                // tras un 0 inicial
+	stInt                 // dígitos de la parte entera
+	stDot                 // tras '.'
+	stFrac                // dígitos de la parte decimal
+	stExp                 // tras 'e'
+	stExpSign             // tras el signo del exponente
+	stExpDigits           // dígitos del exponente
+	stLiteral             // dentro de true, false o null
+	stEnd                 // valor raíz completo: sólo espacios
+)
+
+// Scanner valida un documento que se le entrega por trozos con Write. Es un
+// io.Writer para poder ponerlo detrás de un io.TeeReader.
+type Scanner struct {
+	lim     Limits
+	off     int64
+	state   int
+	stack   []byte // '{' o '[' de cada nivel abierto
+	isKey   bool   // el string en curso es una clave
+	strLen  int
+	hexLeft int
+	literal string
+	litPos  int
+	err     error
+}
+
+// New devuelve un Scanner con los límites dados
+func New(lim Limits) *Scanner {
+	depth := lim.MaxDepth
+	if depth <= 0 || depth > 64 {
+		depth = 64
+	}
+	return &Scanner{lim: lim, state: stValue, stack: make([]byte, 0, depth)}
+}
+
+// Check lee r entero con un búfer fijo y devuelve el primer problema
+func Check(r io.Reader, lim Limits) error {
+	s := New(lim)
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := s.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return s.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write procesa p. Devuelve el primer error encontrado y, a partir de ahí,
+// el mismo error en cada llamada.
+func (s *Scanner) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for i, c := range p {
+		if s.lim.MaxBytes > 0 && s.off >= s.lim.MaxBytes {
+			s.fail(ErrTooLarge, fmt.Sprintf("el máximo es %d bytes", s.lim.MaxBytes))
+			return i, s.err
+		}
+		if !s.step(c) {
+			return i, s.err
+		}
+		s.off++
+	}
+	return len(p), nil
+}
+
+// Close indica el fin del documento: falla si el valor raíz está incompleto
+func (s *Scanner) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	switch s.state {
+	case stEnd:
+		return nil
+	case stAfter, stZero, stInt, stFrac, stExpDigits:
+		if len(s.stack) == 0 {
+			return nil
+		}
+	}
+	if s.off == 0 {
+		s.fail(ErrSyntax, "documento vacío")
+	} else {
+		s.fail(ErrSyntax, "fin inesperado del documento")
+	}
+	return s.err
+}
+
+func (s *Scanner) fail(kind error, detail string) bool {
+	s.err = &Error{Offset: s.off, Err: kind, Detail: detail}
+	return false
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// step consume un byte; false si el documento ya no es válido
+func (s *Scanner) step(c byte) bool {
+	switch s.state {
+	case stValue:
+		return s.beginValue(c)
+	case stValueOrClose:
+		if isSpace(c) {
+			return true
+		}
+		if c == ']' {
+			return s.pop()
+		}
+		return s.beginValue(c)
+	case stKeyOrClose, stKey:
+		if isSpace(c) {
+			return true
+		}
+		if c == '}' && s.state == stKeyOrClose {
+			return s.pop()
+		}
+		if c != '"' {
+			return s.fail(ErrSyntax, fmt.Sprintf("se esperaba una clave y hay %q", c))
+		}
+		s.state, s.isKey, s.strLen = stString, true, 0
+		return true
+	case stColon:
+		if isSpace(c) {
+			return true
+		}
+		if c != ':' {
+			return s.fail(ErrSyntax, fmt.Sprintf("se esperaba ':' y hay %q", c))
+		}
+		s.state = stValue
+		return true
+	case stAfter:
+		return s.afterValue(c)
+	case stString:
+		return s.inString(c)
+	case stEscape:
+		switch c {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			s.state = stString
+		case 'u':
+			s.state, s.hexLeft = stUnicode, 4
+		default:
+			return s.fail(ErrSyntax, fmt.Sprintf("escape inválido \\%c", c))
+		}
+		return s.countString()
+	case stUnicode:
+		if !isHex(c) {
+			return s.fail(ErrSyntax, "escape \\u sin cuatro dígitos hexadecimales")
+		}
+		if s.hexLeft--; s.hexLeft == 0 {
+			s.state = stString
+		}
+		return s.countString()
+	case stNeg:
+		switch {
+		case c == '0':
+			s.state = stZero
+		case isDigit(c):
+			s.state = stInt
+		default:
+			return s.fail(ErrSyntax, "se esperaba un dígito tras '-'")
+		}
+		return true
+	case stZero, stInt:
+		switch {
+		case isDigit(c) && s.state == stInt:
+			return true
+		case isDigit(c):
+			return s.fail(ErrSyntax, "número con ceros a la izquierda")
+		case c == '.':
+			s.state = stDot
+			return true
+		case c == 'e' || c == 'E':
+			s.state = stExp
+			return true
+		}
+		return s.afterValue(c)
+	case stDot:
+		if !isDigit(c) {
+			return s.fail(ErrSyntax, "se esperaba un dígito tras '.'")
+		}
+		s.state = stFrac
+		return true
+	case stFrac:
+		switch {
+		case isDigit(c):
+			return true
+		case c == 'e' || c == 'E':
+			s.state = stExp
+			return true
+		}
+		return s.afterValue(c)
+	case stExp:
+		switch {
+		case c == '+' || c == '-':
+			s.state = stExpSign
+		case isDigit(c):
+			s.state = stExpDigits
+		default:
+			return s.fail(ErrSyntax, "exponente sin dígitos")
+		}
+		return true
+	case stExpSign:
+		if !isDigit(c) {
+			return s.fail(ErrSyntax, "exponente sin dígitos")
+		}
+		s.state = stExpDigits
+		return true
+	case stExpDigits:
+		if isDigit(c) {
+			return true
+		}
+		return s.afterValue(c)
+	case stLiteral:
+		if c != s.literal[s.litPos] {
+			return s.fail(ErrSyntax, fmt.Sprintf("literal inválido, se esperaba %q", s.literal))
+		}
+		if s.litPos++; s.litPos == len(s.literal) {
+			s.state = stAfter
+		}
+		return true
+	case stEnd:
+		if !isSpace(c) {
+			return s.fail(ErrSyntax, fmt.Sprintf("contenido tras el documento: %q", c))
+		}
+		return true
+	}
+	return s.fail(ErrSyntax, "estado desconocido")
+}
+
+// beginValue empieza un valor con el byte c
+func (s *Scanner) beginValue(c byte) bool {
+	switch {
+	case isSpace(c):
+		return true
+	case c == '{' || c == '[':
+		if s.lim.MaxDepth > 0 && len(s.stack) >= s.lim.MaxDepth {
+			return s.fail(ErrTooDeep, fmt.Sprintf("el máximo es %d niveles", s.lim.MaxDepth))
+		}
+		s.stack = append(s.stack, c)
+		if c == '{' {
+			s.state = stKeyOrClose
+		} else {
+			s.state = stValueOrClose
+		}
+	case c == '"':
+		s.state, s.isKey, s.strLen = stString, false, 0
+	case c == '-':
+		s.state = stNeg
+	case c == '0':
+		s.state = stZero
+	case isDigit(c):
+		s.state = stInt
+	case c == 't':
+		s.state, s.literal, s.litPos = stLiteral, "true", 1
+	case c == 'f':
+		s.state, s.literal, s.litPos = stLiteral, "false", 1
+	case c == 'n':
+		s.state, s.literal, s.litPos = stLiteral, "null", 1
+	default:
+		return s.fail(ErrSyntax, fmt.Sprintf("se esperaba un valor y hay %q", c))
+	}
+	return true
+}
+
+// afterValue trata el byte que sigue a un valor completo
+func (s *Scanner) afterValue(c byte) bool {
+	if isSpace(c) {
+		s.state = stAfter
+		return true
+	}
+	if len(s.stack) == 0 {
+		s.state = stEnd
+		return s.step(c)
+	}
+	top := s.stack[len(s.stack)-1]
+	switch {
+	case c == ',' && top == '{':
+		s.state = stKey
+	case c == ',':
+		s.state = stValue
+	case (c == '}' && top == '{') || (c == ']' && top == '['):
+		return s.pop()
+	default:
+		return s.fail(ErrSyntax, fmt.Sprintf("se esperaba ',' o cierre y hay %q", c))
+	}
+	return true
+}
+
+// pop cierra el objeto o array en curso
+func (s *Scanner) pop() bool {
+	s.stack = s.stack[:len(s.stack)-1]
+	s.state = stAfter
+	if len(s.stack) == 0 {
+		s.state = stEnd
+	}
+	return true
+}
+
+// inString trata un byte dentro de un string
+func (s *Scanner) inString(c byte) bool {
+	switch {
+	case c == '"':
+		if s.isKey {
+			s.state = stColon
+		} else {
+			s.state = stAfter
+			if len(s.stack) == 0 {
+				s.state = stEnd
+			}
+		}
+		return true
+	case c == '\\':
+		s.state = stEscape
+	case c < 0x20:
+		return s.fail(ErrSyntax, "carácter de control sin escapar en un string")
+	}
+	return s.countString()
+}
+
+func (s *Scanner) countString() bool {
+	if s.strLen++; s.lim.MaxStringBytes > 0 && s.strLen > s.lim.MaxStringBytes {
+		return s.fail(ErrTooLarge, fmt.Sprintf("string de más de %d bytes", s.lim.MaxStringBytes))
+	}
+	return true
+}
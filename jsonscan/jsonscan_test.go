@@ -0,0 +1,98 @@
+// jsonscan_test.go
+package jsonscan
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// scanChunks pasa doc al Scanner en trozos de size bytes
+func scanChunks(doc string, size int, lim Limits) error {
+	s := New(lim)
+	for len(doc) > 0 {
+		n := size
+		if n > len(doc) {
+			n = len(doc)
+		}
+		if _, err := s.Write([]byte(doc[:n])); err != nil {
+			return err
+		}
+		doc = doc[n:]
+	}
+	return s.Close()
+}
+
+// Sin límites, el Scanner acepta exactamente lo que acepta encoding/json,
+// se le entregue el documento de golpe o byte a byte
+func TestScannerSyntax(t *testing.T) {
+	docs := []string{
+		`{}`, `[]`, `0`, `-0`, `1.5e+10`, `-12E-3`, `"a"`, `true`, `false`, `null`,
+		` {"a" : [1, 2.0, {"b": null}], "c": "é\n\"\\\/"} `,
+		`[[[[]]]]`, `{"a":{"b":{"c":[true,false]}}}`, "\t\r\n[1]\n",
+		// Inválidos
+		``, ` `, `{`, `}`, `[1,]`, `{"a":1,}`, `{"a" 1}`, `{a:1}`, `[1 2]`,
+		`01`, `-`, `1.`, `.5`, `1e`, `1e+`, `+1`, `0x10`, `tru`, `nul`, `True`,
+		`"abc`, `"\x"`, `"\u12g4"`, "\"a\tb\"", `{"a":1}{}`, `[1]]`, `{]`, `[}`,
+		`"a" "b"`, `1 2`, `{"a":[}`,
+	}
+	for _, doc := range docs {
+		want := json.Valid([]byte(doc))
+		for _, size := range []int{1, 3, 4096} {
+			err := scanChunks(doc, size, Limits{})
+			if (err == nil) != want {
+				t.Errorf("%q (trozos de %d): err=%v, json.Valid=%v", doc, size, err, want)
+			}
+			if err != nil && !errors.Is(err, ErrSyntax) {
+				t.Errorf("%q: %v no es ErrSyntax", doc, err)
+			}
+		}
+	}
+}
+
+func TestScannerLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		lim  Limits
+		want error
+	}{
+		{"profundidad justa", `[[{"a":[]}]]`, Limits{MaxDepth: 4}, nil},
+		{"demasiado profundo", `[[{"a":[[]]}]]`, Limits{MaxDepth: 4}, ErrTooDeep},
+		{"tamaño justo", `{"a":1}`, Limits{MaxBytes: 7}, nil},
+		{"demasiado grande", `{"a":12}`, Limits{MaxBytes: 7}, ErrTooLarge},
+		{"string justo", `{"abc":"\n"}`, Limits{MaxStringBytes: 3}, nil},
+		{"string largo", `["abcd"]`, Limits{MaxStringBytes: 3}, ErrTooLarge},
+		{"clave larga", `{"abcd":1}`, Limits{MaxStringBytes: 3}, ErrTooLarge},
+		{"escape sin resolver", `["\u00e9"]`, Limits{MaxStringBytes: 5}, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := scanChunks(tt.doc, 2, tt.lim)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, se esperaba %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// El error lleva el byte en el que se detectó y se repite en las
+// escrituras siguientes
+func TestScannerErrorOffset(t *testing.T) {
+	s := New(Limits{})
+	n, err := s.Write([]byte(`{"a":1,]`))
+	var e *Error
+	if !errors.As(err, &e) || e.Offset != 7 || n != 7 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if _, again := s.Write([]byte(`}`)); again != err {
+		t.Fatalf("el error debe repetirse: %v", again)
+	}
+
+	// Check corta sin leer el resto del documento
+	err = Check(strings.NewReader(strings.Repeat("[", 100)), Limits{MaxDepth: 10})
+	if !errors.As(err, &e) || e.Offset != 10 || !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("Check: %v", err)
+	}
+}
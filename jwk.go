@@ -0,0 +1,62 @@
+// jwk.go
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// jwk es una clave pública en formato JSON Web Key (RFC 7517). Sólo se usan
+// los campos necesarios para verificar firmas.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// jwkSet es un documento JWKS
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKey convierte la JWK en una clave de crypto/*; es la misma
+// conversión que usa la verificación offline de la librería
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	return firmajson.JWK(k).PublicKey()
+}
+
+// publicJWK exporta la clave pública de una versión asimétrica como JWK;
+// el kid es el nombre de la versión, el mismo que "key_version" en los
+// sobres
+func publicJWK(k *firmajson.Key) (jwk, error) {
+	out := jwk{Kid: k.Name, Alg: k.Alg, Use: "sig"}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.Public.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		out.Kty, out.Crv = "EC", pub.Curve.Params().Name
+		out.X, out.Y = b64(pub.X.FillBytes(make([]byte, size))), b64(pub.Y.FillBytes(make([]byte, size)))
+	case *rsa.PublicKey:
+		out.Kty = "RSA"
+		out.N = b64(pub.N.Bytes())
+		out.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64(pub)
+	default:
+		return out, fmt.Errorf("tipo de clave pública no soportado: %T", k.Public)
+	}
+	return out, nil
+}
@@ -0,0 +1,330 @@
+// jws.go
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Además del sobre propio, /sign puede devolver la firma como JWS (RFC 7515)
+// para interoperar con librerías JOSE:
+//
+//	?format=jws       o Accept: application/jose       serialización compacta
+//	?format=jws-json  o Accept: application/jose+json  JSON aplanada
+//
+// El payload del JWS son los bytes canónicos del documento (con el mismo
+// timestamp y campos inyectados que el sobre) y la cabecera protegida lleva
+// "alg" y "kid" (la versión de la clave, la misma que "key_version"). Con
+// claves HMAC el alg es HS256/384/512 y sólo lo puede verificar este
+// servicio; con claves asimétricas cualquiera puede hacerlo con la clave de
+// /.well-known/jwks.json.
+//
+// /verify acepta ambas formas: {"jws": "a.b.c"}, {"protected", "payload",
+// "signature"} o el JWS compacto en crudo con Content-Type
+// application/jose.
+
+const (
+	formatJWS     = "jws"
+	formatJWSJSON = "jws-json"
+)
+
+// errJWSAlgorithm indica que la clave de firma no tiene equivalente JWS
+var errJWSAlgorithm = errors.New("el algoritmo de la clave no tiene equivalente JWS")
+
+// jwsHeader es la cabecera protegida
+type jwsHeader struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid,omitempty"`
+	Iss  string   `json:"iss,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+	// Pistas de terceros para elegir la clave (ver keyhints.go)
+	X5t     string   `json:"x5t,omitempty"`
+	X5tS256 string   `json:"x5t#S256,omitempty"`
+	X5c     []string `json:"x5c,omitempty"`
+}
+
+// jwsObject son las tres partes de un JWS, ya en base64url
+type jwsObject struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func (o *jwsObject) compact() string {
+	return o.Protected + "." + o.Payload + "." + o.Signature
+}
+
+func (o *jwsObject) signingInput() []byte {
+	return []byte(o.Protected + "." + o.Payload)
+}
+
+// requestSignFormat devuelve el formato de salida pedido a /sign: "" para
+// el sobre de siempre, formatJWS o formatJWSJSON
+func requestSignFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "envelope":
+	case formatJWS, formatJWSJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("format debe ser envelope, jws o jws-json")
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		switch mt {
+		case "application/jose":
+			return formatJWS, nil
+		case "application/jose+json":
+			return formatJWSJSON, nil
+		}
+	}
+	return "", nil
+}
+
+// isCompactJWSBody indica si el body de /verify es un JWS compacto en crudo
+func isCompactJWSBody(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/jose"
+}
+
+// jwsAlgForKey devuelve el alg JWS de una clave de KMS
+func jwsAlgForKey(k *firmajson.Key) string {
+	if k.Asymmetric() {
+		return k.Alg
+	}
+	switch k.KMSAlgorithm {
+	case "HMAC_SHA256":
+		return "HS256"
+	case "HMAC_SHA384":
+		return "HS384"
+	case "HMAC_SHA512":
+		return "HS512"
+	}
+	return ""
+}
+
+// signJWS firma data (los bytes canónicos) como JWS con la clave del alias
+// de ctx; kid es su versión de clave
+func signJWS(ctx context.Context, data []byte) (*jwsObject, error) {
+	s, err := signerFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k, err := s.Key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	alg := jwsAlgForKey(k)
+	if alg == "" {
+		return nil, errJWSAlgorithm
+	}
+	header, err := json.Marshal(jwsHeader{Alg: alg, Kid: k.Name})
+	if err != nil {
+		return nil, err
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	obj := &jwsObject{Protected: b64(header), Payload: b64(data)}
+	sig, err := kmsSignRaw(ctx, obj.signingInput())
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(alg, "ES") {
+		// KMS devuelve ECDSA en DER y JWS exige r||s de tamaño fijo
+		if sig, err = ecdsaDERToJOSE(sig, alg); err != nil {
+			return nil, err
+		}
+	}
+	obj.Signature = b64(sig)
+	return obj, nil
+}
+
+// ecdsaDERToJOSE convierte una firma ECDSA ASN.1 a la concatenación r||s
+func ecdsaDERToJOSE(der []byte, alg string) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &rs); err != nil || len(rest) > 0 {
+		return nil, errors.New("firma ECDSA DER inválida")
+	}
+	size := 32
+	if alg == "ES384" {
+		size = 48
+	}
+	out := make([]byte, 2*size)
+	rs.R.FillBytes(out[:size])
+	rs.S.FillBytes(out[size:])
+	return out, nil
+}
+
+// writeJWS responde con el JWS en el formato pedido
+func writeJWS(w http.ResponseWriter, format string, obj *jwsObject) {
+	if format == formatJWSJSON {
+		w.Header().Set("Content-Type", "application/jose+json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(obj)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jose")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(obj.compact()))
+}
+
+// parseJWS obtiene las partes del JWS de una petición de /verify
+func parseJWS(req *verifyRequest) (*jwsObject, error) {
+	if req.JWS != "" {
+		parts := strings.Split(req.JWS, ".")
+		if len(parts) != 3 {
+			return nil, errors.New("el JWS compacto debe tener tres partes")
+		}
+		return &jwsObject{Protected: parts[0], Payload: parts[1], Signature: parts[2]}, nil
+	}
+	var payload string
+	if err := json.Unmarshal(req.Payload, &payload); err != nil {
+		return nil, errors.New("en un JWS JSON el payload debe ser un string base64url")
+	}
+	return &jwsObject{Protected: req.Protected, Payload: payload, Signature: req.Signature}, nil
+}
+
+// verifyJWS verifica un JWS: con nuestra clave si el kid es el de la clave
+// de firma (o no viene), o como un sobre externo si el kid o el iss son de
+// otro emisor. Los errores son *verifyFailure.
+func verifyJWS(ctx context.Context, req *verifyRequest) (verifyResult, error) {
+	res := verifyResult{Key: defaultKeyAlias}
+	obj, err := parseJWS(req)
+	if err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, err.Error()}
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(obj.Protected)
+	var header jwsHeader
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil || header.Alg == "" {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, "Cabecera protegida del JWS inválida"}
+	}
+	if len(header.Crit) > 0 {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, "Cabeceras crit no soportadas"}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(obj.Payload)
+	if err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidPayload, "Payload base64url inválido"}
+	}
+	if err := firmajson.DecodeJSON(data, &res.Obj); err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidPayload, "El payload del JWS no es JSON válido"}
+	}
+	res.Data = data
+	sig, err := base64.RawURLEncoding.DecodeString(obj.Signature)
+	if err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidSigEncoding, "Firma base64url inválida"}
+	}
+
+	// Claves del almacén de confianza señaladas por kid, x5t o x5c
+	if !acceptedKeyVersion(header.Kid) && !strings.HasPrefix(header.Kid, "did:") {
+		tk, hint, found, err := trustedKeyFromHints(ctx, header)
+		if err != nil {
+			return res, &verifyFailure{http.StatusBadGateway, errIssuerKeyFailed, fmt.Sprintf("Error buscando la clave: %v", err)}
+		}
+		if found {
+			req.Iss = header.Iss
+			res.External, res.Key, res.KeyHint = true, tk.ID, hint
+			res.Valid, res.Reason, err = verifyTrustedKey(tk, header.Iss, header.Alg, obj.signingInput(), sig)
+			if err != nil {
+				return res, &verifyFailure{http.StatusBadGateway, errIssuerKeyFailed, fmt.Sprintf("Error verificando: %v", err)}
+			}
+			return res, nil
+		}
+	}
+
+	res.External = header.Iss != "" && header.Iss != issuerID() || strings.HasPrefix(header.Kid, "did:")
+	if res.External {
+		req.Iss = header.Iss
+		res.Key = header.Kid
+		res.Valid, res.Reason, err = verifyFederated(ctx, header.Iss, header.Kid, header.Alg, res.Obj, obj.signingInput(), obj.Signature)
+		if err != nil {
+			return res, &verifyFailure{http.StatusBadGateway, errIssuerKeyFailed, fmt.Sprintf("Error verificando: %v", err)}
+		}
+		return res, nil
+	}
+
+	if header.Kid != "" && !acceptedKeyVersion(header.Kid) {
+		res.Reason = fmt.Sprintf("kid %s no es una versión de firma aceptada", header.Kid)
+		return res, nil
+	}
+	kid := header.Kid
+	if kid == "" {
+		kid = nameVersion
+	}
+	s, err := signerForKeyVersion(kid)
+	if err != nil {
+		return res, kmsVerifyFailure(err)
+	}
+	k, err := s.Key(ctx)
+	if err != nil {
+		return res, kmsVerifyFailure(err)
+	}
+	if alg := jwsAlgForKey(k); header.Alg != alg {
+		res.Reason = fmt.Sprintf("alg %s no coincide con el de la clave (%s)", header.Alg, alg)
+		return res, nil
+	}
+	if keyPurged(ctx, res.Key, time.Now()) {
+		res.Reason = "La clave se borró y ya no verifica"
+		return res, nil
+	}
+	v, err := s.Verify(ctx, obj.signingInput(), sig)
+	if err == nil && v.IntegrityAnomaly != "" {
+		log.Printf("🚨 MacVerify con integridad incoherente (%s): %s", kid, v.IntegrityAnomaly)
+	}
+	if err != nil {
+		return res, kmsVerifyFailure(err)
+	}
+	res.Valid, res.Verification = v.Valid, &v
+	if v.IntegrityAnomaly != "" {
+		res.Reason = "La respuesta de KMS no superó la comprobación de integridad"
+	}
+	return res, nil
+}
+
+// validateJWSRequest comprueba la forma de un JWS enviado a /verify, en
+// crudo (compact) o como objeto JSON (fields)
+func validateJWSRequest(compact string, fields map[string]json.RawMessage) []validationProblem {
+	var problems []validationProblem
+	if fields != nil {
+		for name := range fields {
+			switch name {
+			case "jws", "protected", "payload", "signature":
+			default:
+				problems = append(problems, validationProblem{name, errInvalidRequest, fmt.Sprintf("Campo desconocido %q en un JWS", name)})
+			}
+		}
+		if raw, ok := fields["jws"]; ok {
+			if json.Unmarshal(raw, &compact) != nil {
+				return append(problems, validationProblem{"jws", errInvalidRequest, "jws debe ser un string"})
+			}
+			if len(fields) > 1 {
+				problems = append(problems, validationProblem{"jws", errInvalidRequest, "jws no se combina con otros campos"})
+			}
+		} else {
+			for _, name := range []string{"protected", "payload", "signature"} {
+				var s string
+				if json.Unmarshal(fields[name], &s) != nil || s == "" {
+					problems = append(problems, validationProblem{name, errInvalidRequest, fmt.Sprintf("%s debe ser un string base64url no vacío", name)})
+				}
+			}
+			return problems
+		}
+	}
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return append(problems, validationProblem{"jws", errInvalidRequest, "El JWS compacto debe tener tres partes separadas por puntos"})
+	}
+	if len(parts[1]) > base64.RawURLEncoding.EncodedLen(maxPayloadBytes()) {
+		problems = append(problems, validationProblem{"jws", errPayloadTooLarge, fmt.Sprintf("El payload supera el máximo de %d bytes", maxPayloadBytes())})
+	}
+	return problems
+}
@@ -0,0 +1,104 @@
+// keyhints.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Los JWS de terceros suelen identificar su clave en la cabecera protegida
+// en vez de con un kid pactado de antemano. Al verificarlos se prueban, en
+// este orden, las pistas que traiga:
+//
+//	kid       id de una clave del almacén de confianza
+//	x5t#S256  SHA-256 del certificado (base64url)
+//	x5t       SHA-1 del certificado (base64url)
+//	x5c       cadena de certificados; vale si el primero es un certificado
+//	          del almacén o tiene la clave pública de una clave del almacén
+//
+// Las pistas sólo eligen la clave: el certificado de x5c no da confianza
+// por sí mismo. La respuesta de /verify dice qué pista se usó.
+
+// trustedKeyFromHints busca en el almacén de confianza la clave a la que
+// apuntan las pistas de la cabecera. Devuelve también el nombre de la pista.
+func trustedKeyFromHints(ctx context.Context, h jwsHeader) (trustedKey, string, bool, error) {
+	if h.Kid != "" {
+		k, found, err := lookupTrustedKey(ctx, h.Kid)
+		if err != nil || found {
+			return k, "kid", found, err
+		}
+	}
+	if h.X5tS256 == "" && h.X5t == "" && len(h.X5c) == 0 {
+		return trustedKey{}, "", false, nil
+	}
+
+	var leaf *x509.Certificate
+	if len(h.X5c) > 0 {
+		// x5c va en Base64 estándar, no base64url (RFC 7515, 4.1.6)
+		if der, err := base64.StdEncoding.DecodeString(h.X5c[0]); err == nil {
+			leaf, _ = x509.ParseCertificate(der)
+		}
+	}
+
+	records, ids, err := db.List(ctx, trustCollection)
+	if err != nil {
+		return trustedKey{}, "", false, err
+	}
+	var keys []trustedKey
+	for _, id := range ids {
+		var k trustedKey
+		if err := json.Unmarshal(records[id], &k); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	for _, hint := range []string{"x5t#S256", "x5t", "x5c"} {
+		for _, k := range keys {
+			if keyMatchesHint(k, hint, h, leaf) {
+				return k, hint, true, nil
+			}
+		}
+	}
+	return trustedKey{}, "", false, nil
+}
+
+// keyMatchesHint indica si la clave de confianza k es la que indica la pista
+func keyMatchesHint(k trustedKey, hint string, h jwsHeader, leaf *x509.Certificate) bool {
+	var cert *x509.Certificate
+	if k.CertPEM != "" {
+		cert, _ = k.certificate()
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch hint {
+	case "x5t#S256":
+		if h.X5tS256 == "" || cert == nil {
+			return false
+		}
+		sum := sha256.Sum256(cert.Raw)
+		return b64(sum[:]) == h.X5tS256
+	case "x5t":
+		if h.X5t == "" || cert == nil {
+			return false
+		}
+		sum := sha1.Sum(cert.Raw)
+		return b64(sum[:]) == h.X5t
+	case "x5c":
+		if leaf == nil {
+			return false
+		}
+		if cert != nil && cert.Equal(leaf) {
+			return true
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return false
+		}
+		eq, ok := pub.(interface{ Equal(crypto.PublicKey) bool })
+		return ok && eq.Equal(leaf.PublicKey)
+	}
+	return false
+}
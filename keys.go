@@ -0,0 +1,196 @@
+// keys.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// defaultKeyAlias es el alias de la clave configurada con KMS_KEY
+const defaultKeyAlias = "default"
+
+// keyConfig son las políticas asociadas a un alias de clave, cargadas de
+// KEYS_FILE (un objeto JSON alias → keyConfig)
+type keyConfig struct {
+	// Windows restringe la firma a ciertas franjas; vacío = sin restricción
+	Windows []signingWindow `json:"windows,omitempty"`
+	// Region es la región de residencia de la clave (p.ej. "eu")
+	Region string `json:"region,omitempty"`
+	// Priority es "interactive" (por defecto) o "batch"; ver pacer.go
+	Priority string `json:"priority,omitempty"`
+	// KeyVersion es la CryptoKeyVersion propia del alias (el nombre completo
+	// del recurso); vacío = la clave de firma del servicio
+	KeyVersion string `json:"key_version,omitempty"`
+	// DocTypes son los doc_type que se firman con este alias en un
+	// manifiesto cuando el documento no indica la clave
+	DocTypes []string `json:"doc_types,omitempty"`
+}
+
+// signingWindow es una franja en la que se permite firmar. Todas las
+// condiciones indicadas deben cumplirse a la vez.
+type signingWindow struct {
+	Timezone string   `json:"timezone,omitempty"` // IANA, por defecto UTC
+	Days     []string `json:"days,omitempty"`     // "mon".."sun"
+	From     string   `json:"from,omitempty"`     // "HH:MM"
+	To       string   `json:"to,omitempty"`       // "HH:MM", exclusivo
+	// LastBusinessDays limita a los N últimos días laborables (L-V) del mes
+	LastBusinessDays int `json:"last_business_days,omitempty"`
+}
+
+var keyConfigs = map[string]keyConfig{}
+
+// configuredAliases devuelve los alias de KEYS_FILE ordenados
+func configuredAliases() []string {
+	aliases := make([]string, 0, len(keyConfigs))
+	for alias := range keyConfigs {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// loadKeyConfigs lee KEYS_FILE si está definido
+func loadKeyConfigs() error {
+	path := getEnv("KEYS_FILE", "")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &keyConfigs); err != nil {
+		return err
+	}
+	for alias, kc := range keyConfigs {
+		for _, win := range kc.Windows {
+			if _, err := win.location(); err != nil {
+				return fmt.Errorf("%s: %w", alias, err)
+			}
+		}
+		if kc.Priority != "" && kc.Priority != priorityInteractive && kc.Priority != priorityBatch {
+			return fmt.Errorf("%s: priority %q desconocida", alias, kc.Priority)
+		}
+		if kc.KeyVersion != "" && signerBackend != backendGCPKMS {
+			return fmt.Errorf("%s: key_version sólo se admite con SIGNER_BACKEND=gcp-kms", alias)
+		}
+		for _, d := range kc.DocTypes {
+			if other := aliasForDocType(d); other != defaultKeyAlias && other != alias {
+				return fmt.Errorf("%s: el doc_type %q ya es de %s", alias, d, other)
+			}
+		}
+	}
+	return nil
+}
+
+// aliasForDocType devuelve el alias que firma el doc_type, o el alias por
+// defecto si ninguno lo reclama
+func aliasForDocType(docType string) string {
+	for alias, kc := range keyConfigs {
+		if contains(kc.DocTypes, docType) {
+			return alias
+		}
+	}
+	return defaultKeyAlias
+}
+
+// aliasKeyVersion devuelve la versión de clave con la que firma el alias
+func aliasKeyVersion(alias string) string {
+	if kv := keyConfigs[alias].KeyVersion; kv != "" {
+		return kv
+	}
+	return nameVersion
+}
+
+type signingAliasKey struct{}
+
+// signingAlias devuelve el alias con el que se firma en ctx (ver
+// withKeyPriority); por defecto, el del servicio
+func signingAlias(ctx context.Context) string {
+	if alias, ok := ctx.Value(signingAliasKey{}).(string); ok {
+		return alias
+	}
+	return defaultKeyAlias
+}
+
+// signerFor devuelve el backend con el que se firma en ctx: el de la
+// versión de clave del alias
+func signerFor(ctx context.Context) (firmajson.Backend, error) {
+	return signerForKeyVersion(aliasKeyVersion(signingAlias(ctx)))
+}
+
+// signingAllowedAt indica si la política del alias permite firmar en t
+func signingAllowedAt(alias string, t time.Time) bool {
+	kc := keyConfigs[alias]
+	if len(kc.Windows) == 0 {
+		return true
+	}
+	for _, win := range kc.Windows {
+		if win.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (win signingWindow) location() (*time.Location, error) {
+	if win.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(win.Timezone)
+}
+
+func (win signingWindow) contains(t time.Time) bool {
+	loc, err := win.location()
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	if len(win.Days) > 0 {
+		day := strings.ToLower(t.Weekday().String()[:3])
+		if !contains(win.Days, day) {
+			return false
+		}
+	}
+	clock := t.Format("15:04")
+	if win.From != "" && clock < win.From {
+		return false
+	}
+	if win.To != "" && clock >= win.To {
+		return false
+	}
+	if win.LastBusinessDays > 0 && !isLastBusinessDay(t, win.LastBusinessDays) {
+		return false
+	}
+	return true
+}
+
+// isLastBusinessDay comprueba si t cae en uno de los n últimos días de lunes
+// a viernes de su mes
+func isLastBusinessDay(t time.Time, n int) bool {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	remaining := 0
+	for d := t.AddDate(0, 0, 1); d.Month() == t.Month(); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			remaining++
+		}
+	}
+	return remaining < n
+}
+
+// keyPriority devuelve la clase de la clave: interactiva o de lotes
+func keyPriority(alias string) string {
+	if keyConfigs[alias].Priority == priorityBatch {
+		return priorityBatch
+	}
+	return priorityInteractive
+}
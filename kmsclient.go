@@ -0,0 +1,75 @@
+// kmsclient.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// kmsClientOptions configura el canal gRPC con KMS. Con la conexión única
+// por defecto, bajo carga sostenida las peticiones se bloquean unas a otras
+// (head-of-line), así que se puede repartir la carga en un pool
+// (KMS_GRPC_POOL_SIZE), mantener las conexiones vivas con keepalive
+// (KMS_KEEPALIVE_TIME / KMS_KEEPALIVE_TIMEOUT) y limitar las llamadas en
+// vuelo por conexión (KMS_MAX_CONCURRENT_STREAMS).
+//
+// Todas las llamadas tienen además un plazo (kmsdeadline.go), se
+// reintentan si el fallo es pasajero (kmsretry.go), pasan por el pacer de
+// cuota (pacer.go) y se miden (metrics.go). Los spans gRPC los pone la propia librería de Google
+// con el proveedor de trazas global (ver tracing.go).
+func kmsClientOptions() []option.ClientOption {
+	configurePacerFromEnv()
+	kmsRetryBudget = newRetryBudget()
+	opts := []option.ClientOption{option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(kmsDiagnoseInterceptor, kmsDeadlineInterceptor, kmsRetryInterceptor, pacerInterceptor, kmsMetricsInterceptor))}
+	pool := envInt("KMS_GRPC_POOL_SIZE", 0)
+	if pool > 0 {
+		opts = append(opts, option.WithGRPCConnectionPool(pool))
+	} else {
+		pool = 1
+	}
+
+	// Ya validado al arrancar (ver validateConfig)
+	if params, _ := kmsKeepalive(); params != nil {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithKeepaliveParams(*params)))
+	}
+
+	// El máximo de streams lo negocia el servidor; aquí sólo evitamos
+	// encolar en el cliente más llamadas de las que caben en el pool
+	if streams := envInt("KMS_MAX_CONCURRENT_STREAMS", 0); streams > 0 {
+		sem := make(chan struct{}, streams*pool)
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				defer func() { <-sem }()
+				return invoker(ctx, method, req, reply, cc, callOpts...)
+			})))
+	}
+	return opts
+}
+
+// kmsKeepalive lee KMS_KEEPALIVE_TIME y KMS_KEEPALIVE_TIMEOUT (20s); nil
+// sin KMS_KEEPALIVE_TIME
+func kmsKeepalive() (*keepalive.ClientParameters, error) {
+	kt := getEnv("KMS_KEEPALIVE_TIME", "")
+	if kt == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(kt)
+	if err != nil {
+		return nil, fmt.Errorf("KMS_KEEPALIVE_TIME inválido: %v", err)
+	}
+	timeout, err := time.ParseDuration(getEnv("KMS_KEEPALIVE_TIMEOUT", "20s"))
+	if err != nil {
+		return nil, fmt.Errorf("KMS_KEEPALIVE_TIMEOUT inválido: %v", err)
+	}
+	return &keepalive.ClientParameters{Time: interval, Timeout: timeout, PermitWithoutStream: true}, nil
+}
@@ -0,0 +1,66 @@
+// kmsdeadline.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Las llamadas a KMS heredan el contexto de la petición, así que si el
+// cliente se va se cancelan, y cada una tiene además un plazo propio,
+// KMS_CALL_TIMEOUT (10s), que incluye la espera en el pacer. Si KMS no
+// responde a tiempo la petición acaba en 504 KMS_TIMEOUT en vez de colgarse
+// hasta que el cliente se canse.
+
+// kmsCallTimeout es el plazo de cada llamada a KMS
+func kmsCallTimeout() time.Duration {
+	return envDuration("KMS_CALL_TIMEOUT", 10*time.Second)
+}
+
+// kmsDeadlineInterceptor acota cada llamada a KMS con KMS_CALL_TIMEOUT. Va
+// el primero de la cadena para que el plazo cubra también el pacer.
+func kmsDeadlineInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if timeout := kmsCallTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// kmsTimedOut indica si err es un plazo vencido, nuestro o de KMS
+func kmsTimedOut(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded
+}
+
+// kmsErrorStatus es el estado y el código con que se responde a un error de
+// KMS: 504 KMS_TIMEOUT si venció el plazo, 503 KMS_BUSY si el fallo era
+// pasajero y se agotaron los reintentos (ver kmsretry.go), 500
+// KMS_PERMISSION_DENIED o KMS_KEY_NOT_FOUND si es de configuración (ver
+// kmsdiagnose.go), si no 500 con code
+func kmsErrorStatus(err error, code errCode) (int, errCode) {
+	switch {
+	case kmsTimedOut(err):
+		return http.StatusGatewayTimeout, errKMSTimeout
+	case kmsRetryable(err) || errors.Is(err, errPacerSaturated):
+		return http.StatusServiceUnavailable, errKMSBusy
+	case status.Code(err) == codes.PermissionDenied:
+		return http.StatusInternalServerError, errKMSPermissionDenied
+	case status.Code(err) == codes.NotFound:
+		return http.StatusInternalServerError, errKMSKeyNotFound
+	}
+	return http.StatusInternalServerError, code
+}
+
+// kmsVerifyFailure es el verifyFailure de un error de KMS al verificar
+func kmsVerifyFailure(err error) *verifyFailure {
+	status, code := kmsErrorStatus(err, errKMSVerifyFailed)
+	return &verifyFailure{status, code, fmt.Sprintf("Error verificando: %v", err)}
+}
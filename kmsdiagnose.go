@@ -0,0 +1,374 @@
+// kmsdiagnose.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/iam/apiv1/iampb"
+	kms "cloud.google.com/go/kms/apiv1"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Diagnóstico de permisos de KMS. Un PERMISSION_DENIED o un NOT_FOUND de
+// KMS casi siempre es un problema de IAM o de configuración, así que en vez
+// del mensaje de gRPC tal cual la respuesta lleva un bloque "diagnostic"
+// con el recurso, la cuenta de servicio con la que se llamó, el permiso y
+// el rol que faltan y el comando para concederlo:
+//
+//	{"code": "KMS_PERMISSION_DENIED", "message": "...", "details": {"diagnostic": {
+//	   "resource": "projects/.../cryptoKeyVersions/1",
+//	   "service_account": "firma@proyecto.iam.gserviceaccount.com",
+//	   "permission": "cloudkms.cryptoKeyVersions.useToSign",
+//	   "role": "roles/cloudkms.signerVerifier", "hints": [...]}}}
+//
+// Con KMS_ERROR_DIAGNOSTICS=false el bloque sólo va al log. GET
+// /admin/diagnose hace las mismas comprobaciones a demanda sobre todas las
+// claves configuradas (con TestIamPermissions, sin firmar nada).
+
+// kmsDiagnostic explica un error de permisos o de recurso de KMS
+type kmsDiagnostic struct {
+	Code           string   `json:"code"` // PermissionDenied o NotFound
+	Method         string   `json:"method"`
+	Resource       string   `json:"resource,omitempty"`
+	ServiceAccount string   `json:"service_account,omitempty"`
+	Permission     string   `json:"permission,omitempty"`
+	Role           string   `json:"role,omitempty"`
+	Hints          []string `json:"hints"`
+}
+
+// kmsDiagnosticError es un error de KMS con su diagnóstico. Conserva el
+// estado gRPC original, así que status.Code sigue funcionando.
+type kmsDiagnosticError struct {
+	diag kmsDiagnostic
+	err  error
+}
+
+func (e *kmsDiagnosticError) Error() string {
+	d := e.diag
+	msg := fmt.Sprintf("KMS respondió %s a %s sobre %s", d.Code, d.Method, d.Resource)
+	if d.ServiceAccount != "" {
+		msg += " con la cuenta " + d.ServiceAccount
+	}
+	if len(d.Hints) > 0 {
+		msg += ": " + d.Hints[0]
+	}
+	return msg
+}
+
+func (e *kmsDiagnosticError) Unwrap() error { return e.err }
+
+func (e *kmsDiagnosticError) GRPCStatus() *status.Status { return status.Convert(e.err) }
+
+// kmsDiagnosticOf devuelve el diagnóstico de err, o nil si no lo tiene
+func kmsDiagnosticOf(err error) *kmsDiagnostic {
+	var de *kmsDiagnosticError
+	if errors.As(err, &de) {
+		return &de.diag
+	}
+	return nil
+}
+
+// kmsMethodAccess es el permiso que necesita cada método de KMS y el rol
+// predefinido más pequeño que lo incluye
+var kmsMethodAccess = map[string][2]string{
+	"AsymmetricSign":      {"cloudkms.cryptoKeyVersions.useToSign", "roles/cloudkms.signerVerifier"},
+	"MacSign":             {"cloudkms.cryptoKeyVersions.useToSign", "roles/cloudkms.signerVerifier"},
+	"MacVerify":           {"cloudkms.cryptoKeyVersions.useToVerify", "roles/cloudkms.signerVerifier"},
+	"GetPublicKey":        {"cloudkms.cryptoKeyVersions.viewPublicKey", "roles/cloudkms.publicKeyViewer"},
+	"GetCryptoKeyVersion": {"cloudkms.cryptoKeyVersions.get", "roles/cloudkms.viewer"},
+	"GetCryptoKey":        {"cloudkms.cryptoKeys.get", "roles/cloudkms.viewer"},
+	"Encrypt":             {"cloudkms.cryptoKeyVersions.useToEncrypt", "roles/cloudkms.cryptoKeyEncrypterDecrypter"},
+	"Decrypt":             {"cloudkms.cryptoKeyVersions.useToDecrypt", "roles/cloudkms.cryptoKeyEncrypterDecrypter"},
+}
+
+var kmsKeyPattern = regexp.MustCompile(`^projects/([^/]+)/locations/([^/]+)/keyRings/([^/]+)/cryptoKeys/([^/]+)`)
+
+// kmsDiagnoseInterceptor añade el diagnóstico a los PERMISSION_DENIED y
+// NOT_FOUND de KMS. Va el primero de la cadena para ver el error final,
+// ya sin reintentos.
+func kmsDiagnoseInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.NotFound:
+	default:
+		return err
+	}
+	resource := ""
+	switch req := req.(type) {
+	case interface{ GetName() string }:
+		resource = req.GetName()
+	case interface{ GetResource() string }:
+		resource = req.GetResource()
+	}
+	d := diagnoseKMSError(ctx, method[strings.LastIndex(method, "/")+1:], resource, err)
+	raw, _ := json.Marshal(d)
+	log.Printf("🔐 KMS %s: %s", d.Code, raw)
+	return &kmsDiagnosticError{diag: d, err: err}
+}
+
+// diagnoseKMSError compone el diagnóstico de un error de method sobre
+// resource
+func diagnoseKMSError(ctx context.Context, method, resource string, err error) kmsDiagnostic {
+	st := status.Convert(err)
+	d := kmsDiagnostic{Code: st.Code().String(), Method: method, Resource: resource, Hints: []string{}}
+	d.ServiceAccount, _ = kmsServiceAccount(ctx)
+	if access, ok := kmsMethodAccess[method]; ok && st.Code() == codes.PermissionDenied {
+		d.Permission, d.Role = access[0], access[1]
+	}
+	project := getEnv("GOOGLE_CLOUD_PROJECT", "")
+	if m := kmsKeyPattern.FindStringSubmatch(resource); m != nil {
+		project = m[1]
+	}
+
+	if st.Code() == codes.NotFound {
+		d.Hints = append(d.Hints, "El recurso no existe: "+kmsResourceSource(resource))
+		if m := kmsKeyPattern.FindStringSubmatch(resource); m != nil {
+			d.Hints = append(d.Hints, fmt.Sprintf("Lista las versiones que hay: gcloud kms keys versions list --key %s --keyring %s --location %s --project %s", m[4], m[3], m[2], m[1]))
+		}
+		return d
+	}
+
+	if strings.Contains(st.Message(), "SERVICE_DISABLED") || strings.Contains(st.Message(), "has not been used") {
+		d.Hints = append(d.Hints, fmt.Sprintf("La API de Cloud KMS no está habilitada: gcloud services enable cloudkms.googleapis.com --project %s", project))
+	}
+	if d.Role != "" {
+		d.Hints = append(d.Hints, kmsGrantHint(resource, d.ServiceAccount, d.Permission, d.Role))
+	}
+	if d.ServiceAccount == "" {
+		d.Hints = append(d.Hints, "No se pudo averiguar la cuenta de servicio: revisa GOOGLE_APPLICATION_CREDENTIALS o la cuenta asignada al servicio")
+	}
+	return d
+}
+
+// kmsGrantHint explica cómo conceder role a account sobre la clave de
+// resource
+func kmsGrantHint(resource, account, permission, role string) string {
+	hint := fmt.Sprintf("Falta el rol %s (permiso %s)", role, permission)
+	if account == "" {
+		account = "CUENTA"
+	}
+	if m := kmsKeyPattern.FindStringSubmatch(resource); m != nil {
+		hint += fmt.Sprintf(": gcloud kms keys add-iam-policy-binding %s --keyring %s --location %s --project %s --member serviceAccount:%s --role %s", m[4], m[3], m[2], m[1], account, role)
+	}
+	return hint
+}
+
+// kmsPermissionRole es el rol de kmsMethodAccess que incluye permission
+func kmsPermissionRole(permission string) string {
+	for _, access := range kmsMethodAccess {
+		if access[0] == permission {
+			return access[1]
+		}
+	}
+	return ""
+}
+
+// kmsResourceSource dice de qué configuración sale un recurso de KMS, para
+// saber qué revisar si no existe
+func kmsResourceSource(resource string) string {
+	switch {
+	case resource == nameVersion:
+		return "revisa GOOGLE_CLOUD_PROJECT, KMS_LOCATION, KMS_KEY_RING, KMS_KEY y KMS_KEY_VERSION"
+	case resource != "" && resource == encryptionKeyName():
+		return "revisa KMS_ENCRYPTION_KEY"
+	case contains(acceptedKeyVersions(), resource):
+		return "revisa ACCEPTED_KEY_VERSIONS"
+	}
+	for alias, kc := range keyConfigs {
+		if kc.KeyVersion == resource {
+			return fmt.Sprintf("revisa key_version del alias %s en KEYS_FILE", alias)
+		}
+	}
+	return "revisa el nombre del recurso"
+}
+
+var (
+	kmsAccountOnce sync.Once
+	kmsAccount     string
+	kmsAccountFrom string
+)
+
+// kmsServiceAccount averigua (una vez) con qué cuenta se llama a KMS: la
+// de las credenciales por defecto si son de una cuenta de servicio, o la
+// del servidor de metadatos en GCP. Devuelve también de dónde la sacó.
+func kmsServiceAccount(ctx context.Context) (account, source string) {
+	kmsAccountOnce.Do(func() {
+		if creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloudkms"); err == nil && len(creds.JSON) > 0 {
+			var f struct {
+				ClientEmail      string `json:"client_email"`
+				ImpersonationURL string `json:"service_account_impersonation_url"`
+			}
+			if json.Unmarshal(creds.JSON, &f) == nil {
+				switch {
+				case f.ImpersonationURL != "":
+					// .../serviceAccounts/CUENTA:generateAccessToken
+					email := f.ImpersonationURL[strings.LastIndex(f.ImpersonationURL, "/")+1:]
+					kmsAccount, kmsAccountFrom = strings.TrimSuffix(email, ":generateAccessToken"), "impersonation"
+				case f.ClientEmail != "":
+					kmsAccount, kmsAccountFrom = f.ClientEmail, "credentials_file"
+				}
+			}
+		}
+		if kmsAccount == "" && metadata.OnGCE() {
+			if email, err := metadata.EmailWithContext(ctx, "default"); err == nil {
+				kmsAccount, kmsAccountFrom = email, "metadata_server"
+			}
+		}
+	})
+	return kmsAccount, kmsAccountFrom
+}
+
+// writeKMSError responde a un error de KMS con el estado de kmsErrorStatus
+// y, si lo hay, el bloque de diagnóstico
+func writeKMSError(w http.ResponseWriter, err error, code errCode, msg string) {
+	status, code := kmsErrorStatus(err, code)
+	if d := kmsDiagnosticOf(err); d != nil && getEnv("KMS_ERROR_DIAGNOSTICS", "true") == "true" {
+		writeErrorDetails(w, status, code, msg, map[string]interface{}{"diagnostic": d})
+		return
+	}
+	writeError(w, status, code, msg)
+}
+
+// diagnoseCheck es el resultado de comprobar una clave
+type diagnoseCheck struct {
+	Name               string         `json:"name"`
+	Resource           string         `json:"resource"`
+	OK                 bool           `json:"ok"`
+	State              string         `json:"state,omitempty"`
+	MissingPermissions []string       `json:"missing_permissions,omitempty"`
+	Diagnostic         *kmsDiagnostic `json:"diagnostic,omitempty"`
+	Error              string         `json:"error,omitempty"`
+}
+
+// diagnoseKey comprueba que resource existe y que la cuenta tiene los
+// permisos de perms sobre su CryptoKey
+func diagnoseKey(ctx context.Context, client *kms.KeyManagementClient, name, resource string, perms []string) diagnoseCheck {
+	c := diagnoseCheck{Name: name, Resource: resource}
+	fail := func(err error) diagnoseCheck {
+		c.Diagnostic = kmsDiagnosticOf(err)
+		c.Error = err.Error()
+		return c
+	}
+	if strings.Contains(resource, "/cryptoKeyVersions/") {
+		v, err := client.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: resource})
+		if err != nil {
+			return fail(err)
+		}
+		c.State = v.State.String()
+	} else {
+		k, err := client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: resource})
+		if err != nil {
+			return fail(err)
+		}
+		if k.Primary != nil {
+			c.State = k.Primary.State.String()
+		}
+	}
+	key := kmsKeyPattern.FindString(resource)
+	resp, err := client.TestIamPermissions(ctx, &iampb.TestIamPermissionsRequest{Resource: key, Permissions: perms})
+	if err != nil {
+		return fail(err)
+	}
+	for _, p := range perms {
+		if !contains(resp.Permissions, p) {
+			c.MissingPermissions = append(c.MissingPermissions, p)
+		}
+	}
+	if len(c.MissingPermissions) > 0 {
+		account, _ := kmsServiceAccount(ctx)
+		d := kmsDiagnostic{Code: codes.PermissionDenied.String(), Method: "TestIamPermissions", Resource: resource, ServiceAccount: account, Hints: []string{}}
+		for _, p := range c.MissingPermissions {
+			d.Hints = append(d.Hints, kmsGrantHint(resource, account, p, kmsPermissionRole(p)))
+		}
+		c.Diagnostic = &d
+	}
+	c.OK = len(c.MissingPermissions) == 0 && (c.State == "" || c.State == kmspb.CryptoKeyVersion_ENABLED.String())
+	return c
+}
+
+// diagnoseHandler atiende GET /admin/diagnose: la cuenta con la que se
+// llama a KMS y, para cada clave configurada, si existe, si está habilitada
+// y si la cuenta tiene los permisos que necesita
+func diagnoseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if signerBackend != backendGCPKMS {
+		writeError(w, http.StatusNotFound, errNotConfigured, "El diagnóstico de KMS necesita SIGNER_BACKEND=gcp-kms")
+		return
+	}
+	ctx := r.Context()
+	account, source := kmsServiceAccount(ctx)
+	// Sin KMS listo no hay cliente: se abre uno para el diagnóstico
+	client := kmsClient
+	if client == nil {
+		var err error
+		client, err = kms.NewKeyManagementClient(ctx, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(kmsDeadlineInterceptor, kmsDiagnoseInterceptor)))
+		if err != nil {
+			writeKMSError(w, err, errKMSError, fmt.Sprintf("Error creando el cliente de KMS: %v", err))
+			return
+		}
+		defer client.Close()
+		disableGAXRetries(client)
+	}
+	signPerms := []string{"cloudkms.cryptoKeyVersions.useToSign", "cloudkms.cryptoKeyVersions.useToVerify", "cloudkms.cryptoKeyVersions.viewPublicKey"}
+	verifyPerms := []string{"cloudkms.cryptoKeyVersions.useToVerify", "cloudkms.cryptoKeyVersions.viewPublicKey"}
+
+	checks := []diagnoseCheck{diagnoseKey(ctx, client, "signing_key", nameVersion, signPerms)}
+	for _, kv := range acceptedKeyVersions()[1:] {
+		checks = append(checks, diagnoseKey(ctx, client, "accepted_key_version", kv, verifyPerms))
+	}
+	for _, alias := range configuredAliases() {
+		if kv := keyConfigs[alias].KeyVersion; kv != "" {
+			checks = append(checks, diagnoseKey(ctx, client, "alias:"+alias, kv, signPerms))
+		}
+	}
+	if kek := encryptionKeyName(); kek != "" {
+		checks = append(checks, diagnoseKey(ctx, client, "encryption_key", kek, []string{"cloudkms.cryptoKeyVersions.useToEncrypt", "cloudkms.cryptoKeyVersions.useToDecrypt"}))
+	}
+
+	ok := true
+	for _, c := range checks {
+		ok = ok && c.OK
+	}
+	if !kmsReady.Load() {
+		ok = false
+	}
+	resp := map[string]interface{}{
+		"ok":        ok,
+		"kms_ready": kmsReady.Load(),
+		"checks":    checks,
+	}
+	if account != "" {
+		resp["service_account"] = account
+		resp["service_account_source"] = source
+	}
+	kmsStateMu.Lock()
+	lastErr := kmsLastErr
+	kmsStateMu.Unlock()
+	if !kmsReady.Load() && lastErr != nil {
+		resp["kms_error"] = lastErr.Error()
+		if d := kmsDiagnosticOf(lastErr); d != nil {
+			resp["kms_diagnostic"] = d
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,117 @@
+// kmsretry.go
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reintentos de las llamadas a KMS que fallan por un motivo pasajero
+// (UNAVAILABLE, RESOURCE_EXHAUSTED): hasta KMS_RETRY_ATTEMPTS intentos en
+// total (4), con espera exponencial desde KMS_RETRY_INITIAL (100ms) hasta
+// KMS_RETRY_MAX_DELAY (2s) y jitter completo. Todos caben en el plazo de
+// KMS_CALL_TIMEOUT (ver kmsdeadline.go) y cada intento vuelve a pasar por
+// el pacer.
+//
+// Para no multiplicar la carga cuando KMS está caído de verdad, los
+// reintentos salen de un presupuesto compartido, como el retry throttling
+// de gRPC: cada fallo pasajero gasta un token de KMS_RETRY_BUDGET (10),
+// cada éxito devuelve KMS_RETRY_BUDGET_RATIO (0.1), y sólo se reintenta con
+// más de la mitad. Agotados los reintentos se responde 503 KMS_BUSY con
+// Retry-After (KMS_RETRY_AFTER, 2s).
+//
+// Los reintentos propios de la librería de KMS se desactivan (ver
+// disableGAXRetries) para que no se multipliquen con estos.
+
+// retryBudget es el presupuesto de reintentos
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+// kmsRetryBudget se crea con el cliente de KMS (ver kmsClientOptions)
+var kmsRetryBudget = &retryBudget{}
+
+func newRetryBudget() *retryBudget {
+	limit := float64(envInt("KMS_RETRY_BUDGET", 10))
+	ratio, err := strconv.ParseFloat(getEnv("KMS_RETRY_BUDGET_RATIO", "0.1"), 64)
+	if err != nil || ratio < 0 {
+		ratio = 0.1
+	}
+	return &retryBudget{tokens: limit, max: limit, ratio: ratio}
+}
+
+// success devuelve parte de un token
+func (b *retryBudget) success() {
+	b.mu.Lock()
+	b.tokens = min(b.max, b.tokens+b.ratio)
+	b.mu.Unlock()
+}
+
+// failure gasta un token y dice si aún se puede reintentar
+func (b *retryBudget) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = max(0, b.tokens-1)
+	return b.tokens > b.max/2
+}
+
+// kmsRetryable indica si el error de KMS es pasajero
+func kmsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// kmsRetryInterceptor reintenta las llamadas a KMS con fallos pasajeros. Va
+// detrás del plazo y delante del pacer.
+func kmsRetryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	attempts := envInt("KMS_RETRY_ATTEMPTS", 4)
+	delay := envDuration("KMS_RETRY_INITIAL", 100*time.Millisecond)
+	maxDelay := envDuration("KMS_RETRY_MAX_DELAY", 2*time.Second)
+	name := method[strings.LastIndex(method, "/")+1:]
+	for attempt := 1; ; attempt++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			kmsRetryBudget.success()
+			return nil
+		}
+		if !kmsRetryable(err) {
+			return err
+		}
+		if !kmsRetryBudget.failure() || attempt >= attempts {
+			return err
+		}
+		kmsRetries.inc(name, status.Code(err).String())
+		// Jitter completo: entre 0 y la espera exponencial
+		if !sleepCtx(ctx, rand.N(delay+1)) {
+			return err
+		}
+		delay = min(2*delay, maxDelay)
+	}
+}
+
+// disableGAXRetries quita los reintentos y plazos por defecto del cliente
+// de KMS: de eso se encargan kmsRetryInterceptor y kmsDeadlineInterceptor
+func disableGAXRetries(client *kms.KeyManagementClient) {
+	client.CallOptions = &kms.KeyManagementCallOptions{}
+}
+
+// kmsRetryAfter es lo que se pide esperar al cliente cuando se agotan los
+// reintentos
+func kmsRetryAfter() time.Duration {
+	return envDuration("KMS_RETRY_AFTER", 2*time.Second)
+}
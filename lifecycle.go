@@ -0,0 +1,159 @@
+// lifecycle.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Los subsistemas con vida propia (el listener HTTP, los workers
+// periódicos, los sinks de auditoría, la sincronización NTP...) se
+// registran en lifecycle con su arranque y su parada en vez de lanzar
+// goroutines sueltas. Arrancan en orden de registro y se paran en orden
+// inverso, cada uno con un tiempo máximo (SHUTDOWN_HOOK_TIMEOUT, 10s): el
+// listener, que se registra el último, deja de aceptar peticiones antes de
+// que se paren los workers y los sinks en los que escriben.
+//
+// Lo que se registra con lifecycle ya en marcha (p.ej. lo que espera a
+// KMS, ver onKMSReady) arranca en el acto.
+
+// component es un subsistema registrado
+type component struct {
+	name  string
+	start func(ctx context.Context) error
+	stop  func(ctx context.Context) error
+}
+
+// lifecycleManager arranca y para los subsistemas
+type lifecycleManager struct {
+	mu         sync.Mutex
+	components []*component
+	running    bool
+	stopping   bool
+}
+
+var lifecycle = &lifecycleManager{}
+
+// Register añade un subsistema. start y stop pueden ser nil; start no debe
+// bloquear (lo que dure se lanza en una goroutine) y stop debe volver en
+// cuanto ctx caduque.
+func (m *lifecycleManager) Register(name string, start, stop func(ctx context.Context) error) error {
+	c := &component{name: name, start: start, stop: stop}
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return fmt.Errorf("%s: el servicio se está parando", name)
+	}
+	running := m.running
+	m.mu.Unlock()
+	if running && c.start != nil {
+		if err := c.start(context.Background()); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	m.mu.Lock()
+	m.components = append(m.components, c)
+	m.mu.Unlock()
+	return nil
+}
+
+// Go registra un worker: run se ejecuta en su propia goroutine y debe
+// volver cuando se cancele ctx, que es lo que hace la parada
+func (m *lifecycleManager) Go(name string, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	start := func(context.Context) error {
+		go func() {
+			defer close(done)
+			run(ctx)
+		}()
+		return nil
+	}
+	stop := func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+	}
+	if err := m.Register(name, start, stop); err != nil {
+		cancel()
+		log.Printf("⚠️  %v", err)
+	}
+}
+
+// Start arranca en orden los subsistemas registrados. Si uno falla, para
+// los que ya habían arrancado y devuelve el error.
+func (m *lifecycleManager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	pending := append([]*component(nil), m.components...)
+	m.running = true
+	m.mu.Unlock()
+	for i, c := range pending {
+		if c.start == nil {
+			continue
+		}
+		if err := c.start(ctx); err != nil {
+			m.stopAll(pending[:i])
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// Stop para los subsistemas en orden inverso al de registro y devuelve los
+// errores de parada, incluidos los que agotaron su tiempo
+func (m *lifecycleManager) Stop() error {
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopping = true
+	components := append([]*component(nil), m.components...)
+	m.mu.Unlock()
+	return m.stopAll(components)
+}
+
+func (m *lifecycleManager) stopAll(components []*component) error {
+	timeout, err := time.ParseDuration(getEnv("SHUTDOWN_HOOK_TIMEOUT", "10s"))
+	if err != nil || timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	var errs []error
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		if c.stop == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		err := c.stop(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("⚠️  Parando %s: %v", c.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		log.Printf("Parado %s (%s)", c.name, time.Since(start).Round(time.Millisecond))
+	}
+	return errors.Join(errs...)
+}
+
+// sleepCtx espera d o hasta que se cancele ctx; false si se canceló
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
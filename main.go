@@ -5,20 +5,35 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	kms "cloud.google.com/go/kms/apiv1"
 	"github.com/joho/godotenv"
-	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"example.com/firmajson/pkg/firmajson"
 )
 
+// kmsClient y signer (que firma y verifica con la versión de clave de
+// firma, ver pkg/firmajson) se publican en el arranque cuando KMS está
+// listo (ver startup.go). kmsClient es nil si SIGNER_BACKEND no es gcp-kms
+// (ver backends.go).
 var (
 	kmsClient   *kms.KeyManagementClient
+	signer      firmajson.Backend
+	keyRingName string
+	kmsLocation string
 	nameVersion string
 )
 
@@ -27,134 +42,558 @@ func init() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("⚠️  No se ha encontrado .env, usando vars de entorno")
 	}
+	firmajson.ParallelMinItems = envInt("CANONICAL_PARALLEL_MIN", firmajson.ParallelMinItems)
+}
 
-	// Inicializa el cliente de Cloud KMS
-	ctx := context.Background()
-	var err error
-	kmsClient, err = kms.NewKeyManagementClient(ctx)
-	if err != nil {
-		log.Fatalf("kms.NewKeyManagementClient: %v", err)
+func main() {
+	configureSignerBackend()
+	if err := configureEntropy(); err != nil {
+		exitWith(exitConfig, "ENTROPY_SOURCE: %v", err)
 	}
 
-	// Construye el nombre completo de la CryptoKeyVersion
-	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if projectID == "" {
-		log.Fatal("❌ GOOGLE_CLOUD_PROJECT no está definido")
+	registerRoutes()
+
+	if err := configureTracing(); err != nil {
+		exitWith(exitConfig, "OTEL: %v", err)
+	}
+	var err error
+	if db, err = openStore(); err != nil {
+		exitWith(exitStore, "STORE: %v", err)
+	}
+	warnBreakglassStore()
+	if err := loadKeyConfigs(); err != nil {
+		exitWith(exitConfig, "KEYS_FILE: %v", err)
+	}
+	if err := loadResidencyRules(); err != nil {
+		exitWith(exitConfig, "RESIDENCY_FILE: %v", err)
+	}
+	if err := loadRedactionRules(); err != nil {
+		exitWith(exitConfig, "REDACTION_FILE: %v", err)
+	}
+	if err := loadTrustedIssuers(); err != nil {
+		exitWith(exitConfig, "FEDERATION_ISSUERS_FILE: %v", err)
+	}
+	if err := configureDID(); err != nil {
+		exitWith(exitConfig, "DID: %v", err)
+	}
+	if err := configureBLS(); err != nil {
+		exitWith(exitConfig, "LOCAL_BLS: %v", err)
+	}
+	if err := configureNonceStore(); err != nil {
+		exitWith(exitConfig, "NONCE_STORE: %v", err)
+	}
+	if err := configureTimeSource(); err != nil {
+		exitWith(exitConfig, "TIME_SOURCE: %v", err)
 	}
-	locationID := getEnv("KMS_LOCATION", "global")
-	keyRingID := getEnv("KMS_KEY_RING", "EzeKeyRing")
-	keyID := getEnv("KMS_KEY", "EzeKey")
-	keyVersionID := getEnv("KMS_KEY_VERSION", "1")
+	if err := startSIEMSink(); err != nil {
+		exitWith(exitConfig, "SIEM: %v", err)
+	}
+	if err := startPubSubPublisher(); err != nil {
+		exitWith(exitConfig, "PUBSUB: %v", err)
+	}
+	if err := validateConfig(); err != nil {
+		exitWith(exitConfig, "%v", err)
+	}
+	// KMS con reintentos en segundo plano; mientras no esté listo se sirve
+	// en modo degradado (ver startup.go)
+	startKMS()
+	onKMSReady(startConfigSnapshots)
+	startAuditCompactor()
+	startRetimestamper()
+	startEnvelopeRetention()
+	onKMSReady(startDeferredSigner)
+	onKMSReady(startScheduler)
+	onKMSReady(startVerifyJobWorkers)
+	startSubscriptionWorkers()
 
-	nameVersion = fmt.Sprintf(
-		"projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s",
-		projectID, locationID, keyRingID, keyID, keyVersionID,
-	)
-}
+	// Cadena de middlewares alrededor del enrutador (ver middleware.go)
+	handler := buildHandler(http.DefaultServeMux)
 
-func main() {
-	http.HandleFunc("/sign", signHandler)
-	http.HandleFunc("/verify", verifyHandler)
+	// Los listeners se registran los últimos para pararse los primeros
+	// (ver lifecycle.go)
+	if err := registerGRPCServer(); err != nil {
+		exitWith(exitConfig, "GRPC: %v", err)
+	}
+	serveErr := registerHTTPServer(handler)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := lifecycle.Start(ctx); err != nil {
+		exitWith(exitConfig, "Arranque: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+		log.Printf("Parando …")
+		lifecycle.Stop()
+	case err := <-serveErr:
+		log.Printf("❌ HTTP: %v", err)
+		lifecycle.Stop()
+		os.Exit(1)
+	}
+}
 
+// registerHTTPServer registra el listener HTTP (HTTPS con TLS_CERT_FILE) en
+// lifecycle. La parada deja de aceptar conexiones y espera a las
+// peticiones en curso (ver shutdown.go); si el servidor cae por su cuenta,
+// el error llega por el canal devuelto.
+func registerHTTPServer(handler http.Handler) <-chan error {
 	port := getEnv("PORT", "8080")
-	log.Printf("Listening on :%s …", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	srv := &http.Server{Addr: ":" + port, Handler: handler}
+	configureServerTimeouts(srv)
+	certFile := getEnv("TLS_CERT_FILE", "")
+	if certFile != "" {
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			exitWith(exitConfig, "TLS: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	serveErr := make(chan error, 1)
+	start := func(context.Context) error {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			var err error
+			if certFile != "" {
+				log.Printf("Listening on :%s (TLS) …", port)
+				err = srv.ServeTLS(ln, certFile, getEnv("TLS_KEY_FILE", ""))
+			} else {
+				log.Printf("Listening on :%s …", port)
+				err = srv.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+			}
+		}()
+		return nil
+	}
+	if err := lifecycle.Register("http", start, drainHTTPServer(srv)); err != nil {
+		exitWith(exitConfig, "HTTP: %v", err)
+	}
+	return serveErr
 }
 
 // signHandler acepta cualquier JSON, inyecta "timestamp" y lo firma
 func signHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Sólo POST permitido"})
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
 		return
 	}
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No se pudo leer el body"})
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
 		return
 	}
-	var payloadMap map[string]interface{}
-	if err := json.Unmarshal(body, &payloadMap); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "JSON inválido"})
+	payloadMap, data, ok := preparePayload(w, r, alias)
+	if !ok {
 		return
 	}
 
-	// Inyectar timestamp UTC
-	payloadMap["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
-
-	// Canonicalizar payload
-	data, err := json.Marshal(payloadMap)
+	// Firmar con Cloud KMS, por el pacer de la clase de la clave
+	ctx := withKeyPriority(r.Context(), alias)
+	format, _ := requestSignFormat(r)
+	if format != "" {
+		// Salida JWS (ver jws.go): no se guarda ni se envía acuse
+		audit := newAuditEntry(r, "sign", alias, data)
+		obj, err := signJWS(ctx, data)
+		if err != nil {
+			audit.Outcome, audit.Detail = "error", err.Error()
+			recordAudit(ctx, audit)
+			if errors.Is(err, errJWSAlgorithm) {
+				writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+				return
+			}
+			writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+			return
+		}
+		audit.Outcome = "ok"
+		recordAudit(ctx, audit)
+		writeJWS(w, format, obj)
+		return
+	}
+	resp, err := signCanonical(ctx, r, alias, payloadMap, data)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Error interno al serializar payload"})
+		if deferRequested(r) && kmsUnavailable(err) {
+			// El cliente prefiere una firma tardía a un error
+			queueDeferred(w, r, alias, payloadMap, data)
+			return
+		}
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
 		return
 	}
+	digest, _ := resp["digest"].(string)
+	finishSign(ctx, w, r, alias, resp, payloadMap, data, requestEscape(r), digest, injectedFields(r, alias, payloadMap))
+}
 
-	// Firmar con Cloud KMS
-	ctx := context.Background()
-	sigResp, err := kmsClient.MacSign(ctx, &kmspb.MacSignRequest{
-		Name: nameVersion,
-		Data: data,
-	})
+// signCanonical firma los bytes canónicos de un documento ya preparado,
+// con el AAD y el resumen que pida r, y lo audita. Devuelve el sobre
+// (payload, signature e información de la firma). Es el núcleo de firma
+// que comparten /sign y Signer.Sign (ver grpc.go).
+func signCanonical(ctx context.Context, r *http.Request, alias string, payloadMap map[string]interface{}, data []byte) (map[string]interface{}, error) {
+	audit := newAuditEntry(r, "sign", alias, data)
+	start := time.Now()
+	aad, digest := requestAAD(r), requestDigest(r)
+	signature, err := kmsSign(ctx, withAAD(withDigest(data, digest), aad))
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Error firmando: %v", err)})
-		return
+		audit.Outcome, audit.Detail = "error", err.Error()
+		if deferRequested(r) && kmsUnavailable(err) {
+			audit.Outcome = "queued"
+		}
+		recordAudit(ctx, audit)
+		return nil, err
 	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+	maybeShadowSign(withDigest(data, digest), time.Since(start))
 
-	signature := base64.StdEncoding.EncodeToString(sigResp.Mac)
 	resp := map[string]interface{}{
 		"payload":   payloadMap,
 		"signature": signature,
 	}
-	writeJSON(w, http.StatusOK, resp)
+	addSignatureInfo(ctx, resp, signature)
+	if aad != nil {
+		resp["aad"] = true
+	}
+	if digest != "" {
+		resp["digest"] = digest
+	}
+	return resp, nil
 }
 
-// verifyHandler reconstruye CANÓNICAMENTE el payload y verifica la firma
-func verifyHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Sólo POST permitido"})
+// finishSign termina una firma ya hecha igual en /sign y /sign/commit (ver
+// recordSigned) y responde comprimido, separado o sin eco según la
+// petición. injected son los campos que el servicio añadió al documento.
+func finishSign(ctx context.Context, w http.ResponseWriter, r *http.Request, alias string, resp, payloadMap map[string]interface{}, data []byte, escape, digest string, injected map[string]interface{}) {
+	if err := recordSigned(ctx, r, alias, resp, payloadMap, data, escape, digest); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Firmado pero no guardado: %v", err))
 		return
 	}
+	if enc, _ := requestCompression(r); enc != "" {
+		if err := compressEnvelope(resp, enc, data); err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("Error comprimiendo: %v", err))
+			return
+		}
+	} else if detachedRequested(r) {
+		detachPayload(resp, injected, data)
+	} else if !echoPayload(r) {
+		omitPayload(resp, injected)
+	}
+	writeJSON(w, http.StatusOK, selectFields(r, resp))
+}
 
-	// Definimos una request genérica
-	var req struct {
-		Payload   json.RawMessage `json:"payload"`
-		Signature string          `json:"signature"`
+// recordSigned guarda el sobre firmado (con STORE_ENVELOPES, y anota su id
+// en resp), lo pasa a documentSigned (Pub/Sub y suscripciones) y manda el
+// acuse. El error es del store: la firma ya está hecha.
+func recordSigned(ctx context.Context, r *http.Request, alias string, resp, payloadMap map[string]interface{}, data []byte, escape, digest string) error {
+	signature, _ := resp["signature"].(string)
+	if escape != "" && escape != escapeHTML {
+		resp["escape"] = escape
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "JSON inválido"})
-		return
+	if envelopeStorageEnabled() {
+		id, err := storeEnvelope(ctx, metaOf(r), alias, payloadMap, signature, escape, digest)
+		if err != nil {
+			return err
+		}
+		resp["envelope_id"] = id
+	}
+	documentSigned(alias, resp, payloadMap, escape)
+	if owner, _ := requestNotifyOwner(r); owner != "" {
+		id, _ := resp["envelope_id"].(string)
+		sendReceipt(metaOf(r), owner, alias, data, signature, id)
 	}
+	return nil
+}
 
-	// 1) Volver a parsear el RawMessage en un objeto para canonicalizar:
-	var obj interface{}
-	if err := json.Unmarshal(req.Payload, &obj); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Payload inválido"})
-		return
+// preparePayload lee el JSON del body, inyecta "timestamp" y devuelve el
+// payload junto con sus bytes canónicos. Si algo falla ya ha respondido.
+func preparePayload(w http.ResponseWriter, r *http.Request, alias string) (map[string]interface{}, []byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return nil, nil, false
+	}
+	payloadMap, data, f := signableDocument(r, alias, body)
+	if f != nil {
+		f.write(w)
+		return nil, nil, false
+	}
+	return payloadMap, data, true
+}
+
+// signableDocument decodifica el objeto JSON a firmar y lo prepara (ver
+// signablePayload)
+func signableDocument(r *http.Request, alias string, body []byte) (map[string]interface{}, []byte, *signFailure) {
+	var payloadMap map[string]interface{}
+	if err := firmajson.DecodeJSON(body, &payloadMap); err != nil || payloadMap == nil {
+		return nil, nil, &signFailure{http.StatusBadRequest, errInvalidJSON, "JSON inválido"}
+	}
+	data, f := signablePayload(r, alias, payloadMap, requestEscape(r))
+	if f != nil {
+		return nil, nil, f
+	}
+	return payloadMap, data, nil
+}
+
+// signFailure es un error al autorizar una firma o preparar el documento,
+// con la respuesta HTTP que le corresponde
+type signFailure struct {
+	status int
+	code   errCode
+	msg    string
+}
+
+func (f *signFailure) Error() string { return f.msg }
+
+// write responde con el error
+func (f *signFailure) write(w http.ResponseWriter) {
+	writeError(w, f.status, f.code, f.msg)
+}
+
+// signablePayload completa el documento del cliente con los campos que
+// inyecta el servicio (nonce, cnf, cifrado, enriquecedores, residencia,
+// timestamp) y devuelve sus bytes canónicos en la forma escape
+func signablePayload(r *http.Request, alias string, payloadMap map[string]interface{}, escape string) ([]byte, *signFailure) {
+	// Residencia: la región de la clave debe ser la que exigen el tenant y
+	// el tipo de documento
+	if err := checkResidency(r, alias); err != nil {
+		return nil, &signFailure{http.StatusForbidden, errResidencyViolation, err.Error()}
+	}
+
+	// Inyectar nonce: aleatorio con ?nonce=true (o siempre con
+	// NONCE_INJECT=always, ver replay.go) o derivado de la semilla de
+	// X-Nonce-Seed para pipelines idempotentes
+	if nonceRequested(r) {
+		seed := r.Header.Get("X-Nonce-Seed")
+		if _, exists := payloadMap["nonce"]; exists {
+			return nil, &signFailure{http.StatusBadRequest, errReservedField, `El campo "nonce" está reservado`}
+		}
+		var nonce string
+		var err error
+		if seed != "" {
+			nonce, err = deterministicNonce(seed, payloadMap)
+		} else {
+			nonce, err = randomNonce()
+		}
+		if err != nil {
+			return nil, &signFailure{http.StatusInternalServerError, errInternal, "No se pudo generar el nonce"}
+		}
+		payloadMap["nonce"] = nonce
 	}
-	// 2) Serializar canónicamente (sin indentación, keys ordenadas):
-	canonicalData, err := json.Marshal(obj)
+
+	// Ligar el sobre al certificado mTLS del cliente con ?bind=cert
+	if r.URL.Query().Get("bind") == "cert" {
+		thumb, err := clientCertThumbprint(r)
+		if err != nil {
+			return nil, &signFailure{http.StatusBadRequest, errInvalidRequest, err.Error()}
+		}
+		payloadMap[confirmationClaim] = map[string]interface{}{"x5t#S256": thumb}
+	}
+
+	// Cifrar los campos pedidos en ?encrypt= antes de firmar
+	if paths := queryList(r, "encrypt"); len(paths) > 0 {
+		if err := encryptFields(r.Context(), payloadMap, paths); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errInvalidPointer) {
+				status = http.StatusBadRequest
+			}
+			return nil, &signFailure{status, errEncryptionFailed, fmt.Sprintf("No se pudieron cifrar los campos: %v", err)}
+		}
+	}
+
+	// Campos propios del despliegue (ver enrich), cubiertos por la firma
+	if err := applyEnrichers(r, payloadMap); err != nil {
+		status, code := http.StatusInternalServerError, errInternal
+		if errors.Is(err, errEnrichedFieldReserved) {
+			status, code = http.StatusBadRequest, errReservedField
+		}
+		return nil, &signFailure{status, code, err.Error()}
+	}
+
+	// Registrar bajo la firma dónde se ha firmado si la clave tiene región
+	if keyConfigs[alias].Region != "" {
+		payloadMap["signed_in"] = residencyClaim(alias)
+	}
+
+	// Inyectar timestamp UTC de la fuente configurada (ver timesource.go)
+	now, err := signingClock.Now()
+	if err != nil {
+		return nil, &signFailure{http.StatusServiceUnavailable, errTimeSourceUnavailable, err.Error()}
+	}
+	payloadMap["timestamp"] = now.Format(time.RFC3339Nano)
+	if src := signingClock.Name(); src != "system" {
+		payloadMap[timeSourceClaim] = src
+	}
+
+	data, err := canonicalJSONEscaped(payloadMap, escape)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Error interno al serializar payload"})
+		return nil, &signFailure{http.StatusInternalServerError, errInternal, "Error interno al serializar payload"}
+	}
+	return data, nil
+}
+
+// verifyHandler verifica un sobre (ver checkEnvelope). Con ?claims=true
+// devuelve además el documento, redactado (ver redaction.go).
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
 		return
 	}
-	// 3) Decodificar la firma Base64:
-	mac, err := base64.StdEncoding.DecodeString(req.Signature)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Firma Base64 inválida"})
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
 		return
 	}
-	// 4) Verificar con Cloud KMS
-	ctx := context.Background()
-	verifyResp, err := kmsClient.MacVerify(ctx, &kmspb.MacVerifyRequest{
-		Name: nameVersion,
-		Data: canonicalData,
-		Mac:  mac,
-	})
+	resp, res, err := checkEnvelope(r, body)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Error verificando: %v", err)})
+		var f *verifyFailure
+		errors.As(err, &f)
+		writeError(w, f.status, f.code, f.msg)
 		return
 	}
+	if r.URL.Query().Get("claims") == "true" {
+		// El documento verificado, sin lo que el llamante no puede ver
+		claims, redacted, err := redactPayload(r, res.Obj)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+			return
+		}
+		if claims != nil {
+			resp["claims"] = claims
+		}
+		if redacted != nil {
+			resp["redacted"] = redacted
+		}
+	}
+	writeJSON(w, http.StatusOK, selectFields(r, resp))
+}
+
+// checkEnvelope verifica el sobre del body (ver verifyEnvelope), le aplica
+// las políticas de /verify y lo audita. Devuelve la respuesta de /verify
+// sin los claims. Es el núcleo de verificación que comparten /verify y
+// Signer.Verify (ver grpc.go); los errores son *verifyFailure.
+func checkEnvelope(r *http.Request, body []byte) (map[string]interface{}, verifyResult, error) {
+	req, err := decodeVerifyRequest(r, body)
+	if err != nil {
+		return nil, verifyResult{}, &verifyFailure{http.StatusBadRequest, errInvalidJSON, "JSON inválido"}
+	}
+
+	ctx := r.Context()
+	res, err := verifyEnvelope(ctx, &req)
+	if res.Data == nil {
+		// Ni siquiera se llegó a canonicalizar: no hay nada que auditar
+		return nil, res, err
+	}
+	audit := newAuditEntry(r, "verify", res.Key, res.Data)
+	if res.External {
+		audit.Detail = "iss=" + req.Iss
+	}
+	if err != nil {
+		audit.Outcome = "error"
+		if !res.External {
+			audit.Detail = err.Error()
+		}
+		recordAudit(ctx, audit)
+		return nil, res, err
+	}
+	applyVerifyPolicies(r, &res)
+	audit.Outcome = outcomeOf(res.Valid)
+	if res.Reason != "" && !res.External {
+		audit.Detail = res.Reason
+	}
+	recordAudit(ctx, audit)
+	mirrorVerify(r, body, audit.PayloadSHA256, res.Valid)
+
+	resp := map[string]interface{}{"valid": res.Valid}
+	if res.External {
+		resp["issuer"] = req.Iss
+	}
+	if res.KeyHint != "" {
+		resp["key_hint"] = res.KeyHint
+		resp["trusted_key"] = res.Key
+	}
+	if !res.Valid {
+		resp["code"] = res.invalidCode()
+	}
+	if res.Reason != "" {
+		resp["reason"] = res.Reason
+	}
+	if res.Verification != nil {
+		resp["verification"] = res.Verification
+	}
+	if c, flagged := requiresSecondaryValidation(ctx, res.Key, payloadTimestamp(res.Obj)); res.Valid && !res.External && flagged {
+		resp["requires_secondary_validation"] = true
+		resp["compromise_reason"] = c.Reason
+	}
+	return resp, res, nil
+}
+
+// applyVerifyPolicies aplica a un sobre con firma válida lo que exige /verify
+// además de la firma: el certificado al que está ligado, la antigüedad
+// máxima (?maxAge=) y, al final, los reenvíos (el nonce de un sobre válido
+// sólo se acepta una vez)
+func applyVerifyPolicies(r *http.Request, res *verifyResult) {
+	if res.Valid {
+		if reason := checkCertBinding(r, res.Obj); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errCertBinding
+		}
+	}
+	if res.Valid {
+		if reason := checkFreshness(r, res.Obj, time.Now()); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errEnvelopeStale
+		}
+	}
+	if res.Valid {
+		if reason := checkReplay(r.Context(), res.Obj); reason != "" {
+			res.Valid, res.Reason, res.Code = false, reason, errEnvelopeReplayed
+		}
+	}
+}
+
+// kmsSign firma los bytes canónicos con Cloud KMS y devuelve la firma en
+// Base64 (ver kmsSignRaw)
+func kmsSign(ctx context.Context, data []byte) (string, error) {
+	sig, err := kmsSignRaw(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// kmsSignRaw firma con Cloud KMS: el MAC con claves HMAC o la firma
+// asimétrica (ver firmajson.KMS), con la clave del alias de ctx
+func kmsSignRaw(ctx context.Context, data []byte) ([]byte, error) {
+	ctx, end := startSpan(ctx, "sign", attribute.String("key", signingAlias(ctx)), attribute.Int("bytes", len(data)))
+	s, err := signerFor(ctx)
+	if err != nil {
+		end(err)
+		return nil, err
+	}
+	sig, err := s.Sign(ctx, data)
+	end(err)
+	return sig, err
+}
+
+// kmsVerify comprueba que mac es la firma de los bytes canónicos (ver
+// kmsVerifyDetailed)
+func kmsVerify(ctx context.Context, data, mac []byte) (bool, error) {
+	v, err := kmsVerifyDetailed(ctx, data, mac)
+	return v.Valid, err
+}
+
+// kmsVerification describe cómo se verificó una firma
+type kmsVerification = firmajson.Verification
 
-	writeJSON(w, http.StatusOK, map[string]bool{"valid": verifyResp.Success})
+// kmsVerifyDetailed verifica con Cloud KMS si la clave es MAC, o en local
+// con la clave pública si es asimétrica, y devuelve los metadatos de la
+// verificación
+func kmsVerifyDetailed(ctx context.Context, data, mac []byte) (kmsVerification, error) {
+	ctx, end := startSpan(ctx, "verify", attribute.Int("bytes", len(data)))
+	v, err := signer.Verify(ctx, data, mac)
+	end(err)
+	if err == nil && v.IntegrityAnomaly != "" {
+		log.Printf("🚨 MacVerify con integridad incoherente: %s", v.IntegrityAnomaly)
+	}
+	return v, err
 }
 
 // writeJSON emite siempre JSON con el Content-Type adecuado
@@ -164,9 +603,107 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// queryList devuelve los valores de un parámetro de query, admitiendo tanto
+// ?k=a&k=b como ?k=a,b
+func queryList(r *http.Request, key string) []string {
+	var out []string
+	for _, v := range r.URL.Query()[key] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// selectFields recorta la respuesta a los campos pedidos con ?fields=
+// (p.ej. ?fields=signature,key_version), para no devolver el payload entero
+// cuando no hace falta. Sin el parámetro se devuelve completa.
+func selectFields(r *http.Request, resp map[string]interface{}) map[string]interface{} {
+	fields := queryList(r, "fields")
+	if len(fields) == 0 {
+		return resp
+	}
+	out := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if v, ok := resp[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
+
 func getEnv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return def
 }
+
+// registerRoutes registra los handlers HTTP. Está aparte de main para que
+// openapi_test.go compruebe que todas las rutas están documentadas.
+func registerRoutes() {
+	handle("/sign", validated(validateSignRequest, signHandler))
+	handle("/sign/prepare", validated(validateSignRequest, signPrepareHandler))
+	handle("/sign/batch", validated(validateSignBatchRequest, signBatchHandler))
+	handle("/sign/commit", signCommitHandler)
+	handle("/sign/deferred/", deferredHandler)
+	handle("/subscriptions", subscriptionsHandler)
+	handle("/subscriptions/", subscriptionHandler)
+	handle("/sign/manifest", signManifestHandler)
+	handle("/sign/patch", validated(validatePatchRequest, signPatchHandler))
+	handle("/sign/compact", validated(validateSignCompactRequest, signCompactHandler))
+	handle("/sign/bls", validated(validateSignBatchRequest, signBLSHandler))
+	handle("/verify", validated(validateVerifyRequest, verifyHandler))
+	handle("/verify/batch", validated(validateVerifyBatchRequest, verifyBatchHandler))
+	handle("/verify/report", validated(validateVerifyRequest, verifyReportHandler))
+	handle("/verify/jobs", verifyJobsHandler)
+	handle("/verify/jobs/", verifyJobHandler)
+	handle("/verify/manifest", verifyManifestHandler)
+	handle("/verify/compact", verifyCompactHandler)
+	handle("/verify/aggregate", verifyAggregateHandler)
+	handle("/bls/aggregate", blsAggregateHandler)
+	handle("/hash", validated(validateSignRequest, hashHandler))
+	handle("/introspect", introspectHandler)
+	handle("/public/verify", publicVerifyHandler)
+	handle("/decrypt", validated(validateEnvelopeRequest, decryptHandler))
+	handle("/admin/anomalies", anomaliesHandler)
+	handle("/admin/approvals", approvalsHandler)
+	handle("/admin/blocked/", blockedCallerHandler)
+	handle("/admin/audit", auditQueryHandler)
+	handle("/admin/envelopes", envelopesListHandler)
+	handle("/admin/envelopes/", envelopesAdminHandler)
+	handle("/admin/dpop/keys/", dpopKeyHandler)
+	handle("/admin/export", exportHandler)
+	handle("/admin/holds", legalHoldsHandler)
+	handle("/admin/holds/", legalHoldsHandler)
+	handle("/admin/keys", keysListHandler)
+	handle("/admin/keys/", keysAdminHandler)
+	handle("/admin/diagnose", diagnoseHandler)
+	handle("/admin/owners/", ownerHandler)
+	handle("/admin/mirror", mirrorHandler)
+	handle("/admin/pubsub", pubsubHandler)
+	handle("/admin/pubsub/", pubsubHandler)
+	handle("/admin/replica", replicaHandler)
+	handle("/admin/replica/reconcile", replicaHandler)
+	handle("/admin/schedules", schedulesHandler)
+	handle("/admin/schedules/", schedulesHandler)
+	handle("/admin/shadow", shadowHandler)
+	handle("/admin/kms/pacer", kmsPacerHandler)
+	handle("/admin/trust/keys", trustKeysHandler)
+	handle("/admin/trust/keys/", trustKeyHandler)
+	handle("/usage", usageHandler)
+	handle("/errors", errorsHandler)
+	handle("/openapi.json", openapiHandler)
+	handle("/healthz", healthHandler)
+	handle("/metrics", metricsHandler)
+	handle("/version", versionHandler)
+	handle("/.well-known/openid-federation", issuerMetadataHandler)
+	handle("/.well-known/jwks.json", jwksHandler)
+	handle("/keys/", keyPublicHandler)
+	handle("/.well-known/firma-json", discoveryHandler)
+	handle("/.well-known/firma-json/keys", rotationFeedHandler)
+	handle("/config/snapshot", configSnapshotHandler)
+	handle("/config/snapshots", configSnapshotsHandler)
+}
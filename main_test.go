@@ -0,0 +1,68 @@
+// main_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Los tests usan el backend local (HMAC en proceso) y el store en memoria:
+// no necesitan red ni credenciales.
+func TestMain(m *testing.M) {
+	os.Setenv("SIGNER_BACKEND", backendLocal)
+	os.Setenv("LOCAL_HMAC_SECRET", "secreto-de-test-de-al-menos-32-bytes")
+	configureSignerBackend()
+	if err := configureEntropy(); err != nil {
+		log.Fatalf("entropía: %v", err)
+	}
+	db = newMemoryStore()
+	if err := initKMS(); err != nil {
+		log.Fatalf("KMS: %v", err)
+	}
+	os.Exit(m.Run())
+}
+
+// doJSON llama a h con body y devuelve el código y la respuesta decodificada
+func doJSON(t *testing.T, h http.HandlerFunc, method, target string, body interface{}, header http.Header) (int, map[string]interface{}) {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(raw))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	var out map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s %s: respuesta ilegible %q", method, target, rec.Body.String())
+	}
+	return rec.Code, out
+}
+
+// testSign firma doc con POST /sign y las opciones de query
+func testSign(t *testing.T, query string, doc interface{}, header http.Header) map[string]interface{} {
+	t.Helper()
+	code, resp := doJSON(t, validated(validateSignRequest, signHandler), http.MethodPost, "/sign"+query, doc, header)
+	if code != http.StatusOK {
+		t.Fatalf("/sign%s: %d %v", query, code, resp)
+	}
+	return resp
+}
+
+// testVerify verifica env con POST /verify
+func testVerify(t *testing.T, env interface{}, header http.Header) map[string]interface{} {
+	t.Helper()
+	code, resp := doJSON(t, validated(validateVerifyRequest, verifyHandler), http.MethodPost, "/verify", env, header)
+	if code != http.StatusOK {
+		t.Fatalf("/verify: %d %v", code, resp)
+	}
+	return resp
+}
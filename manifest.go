@@ -0,0 +1,313 @@
+// manifest.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Un manifiesto firma un conjunto de documentos como un paquete (p.ej. el
+// cierre mensual): cada documento se firma con la clave de su doc_type
+// (KEYS_FILE, ver keys.go) y el manifiesto, firmado con la clave del
+// servicio, fija el orden, el hash canónico y la versión de clave de cada
+// uno. Se verifica como una unidad con POST /verify/manifest: si falta,
+// sobra, se reordena o se altera un documento, el paquete no es válido.
+
+// manifestType identifica los manifiestos dentro del propio payload firmado
+const manifestType = "firma-json/manifest"
+
+// manifestEntry es la línea del manifiesto de un documento
+type manifestEntry struct {
+	Index      int    `json:"index"`
+	DocType    string `json:"doc_type,omitempty"`
+	Key        string `json:"key"`
+	KeyVersion string `json:"key_version"`
+	SHA256     string `json:"sha256"`
+}
+
+// manifestDocument es un documento firmado del paquete
+type manifestDocument struct {
+	Index      int             `json:"index"`
+	Payload    json.RawMessage `json:"payload"`
+	Signature  string          `json:"signature"`
+	KeyVersion string          `json:"key_version"`
+}
+
+// signManifestRequest es el cuerpo de /sign/manifest
+type signManifestRequest struct {
+	Name      string          `json:"name"`
+	Documents []manifestInput `json:"documents"`
+}
+
+// manifestInput es un documento a firmar dentro del paquete
+type manifestInput struct {
+	DocType string          `json:"doc_type,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// signManifestHandler firma un paquete (POST /sign/manifest) con
+// {"name": "...", "documents": [{"doc_type": "...", "key": "...", "payload": {...}}]}.
+// key es opcional: por defecto, el alias que reclama el doc_type. Todos los
+// documentos llevan el mismo "timestamp". La respuesta se puede enviar tal
+// cual a /verify/manifest.
+func signManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !requireDPoP(w, r) || !guardCaller(w, r) {
+		return
+	}
+	var req signManifestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	if max := envInt("MANIFEST_MAX_DOCUMENTS", 500); len(req.Documents) == 0 || len(req.Documents) > max {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("documents debe tener entre 1 y %d documentos", max))
+		return
+	}
+
+	now, err := signingClock.Now()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errTimeSourceUnavailable, err.Error())
+		return
+	}
+	timestamp := now.Format(time.RFC3339Nano)
+
+	// Validar todo antes de la primera llamada a KMS
+	var problems []validationProblem
+	payloads := make([]map[string]interface{}, len(req.Documents))
+	entries := make([]manifestEntry, len(req.Documents))
+	authorized := map[string]bool{}
+	for i, d := range req.Documents {
+		field := fmt.Sprintf("documents[%d]", i)
+		alias := d.Key
+		if alias == "" {
+			alias = aliasForDocType(d.DocType)
+		}
+		if _, known := keyConfigs[alias]; !known && alias != defaultKeyAlias {
+			problems = append(problems, validationProblem{Field: field + ".key", Code: errUnknownKey, Message: fmt.Sprintf("Alias de clave desconocido: %q", alias)})
+			continue
+		}
+		if err := firmajson.DecodeJSON(d.Payload, &payloads[i]); err != nil || payloads[i] == nil {
+			problems = append(problems, validationProblem{Field: field + ".payload", Code: errInvalidPayload, Message: "El payload debe ser un objeto JSON"})
+			continue
+		}
+		if _, exists := payloads[i]["timestamp"]; exists {
+			problems = append(problems, validationProblem{Field: field + ".payload.timestamp", Code: errReservedField, Message: `El campo "timestamp" está reservado`})
+			continue
+		}
+		if !authorized[alias] {
+			if !authorizeSigning(w, r, alias) {
+				return
+			}
+			authorized[alias] = true
+		}
+		payloads[i]["timestamp"] = timestamp
+		entries[i] = manifestEntry{Index: i, DocType: d.DocType, Key: alias, KeyVersion: aliasKeyVersion(alias)}
+	}
+	if len(problems) > 0 {
+		writeValidationProblems(w, problems)
+		return
+	}
+
+	documents := make([]manifestDocument, len(entries))
+	for i := range entries {
+		data, err := canonicalJSON(payloads[i])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("documents[%d]: %v", i, err))
+			return
+		}
+		ctx := withKeyPriority(r.Context(), entries[i].Key)
+		meta := metaOf(r)
+		meta.DocType = entries[i].DocType
+		audit := newAuditEntryFor(meta, "sign_manifest", entries[i].Key, data)
+		audit.Detail = fmt.Sprintf("index=%d", i)
+		sig, err := kmsSignRaw(ctx, data)
+		if err != nil {
+			audit.Outcome, audit.Detail = "error", audit.Detail+" "+err.Error()
+			recordAudit(ctx, audit)
+			writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando documents[%d]: %v", i, err))
+			return
+		}
+		audit.Outcome = "ok"
+		recordAudit(ctx, audit)
+		sum := sha256.Sum256(data)
+		entries[i].SHA256 = hex.EncodeToString(sum[:])
+		documents[i] = manifestDocument{Index: i, Payload: data, Signature: base64.StdEncoding.EncodeToString(sig), KeyVersion: entries[i].KeyVersion}
+	}
+
+	manifest := map[string]interface{}{
+		"type":      manifestType,
+		"timestamp": timestamp,
+		"documents": entries,
+	}
+	if req.Name != "" {
+		manifest["name"] = req.Name
+	}
+	// Se canonicaliza desde su forma JSON genérica, la misma que verá
+	// /verify/manifest
+	raw, _ := json.Marshal(manifest)
+	var generic interface{}
+	firmajson.DecodeJSON(raw, &generic)
+	data, err := canonicalJSON(generic)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+		return
+	}
+	ctx := r.Context()
+	audit := newAuditEntry(r, "sign_manifest", defaultKeyAlias, data)
+	audit.Detail = fmt.Sprintf("documents=%d", len(documents))
+	signature, err := kmsSign(ctx, data)
+	if err != nil {
+		audit.Outcome, audit.Detail = "error", err.Error()
+		recordAudit(ctx, audit)
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando el manifiesto: %v", err))
+		return
+	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"manifest":    json.RawMessage(data),
+		"signature":   signature,
+		"key_version": nameVersion,
+		"documents":   documents,
+	})
+}
+
+// manifestItemResult es el resultado de verificar una parte del paquete
+type manifestItemResult struct {
+	Index  int    `json:"index"`
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// verifyManifestRequest es el cuerpo de /verify/manifest: la respuesta de
+// /sign/manifest tal cual
+type verifyManifestRequest struct {
+	Manifest   json.RawMessage    `json:"manifest"`
+	Signature  string             `json:"signature"`
+	KeyVersion string             `json:"key_version,omitempty"`
+	Documents  []manifestDocument `json:"documents"`
+}
+
+// verifyManifestHandler verifica un paquete (POST /verify/manifest): la
+// firma del manifiesto y, documento a documento, su firma, su hash y su
+// posición. El paquete sólo es válido si lo es todo.
+func verifyManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	var req verifyManifestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	var generic interface{}
+	if err := firmajson.DecodeJSON(req.Manifest, &generic); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidPayload, "manifest no es JSON válido")
+		return
+	}
+	var manifest struct {
+		Type      string          `json:"type"`
+		Documents []manifestEntry `json:"documents"`
+	}
+	if err := json.Unmarshal(req.Manifest, &manifest); err != nil || manifest.Type != manifestType {
+		writeError(w, http.StatusBadRequest, errInvalidPayload, "manifest no es un manifiesto de firma-json")
+		return
+	}
+	ctx := r.Context()
+
+	out := map[string]interface{}{}
+	head := verifyManifestPart(ctx, req.KeyVersion, generic, req.Signature)
+	out["manifest"] = struct {
+		Valid  bool   `json:"valid"`
+		Reason string `json:"reason,omitempty"`
+	}{head.Valid, head.Reason}
+	valid := head.Valid
+
+	if len(req.Documents) != len(manifest.Documents) {
+		valid = false
+		out["reason"] = fmt.Sprintf("El manifiesto tiene %d documentos y se han enviado %d", len(manifest.Documents), len(req.Documents))
+	}
+	results := make([]manifestItemResult, len(req.Documents))
+	for i, d := range req.Documents {
+		results[i] = manifestItemResult{Index: i}
+		if i >= len(manifest.Documents) {
+			results[i].Reason = "El documento no está en el manifiesto"
+			continue
+		}
+		entry := manifest.Documents[i]
+		var obj interface{}
+		if err := firmajson.DecodeJSON(d.Payload, &obj); err != nil {
+			results[i].Reason = "payload no es JSON válido"
+			continue
+		}
+		data, err := canonicalJSON(obj)
+		if err != nil {
+			results[i].Reason = err.Error()
+			continue
+		}
+		sum := sha256.Sum256(data)
+		switch {
+		case entry.Index != i || (d.Index != 0 && d.Index != i):
+			results[i].Reason = "El documento no está en la posición que fija el manifiesto"
+		case hex.EncodeToString(sum[:]) != entry.SHA256:
+			results[i].Reason = "El hash del documento no coincide con el del manifiesto"
+		case d.KeyVersion != "" && d.KeyVersion != entry.KeyVersion:
+			results[i].Reason = "key_version no coincide con la del manifiesto"
+		default:
+			res := verifyManifestPart(ctx, entry.KeyVersion, obj, d.Signature)
+			results[i].Valid, results[i].Reason = res.Valid, res.Reason
+		}
+		valid = valid && results[i].Valid
+	}
+	out["documents"] = results
+	out["valid"] = valid
+	writeJSON(w, http.StatusOK, out)
+}
+
+// verifyManifestPart verifica una firma del paquete con su versión de clave
+func verifyManifestPart(ctx context.Context, keyVersion string, obj interface{}, signature string) manifestItemResult {
+	var res manifestItemResult
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		res.Reason = "La firma no es Base64 válido"
+		return res
+	}
+	if keyVersion == "" {
+		keyVersion = nameVersion
+	}
+	s, err := signerForKeyVersion(keyVersion)
+	if err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	data, err := canonicalJSON(obj)
+	if err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	v, err := s.Verify(ctx, data, sig)
+	if err != nil {
+		res.Reason = fmt.Sprintf("Error verificando: %v", err)
+		return res
+	}
+	res.Valid = v.Valid
+	if !v.Valid {
+		res.Reason = "Firma no válida"
+	}
+	return res
+}
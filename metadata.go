@@ -0,0 +1,167 @@
+// metadata.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metadataMu      sync.Mutex
+	metadataCached  map[string]interface{}
+	metadataExpires time.Time
+)
+
+// keyVersionAlgorithm devuelve el algoritmo de la CryptoKeyVersion con la
+// que firmamos (la del alias de ctx), p.ej. HMAC_SHA256 o EC_SIGN_P256_SHA256
+func keyVersionAlgorithm(ctx context.Context) (string, error) {
+	s, err := signerFor(ctx)
+	if err != nil {
+		return "", err
+	}
+	k, err := s.Key(ctx)
+	if err != nil {
+		return "", err
+	}
+	return k.KMSAlgorithm, nil
+}
+
+// addSignatureInfo añade a la respuesta de firma el algoritmo, la longitud
+// de la firma, el alias y la versión de clave, para que el consumidor
+// compruebe que integra contra el tipo de clave esperado. Si KMS no responde se omite el
+// algoritmo en vez de fallar la firma.
+func addSignatureInfo(ctx context.Context, resp map[string]interface{}, signature string) {
+	if alg, err := keyVersionAlgorithm(ctx); err == nil {
+		resp["alg"] = alg
+	}
+	if mac, err := base64.StdEncoding.DecodeString(signature); err == nil {
+		resp["signature_length"] = len(mac)
+	}
+	resp["key"] = signingAlias(ctx)
+	resp["key_version"] = aliasKeyVersion(signingAlias(ctx))
+}
+
+// checkSignatureHints compara las pistas opcionales de /verify con las
+// versiones de clave aceptadas (ver rotation.go) y devuelve el motivo de la
+// discrepancia, o "" si todo cuadra. alg se comprueba con la versión que se
+// use para verificar.
+func checkSignatureHints(keyVersion string, sigLen int, mac []byte) string {
+	if keyVersion != "" && !acceptedKeyVersion(keyVersion) {
+		return fmt.Sprintf("key_version %s no es una versión de firma aceptada", keyVersion)
+	}
+	if sigLen != 0 && sigLen != len(mac) {
+		return fmt.Sprintf("signature_length %d no coincide con la firma (%d bytes)", sigLen, len(mac))
+	}
+	return ""
+}
+
+// publicBaseURL es la URL pública del servicio (PUBLIC_BASE_URL) o, si no
+// está definida, la deducida de la propia petición
+func publicBaseURL(r *http.Request) string {
+	if base := getEnv("PUBLIC_BASE_URL", ""); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	scheme := "https"
+	if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") == "http" {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+// issuerMetadataHandler publica en /.well-known/openid-federation los
+// metadatos del emisor firmados, para que los terceros puedan configurar la
+// confianza en este servicio de forma automática. La firma se cachea
+// METADATA_TTL para no llamar a KMS en cada petición.
+func issuerMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	iss := issuerID()
+	if iss == "" {
+		writeError(w, http.StatusNotFound, errNotConfigured, "ISSUER_ID no está definido")
+		return
+	}
+
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	if metadataCached != nil && time.Now().Before(metadataExpires) {
+		writeJSON(w, http.StatusOK, metadataCached)
+		return
+	}
+
+	ttl, err := time.ParseDuration(getEnv("METADATA_TTL", "1h"))
+	if err != nil {
+		ttl = time.Hour
+	}
+	ctx := r.Context()
+	alg, err := keyVersionAlgorithm(ctx)
+	if err != nil {
+		writeKMSError(w, err, errKMSError, fmt.Sprintf("Error consultando la clave: %v", err))
+		return
+	}
+	now := time.Now().UTC()
+	base := publicBaseURL(r)
+	payload := map[string]interface{}{
+		"iss":                  iss,
+		"sub":                  iss,
+		"iat":                  now.Unix(),
+		"exp":                  now.Add(ttl).Unix(),
+		"jwks_uri":             base + "/.well-known/jwks.json",
+		"verify_endpoint":      base + "/verify",
+		"signing_algs":         []string{alg},
+		"envelope_formats":     []string{"firma-json"},
+		"verification_methods": verificationMethods(),
+		"timestamp":            now.Format(time.RFC3339Nano),
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	signature, err := kmsSign(ctx, data)
+	if err != nil {
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+
+	metadataCached = map[string]interface{}{
+		"payload":   payload,
+		"signature": signature,
+		"iss":       iss,
+	}
+	metadataExpires = now.Add(ttl)
+	writeJSON(w, http.StatusOK, metadataCached)
+}
+
+// jwksHandler publica nuestras claves públicas de verificación (ver
+// publickeys.go). Con claves MAC el conjunto está vacío.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	keys, err := jwksKeys(r.Context())
+	if err != nil {
+		writeKMSError(w, err, errKMSError, fmt.Sprintf("Error consultando la clave: %v", err))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jwkSet{Keys: keys})
+}
+
+// verificationMethods son las formas de identificar claves ajenas que
+// acepta /verify: siempre jwks y los métodos DID habilitados
+func verificationMethods() []string {
+	methods := []string{"jwks"}
+	for _, m := range envList("DID_METHODS") {
+		methods = append(methods, "did:"+m)
+	}
+	return methods
+}
@@ -0,0 +1,366 @@
+// metrics.go
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Métricas en formato de texto de Prometheus (GET /metrics). Si
+// METRICS_TOKEN está definido hay que presentarlo en "Authorization:
+// Bearer" (bearer_token en la configuración del scrape).
+//
+//	firmajson_http_requests_total{route,method,status}
+//	firmajson_http_request_duration_seconds{route}       histograma
+//	firmajson_request_body_bytes{route}                  histograma, sólo POST
+//	firmajson_operations_total{event,outcome}            firmas y verificaciones, de la auditoría
+//	firmajson_errors_total{code}                         respuestas de error por código
+//	firmajson_kms_requests_total{method,code}            llamadas a Cloud KMS por código gRPC
+//	firmajson_kms_request_duration_seconds{method}       histograma, sin la espera del pacer
+//	firmajson_kms_retries_total{method,code}             reintentos por fallos pasajeros
+//	firmajson_kms_pacer_saturated_total{class}           llamadas que el pacer rechazó
+//	firmajson_kms_ready                                  1 fuera del modo degradado
+//	firmajson_pubsub_outstanding_messages / _bytes       pendientes de publicar (ver pubsub.go)
+//	firmajson_pubsub_published_total, _dead_letters_total
+//
+// Si el scraper pide OpenMetrics (Accept: application/openmetrics-text, lo
+// que hace Prometheus con exemplar storage activado) y hay trazas, los
+// histogramas de latencia llevan ejemplares: por cada cubeta, la última
+// observación de una traza muestreada con su trace_id, así que un pico en
+// el p99 de /sign lleva directamente a trazas representativas.
+//
+// Para avisar cuando KMS empieza a limitarnos basta con
+// rate(firmajson_kms_requests_total{code="ResourceExhausted"}[5m]) > 0 o con
+// la subida del p99 de firmajson_kms_request_duration_seconds. route es el
+// patrón registrado, no la ruta, para no disparar la cardinalidad con ids.
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+)
+
+var (
+	httpRequests = newCounterVec("firmajson_http_requests_total",
+		"Peticiones HTTP atendidas", "route", "method", "status")
+	httpDuration = newHistogramVec("firmajson_http_request_duration_seconds",
+		"Duración de las peticiones HTTP", latencyBuckets, "route")
+	requestBodyBytes = newHistogramVec("firmajson_request_body_bytes",
+		"Tamaño del cuerpo de las peticiones POST", sizeBuckets, "route")
+	operations = newCounterVec("firmajson_operations_total",
+		"Operaciones auditadas (firmas, verificaciones...) por resultado", "event", "outcome")
+	errorResponses = newCounterVec("firmajson_errors_total",
+		"Respuestas de error por código", "code")
+	kmsRequests = newCounterVec("firmajson_kms_requests_total",
+		"Llamadas a Cloud KMS por método y código gRPC", "method", "code")
+	kmsDuration = newHistogramVec("firmajson_kms_request_duration_seconds",
+		"Latencia de las llamadas a Cloud KMS", latencyBuckets, "method")
+	kmsRetries = newCounterVec("firmajson_kms_retries_total",
+		"Reintentos de llamadas a KMS por fallos pasajeros", "method", "code")
+	kmsPacerSaturated = newCounterVec("firmajson_kms_pacer_saturated_total",
+		"Llamadas a KMS rechazadas por el pacer al superar KMS_PACER_MAX_WAIT", "class")
+)
+
+// metricsHandler publica las métricas
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	if token := getEnv("METRICS_TOKEN", ""); token != "" {
+		if got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errUnauthorized, "Token de métricas inválido")
+			return
+		}
+	}
+	om := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if om {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	writeMetrics(w, om)
+}
+
+// writeMetrics escribe todas las métricas en formato de texto de
+// Prometheus o, con om, en OpenMetrics con ejemplares
+func writeMetrics(w io.Writer, om bool) {
+	for _, c := range []*counterVec{httpRequests, operations, errorResponses, kmsRequests, kmsRetries, kmsPacerSaturated} {
+		c.write(w, om)
+	}
+	for _, h := range []*histogramVec{httpDuration, requestBodyBytes, kmsDuration} {
+		h.write(w, om)
+	}
+	ready := 0
+	if kmsReady.Load() {
+		ready = 1
+	}
+	writeMetric(w, om, "firmajson_kms_ready", "gauge", "1 si KMS está listo, 0 en modo degradado", ready)
+	if activeReplica != nil {
+		writeMetric(w, om, "firmajson_store_replica_pending", "gauge", "escrituras pendientes de replicar", len(activeReplica.queue))
+		writeMetric(w, om, "firmajson_store_replica_dropped_total", "counter", "escrituras que no se encolaron y esperan a la reconciliación", activeReplica.dropped.Load())
+	}
+	if p := activePublisher; p != nil {
+		messages, bytes := p.flow.outstanding()
+		writeMetric(w, om, "firmajson_pubsub_outstanding_messages", "gauge", "sobres pendientes de publicar", messages)
+		writeMetric(w, om, "firmajson_pubsub_outstanding_bytes", "gauge", "bytes pendientes de publicar", bytes)
+		writeMetric(w, om, "firmajson_pubsub_published_total", "counter", "sobres publicados", p.published.Load())
+		writeMetric(w, om, "firmajson_pubsub_dead_letters_total", "counter", "sobres enviados a fallidos", p.deadLetters.Load())
+	}
+	if om {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// metricFamily es el nombre de la familia en la cabecera: en OpenMetrics
+// los contadores se declaran sin el sufijo _total
+func metricFamily(name, typ string, om bool) string {
+	if om && typ == "counter" {
+		return strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// writeMetric escribe una métrica sin etiquetas
+func writeMetric(w io.Writer, om bool, name, typ, help string, value interface{}) {
+	family := metricFamily(name, typ, om)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", family, help, family, typ, name, value)
+}
+
+// metricsMiddleware cuenta las peticiones, su duración y el tamaño del
+// cuerpo
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		var body *countingReader
+		if r.Method == http.MethodPost && r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+		next.ServeHTTP(rec, r)
+
+		route := metricsRoute(r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.observeCtx(r.Context(), time.Since(start).Seconds(), route)
+		if body != nil {
+			requestBodyBytes.observe(float64(body.n), route)
+		}
+	})
+}
+
+// metricsRoute es el patrón del mux que atiende la petición
+func metricsRoute(r *http.Request) string {
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
+// countingReader cuenta los bytes leídos del cuerpo
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// kmsMetricsInterceptor mide cada llamada a KMS. Va detrás del pacer, así
+// que la latencia es la de KMS y no incluye la espera por la cuota.
+func kmsMetricsInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	name := method[strings.LastIndex(method, "/")+1:]
+	kmsDuration.observeCtx(ctx, time.Since(start).Seconds(), name)
+	kmsRequests.inc(name, status.Code(err).String())
+	return err
+}
+
+// observePacerError cuenta los rechazos del pacer por saturación
+func observePacerError(ctx context.Context, err error) {
+	if errors.Is(err, errPacerSaturated) {
+		kmsPacerSaturated.inc(priorityOf(ctx))
+	}
+}
+
+// counterVec es un contador con etiquetas
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := labelKey(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, om bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	family := metricFamily(c.name, "counter", om)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, c.help, family)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec es un histograma con etiquetas
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // por cubeta, no acumulado
+	count  uint64
+	sum    float64
+	// exemplars es el último ejemplar de cada cubeta, +Inf la última
+	exemplars []*exemplar
+}
+
+// exemplar es una observación con la traza en la que se hizo
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.observeWithExemplar(v, "", values...)
+}
+
+// observeCtx observa v con la traza de ctx como ejemplar, si se muestrea
+func (h *histogramVec) observeCtx(ctx context.Context, v float64, values ...string) {
+	h.observeWithExemplar(v, exemplarTraceID(ctx), values...)
+}
+
+// observeWithExemplar observa v y, si traceID no es "", lo guarda como
+// ejemplar de su cubeta en lugar del anterior
+func (h *histogramVec) observeWithExemplar(v float64, traceID string, values ...string) {
+	key := labelKey(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets)), exemplars: make([]*exemplar, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	if traceID != "" {
+		s.exemplars[i] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer, om bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, withLabel(key, "le", formatFloat(b)), cum, s.exemplar(i, om))
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, withLabel(key, "le", "+Inf"), s.count, s.exemplar(len(h.buckets), om))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// exemplar es el ejemplar de la cubeta i en OpenMetrics, o "" si no hay
+func (s *histogram) exemplar(i int, om bool) string {
+	e := s.exemplars[i]
+	if !om || e == nil {
+		return ""
+	}
+	return fmt.Sprintf(` # {trace_id="%s"} %s %s`, e.traceID, formatFloat(e.value), strconv.FormatFloat(float64(e.at.UnixMilli())/1000, 'f', 3, 64))
+}
+
+// labelEscaper escapa un valor de etiqueta como pide el formato de texto
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelKey compone {a="x",b="y"}, que sirve a la vez de clave y de texto
+func labelKey(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = n + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withLabel añade una etiqueta a una clave de labelKey
+func withLabel(key, name, value string) string {
+	l := name + `="` + labelEscaper.Replace(value) + `"`
+	if key == "" {
+		return "{" + l + "}"
+	}
+	return key[:len(key)-1] + "," + l + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,58 @@
+// metrics_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Las observaciones hechas dentro de una traza muestreada salen como
+// ejemplares en OpenMetrics y no en el formato de texto clásico
+func TestHistogramExemplars(t *testing.T) {
+	h := newHistogramVec("test_duration_seconds", "test", latencyBuckets, "route")
+
+	sampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample()))
+	ctx, span := sampled.Tracer("test").Start(context.Background(), "sign")
+	h.observeCtx(ctx, 0.3, "/sign")
+	span.End()
+	id := span.SpanContext().TraceID().String()
+
+	unsampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()))
+	ctx, span = unsampled.Tracer("test").Start(context.Background(), "sign")
+	h.observeCtx(ctx, 0.02, "/sign")
+	span.End()
+
+	var om bytes.Buffer
+	h.write(&om, true)
+	want := `test_duration_seconds_bucket{route="/sign",le="0.5"} 2 # {trace_id="` + id + `"} 0.3 `
+	if !strings.Contains(om.String(), want) {
+		t.Fatalf("falta el ejemplar %q en:\n%s", want, om.String())
+	}
+	if n := strings.Count(om.String(), "trace_id="); n != 1 {
+		t.Fatalf("%d ejemplares, se esperaba sólo el de la traza muestreada:\n%s", n, om.String())
+	}
+
+	var text bytes.Buffer
+	h.write(&text, false)
+	if strings.Contains(text.String(), "trace_id") {
+		t.Fatalf("el formato de texto clásico no admite ejemplares:\n%s", text.String())
+	}
+}
+
+// En OpenMetrics los contadores se declaran sin _total y el texto acaba en
+// # EOF
+func TestOpenMetricsFormat(t *testing.T) {
+	var out bytes.Buffer
+	writeMetrics(&out, true)
+	s := out.String()
+	if !strings.HasSuffix(s, "# EOF\n") {
+		t.Fatalf("falta # EOF al final")
+	}
+	if !strings.Contains(s, "# TYPE firmajson_http_requests counter\n") {
+		t.Fatalf("la familia del contador debe ir sin _total:\n%s", s)
+	}
+}
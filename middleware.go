@@ -0,0 +1,136 @@
+// middleware.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// middleware envuelve un handler. Es el punto de extensión de la capa HTTP:
+// autenticación, límites, logs, métricas o políticas propias de cada
+// organización se añaden como middleware sin tocar los handlers.
+//
+// Cada despliegue registra los suyos desde el init() de un fichero propio:
+//
+//	func init() {
+//		registerMiddleware("corp-policy", func(next http.Handler) http.Handler {
+//			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//				if r.Header.Get("X-Corp-Zone") == "" {
+//					writeError(w, http.StatusForbidden, errUnauthorized, "Zona desconocida")
+//					return
+//				}
+//				next.ServeHTTP(w, r)
+//			})
+//		})
+//	}
+//
+// El orden de la cadena es: recuperación de panics, el recuento de
+// peticiones en curso (ver shutdown.go), trazas (ver tracing.go),
+// métricas, log de acceso, el límite del cuerpo (ver bodylimit.go), el
+// bloqueo del modo degradado (ver startup.go), los registrados (en orden de
+// registro, el primero es el más externo) y por último el enrutado a los
+// handlers, que aplican después su validación (validated) y sus propias
+// comprobaciones.
+type middleware func(http.Handler) http.Handler
+
+type namedMiddleware struct {
+	name string
+	mw   middleware
+}
+
+var (
+	middlewaresMu sync.Mutex
+	middlewares   []namedMiddleware
+)
+
+// registerMiddleware añade un middleware al final de la cadena
+func registerMiddleware(name string, mw middleware) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	middlewares = append(middlewares, namedMiddleware{name, mw})
+}
+
+// chain aplica los middlewares a h; el primero queda como el más externo
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// buildHandler monta la cadena completa alrededor del enrutador
+func buildHandler(mux http.Handler) http.Handler {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	mws := []middleware{recoverMiddleware, inFlightMiddleware, tracingMiddleware, metricsMiddleware, accessLogMiddleware, bodyLimitMiddleware, kmsReadyMiddleware}
+	for _, m := range middlewares {
+		log.Printf("Middleware: %s", m.name)
+		mws = append(mws, m.mw)
+	}
+	return chain(mux, mws...)
+}
+
+// statusRecorder recuerda el código y el tamaño de la respuesta
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap deja a http.ResponseController llegar al writer original
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// recoverMiddleware convierte un panic de un handler en un 500 con código
+// en vez de cortar la conexión
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				log.Printf("❌ panic en %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				if rec.status == 0 {
+					writeError(w, http.StatusInternalServerError, errInternal, "Error interno")
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// accessLogMiddleware escribe una línea por petición con ACCESS_LOG=true
+func accessLogMiddleware(next http.Handler) http.Handler {
+	if getEnv("ACCESS_LOG", "false") != "true" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		line := fmt.Sprintf("%s %s %d %dB %s caller=%s", r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start).Round(time.Microsecond), callerID(r))
+		if id := traceID(r.Context()); id != "" {
+			line += " trace=" + id
+		}
+		log.Print(line)
+	})
+}
@@ -0,0 +1,146 @@
+// mirror.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// El espejo de /verify reenvía una muestra (MIRROR_VERIFY_PERCENT) de las
+// peticiones de verificación a otro backend o entorno (MIRROR_VERIFY_URL) y
+// compara su resultado con el nuestro. Sirve para validar una nueva
+// canonicalización o un nuevo backend con entradas reales de producción.
+// Las discrepancias se registran con el hash del payload, nunca con el
+// payload.
+
+// mirrorMismatch es una discrepancia entre producción y el espejo
+type mirrorMismatch struct {
+	Time          time.Time `json:"time"`
+	PayloadSHA256 string    `json:"payload_sha256"`
+	Primary       bool      `json:"primary"`
+	Mirror        bool      `json:"mirror"`
+}
+
+type mirrorStats struct {
+	URL        string           `json:"url"`
+	Percent    float64          `json:"percent"`
+	Sent       int              `json:"sent"`
+	Dropped    int              `json:"dropped"`
+	Errors     int              `json:"errors"`
+	Matches    int              `json:"matches"`
+	Mismatches int              `json:"mismatches"`
+	Recent     []mirrorMismatch `json:"recent"`
+}
+
+// mirrorRecentMax es cuántas discrepancias recientes se conservan
+const mirrorRecentMax = 50
+
+var (
+	mirrorMu       sync.Mutex
+	mirrorCounts   mirrorStats
+	mirrorInFlight = make(chan struct{}, 16)
+	mirrorClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+func mirrorPercent() float64 {
+	p, err := strconv.ParseFloat(getEnv("MIRROR_VERIFY_PERCENT", "0"), 64)
+	if err != nil || p < 0 {
+		return 0
+	}
+	return p
+}
+
+// mirrorVerify reenvía la petición original al espejo en segundo plano. Si
+// ya hay demasiadas en vuelo se descarta, para no afectar a producción.
+// Las peticiones que ya vienen de un espejo no se reenvían.
+func mirrorVerify(r *http.Request, body []byte, payloadSHA256 string, valid bool) {
+	url := getEnv("MIRROR_VERIFY_URL", "")
+	if url == "" || r.Header.Get("X-Mirrored") != "" || rand.Float64()*100 >= mirrorPercent() {
+		return
+	}
+	select {
+	case mirrorInFlight <- struct{}{}:
+	default:
+		mirrorMu.Lock()
+		mirrorCounts.Dropped++
+		mirrorMu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-mirrorInFlight }()
+		mirrorValid, err := postMirror(url, body)
+
+		mirrorMu.Lock()
+		defer mirrorMu.Unlock()
+		mirrorCounts.Sent++
+		switch {
+		case err != nil:
+			mirrorCounts.Errors++
+			log.Printf("⚠️  Espejo de verify: %v", err)
+		case mirrorValid == valid:
+			mirrorCounts.Matches++
+		default:
+			mirrorCounts.Mismatches++
+			log.Printf("⚠️  Espejo de verify discrepa en %s: producción=%v espejo=%v", payloadSHA256, valid, mirrorValid)
+			mirrorCounts.Recent = append(mirrorCounts.Recent, mirrorMismatch{
+				Time: time.Now().UTC(), PayloadSHA256: payloadSHA256, Primary: valid, Mirror: mirrorValid,
+			})
+			if n := len(mirrorCounts.Recent); n > mirrorRecentMax {
+				mirrorCounts.Recent = mirrorCounts.Recent[n-mirrorRecentMax:]
+			}
+		}
+	}()
+}
+
+func postMirror(url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Para que el espejo no vuelva a reenviarla
+	req.Header.Set("X-Mirrored", "1")
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var out struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+	return out.Valid, nil
+}
+
+// mirrorHandler devuelve las estadísticas del espejo (GET /admin/mirror)
+func mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	mirrorMu.Lock()
+	stats := mirrorCounts
+	stats.Recent = append([]mirrorMismatch{}, mirrorCounts.Recent...)
+	mirrorMu.Unlock()
+	stats.URL = getEnv("MIRROR_VERIFY_URL", "")
+	stats.Percent = mirrorPercent()
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,47 @@
+// nonce.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// nonceInfo separa las derivaciones HKDF de nonces de cualquier otro uso de
+// la misma semilla
+const nonceInfo = "firma-json nonce v1"
+
+// nonceRequested indica si al firmar se inyecta un nonce: con ?nonce=true,
+// con X-Nonce-Seed o siempre con NONCE_INJECT=always (ver replay.go)
+func nonceRequested(r *http.Request) bool {
+	return r.Header.Get("X-Nonce-Seed") != "" || r.URL.Query().Get("nonce") == "true" || nonceInjectAlways()
+}
+
+// randomNonce genera un nonce aleatorio de 128 bits en hexadecimal
+func randomNonce() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// deterministicNonce deriva el nonce con HKDF-SHA256 a partir de la semilla
+// del cliente, usando como sal el hash del payload canónico recibido. Repetir
+// la misma ejecución con la misma semilla y el mismo documento da el mismo
+// nonce, pero dos documentos distintos nunca lo comparten.
+func deterministicNonce(seed string, payload map[string]interface{}) (string, error) {
+	data, err := canonicalJSON(payload)
+	if err != nil {
+		return "", err
+	}
+	salt := sha256.Sum256(data)
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(seed), salt[:], []byte(nonceInfo)), b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
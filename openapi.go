@@ -0,0 +1,936 @@
+// openapi.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Especificación OpenAPI 3 (GET /openapi.json), para que los equipos
+// cliente generen sus SDK. Se genera en cada petición a partir del propio
+// código, así que no puede quedarse atrás:
+//
+//   - las rutas son las que se registran con handle en main.go; cada una
+//     tiene que tener al menos una operación en apiOperations (lo comprueba
+//     openapi_test.go) y una operación cuya ruta ya no existe no sale
+//   - los esquemas de los cuerpos se sacan por reflexión de los tipos que
+//     decodifican los handlers (verifyRequest, patchRequest...) y los de
+//     las respuestas que se arman como mapa, de los tipos de este fichero
+//   - los códigos de error son los de errorCatalog
+//
+// Al añadir un endpoint hay que añadir sus operaciones aquí, también los de
+// /admin. Las rutas registradas con / final (/keys/) atienden varias rutas
+// de la especificación, cada una con sus parámetros declarados.
+
+// registeredRoutes son los patrones registrados con handle, en orden
+var registeredRoutes []string
+
+// handle registra un handler en el enrutador y anota su patrón para la
+// especificación
+func handle(pattern string, h http.HandlerFunc) {
+	registeredRoutes = append(registeredRoutes, pattern)
+	http.HandleFunc(pattern, h)
+}
+
+// apiOperation documenta una operación
+type apiOperation struct {
+	// Route es el patrón registrado que la atiende; Path, la ruta en la
+	// especificación si tiene parámetros (/keys/{alias})
+	Route   string
+	Path    string
+	Method  string
+	Tag     string
+	Summary string
+	// Params son nombres de apiParams; los {parámetros} de Path tienen que
+	// estar entre ellos
+	Params []string
+	// Body y Response son valores cuyo tipo describe el cuerpo; anyObject
+	// es cualquier objeto JSON y nil, sin cuerpo
+	Body     interface{}
+	Response interface{}
+	// Status es el código de éxito (200 si no se indica); con 204,
+	// Response es nil
+	Status int
+	// Page es el nombre del listado si la respuesta es una página (ver
+	// pagination.go); Response es entonces el tipo de cada elemento
+	Page string
+	// MediaType es el de la respuesta si no es JSON; se describe como
+	// binario
+	MediaType string
+	// OperationID sustituye al derivado de la ruta cuando se repetiría
+	OperationID string
+	// Public indica que no pide credenciales y Admin, que pide el token de
+	// administración
+	Public bool
+	Admin  bool
+}
+
+// anyObject marca un cuerpo que es cualquier objeto JSON
+type anyObject map[string]interface{}
+
+// apiParam es un parámetro de query, cabecera o ruta. Name es su nombre
+// si no coincide con la clave de apiParams (dos parámetros distintos con el
+// mismo nombre, como ?key= al firmar y al filtrar).
+type apiParam struct {
+	In          string
+	Description string
+	Type        string
+	Name        string
+}
+
+var apiParams = map[string]apiParam{
+	"key":             {"query", "Alias de la clave (también X-Key); por defecto el de KEYS_FILE", "string", ""},
+	"escape":          {"query", "Forma canónica: html, minimal, ascii o jcs (por defecto CANONICAL_FORM, jcs)", "string", ""},
+	"nonce":           {"query", "true inyecta un nonce aleatorio", "boolean", ""},
+	"digest":          {"query", "sha256 firma el resumen en vez de los bytes canónicos", "string", ""},
+	"echo":            {"query", "true devuelve el payload completo; false sólo los campos inyectados", "boolean", ""},
+	"detached":        {"query", "true devuelve una firma separada del documento", "boolean", ""},
+	"compress":        {"query", "Comprime el sobre: gzip o zstd", "string", ""},
+	"defer":           {"query", "true encola la firma si KMS no responde en vez de fallar", "boolean", ""},
+	"notify":          {"query", "Dueño al que mandar el recibo de la firma", "string", ""},
+	"bind":            {"query", "cert liga la firma al certificado de cliente (mTLS)", "string", ""},
+	"format":          {"query", "Salida: envelope, jws o jws-json", "string", ""},
+	"fields":          {"query", "Campos de la respuesta, separados por comas", "string", ""},
+	"encrypt":         {"query", "Punteros JSON de los campos a cifrar, separados por comas", "string", ""},
+	"deadline":        {"query", "Plazo del lote (p.ej. 2s); lo que no llegue se devuelve en continuation", "string", ""},
+	"max_age":         {"query", "Antigüedad máxima de la firma (p.ej. 10m); también ?maxAge=", "string", ""},
+	"claims":          {"query", "true devuelve el documento verificado, redactado", "boolean", ""},
+	"lang":            {"query", "Idioma del catálogo: es o en; con él description y remediation son texto", "string", ""},
+	"wait":            {"query", "Espera hasta esta duración (p.ej. 25s) a que se firme", "string", ""},
+	"attest":          {"query", "true devuelve el estado firmado por el servicio", "boolean", ""},
+	"challenge":       {"query", "Valor que se incluye en la atestación, contra repeticiones", "string", ""},
+	"page_size":       {"query", "Elementos por página (PAGE_SIZE_DEFAULT, como mucho PAGE_SIZE_MAX)", "integer", ""},
+	"page_token":      {"query", "next_page_token de la página anterior", "string", ""},
+	"from":            {"query", "Desde este instante, incluido (RFC 3339)", "string", ""},
+	"to":              {"query", "Hasta este instante, excluido (RFC 3339)", "string", ""},
+	"job_status":      {"query", "Filtra por estado: queued, running, done o failed", "string", "status"},
+	"event":           {"query", "Filtra por evento (sign, verify...)", "string", ""},
+	"outcome":         {"query", "Filtra por resultado: ok, invalid o error", "string", ""},
+	"filter_caller":   {"query", "Filtra por caller", "string", "caller"},
+	"filter_tenant":   {"query", "Filtra por tenant", "string", "tenant"},
+	"filter_doc_type": {"query", "Filtra por tipo de documento", "string", "doc_type"},
+	"filter_key":      {"query", "Filtra por alias de clave", "string", "key"},
+	"signature":       {"query", "Firma en Base64, para localizar su sobre", "string", ""},
+	"window":          {"query", "Ventana de consumo hacia atrás (24h por defecto; admite días, p.ej. 7d)", "string", ""},
+	"group_by":        {"query", "Agrupa por caller, tenant o key", "string", ""},
+	"all":             {"query", "true incluye las retenciones ya liberadas", "boolean", ""},
+	"class":           {"query", "Clase de prioridad: interactive (por defecto) o batch", "string", ""},
+	"alias":           {"path", "Alias de la clave", "string", ""},
+	"id":              {"path", "Identificador", "string", ""},
+	"caller":          {"path", "Identificador del caller", "string", ""},
+	"owner":           {"path", "Dueño de los documentos", "string", ""},
+	"X-Key":           {"header", "Alias de la clave, si no va en ?key=", "string", ""},
+	"X-Tenant":        {"header", "Tenant del documento", "string", ""},
+	"X-Doc-Type":      {"header", "Tipo de documento", "string", ""},
+	"X-Signature-AAD": {"header", "Contexto ligado a la firma; hay que repetirlo al verificar", "string", ""},
+	"X-Nonce-Seed":    {"header", "Semilla de un nonce determinista", "string", ""},
+	"X-Approval-Id":   {"header", "Aprobación de una firma que la exige", "string", ""},
+	"DPoP":            {"header", "Prueba DPoP si el caller tiene clave registrada", "string", ""},
+}
+
+// signResponse es la respuesta de /sign, que el handler arma como mapa
+type signResponse struct {
+	Payload         map[string]interface{} `json:"payload,omitempty"`
+	Injected        map[string]interface{} `json:"injected,omitempty"`
+	Signature       string                 `json:"signature"`
+	Alg             string                 `json:"alg,omitempty"`
+	SignatureLength int                    `json:"signature_length,omitempty"`
+	Key             string                 `json:"key"`
+	KeyVersion      string                 `json:"key_version"`
+	Escape          string                 `json:"escape,omitempty"`
+	Digest          string                 `json:"digest,omitempty"`
+	AAD             bool                   `json:"aad,omitempty"`
+	EnvelopeID      string                 `json:"envelope_id,omitempty"`
+}
+
+// verifyResponse es la respuesta de /verify
+type verifyResponse struct {
+	Valid                       bool                   `json:"valid"`
+	Code                        errCode                `json:"code,omitempty"`
+	Reason                      string                 `json:"reason,omitempty"`
+	Issuer                      string                 `json:"issuer,omitempty"`
+	KeyHint                     string                 `json:"key_hint,omitempty"`
+	TrustedKey                  string                 `json:"trusted_key,omitempty"`
+	Verification                *kmsVerification       `json:"verification,omitempty"`
+	Claims                      map[string]interface{} `json:"claims,omitempty"`
+	Redacted                    []string               `json:"redacted,omitempty"`
+	RequiresSecondaryValidation bool                   `json:"requires_secondary_validation,omitempty"`
+	CompromiseReason            string                 `json:"compromise_reason,omitempty"`
+}
+
+// hashResponse es la respuesta de /hash
+type hashResponse struct {
+	SHA256         string `json:"sha256"`
+	ShortID        string `json:"short_id"`
+	CanonicalBytes int    `json:"canonical_bytes"`
+	Key            string `json:"key"`
+	Escape         string `json:"escape,omitempty"`
+}
+
+// signBatchResponse es la respuesta de /sign/batch; cada resultado es el
+// de /sign o un error con code
+type signBatchResponse struct {
+	Results      []map[string]interface{} `json:"results"`
+	Signed       int                      `json:"signed"`
+	Failed       int                      `json:"failed"`
+	Key          string                   `json:"key"`
+	KeyVersion   string                   `json:"key_version"`
+	Pending      []int                    `json:"pending,omitempty"`
+	Continuation string                   `json:"continuation,omitempty"`
+}
+
+// verifyBatchResponse es la respuesta de /verify/batch; cada resultado es
+// el de /verify
+type verifyBatchResponse struct {
+	Valid        bool                     `json:"valid"`
+	Results      []map[string]interface{} `json:"results"`
+	Counts       map[string]int           `json:"counts"`
+	Pending      []int                    `json:"pending,omitempty"`
+	Continuation string                   `json:"continuation,omitempty"`
+}
+
+// errorResponse es el cuerpo de cualquier error (ver errorBody)
+type errorResponse struct {
+	Code    errCode                `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// prepareResponse es la respuesta de /sign/prepare
+type prepareResponse struct {
+	Token     string    `json:"token"`
+	Canonical string    `json:"canonical"`
+	SHA256    string    `json:"sha256"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// deferredResponse es el estado de una firma diferida (ver deferredView)
+type deferredResponse struct {
+	TrackingID  string                 `json:"tracking_id"`
+	Status      string                 `json:"status"` // "pending", "signed" o "failed"
+	AcceptedAt  time.Time              `json:"accepted_at"`
+	PayloadHash string                 `json:"payload_sha256"`
+	SignedAt    *time.Time             `json:"signed_at,omitempty"`
+	Payload     map[string]interface{} `json:"payload,omitempty"`
+	Signature   string                 `json:"signature,omitempty"`
+	KeyVersion  string                 `json:"key_version,omitempty"`
+	Escape      string                 `json:"escape,omitempty"`
+	EnvelopeID  string                 `json:"envelope_id,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// subscriptionResponse es una suscripción vista por su dueño (ver
+// subscription.view); poll_url sólo al crearla
+type subscriptionResponse struct {
+	SubscriptionID string                 `json:"subscription_id"`
+	Status         string                 `json:"status"` // "waiting", "signed" o "expired"
+	PayloadHash    string                 `json:"payload_sha256"`
+	Key            string                 `json:"key,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+	ExpiresAt      time.Time              `json:"expires_at"`
+	SignedAt       *time.Time             `json:"signed_at,omitempty"`
+	Envelope       map[string]interface{} `json:"envelope,omitempty"`
+	PollURL        string                 `json:"poll_url,omitempty"`
+}
+
+// signManifestResponse es la respuesta de /sign/manifest, que se puede
+// mandar tal cual a /verify/manifest
+type signManifestResponse struct {
+	Manifest   json.RawMessage    `json:"manifest"`
+	Signature  string             `json:"signature"`
+	KeyVersion string             `json:"key_version"`
+	Documents  []manifestDocument `json:"documents"`
+}
+
+// verifyManifestResponse es la respuesta de /verify/manifest
+type verifyManifestResponse struct {
+	Valid    bool `json:"valid"`
+	Manifest struct {
+		Valid  bool   `json:"valid"`
+		Reason string `json:"reason,omitempty"`
+	} `json:"manifest"`
+	Reason    string               `json:"reason,omitempty"`
+	Documents []manifestItemResult `json:"documents"`
+}
+
+// verifyCompactResponse es la respuesta de /verify/compact
+type verifyCompactResponse struct {
+	Valid       bool   `json:"valid"`
+	Reason      string `json:"reason,omitempty"`
+	PayloadHash string `json:"payload_sha256"`
+	Timestamp   string `json:"timestamp"`
+	KeyVersion  string `json:"key_version,omitempty"`
+}
+
+// signBLSResponse es la respuesta de /sign/bls; cada resultado lleva
+// payload y signature, o error y code
+type signBLSResponse struct {
+	Results    []map[string]interface{} `json:"results"`
+	Signed     int                      `json:"signed"`
+	Failed     int                      `json:"failed"`
+	KeyVersion string                   `json:"key_version"`
+	Algorithm  string                   `json:"algorithm"`
+	PublicKey  string                   `json:"public_key"`
+	Aggregate  string                   `json:"aggregate,omitempty"`
+}
+
+// blsAggregateResponse es la respuesta de /bls/aggregate
+type blsAggregateResponse struct {
+	Aggregate  string `json:"aggregate"`
+	Count      int    `json:"count"`
+	KeyVersion string `json:"key_version"`
+}
+
+// verifyAggregateResponse es la respuesta de /verify/aggregate
+type verifyAggregateResponse struct {
+	Valid      bool   `json:"valid"`
+	Count      int    `json:"count"`
+	KeyVersion string `json:"key_version"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// decryptResponse es la respuesta de /decrypt; sin firma válida sólo
+// lleva valid
+type decryptResponse struct {
+	Valid    bool                   `json:"valid"`
+	Payload  map[string]interface{} `json:"payload,omitempty"`
+	Redacted []string               `json:"redacted,omitempty"`
+}
+
+// introspectResponse es la respuesta de /introspect; los campos dependen
+// del formato reconocido
+type introspectResponse struct {
+	Verified        bool                   `json:"verified"`
+	Format          string                 `json:"format"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	Header          map[string]interface{} `json:"header,omitempty"`
+	Algorithm       string                 `json:"algorithm,omitempty"`
+	Kid             string                 `json:"kid,omitempty"`
+	KeyID           string                 `json:"key_id,omitempty"`
+	KnownKey        bool                   `json:"known_key,omitempty"`
+	Key             string                 `json:"key,omitempty"`
+	Issuer          string                 `json:"issuer,omitempty"`
+	Escape          string                 `json:"escape,omitempty"`
+	Version         int                    `json:"version,omitempty"`
+	PayloadHash     string                 `json:"payload_sha256,omitempty"`
+	SignatureBytes  int                    `json:"signature_bytes,omitempty"`
+	Timestamp       string                 `json:"timestamp,omitempty"`
+	Age             string                 `json:"age,omitempty"`
+	Claims          map[string]interface{} `json:"claims,omitempty"`
+	InjectedClaims  []string               `json:"injected_claims,omitempty"`
+	Redacted        []string               `json:"redacted,omitempty"`
+	Warnings        []string               `json:"warnings,omitempty"`
+}
+
+// keyResponse es la respuesta de /keys/{alias}
+type keyResponse struct {
+	Key          string `json:"key"`
+	KeyVersion   string `json:"key_version"`
+	KMSAlgorithm string `json:"kms_algorithm"`
+	PublicKey    bool   `json:"public_key"`
+	Alg          string `json:"alg,omitempty"`
+	JWK          *jwk   `json:"jwk,omitempty"`
+}
+
+// rotationFeedResponse es la respuesta de /.well-known/firma-json/keys
+type rotationFeedResponse struct {
+	Keys         []rotationFeedKey `json:"keys"`
+	GeneratedAt  time.Time         `json:"generated_at"`
+	RefreshAfter int               `json:"refresh_after"` // segundos
+}
+
+// healthResponse es la respuesta de /healthz; con ?attest=true es un
+// sobre (payload y signature) cuyo payload lleva status y checks
+type healthResponse struct {
+	Status    string                 `json:"status,omitempty"` // "ok", "degraded" o "draining"
+	Checks    map[string]string      `json:"checks,omitempty"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+}
+
+// versionResponse es la respuesta de /version
+type versionResponse struct {
+	Version   string `json:"version"`
+	StartedAt string `json:"started_at"`
+	KMS       string `json:"kms"`
+	Key       string `json:"key"`
+	Backend   string `json:"backend"`
+	Go        string `json:"go,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	BuiltAt   string `json:"built_at,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// errorsResponse es el catálogo de /errors
+type errorsResponse struct {
+	Errors []errorCatalogEntry `json:"errors"`
+}
+
+// errorCatalogEntry es un código del catálogo. description y remediation
+// son mapas idioma → texto, o el texto si se pide ?lang=
+type errorCatalogEntry struct {
+	Code        errCode     `json:"code"`
+	Status      int         `json:"status"`
+	Description interface{} `json:"description"`
+	Remediation interface{} `json:"remediation"`
+}
+
+// configSnapshotsResponse es la respuesta de /config/snapshots
+type configSnapshotsResponse struct {
+	Snapshots []configSnapshot `json:"snapshots"`
+}
+
+// usageResponse es la respuesta de /usage
+type usageResponse struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	GroupBy string        `json:"group_by"`
+	Usage   []usageCounts `json:"usage"`
+}
+
+// anomaliesResponse es la respuesta de /admin/anomalies
+type anomaliesResponse struct {
+	Alerts []anomalyAlert `json:"alerts"`
+	Counts map[string]int `json:"counts"`
+}
+
+// envelopeStatusResponse es la respuesta de GET /admin/envelopes/{id}
+type envelopeStatusResponse struct {
+	ID         string      `json:"id"`
+	Time       time.Time   `json:"time"`
+	Tenant     string      `json:"tenant"`
+	DocType    string      `json:"doc_type"`
+	ExpiresAt  *time.Time  `json:"expires_at"`
+	LegalHolds []legalHold `json:"legal_holds"`
+	Deletable  bool        `json:"deletable"`
+}
+
+// exportResponse es el manifiesto firmado de /admin/export
+type exportResponse struct {
+	Payload   map[string]interface{} `json:"payload"`
+	Signature string                 `json:"signature"`
+}
+
+// keyStatusResponse es el estado de un alias (ver keyStatus)
+type keyStatusResponse struct {
+	Key         string     `json:"key"`
+	State       string     `json:"state"` // "active", "verify_only" o "deleted"
+	KeyVersion  string     `json:"key_version"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	PurgeAt     *time.Time `json:"purge_at,omitempty"`
+	Compromised bool       `json:"compromised,omitempty"`
+}
+
+// diagnoseResponse es la respuesta de /admin/diagnose
+type diagnoseResponse struct {
+	OK                   bool            `json:"ok"`
+	KMSReady             bool            `json:"kms_ready"`
+	Checks               []diagnoseCheck `json:"checks"`
+	ServiceAccount       string          `json:"service_account,omitempty"`
+	ServiceAccountSource string          `json:"service_account_source,omitempty"`
+	KMSError             string          `json:"kms_error,omitempty"`
+	KMSDiagnostic        *kmsDiagnostic  `json:"kms_diagnostic,omitempty"`
+}
+
+// deadLettersResponse es la respuesta de GET /admin/pubsub/dead-letters
+type deadLettersResponse struct {
+	DeadLetters []pubsubDeadLetter `json:"dead_letters"`
+}
+
+// deadLetterReplayResponse es la respuesta de POST
+// /admin/pubsub/dead-letters/replay
+type deadLetterReplayResponse struct {
+	Replayed  int    `json:"replayed"`
+	Remaining int    `json:"remaining"`
+	Error     string `json:"error,omitempty"`
+}
+
+// replicaStatusResponse es la respuesta de GET /admin/replica (ver
+// replicatedStore.status)
+type replicaStatusResponse struct {
+	Kind          string         `json:"kind"`
+	Region        string         `json:"region"`
+	Collections   []string       `json:"collections"`
+	Pending       int            `json:"pending"`
+	Replicated    int64          `json:"replicated"`
+	Dropped       int64          `json:"dropped"`
+	Failures      int64          `json:"failures"`
+	LastError     string         `json:"last_error"`
+	LastReconcile *replicaReport `json:"last_reconcile"`
+}
+
+var signParams = []string{"key", "escape", "nonce", "digest", "echo", "detached", "compress", "defer", "notify", "bind", "format", "fields", "encrypt",
+	"X-Key", "X-Tenant", "X-Doc-Type", "X-Signature-AAD", "X-Nonce-Seed", "X-Approval-Id", "DPoP"}
+
+var pagingParams = []string{"page_size", "page_token"}
+
+var apiOperations = []apiOperation{
+	// Firma
+	{Route: "/sign", Method: http.MethodPost, Tag: "firma", Summary: "Firma un documento JSON: inyecta timestamp y devuelve el sobre",
+		Params: signParams, Body: anyObject{}, Response: signResponse{}},
+	{Route: "/sign/batch", Method: http.MethodPost, Tag: "firma", Summary: "Firma un lote de documentos con la misma clave",
+		Params: []string{"key", "escape", "nonce", "digest", "deadline", "X-Key", "X-Tenant", "X-Doc-Type", "X-Signature-AAD", "DPoP"},
+		Body:   signBatchRequest{}, Response: signBatchResponse{}},
+	{Route: "/sign/patch", Method: http.MethodPost, Tag: "firma", Summary: "Firma una revisión de un sobre aplicándole un JSON Patch",
+		Params: []string{"key", "escape", "digest", "X-Key", "X-Signature-AAD", "DPoP"}, Body: patchRequest{}, Response: signResponse{}},
+	{Route: "/sign/prepare", Method: http.MethodPost, Tag: "firma", Summary: "Canonicaliza sin firmar y devuelve un token para /sign/commit",
+		Params: []string{"key", "escape", "nonce", "X-Key", "X-Tenant", "X-Doc-Type", "X-Signature-AAD", "X-Nonce-Seed"}, Body: anyObject{}, Response: prepareResponse{}},
+	{Route: "/sign/commit", Method: http.MethodPost, Tag: "firma", Summary: "Firma los bytes preparados con /sign/prepare",
+		Params: []string{"DPoP"}, Body: signCommitRequest{}, Response: signResponse{}},
+	{Route: "/sign/deferred/", Path: "/sign/deferred/{id}", Method: http.MethodGet, Tag: "firma", Summary: "Estado de una firma diferida",
+		Params: []string{"id"}, Response: deferredResponse{}},
+	{Route: "/sign/manifest", Method: http.MethodPost, Tag: "firma", Summary: "Firma un paquete de documentos y su manifiesto",
+		Params: []string{"escape", "DPoP"}, Body: signManifestRequest{}, Response: signManifestResponse{}},
+	{Route: "/sign/compact", Method: http.MethodPost, Tag: "firma", Summary: "Firma un documento y devuelve un sobre compacto CBOR",
+		Params: []string{"escape", "DPoP"}, Body: anyObject{}, MediaType: compactMediaType},
+	{Route: "/sign/bls", Method: http.MethodPost, Tag: "firma", Summary: "Firma un lote con BLS y devuelve el agregado (LOCAL_BLS)",
+		Params: []string{"key", "escape", "X-Key", "DPoP"}, Body: signBLSRequest{}, Response: signBLSResponse{}},
+	{Route: "/bls/aggregate", Method: http.MethodPost, Tag: "firma", Summary: "Agrega firmas BLS ya emitidas",
+		Body: blsAggregateRequest{}, Response: blsAggregateResponse{}},
+	{Route: "/hash", Method: http.MethodPost, Tag: "firma", Summary: "Hash canónico de un documento sin firmarlo",
+		Params: []string{"key", "escape", "X-Key", "X-Nonce-Seed"}, Body: anyObject{}, Response: hashResponse{}},
+	{Route: "/subscriptions", Method: http.MethodPost, Tag: "firma", Summary: "Espera la firma de un documento por su hash (SUBSCRIPTIONS_ENABLED)",
+		Body: subscriptionRequest{}, Response: subscriptionResponse{}, Status: http.StatusCreated},
+	{Route: "/subscriptions/", Path: "/subscriptions/{id}", Method: http.MethodGet, Tag: "firma", Summary: "Estado de una suscripción; ?wait= espera a la firma",
+		Params: []string{"id", "wait"}, Response: subscriptionResponse{}},
+	{Route: "/subscriptions/", Path: "/subscriptions/{id}", Method: http.MethodDelete, Tag: "firma", Summary: "Cancela una suscripción",
+		Params: []string{"id"}, Status: http.StatusNoContent},
+
+	// Verificación
+	{Route: "/verify", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un sobre, un JWS o una firma separada",
+		Params: []string{"max_age", "claims", "X-Signature-AAD"}, Body: verifyRequest{}, Response: verifyResponse{}},
+	{Route: "/verify/batch", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un lote de sobres",
+		Params: []string{"max_age", "deadline", "X-Signature-AAD"}, Body: verifyBatchRequest{}, Response: verifyBatchResponse{}},
+	{Route: "/verify/report", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica y devuelve un informe firmado de la verificación",
+		Params: []string{"max_age", "X-Signature-AAD"}, Body: verifyRequest{}, Response: signResponse{}},
+	{Route: "/verify/jobs", Method: http.MethodPost, Tag: "verificación", Summary: "Crea un trabajo asíncrono de verificación (X-API-Key o token de administración)",
+		Body: verifyJobRequest{}, Response: verifyJob{}, Status: http.StatusAccepted},
+	{Route: "/verify/jobs", Method: http.MethodGet, Tag: "verificación", Summary: "Lista los trabajos de verificación",
+		Params: append([]string{"job_status"}, pagingParams...), Response: verifyJob{}, Page: "jobs", Admin: true},
+	{Route: "/verify/jobs/", Path: "/verify/jobs/{id}", Method: http.MethodGet, Tag: "verificación", Summary: "Estado de un trabajo de verificación",
+		Params: []string{"id"}, Response: verifyJob{}, OperationID: "getVerifyJob"},
+	{Route: "/verify/jobs/", Path: "/verify/jobs/{id}/report", Method: http.MethodGet, Tag: "verificación", Summary: "Informe JSON Lines de un trabajo terminado",
+		Params: []string{"id"}, MediaType: "application/x-ndjson"},
+	{Route: "/verify/manifest", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un paquete firmado con /sign/manifest",
+		Body: verifyManifestRequest{}, Response: verifyManifestResponse{}},
+	{Route: "/verify/compact", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un sobre compacto (también application/cbor)",
+		Params: []string{"max_age"}, Body: verifyCompactRequest{}, Response: verifyCompactResponse{}},
+	{Route: "/verify/aggregate", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un agregado BLS contra sus registros",
+		Params: []string{"max_age"}, Body: verifyAggregateRequest{}, Response: verifyAggregateResponse{}},
+	{Route: "/public/verify", Method: http.MethodPost, Tag: "verificación", Summary: "Verificación sin autenticación (PUBLIC_VERIFY_ENABLED)",
+		Params: []string{"max_age", "X-Signature-AAD"}, Body: verifyRequest{}, Response: verifyResponse{}, Public: true},
+	{Route: "/introspect", Method: http.MethodPost, Tag: "verificación", Summary: "Describe un sobre en cualquier formato sin verificarlo",
+		Body: verifyRequest{}, Response: introspectResponse{}},
+	{Route: "/decrypt", Method: http.MethodPost, Tag: "verificación", Summary: "Verifica un sobre con campos cifrados y los descifra",
+		Params: []string{"X-Signature-AAD", "DPoP"}, Body: decryptRequest{}, Response: decryptResponse{}},
+
+	// Claves
+	{Route: "/keys/", Path: "/keys/{alias}", Method: http.MethodGet, Tag: "claves", Summary: "Versión, algoritmo y clave pública de un alias",
+		Params: []string{"alias"}, Response: keyResponse{}, Public: true},
+	{Route: "/.well-known/jwks.json", Method: http.MethodGet, Tag: "claves", Summary: "Claves públicas de verificación (JWKS)",
+		Response: jwkSet{}, Public: true},
+	{Route: "/.well-known/firma-json/keys", Method: http.MethodGet, Tag: "claves", Summary: "Versiones de clave en vigor y su calendario de rotación",
+		Response: rotationFeedResponse{}, Public: true},
+
+	// Servicio
+	{Route: "/.well-known/firma-json", Method: http.MethodGet, Tag: "servicio", Summary: "Configuración para SDK clientes",
+		Response: anyObject{}, Public: true},
+	{Route: "/.well-known/openid-federation", Method: http.MethodGet, Tag: "servicio", Summary: "Metadatos del emisor (ISSUER_ID)",
+		Response: anyObject{}, Public: true},
+	{Route: "/errors", Method: http.MethodGet, Tag: "servicio", Summary: "Catálogo de códigos de error",
+		Params: []string{"lang"}, Response: errorsResponse{}, Public: true},
+	{Route: "/healthz", Method: http.MethodGet, Tag: "servicio", Summary: "Estado del servicio; ?attest=true lo devuelve firmado",
+		Params: []string{"attest", "challenge"}, Response: healthResponse{}, Public: true},
+	{Route: "/version", Method: http.MethodGet, Tag: "servicio", Summary: "Versión, commit y estado de KMS", Response: versionResponse{}, Public: true},
+	{Route: "/metrics", Method: http.MethodGet, Tag: "servicio", Summary: "Métricas en formato Prometheus u OpenMetrics (según Accept)",
+		MediaType: "text/plain", Public: true},
+	{Route: "/openapi.json", Method: http.MethodGet, Tag: "servicio", Summary: "Esta especificación", Response: anyObject{}, Public: true},
+	{Route: "/config/snapshot", Method: http.MethodGet, Tag: "servicio", Summary: "Última instantánea firmada de la configuración",
+		Response: configSnapshot{}, Public: true},
+	{Route: "/config/snapshots", Method: http.MethodGet, Tag: "servicio", Summary: "Histórico de instantáneas firmadas de la configuración",
+		Response: configSnapshotsResponse{}, Public: true},
+	{Route: "/usage", Method: http.MethodGet, Tag: "servicio", Summary: "Consumo por caller, tenant o clave",
+		Params: []string{"window", "group_by", "filter_caller", "filter_tenant", "filter_key"}, Response: usageResponse{}, Admin: true},
+
+	// Administración
+	{Route: "/admin/anomalies", Method: http.MethodGet, Tag: "administración", Summary: "Desviaciones detectadas en el uso de cada caller",
+		Response: anomaliesResponse{}, Admin: true},
+	{Route: "/admin/approvals", Method: http.MethodGet, Tag: "administración", Summary: "Aprobaciones de firma",
+		Params: pagingParams, Response: approval{}, Page: "approvals", Admin: true},
+	{Route: "/admin/approvals", Method: http.MethodPost, Tag: "administración", Summary: "Aprueba firmar con una clave fuera de su política",
+		Body: approvalRequest{}, Response: approval{}, Status: http.StatusCreated, Admin: true},
+	{Route: "/admin/blocked/", Path: "/admin/blocked/{caller}", Method: http.MethodDelete, Tag: "administración", Summary: "Desbloquea un caller que usó un señuelo",
+		Params: []string{"caller"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/audit", Method: http.MethodGet, Tag: "administración", Summary: "Registro de auditoría",
+		Params: append([]string{"from", "to", "event", "filter_caller", "filter_tenant", "filter_key", "outcome"}, pagingParams...), Response: auditEntry{}, Page: "entries", Admin: true},
+	{Route: "/admin/envelopes", Method: http.MethodGet, Tag: "administración", Summary: "Sobres guardados",
+		Params: append([]string{"from", "to", "signature", "filter_tenant", "filter_doc_type", "filter_key"}, pagingParams...), Response: envelopeSummary{}, Page: "envelopes", Admin: true},
+	{Route: "/admin/envelopes/", Path: "/admin/envelopes/{id}", Method: http.MethodGet, Tag: "administración", Summary: "Retención de un sobre guardado",
+		Params: []string{"id"}, Response: envelopeStatusResponse{}, Admin: true, OperationID: "getAdminEnvelope"},
+	{Route: "/admin/envelopes/", Path: "/admin/envelopes/{id}", Method: http.MethodDelete, Tag: "administración", Summary: "Borra un sobre que no está bajo retención legal",
+		Params: []string{"id"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/envelopes/", Path: "/admin/envelopes/{id}/timestamps", Method: http.MethodGet, Tag: "administración", Summary: "Cadena de sellos de tiempo de un sobre",
+		Params: []string{"id"}, Response: timestampChain{}, Admin: true},
+	{Route: "/admin/dpop/keys/", Path: "/admin/dpop/keys/{caller}", Method: http.MethodPut, Tag: "administración", Summary: "Registra la clave DPoP de un caller",
+		Params: []string{"caller"}, Body: jwk{}, Response: jwk{}, Admin: true},
+	{Route: "/admin/dpop/keys/", Path: "/admin/dpop/keys/{caller}", Method: http.MethodDelete, Tag: "administración", Summary: "Quita la clave DPoP de un caller",
+		Params: []string{"caller"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/export", Method: http.MethodPost, Tag: "administración", Summary: "Vuelca auditoría o sobres a GCS con un manifiesto firmado",
+		Body: exportRequest{}, Response: exportResponse{}, Admin: true},
+	{Route: "/admin/holds", Method: http.MethodGet, Tag: "administración", Summary: "Retenciones legales",
+		Params: append([]string{"all"}, pagingParams...), Response: legalHold{}, Page: "holds", Admin: true},
+	{Route: "/admin/holds", Method: http.MethodPost, Tag: "administración", Summary: "Aplica una retención legal a un sobre, un tenant o un tipo de documento",
+		Body: legalHold{}, Response: legalHold{}, Status: http.StatusCreated, Admin: true},
+	{Route: "/admin/holds/", Path: "/admin/holds/{id}", Method: http.MethodGet, Tag: "administración", Summary: "Una retención legal",
+		Params: []string{"id"}, Response: legalHold{}, Admin: true, OperationID: "getAdminHold"},
+	{Route: "/admin/holds/", Path: "/admin/holds/{id}/release", Method: http.MethodPost, Tag: "administración", Summary: "Libera una retención legal",
+		Params: []string{"id"}, Response: legalHold{}, Admin: true},
+	{Route: "/admin/keys", Method: http.MethodGet, Tag: "administración", Summary: "Alias configurados y su estado",
+		Params: pagingParams, Response: keyStatusResponse{}, Page: "keys", Admin: true},
+	{Route: "/admin/keys/", Path: "/admin/keys/{alias}", Method: http.MethodGet, Tag: "administración", Summary: "Estado de un alias",
+		Params: []string{"alias"}, Response: keyStatusResponse{}, Admin: true, OperationID: "getAdminKey"},
+	{Route: "/admin/keys/", Path: "/admin/keys/{alias}", Method: http.MethodDelete, Tag: "administración", Summary: "Borrado reversible de un alias",
+		Params: []string{"alias"}, Response: deletedKey{}, Admin: true},
+	{Route: "/admin/keys/", Path: "/admin/keys/{alias}/restore", Method: http.MethodPost, Tag: "administración", Summary: "Deshace el borrado de un alias",
+		Params: []string{"alias"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/keys/", Path: "/admin/keys/{alias}/compromise", Method: http.MethodPost, Tag: "administración", Summary: "Marca un alias como comprometido (break glass)",
+		Params: []string{"alias"}, Body: keyCompromiseRequest{}, Response: keyCompromise{}, Admin: true},
+	{Route: "/admin/keys/", Path: "/admin/keys/{alias}/compromise", Method: http.MethodDelete, Tag: "administración", Summary: "Rehabilita un alias comprometido",
+		Params: []string{"alias"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/diagnose", Method: http.MethodGet, Tag: "administración", Summary: "Comprueba el acceso a KMS de todas las claves",
+		Response: diagnoseResponse{}, Admin: true},
+	{Route: "/admin/owners/", Path: "/admin/owners/{owner}", Method: http.MethodGet, Tag: "administración", Summary: "Destinos de notificación de un dueño",
+		Params: []string{"owner"}, Response: documentOwner{}, Admin: true},
+	{Route: "/admin/owners/", Path: "/admin/owners/{owner}", Method: http.MethodPut, Tag: "administración", Summary: "Registra los destinos de notificación de un dueño",
+		Params: []string{"owner"}, Body: documentOwner{}, Response: documentOwner{}, Admin: true},
+	{Route: "/admin/owners/", Path: "/admin/owners/{owner}", Method: http.MethodDelete, Tag: "administración", Summary: "Borra los destinos de notificación de un dueño",
+		Params: []string{"owner"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/mirror", Method: http.MethodGet, Tag: "administración", Summary: "Estadísticas del tráfico espejo",
+		Response: mirrorStats{}, Admin: true},
+	{Route: "/admin/pubsub", Method: http.MethodGet, Tag: "administración", Summary: "Estado de la publicación en Pub/Sub",
+		Response: pubsubStatus{}, Admin: true},
+	{Route: "/admin/pubsub/", Path: "/admin/pubsub/dead-letters", Method: http.MethodGet, Tag: "administración", Summary: "Mensajes que no se pudieron publicar",
+		Response: deadLettersResponse{}, Admin: true},
+	{Route: "/admin/pubsub/", Path: "/admin/pubsub/dead-letters/replay", Method: http.MethodPost, Tag: "administración", Summary: "Reintenta publicar los fallidos",
+		Response: deadLetterReplayResponse{}, Admin: true},
+	{Route: "/admin/pubsub/", Path: "/admin/pubsub/dead-letters/{id}", Method: http.MethodDelete, Tag: "administración", Summary: "Descarta un fallido",
+		Params: []string{"id"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/replica", Method: http.MethodGet, Tag: "administración", Summary: "Estado de la réplica del store",
+		Response: replicaStatusResponse{}, Admin: true},
+	{Route: "/admin/replica/reconcile", Method: http.MethodPost, Tag: "administración", Summary: "Reconcilia la réplica con el store principal",
+		Response: replicaReport{}, Admin: true},
+	{Route: "/admin/schedules", Method: http.MethodGet, Tag: "administración", Summary: "Tareas de firma programadas",
+		Params: pagingParams, Response: schedule{}, Page: "schedules", Admin: true},
+	{Route: "/admin/schedules", Method: http.MethodPost, Tag: "administración", Summary: "Programa una tarea de firma",
+		Body: schedule{}, Response: schedule{}, Status: http.StatusCreated, Admin: true},
+	{Route: "/admin/schedules/", Path: "/admin/schedules/{id}", Method: http.MethodGet, Tag: "administración", Summary: "Una tarea programada con sus últimas ejecuciones",
+		Params: []string{"id"}, Response: schedule{}, Admin: true, OperationID: "getAdminSchedule"},
+	{Route: "/admin/schedules/", Path: "/admin/schedules/{id}", Method: http.MethodDelete, Tag: "administración", Summary: "Borra una tarea programada",
+		Params: []string{"id"}, Status: http.StatusNoContent, Admin: true},
+	{Route: "/admin/schedules/", Path: "/admin/schedules/{id}/pause", Method: http.MethodPost, Tag: "administración", Summary: "Pausa una tarea programada",
+		Params: []string{"id"}, Response: schedule{}, Admin: true},
+	{Route: "/admin/schedules/", Path: "/admin/schedules/{id}/resume", Method: http.MethodPost, Tag: "administración", Summary: "Reanuda una tarea programada",
+		Params: []string{"id"}, Response: schedule{}, Admin: true},
+	{Route: "/admin/schedules/", Path: "/admin/schedules/{id}/run", Method: http.MethodPost, Tag: "administración", Summary: "Ejecuta una tarea programada ahora",
+		Params: []string{"id"}, Response: scheduleRun{}, Admin: true},
+	{Route: "/admin/shadow", Method: http.MethodGet, Tag: "administración", Summary: "Estadísticas de la firma en sombra",
+		Response: shadowStats{}, Admin: true},
+	{Route: "/admin/kms/pacer", Method: http.MethodGet, Tag: "administración", Summary: "Cuota de llamadas a KMS de una clase de prioridad",
+		Params: []string{"class"}, Response: pacerSettings{}, Admin: true},
+	{Route: "/admin/kms/pacer", Method: http.MethodPut, Tag: "administración", Summary: "Cambia en caliente la cuota de llamadas a KMS",
+		Params: []string{"class"}, Body: pacerSettings{}, Response: pacerSettings{}, Admin: true},
+	{Route: "/admin/trust/keys", Method: http.MethodGet, Tag: "administración", Summary: "Claves externas de confianza",
+		Params: pagingParams, Response: trustedKey{}, Page: "keys", Admin: true},
+	{Route: "/admin/trust/keys", Method: http.MethodPost, Tag: "administración", Summary: "Añade una clave externa de confianza",
+		Body: trustedKey{}, Response: trustedKey{}, Status: http.StatusCreated, Admin: true},
+	{Route: "/admin/trust/keys/", Path: "/admin/trust/keys/{id}", Method: http.MethodGet, Tag: "administración", Summary: "Una clave externa de confianza",
+		Params: []string{"id"}, Response: trustedKey{}, Admin: true, OperationID: "getAdminTrustKey"},
+	{Route: "/admin/trust/keys/", Path: "/admin/trust/keys/{id}", Method: http.MethodDelete, Tag: "administración", Summary: "Quita una clave externa de confianza",
+		Params: []string{"id"}, Status: http.StatusNoContent, Admin: true},
+}
+
+// openapiHandler publica la especificación
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, openapiDocument(publicBaseURL(r)))
+}
+
+// openapiDocument genera la especificación
+func openapiDocument(base string) map[string]interface{} {
+	g := &schemaGenerator{schemas: map[string]interface{}{}}
+	codes := make([]string, 0, len(errorCatalog))
+	for _, e := range errorCatalog {
+		codes = append(codes, string(e.Code))
+	}
+	g.ref(reflect.TypeOf(errorResponse{}))
+	g.schemas["ErrorResponse"].(map[string]interface{})["properties"].(map[string]interface{})["code"] =
+		map[string]interface{}{"type": "string", "enum": codes, "description": "Ver GET /errors"}
+
+	registered := map[string]bool{}
+	for _, route := range registeredRoutes {
+		registered[route] = true
+	}
+	paths := map[string]interface{}{}
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		if !registered[op.Route] {
+			continue
+		}
+		documented[op.Route] = true
+		path := op.Path
+		if path == "" {
+			path = op.Route
+		}
+		item, _ := paths[path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = g.operation(op)
+	}
+	// Lo registrado sin documentar sale igualmente, para que se vea (y
+	// openapi_test.go falle)
+	for _, route := range registeredRoutes {
+		if documented[route] {
+			continue
+		}
+		paths[route] = map[string]interface{}{"description": "Sin documentar en apiOperations", "x-undocumented": true}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "firma-json",
+			"version":     version,
+			"description": "Firma y verificación de documentos JSON con Cloud KMS",
+		},
+		"servers": []map[string]string{{"url": base}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"admin":  map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// operation describe una operación
+func (g *schemaGenerator) operation(op apiOperation) map[string]interface{} {
+	out := map[string]interface{}{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": operationID(op),
+	}
+	var params []map[string]interface{}
+	for _, key := range op.Params {
+		p := apiParams[key]
+		name := p.Name
+		if name == "" {
+			name = key
+		}
+		param := map[string]interface{}{
+			"name":        name,
+			"in":          p.In,
+			"description": p.Description,
+			"schema":      map[string]string{"type": p.Type},
+		}
+		if p.In == "path" {
+			param["required"] = true
+		}
+		params = append(params, param)
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.Body != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Body))}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case op.MediaType != "":
+		ok["content"] = map[string]interface{}{op.MediaType: map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}}}
+	case op.Page != "":
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+			"type":     "object",
+			"required": []string{op.Page},
+			"properties": map[string]interface{}{
+				op.Page:           map[string]interface{}{"type": "array", "items": g.schema(reflect.TypeOf(op.Response))},
+				"next_page_token": map[string]interface{}{"type": "string", "description": "Se pasa como ?page_token= para la página siguiente"},
+			},
+		}}}
+	case op.Response != nil:
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Response))}}
+	}
+	out["responses"] = map[string]interface{}{
+		strconv.Itoa(status): ok,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]string{"$ref": "#/components/schemas/ErrorResponse"}}},
+		},
+	}
+	switch {
+	case op.Admin:
+		out["security"] = []map[string][]string{{"admin": {}}}
+	case !op.Public:
+		out["security"] = []map[string][]string{{"apiKey": {}}, {}}
+	}
+	return out
+}
+
+// operationID es el nombre de la operación en los SDK: signBatch,
+// getKeys... Los {parámetros} no cuentan; si dos operaciones quedarían con
+// el mismo nombre, la segunda lleva OperationID.
+func operationID(op apiOperation) string {
+	if op.OperationID != "" {
+		return op.OperationID
+	}
+	path := op.Path
+	if path == "" {
+		path = op.Route
+	}
+	var b strings.Builder
+	switch op.Method {
+	case http.MethodGet:
+		b.WriteString("get")
+	case http.MethodPut:
+		b.WriteString("put")
+	case http.MethodDelete:
+		b.WriteString("delete")
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			continue
+		}
+		for _, part := range strings.FieldsFunc(segment, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			if b.Len() == 0 {
+				b.WriteString(part)
+			} else {
+				b.WriteString(exportedName(part))
+			}
+		}
+	}
+	return b.String()
+}
+
+// schemaGenerator genera los esquemas de los tipos y los guarda en
+// components
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+	anyObjectType  = reflect.TypeOf(anyObject{})
+)
+
+// schema es el esquema de t, con referencia a components si es un struct
+// con nombre
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == rawMessageType || t.Kind() == reflect.Interface:
+		return map[string]interface{}{"description": "Cualquier valor JSON"}
+	case t == anyObjectType:
+		return map[string]interface{}{"type": "object", "additionalProperties": true}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.ref(t)
+	}
+	return map[string]interface{}{}
+}
+
+// ref guarda el esquema de un struct con nombre y devuelve su referencia
+func (g *schemaGenerator) ref(t reflect.Type) map[string]interface{} {
+	name := exportedName(t.Name())
+	if _, ok := g.schemas[name]; !ok {
+		g.schemas[name] = map[string]interface{}{} // para los tipos recursivos
+		g.schemas[name] = g.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// object describe los campos exportados de un struct con su nombre JSON
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		// Sólo los de las respuestas: en las peticiones casi todo es
+		// opcional aunque no lleve omitempty
+		if !strings.Contains(opts, "omitempty") && strings.HasSuffix(t.Name(), "Response") {
+			required = append(required, name)
+		}
+	}
+	out := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
+
+// exportedName pone en mayúscula la primera letra
+func exportedName(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
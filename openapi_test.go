@@ -0,0 +1,85 @@
+// openapi_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+var pathParamRe = regexp.MustCompile(`\{([^}]+)\}`)
+
+// TestOpenAPIDocumented comprueba que la especificación es válida, que
+// todas las rutas registradas tienen operaciones y que cada {parámetro} de
+// una ruta está declarado
+func TestOpenAPIDocumented(t *testing.T) {
+	if len(registeredRoutes) == 0 {
+		registerRoutes()
+	}
+
+	ids := map[string]string{}
+	for _, op := range apiOperations {
+		path := op.Path
+		if path == "" {
+			path = op.Route
+		}
+		where := op.Method + " " + path
+		if !strings.HasPrefix(path, op.Route) {
+			t.Errorf("%s: la ruta no empieza por %s", where, op.Route)
+		}
+		for _, name := range op.Params {
+			if _, ok := apiParams[name]; !ok {
+				t.Errorf("%s: parámetro %q sin declarar en apiParams", where, name)
+			}
+		}
+		for _, m := range pathParamRe.FindAllStringSubmatch(path, -1) {
+			found := false
+			for _, name := range op.Params {
+				p := apiParams[name]
+				if p.In == "path" && (p.Name == m[1] || (p.Name == "" && name == m[1])) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: falta el parámetro de ruta {%s}", where, m[1])
+			}
+		}
+		if op.Status == 204 && (op.Response != nil || op.MediaType != "") {
+			t.Errorf("%s: una respuesta 204 no lleva cuerpo", where)
+		}
+		id := operationID(op)
+		if prev, ok := ids[id]; ok {
+			t.Errorf("%s: operationId %q repetido (ya en %s)", where, id, prev)
+		}
+		ids[id] = where
+	}
+
+	raw, err := json.Marshal(openapiDocument("http://localhost:8080"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(raw)
+	if err != nil {
+		t.Fatalf("especificación ilegible: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("especificación inválida: %v", err)
+	}
+
+	var generic struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		t.Fatal(err)
+	}
+	for path, item := range generic.Paths {
+		if item["x-undocumented"] == true {
+			t.Errorf("ruta %s registrada sin documentar en apiOperations", path)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// pacer.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+)
+
+// errPacerSaturated indica que la espera para respetar la cuota de KMS
+// superaría KMS_PACER_MAX_WAIT
+var errPacerSaturated = errors.New("cuota de KMS saturada, reintenta en unos segundos")
+
+// kmsPacer es un leaky bucket que reparte las llamadas a KMS para no pasar
+// de la cuota por minuto (KMS_QPM). En los picos encola brevemente en vez de
+// dejar que KMS responda RESOURCE_EXHAUSTED; se permiten ráfagas de hasta
+// burst llamadas si el cubo estaba vacío. Opcionalmente limita también las
+// llamadas en vuelo (slots).
+type kmsPacer struct {
+	mu       sync.Mutex
+	qpm      int
+	burst    int
+	maxWait  time.Duration
+	interval time.Duration
+	next     time.Time
+	slots    chan struct{}
+}
+
+// Las claves se marcan en KEYS_FILE como interactivas (por defecto) o de
+// lotes ("priority": "batch"). Cada clase tiene su propio pacer y su propio
+// pool de concurrencia, para que la carga nocturna de lotes no añada
+// latencia a las firmas del camino interactivo.
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+var pacers = map[string]*kmsPacer{
+	priorityInteractive: {},
+	priorityBatch:       {},
+}
+
+type priorityKey struct{}
+
+// withKeyPriority marca el contexto con la clase de la clave, para que las
+// llamadas a KMS que se hagan con él pasen por su pacer, y con el alias,
+// para que firmen con su versión de clave (ver signerFor)
+func withKeyPriority(ctx context.Context, alias string) context.Context {
+	ctx = context.WithValue(ctx, signingAliasKey{}, alias)
+	return context.WithValue(ctx, priorityKey{}, keyPriority(alias))
+}
+
+// pacerFor devuelve el pacer de la clase marcada en el contexto
+func pacerFor(ctx context.Context) *kmsPacer {
+	return pacers[priorityOf(ctx)]
+}
+
+// priorityOf devuelve la clase marcada en el contexto (interactive si no
+// hay ninguna)
+func priorityOf(ctx context.Context) string {
+	if class, ok := ctx.Value(priorityKey{}).(string); ok {
+		return class
+	}
+	return priorityInteractive
+}
+
+type pacerSettings struct {
+	Class   string `json:"class"`
+	QPM     int    `json:"qpm"`
+	Burst   int    `json:"burst"`
+	MaxWait string `json:"max_wait"`
+}
+
+// configure cambia la cuota en caliente, sin reiniciar ni perder las
+// reservas en curso. qpm 0 desactiva el pacer.
+func (p *kmsPacer) configure(qpm, burst int, maxWait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.qpm, p.burst, p.maxWait = qpm, burst, maxWait
+	p.interval = 0
+	if qpm > 0 {
+		p.interval = time.Minute / time.Duration(qpm)
+	}
+}
+
+func (p *kmsPacer) settings(class string) pacerSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return pacerSettings{Class: class, QPM: p.qpm, Burst: p.burst, MaxWait: p.maxWait.String()}
+}
+
+// acquire espera turno en el pool de concurrencia de la clase, si lo hay.
+// Devuelve la función que libera el hueco.
+func (p *kmsPacer) acquire(ctx context.Context) (func(), error) {
+	if p.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait reserva el siguiente hueco y espera hasta él
+func (p *kmsPacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	if p.interval == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if floor := now.Add(-time.Duration(p.burst) * p.interval); p.next.Before(floor) {
+		p.next = floor
+	}
+	delay := p.next.Sub(now)
+	if delay > p.maxWait {
+		p.mu.Unlock()
+		return errPacerSaturated
+	}
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pacerInterceptor aplica a cada llamada del cliente de KMS el pacer de su
+// clase
+func pacerInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	p := pacerFor(ctx)
+	_, end := startSpan(ctx, "kms.pacer", attribute.String("class", priorityOf(ctx)))
+	release, err := p.acquire(ctx)
+	if err != nil {
+		end(err)
+		observePacerError(ctx, err)
+		return err
+	}
+	defer release()
+	err = p.wait(ctx)
+	end(err)
+	if err != nil {
+		observePacerError(ctx, err)
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// configurePacerFromEnv carga la cuota de cada clase: KMS_QPM,
+// KMS_PACER_BURST, KMS_PACER_MAX_WAIT y KMS_CONCURRENCY para las claves
+// interactivas, y los mismos con prefijo KMS_BATCH_ para las de lotes
+func configurePacerFromEnv() {
+	for class, prefix := range map[string]string{priorityInteractive: "KMS_", priorityBatch: "KMS_BATCH_"} {
+		maxWait, err := time.ParseDuration(getEnv(prefix+"PACER_MAX_WAIT", "2s"))
+		if err != nil {
+			maxWait = 2 * time.Second
+		}
+		p := pacers[class]
+		p.configure(envInt(prefix+"QPM", 0), envInt(prefix+"PACER_BURST", 10), maxWait)
+		if n := envInt(prefix+"CONCURRENCY", 0); n > 0 {
+			p.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// kmsPacerHandler consulta (GET) o cambia en caliente (PUT) la cuota del
+// pacer de una clase (?class=interactive|batch), p.ej. tras ampliar la cuota
+// del proyecto
+func kmsPacerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	class := r.URL.Query().Get("class")
+	if class == "" {
+		class = priorityInteractive
+	}
+	pacer, ok := pacers[class]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "class debe ser interactive o batch")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, pacer.settings(class))
+	case http.MethodPut:
+		var s pacerSettings
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.QPM < 0 || s.Burst < 0 {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "Se espera {qpm, burst, max_wait} con valores no negativos")
+			return
+		}
+		maxWait := 2 * time.Second
+		if s.MaxWait != "" {
+			d, err := time.ParseDuration(s.MaxWait)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errInvalidRequest, "max_wait inválido")
+				return
+			}
+			maxWait = d
+		}
+		pacer.configure(s.QPM, s.Burst, maxWait)
+		recordAdminAudit(r, "kms_pacer_updated", fmt.Sprintf("class=%s qpm=%d burst=%d max_wait=%s", class, s.QPM, s.Burst, maxWait))
+		writeJSON(w, http.StatusOK, pacer.settings(class))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET o PUT permitido")
+	}
+}
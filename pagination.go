@@ -0,0 +1,95 @@
+// pagination.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Paginación por cursor de los listados (sobres, auditoría, claves,
+// trabajos, retenciones, aprobaciones...). Todos aceptan ?page_size=
+// (PAGE_SIZE_DEFAULT, 100; como mucho PAGE_SIZE_MAX, 1000) y ?page_token=,
+// y responden con la página y "next_page_token" si queda más:
+//
+//	GET /admin/audit?event=sign&page_size=50
+//	GET /admin/audit?event=sign&page_size=50&page_token=...
+//
+// El token es opaco: apunta al último elemento devuelto, así que las altas
+// y bajas entre páginas no hacen saltar ni repetir elementos. Los filtros
+// deben repetirse en cada página.
+
+// pageParams es la página pedida
+type pageParams struct {
+	size  int
+	after string // id del último elemento de la página anterior
+}
+
+// requestPage lee ?page_size= y ?page_token=
+func requestPage(r *http.Request) (pageParams, error) {
+	p := pageParams{size: envInt("PAGE_SIZE_DEFAULT", 100)}
+	max := envInt("PAGE_SIZE_MAX", 1000)
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("page_size debe ser un entero positivo")
+		}
+		p.size = n
+	}
+	p.size = min(p.size, max)
+	if v := r.URL.Query().Get("page_token"); v != "" {
+		after, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(after) == 0 {
+			return p, fmt.Errorf("page_token inválido")
+		}
+		p.after = string(after)
+	}
+	return p, nil
+}
+
+// paginate recorre ids (ordenados) a partir del cursor y devuelve hasta
+// p.size elementos; item decide si el id entra en el listado. next es el
+// token de la página siguiente, o "" si no hay más.
+func paginate[T any](p pageParams, ids []string, item func(id string) (T, bool)) (page []T, next string) {
+	page = []T{}
+	start := 0
+	if p.after != "" {
+		start = sort.SearchStrings(ids, p.after)
+		if start < len(ids) && ids[start] == p.after {
+			start++
+		}
+	}
+	last := ""
+	for _, id := range ids[start:] {
+		v, ok := item(id)
+		if !ok {
+			continue
+		}
+		if len(page) == p.size {
+			return page, base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+		page, last = append(page, v), id
+	}
+	return page, ""
+}
+
+// pageRequest lee la página pedida y responde 400 si no es válida
+func pageRequest(w http.ResponseWriter, r *http.Request) (pageParams, bool) {
+	p, err := requestPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return p, false
+	}
+	return p, true
+}
+
+// writePage responde con la página bajo name y el token de la siguiente
+func writePage(w http.ResponseWriter, name string, page interface{}, next string) {
+	resp := map[string]interface{}{name: page}
+	if next != "" {
+		resp["next_page_token"] = next
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,151 @@
+// bls.go
+package firmajson
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+
+	bls12381 "github.com/cloudflare/circl/ecc/bls12381"
+	"github.com/cloudflare/circl/sign/bls"
+)
+
+// BLS firma con BLS (Boneh–Lynn–Shacham) sobre BLS12-381, con una clave
+// derivada de un secreto en memoria. La gracia de BLS es la agregación: las
+// firmas de miles de registros se suman en una sola (AggregateBLS) que se
+// verifica contra el conjunto entero (VerifyAggregate), y basta guardar ésa.
+//
+// Es el esquema básico de draft-irtf-cfrg-bls-signature en su variante de
+// firma mínima (BLSAlgorithm): firmas en G1 (48 bytes comprimidas), clave
+// pública en G2 y hash a la curva de RFC 9380. La aritmética es la de
+// github.com/cloudflare/circl. Como Local, es para el backend de desarrollo
+// y para comprimir lo que se archiva, no para sustituir a KMS.
+type BLS struct {
+	sk   *bls.PrivateKey[bls.KeyG2SigG1]
+	pub  *bls.PublicKey[bls.KeyG2SigG1]
+	name string
+}
+
+// BLSSignatureSize es la longitud de una firma BLS, agregada o no
+const BLSSignatureSize = bls12381.G1SizeCompressed
+
+// BLSAlgorithm es el identificador del conjunto de parámetros: firmas en
+// G1, hash a G1 de RFC 9380 con SHA-256 y el esquema básico (NUL). Es
+// también la etiqueta de dominio del hash a la curva.
+const BLSAlgorithm = "BLS_SIG_BLS12381G1_XMD:SHA-256_SSWU_RO_NUL_"
+
+// blsKeyInfo separa la derivación de la clave BLS de cualquier otro uso
+// del secreto local
+const blsKeyInfo = "firma-json/bls/v2"
+
+// ErrBLSSignature indica que una firma BLS no es un punto válido de G1
+var ErrBLSSignature = errors.New("firma BLS mal formada")
+
+// NewBLS deriva la clave BLS de secret con el KeyGen del borrador (HKDF-
+// SHA256); name es el identificador de clave
+func NewBLS(secret []byte, name string) (*BLS, error) {
+	if len(secret) < MinLocalSecret {
+		return nil, errors.New("el secreto BLS debe tener al menos 32 bytes")
+	}
+	sk, err := bls.KeyGen[bls.KeyG2SigG1](secret, nil, []byte(blsKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	return &BLS{sk: sk, pub: sk.PublicKey(), name: name}, nil
+}
+
+// KeyVersion devuelve el identificador de clave
+func (b *BLS) KeyVersion() string { return b.name }
+
+// PublicKey devuelve la clave pública (un punto de G2 comprimido, 96 bytes)
+func (b *BLS) PublicKey() []byte {
+	raw, _ := b.pub.MarshalBinary()
+	return raw
+}
+
+// Sign devuelve la firma BLS de data
+func (b *BLS) Sign(_ context.Context, data []byte) ([]byte, error) {
+	return bls.Sign(b.sk, data), nil
+}
+
+// Verify comprueba una firma individual
+func (b *BLS) Verify(_ context.Context, data, sig []byte) (Verification, error) {
+	valid := false
+	if _, err := unmarshalBLS(sig); err == nil {
+		valid = bls.Verify(b.pub, data, sig)
+	}
+	return Verification{
+		Valid:      valid,
+		Method:     "local_bls",
+		KeyVersion: b.name,
+		Algorithm:  BLSAlgorithm,
+	}, nil
+}
+
+// VerifyAggregate comprueba que agg es la suma de las firmas de todos los
+// mensajes de msgs, que deben ser distintos entre sí: el esquema básico
+// sólo es seguro con mensajes distintos. Como todas las firmas son de la
+// misma clave, son dos emparejamientos sea cual sea el número de mensajes.
+func (b *BLS) VerifyAggregate(msgs [][]byte, agg []byte) (bool, error) {
+	sig, err := unmarshalBLS(agg)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) == 0 {
+		return false, errors.New("no hay mensajes que verificar")
+	}
+	seen := make(map[[sha256.Size]byte]bool, len(msgs))
+	h := new(bls12381.G1)
+	h.SetIdentity()
+	for _, m := range msgs {
+		sum := sha256.Sum256(m)
+		if seen[sum] {
+			return false, errors.New("mensajes repetidos en el conjunto")
+		}
+		seen[sum] = true
+		h.Add(h, hashToG1(m, BLSAlgorithm))
+	}
+	var pub bls12381.G2
+	raw, _ := b.pub.MarshalBinary()
+	if err := pub.SetBytes(raw); err != nil {
+		return false, err
+	}
+	// e(Σ H(mᵢ), pk) / e(σ, g2) == 1
+	res := bls12381.ProdPairFrac([]*bls12381.G1{h, sig}, []*bls12381.G2{&pub, bls12381.G2Generator()}, []int{1, -1})
+	return res.IsIdentity(), nil
+}
+
+// AggregateBLS suma firmas BLS en una sola del mismo tamaño
+func AggregateBLS(sigs [][]byte) ([]byte, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("no hay firmas que agregar")
+	}
+	for _, s := range sigs {
+		if _, err := unmarshalBLS(s); err != nil {
+			return nil, err
+		}
+	}
+	return bls.Aggregate(bls.KeyG2SigG1{}, sigs)
+}
+
+// unmarshalBLS decodifica una firma comprimida y rechaza el punto del
+// infinito, los puntos fuera del subgrupo y las codificaciones no canónicas
+func unmarshalBLS(sig []byte) (*bls12381.G1, error) {
+	if len(sig) != BLSSignatureSize {
+		return nil, ErrBLSSignature
+	}
+	p := new(bls12381.G1)
+	if err := p.SetBytes(sig); err != nil || p.IsIdentity() || !bytes.Equal(p.BytesCompressed(), sig) {
+		return nil, ErrBLSSignature
+	}
+	return p, nil
+}
+
+// hashToG1 es hash_to_curve de RFC 9380 (BLS12381G1_XMD:SHA-256_SSWU_RO_)
+// con la etiqueta de dominio dst
+func hashToG1(msg []byte, dst string) *bls12381.G1 {
+	p := new(bls12381.G1)
+	p.Hash(msg, []byte(dst))
+	return p
+}
@@ -0,0 +1,99 @@
+// bls_test.go
+package firmajson
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+)
+
+// Vectores de RFC 9380, apéndice J.9.1 (BLS12381G1_XMD:SHA-256_SSWU_RO_):
+// el punto sin comprimir es x || y
+func TestHashToG1RFC9380(t *testing.T) {
+	const dst = "QUUX-V01-CS02-with-BLS12381G1_XMD:SHA-256_SSWU_RO_"
+	vectors := []struct{ msg, x, y string }{
+		{"",
+			"052926add2207b76ca4fa57a8734416c8dc95e24501772c814278700eed6d1e4e8cf62d9c09db0fac349612b759e79a1",
+			"08ba738453bfed09cb546dbb0783dbb3a5f1f566ed67bb6be0e8c67e2e81a4cc68ee29813bb7994998f3eae0c9c6a265"},
+		{"abc",
+			"03567bc5ef9c690c2ab2ecdf6a96ef1c139cc0b2f284dca0a9a7943388a49a3aee664ba5379a7655d3c68900be2f6903",
+			"0b9c15f3fe6e5cf4211f346271d7b01c8f3b28be689c8429c85b67af215533311f0b8dfaaa154fa6b88176c229f2885d"},
+	}
+	for _, v := range vectors {
+		got := hex.EncodeToString(hashToG1([]byte(v.msg), dst).Bytes())
+		if got != v.x+v.y {
+			t.Errorf("hash_to_curve(%q) = %s", v.msg, got)
+		}
+	}
+}
+
+// Respuesta conocida: la clave y la firma de un secreto fijo no pueden
+// cambiar sin invalidar lo ya archivado
+func TestBLSKnownAnswer(t *testing.T) {
+	const (
+		wantPub = "a9e27e56745a0e5d326f0df48d8911307096dbf16edbdadd4e821a1e09c7f76a73a1a7d85a3f54d96443a1fd7a295b7c10603bea53b1affdc578c3552c13d805a3ece2e48581263ba120e838c56a4125b0eb0d4e2b53150b52637e1f7a21a807"
+		wantSig = "abc930c52c7d9f753d3fad6e7951e50d1206dfe1590d5f29127eb0c06fac92094afb1254885897937be91664e86acdc0"
+	)
+	ctx := context.Background()
+	b, err := NewBLS(bytes.Repeat([]byte{0x42}, 32), "local:test/bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(b.PublicKey()); got != wantPub {
+		t.Errorf("clave pública = %s", got)
+	}
+	msg := []byte(`{"pedido":42}`)
+	sig, err := b.Sign(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(sig); got != wantSig {
+		t.Errorf("firma = %s", got)
+	}
+	if v, err := b.Verify(ctx, msg, sig); err != nil || !v.Valid || v.Algorithm != BLSAlgorithm {
+		t.Errorf("Verify = %+v, %v", v, err)
+	}
+	if v, _ := b.Verify(ctx, []byte(`{"pedido":43}`), sig); v.Valid {
+		t.Error("la firma no debe valer para otro mensaje")
+	}
+}
+
+func TestBLSAggregate(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBLS(bytes.Repeat([]byte{0x07}, 32), "local:test/bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := [][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`), []byte(`{"n":3}`)}
+	var sigs [][]byte
+	for _, m := range msgs {
+		s, _ := b.Sign(ctx, m)
+		sigs = append(sigs, s)
+	}
+	agg, err := AggregateBLS(sigs)
+	if err != nil || len(agg) != BLSSignatureSize {
+		t.Fatalf("AggregateBLS: %x %v", agg, err)
+	}
+	if ok, err := b.VerifyAggregate([][]byte{msgs[2], msgs[0], msgs[1]}, agg); !ok || err != nil {
+		t.Fatalf("el agregado debe valer en cualquier orden: %v", err)
+	}
+	if ok, _ := b.VerifyAggregate(msgs[:2], agg); ok {
+		t.Error("el agregado no debe valer sin uno de los mensajes")
+	}
+	if _, err := b.VerifyAggregate([][]byte{msgs[0], msgs[0]}, agg); err == nil {
+		t.Error("mensajes repetidos deben rechazarse")
+	}
+
+	// El punto del infinito y las codificaciones ajenas no son firmas
+	infinity := make([]byte, BLSSignatureSize)
+	infinity[0] = 0xc0
+	for _, bad := range [][]byte{infinity, make([]byte, BLSSignatureSize), sigs[0][:BLSSignatureSize-1]} {
+		if _, err := AggregateBLS([][]byte{bad}); err != ErrBLSSignature {
+			t.Errorf("AggregateBLS(%x) = %v", bad, err)
+		}
+		if v, _ := b.Verify(ctx, msgs[0], bad); v.Valid {
+			t.Errorf("Verify(%x) no debe valer", bad)
+		}
+	}
+}
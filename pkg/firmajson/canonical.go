@@ -0,0 +1,330 @@
+// canonical.go
+package firmajson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"example.com/firmajson/canonicalizer"
+)
+
+// canonicalJSON serializa el payload a los bytes que se firman. La forma
+// canónica es la de json.Marshal (claves ordenadas, sin espacios, escape
+// HTML). La mayoría de documentos son registros clave/valor planos, así que
+// para ellos se usa un codificador específico que produce exactamente los
+// mismos bytes sin pasar por reflexión.
+//
+// Los arrays grandes de objetos independientes (lotes de 100k registros) se
+// codifican en paralelo por tramos y se concatenan en orden, de modo que el
+// resultado es idéntico al secuencial.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if isFlat(t) {
+			return appendFlatObject(make([]byte, 0, 64*len(t)), t)
+		}
+		if hasLargeArray(t) {
+			return appendObject(nil, t)
+		}
+	case []interface{}:
+		if len(t) >= ParallelMinItems {
+			return appendArrayParallel(nil, t)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// Formas canónicas. Emisores JSON distintos escapan distinto (\u00e9 frente
+// a é, \u003c frente a <), así que quien recalcula los bytes canónicos en
+// local puede pedir la forma que coincide con la suya. La forma se registra
+// en el sobre ("escape") para verificarlo igual.
+const (
+	// FormHTML es la de json.Marshal: <, > y & escapados, no ASCII literal
+	FormHTML = "html"
+	// FormMinimal sólo escapa lo que exige JSON; no ASCII literal
+	FormMinimal = "minimal"
+	// FormASCII escapa además todo lo no ASCII como \uXXXX
+	FormASCII = "ascii"
+	// FormJCS es el JSON Canonicalization Scheme (RFC 8785): no es sólo un
+	// modo de escape, también normaliza números y el orden de claves, y es
+	// la forma que reproducen otros lenguajes (ver canonicalizer)
+	FormJCS = "jcs"
+)
+
+// ValidForm indica si form es una forma canónica conocida ("" = html)
+func ValidForm(form string) bool {
+	switch form {
+	case "", FormHTML, FormMinimal, FormASCII, FormJCS:
+		return true
+	}
+	return false
+}
+
+// Canonicalize serializa v en la forma canónica indicada
+func Canonicalize(v interface{}, form string) ([]byte, error) {
+	switch form {
+	case "", FormHTML:
+		return canonicalJSON(v)
+	case FormJCS:
+		return canonicalizer.Canonicalize(v)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	out := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if form == FormASCII {
+		out = escapeNonASCII(out)
+	}
+	return out, nil
+}
+
+// escapeNonASCII sustituye cada carácter no ASCII por \uXXXX (con pares
+// suplentes fuera del BMP). En JSON válido sólo pueden aparecer dentro de
+// strings, así que basta con recorrer los bytes.
+func escapeNonASCII(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			out = append(out, data[i])
+			i++
+			continue
+		}
+		c, size := utf8.DecodeRune(data[i:])
+		i += size
+		if c > 0xFFFF {
+			r1, r2 := utf16.EncodeRune(c)
+			out = appendUnicodeEscape(appendUnicodeEscape(out, r1), r2)
+			continue
+		}
+		out = appendUnicodeEscape(out, c)
+	}
+	return out
+}
+
+func appendUnicodeEscape(dst []byte, c rune) []byte {
+	return append(dst, '\\', 'u', hexDigits[c>>12&0xF], hexDigits[c>>8&0xF], hexDigits[c>>4&0xF], hexDigits[c&0xF])
+}
+
+// ParallelMinItems es el tamaño a partir del cual un array se codifica en
+// paralelo
+var ParallelMinItems = 1000
+
+func hasLargeArray(m map[string]interface{}) bool {
+	min := ParallelMinItems
+	for _, v := range m {
+		if a, ok := v.([]interface{}); ok && len(a) >= min {
+			return true
+		}
+	}
+	return false
+}
+
+// appendObject codifica el objeto campo a campo para que los arrays grandes
+// que contenga pasen por appendArrayParallel
+func appendObject(dst []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	dst = append(dst, '{')
+	for i, k := range keys {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		b, err := canonicalJSON(m[k])
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, b...)
+	}
+	return append(dst, '}'), nil
+}
+
+// appendArrayParallel reparte el array en un tramo por CPU, codifica cada
+// tramo en su propio buffer y los une en el orden original
+func appendArrayParallel(dst []byte, items []interface{}) ([]byte, error) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(items) {
+		workers = len(items)
+	}
+	if workers == 0 {
+		return append(dst, '[', ']'), nil
+	}
+	chunk := (len(items) + workers - 1) / workers
+	workers = (len(items) + chunk - 1) / chunk
+	parts := make([][]byte, workers)
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from, to := w*chunk, (w+1)*chunk
+		if to > len(items) {
+			to = len(items)
+		}
+		wg.Add(1)
+		go func(w int, items []interface{}) {
+			defer wg.Done()
+			var buf []byte
+			for i, item := range items {
+				if i > 0 {
+					buf = append(buf, ',')
+				}
+				b, err := canonicalJSON(item)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				buf = append(buf, b...)
+			}
+			parts[w] = buf
+		}(w, items[from:to])
+	}
+	wg.Wait()
+
+	dst = append(dst, '[')
+	for w, part := range parts {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+		if w > 0 && len(part) > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, part...)
+	}
+	return append(dst, ']'), nil
+}
+
+// isFlat indica si todos los valores del objeto son escalares
+func isFlat(m map[string]interface{}) bool {
+	for _, v := range m {
+		switch v.(type) {
+		case nil, string, bool, float64:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func appendFlatObject(dst []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	dst = append(dst, '{')
+	for i, k := range keys {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		switch v := m[k].(type) {
+		case nil:
+			dst = append(dst, "null"...)
+		case string:
+			dst = appendJSONString(dst, v)
+		case bool:
+			dst = strconv.AppendBool(dst, v)
+		case float64:
+			var err error
+			if dst, err = appendJSONFloat(dst, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// appendJSONFloat reproduce el formato de float64 de encoding/json
+func appendJSONFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, errors.New("valor numérico no representable en JSON: " + strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 -> e-9, como encoding/json
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString reproduce el escape de strings de encoding/json con
+// escape HTML: <, > y & como \u00XX, U+2028/U+2029 escapados y UTF-8
+// inválido sustituido por U+FFFD
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
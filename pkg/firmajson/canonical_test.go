@@ -0,0 +1,176 @@
+// canonical_test.go
+package firmajson
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// El codificador de objetos planos produce los mismos bytes que json.Marshal
+func TestCanonicalFlatMatchesMarshal(t *testing.T) {
+	docs := []map[string]interface{}{
+		{},
+		{"b": 1.0, "a": "x", "c": nil, "d": true, "e": false},
+		{"z": "<a href=\"x\">&</a>", "y": "\u2028\u2029", "x": "\x00\x1f\t\n\r\b\f\\"},
+		{"é": "ñ", "€": "😀", "A": "a", "a": "A", "aa": "", "a\x00": ""},
+		{"inválido": "\xff\xfe", "k": "a\xc3"},
+		{"n": 1e21, "m": 1e20, "p": 1e-6, "q": 1e-7, "r": -0.0, "s": 123456789.123, "t": 5e-324},
+	}
+	for _, doc := range docs {
+		if !isFlat(doc) {
+			t.Fatalf("%v debe ir por el camino rápido", doc)
+		}
+		want, _ := json.Marshal(doc)
+		got, err := canonicalJSON(doc)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("\n got %s %v\nwant %s", got, err, want)
+		}
+	}
+}
+
+// appendJSONFloat formatea como encoding/json
+func TestAppendJSONFloat(t *testing.T) {
+	floats := []float64{
+		0, math.Copysign(0, -1), 1, -1, 0.1, 1.5, 100, 1e6, 1e20, 1e21, 1.5e21, 123456789012345678,
+		1e-6, 9.99e-7, 1e-7, 1.2e-9, 1e-10, 1e-100, 1e100, -2.5e-8,
+		math.MaxFloat64, math.SmallestNonzeroFloat64, 1 << 53, 0.30000000000000004,
+	}
+	for _, f := range floats {
+		want, _ := json.Marshal(f)
+		got, err := appendJSONFloat(nil, f)
+		if err != nil || string(got) != string(want) {
+			t.Errorf("%v: got %s %v, want %s", f, got, err, want)
+		}
+	}
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := canonicalJSON(map[string]interface{}{"n": f}); err == nil {
+			t.Errorf("%v debe rechazarse", f)
+		}
+	}
+}
+
+// Las claves van ordenadas por bytes en todas las formas salvo jcs, que
+// ordena por unidades UTF-16
+func TestCanonicalKeyOrder(t *testing.T) {
+	doc := map[string]interface{}{
+		"b": map[string]interface{}{"y": 1.0, "x": []interface{}{2.0}},
+		"a": 1.0, "B": 1.0, "｡": 1.0, "\U0001F600": 1.0,
+	}
+	tests := []struct{ form, want string }{
+		{FormHTML, `{"B":1,"a":1,"b":{"x":[2],"y":1},"｡":1,"😀":1}`},
+		{FormMinimal, `{"B":1,"a":1,"b":{"x":[2],"y":1},"｡":1,"😀":1}`},
+		{FormASCII, `{"B":1,"a":1,"b":{"x":[2],"y":1},"\uff61":1,"\ud83d\ude00":1}`},
+		{FormJCS, `{"B":1,"a":1,"b":{"x":[2],"y":1},"😀":1,"｡":1}`},
+	}
+	for _, tt := range tests {
+		got, err := Canonicalize(doc, tt.form)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %s %v, want %s", tt.form, got, err, tt.want)
+		}
+	}
+}
+
+// Formas de escape sobre el mismo string
+func TestCanonicalForms(t *testing.T) {
+	doc := map[string]interface{}{"s": "<\u00e9>&\u2028\n"}
+	tests := []struct{ form, want string }{
+		{"", `{"s":"\u003cé\u003e\u0026\u2028\n"}`},
+		{FormHTML, `{"s":"\u003cé\u003e\u0026\u2028\n"}`},
+		{FormMinimal, `{"s":"<é>&\u2028\n"}`},
+		{FormASCII, `{"s":"<\u00e9>&\u2028\n"}`},
+		{FormJCS, "{\"s\":\"<\u00e9>&\u2028\\n\"}"},
+	}
+	for _, tt := range tests {
+		got, err := Canonicalize(doc, tt.form)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q: got %s %v, want %s", tt.form, got, err, tt.want)
+		}
+	}
+	if ValidForm("utf16") {
+		t.Error("forma desconocida aceptada")
+	}
+}
+
+// El camino paralelo produce los mismos bytes que el secuencial y que
+// json.Marshal, sea cual sea el reparto en tramos
+func TestCanonicalParallelMatchesSequential(t *testing.T) {
+	defer func(n int) { ParallelMinItems = n }(ParallelMinItems)
+
+	for _, n := range []int{0, 1, 2, 7, 64, 1001} {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = map[string]interface{}{
+				"id":    float64(i),
+				"name":  fmt.Sprintf("<registro %d>", i),
+				"lines": []interface{}{map[string]interface{}{"qty": float64(i % 3)}},
+			}
+		}
+		docs := []interface{}{items, map[string]interface{}{"records": items, "count": float64(n)}}
+		for _, doc := range docs {
+			ParallelMinItems = 1 << 30
+			sequential, err := canonicalJSON(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := json.Marshal(doc)
+			if string(sequential) != string(want) {
+				t.Fatalf("n=%d: el secuencial difiere de json.Marshal", n)
+			}
+			ParallelMinItems = 1
+			parallel, err := canonicalJSON(doc)
+			if err != nil || string(parallel) != string(sequential) {
+				t.Fatalf("n=%d: el paralelo difiere (%v)\n got %.200s\nwant %.200s", n, err, parallel, sequential)
+			}
+		}
+	}
+
+	// Un error en cualquier tramo llega al resultado
+	ParallelMinItems = 1
+	bad := []interface{}{map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": math.NaN()}}
+	if _, err := canonicalJSON(map[string]interface{}{"records": bad}); err == nil {
+		t.Fatal("NaN en un tramo paralelo debe fallar")
+	}
+}
+
+// DecodeJSON sólo conserva literal lo que float64 no representa
+func TestDecodeJSONNumbers(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{`1`, 1.0},
+		{`1.50`, 1.5},
+		{`1E2`, 100.0},
+		{`-0.000001`, -0.000001},
+		{`9007199254740993`, json.Number("9007199254740993")},
+		{`12345678901234567890`, json.Number("12345678901234567890")},
+		{`0.10000000000000000001`, json.Number("0.10000000000000000001")},
+		{`1.2300000000000000001000`, json.Number("1.2300000000000000001")},
+		{`1.00000000000000000001E5`, json.Number("1.00000000000000000001e5")},
+		{`1e400`, json.Number("1e400")},
+		{`1e999999999999`, json.Number("1e999999999999")},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := DecodeJSON([]byte(`{"n":`+tt.in+`}`), &v); err != nil {
+			t.Fatalf("%s: %v", tt.in, err)
+		}
+		if got := v.(map[string]interface{})["n"]; got != tt.want {
+			t.Errorf("%s: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	// Los números literales se firman tal cual
+	var doc map[string]interface{}
+	if err := DecodeJSON([]byte(`{"id":9007199254740993,"n":[1.0]}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Canonicalize(doc, FormHTML); string(got) != `{"id":9007199254740993,"n":[1]}` {
+		t.Errorf("canónico: %s", got)
+	}
+	if err := DecodeJSON([]byte(`{} {}`), &doc); err == nil {
+		t.Error("datos tras el documento deben rechazarse")
+	}
+}
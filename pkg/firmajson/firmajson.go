@@ -0,0 +1,163 @@
+// Package firmajson firma y verifica documentos JSON sin pasar por el
+// servidor HTTP: la forma canónica, los sobres y la firma con Cloud KMS son
+// los mismos que usa el servicio, así que un sobre firmado aquí verifica en
+// /verify y al revés.
+//
+//	client, err := kms.NewKeyManagementClient(ctx)
+//	...
+//	key := firmajson.NewKMS(client, "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1")
+//	env, err := firmajson.Sign(ctx, key, doc, firmajson.SignOptions{})
+//	...
+//	v, err := firmajson.Verify(ctx, key, env)
+//	if err == nil && v.Valid { ... }
+//
+// Signer y Verifier permiten sustituir KMS por otra implementación (Vault
+// Transit, un HSM propio, una clave en memoria para tests...). Para
+// verificar sin credenciales ni red basta la clave pública: ver Offline y
+// NewOfflineJWKS.
+package firmajson
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Signer firma los bytes canónicos de un documento
+type Signer interface {
+	// Sign devuelve la firma en bruto de data
+	Sign(ctx context.Context, data []byte) ([]byte, error)
+	// KeyVersion identifica la clave con la que se firma; se registra en
+	// el sobre
+	KeyVersion() string
+}
+
+// Verifier comprueba la firma de unos bytes canónicos
+type Verifier interface {
+	Verify(ctx context.Context, data, sig []byte) (Verification, error)
+}
+
+// Backend es un servicio de claves con el que se firma y se verifica. Hay
+// tres implementaciones: KMS (Cloud KMS), VaultTransit (HashiCorp Vault) y
+// Local (un secreto HMAC en memoria, para desarrollo).
+type Backend interface {
+	Signer
+	Verifier
+	// Key describe la versión de clave; la clave pública sólo en las
+	// asimétricas
+	Key(ctx context.Context) (*Key, error)
+}
+
+// Envelope es el sobre firmado, con los mismos campos que devuelve /sign
+type Envelope struct {
+	Payload    json.RawMessage `json:"payload"`
+	Signature  string          `json:"signature"`
+	KeyVersion string          `json:"key_version,omitempty"`
+	Escape     string          `json:"escape,omitempty"`
+	// Digest es el hash con el que se resumió el payload antes de firmarlo
+	// (ver Digested); "" si se firmaron los bytes canónicos
+	Digest string `json:"digest,omitempty"`
+}
+
+// SignOptions ajusta la firma de un documento
+type SignOptions struct {
+	// Form es la forma canónica (ver Canonicalize); "" es html
+	Form string
+	// Now da la hora del campo "timestamp"; time.Now si es nil
+	Now func() time.Time
+	// Digest firma el resumen de los bytes canónicos en vez de los bytes
+	// (DigestSHA256); para documentos de más de 64 KiB con MacSign
+	Digest string
+}
+
+// ErrReservedField indica que el documento ya trae un campo que añade la
+// firma
+var ErrReservedField = errors.New(`el campo "timestamp" está reservado`)
+
+// ErrInvalidPayload indica que el sobre no trae un documento JSON válido
+var ErrInvalidPayload = errors.New("payload inválido")
+
+// Sign añade "timestamp" (UTC, RFC 3339) al documento, lo serializa en la
+// forma canónica y lo firma. doc se modifica.
+func Sign(ctx context.Context, s Signer, doc map[string]interface{}, opts SignOptions) (*Envelope, error) {
+	if !ValidForm(opts.Form) {
+		return nil, errors.New("forma canónica desconocida: " + opts.Form)
+	}
+	if _, exists := doc["timestamp"]; exists {
+		return nil, ErrReservedField
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	doc["timestamp"] = now().UTC().Format(time.RFC3339Nano)
+	data, err := Canonicalize(doc, opts.Form)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := Digested(data, opts.Digest)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.Sign(ctx, signed)
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{
+		Payload:    data,
+		Signature:  base64.StdEncoding.EncodeToString(sig),
+		KeyVersion: s.KeyVersion(),
+		Digest:     opts.Digest,
+	}
+	if opts.Form != "" && opts.Form != FormHTML {
+		env.Escape = opts.Form
+	}
+	return env, nil
+}
+
+// Verify reconstruye los bytes canónicos del payload del sobre y comprueba
+// la firma
+func Verify(ctx context.Context, v Verifier, env *Envelope) (Verification, error) {
+	var obj interface{}
+	if err := DecodeJSON(env.Payload, &obj); err != nil {
+		return Verification{}, ErrInvalidPayload
+	}
+	data, err := Canonicalize(obj, env.Escape)
+	if err != nil {
+		return Verification{}, err
+	}
+	if data, err = Digested(data, env.Digest); err != nil {
+		return Verification{}, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return Verification{}, errors.New("firma Base64 inválida")
+	}
+	return v.Verify(ctx, data, sig)
+}
+
+// DigestSHA256 es el único resumen que admite Digested
+const DigestSHA256 = "sha256"
+
+// digestDomain separa lo firmado en modo resumen de los bytes canónicos
+const digestDomain = "firma-json/digest\x00"
+
+// Digested devuelve lo que se firma para los bytes canónicos data con el
+// resumen alg: los propios bytes si alg es "", o firma-json/digest\x00,
+// el nombre del hash, \x00 y el hash de data. Así el tamaño de lo firmado
+// no depende del documento y una firma de un modo no vale en el otro.
+func Digested(data []byte, alg string) ([]byte, error) {
+	switch alg {
+	case "":
+		return data, nil
+	case DigestSHA256:
+		sum := sha256.Sum256(data)
+		out := make([]byte, 0, len(digestDomain)+len(alg)+1+len(sum))
+		out = append(append(append(out, digestDomain...), alg...), 0)
+		return append(out, sum[:]...), nil
+	}
+	return nil, errors.New("digest desconocido: " + alg)
+}
@@ -0,0 +1,86 @@
+// integrity.go
+package firmajson
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Protección extremo a extremo contra corrupción en tránsito entre el
+// servicio y KMS: cada petición de firma, verificación o cifrado lleva el
+// CRC32C de lo que se envía, y la respuesta debe confirmar que KMS lo
+// comprobó y traer el CRC32C de lo que devuelve (también la clave pública
+// de GetPublicKey). Cualquier discrepancia hace fallar la operación (nunca
+// se devuelve una firma, un resultado o una clave sin confirmar).
+
+// ErrIntegrity indica que una respuesta de KMS no superó la comprobación
+// de integridad
+var ErrIntegrity = errors.New("la respuesta de KMS no superó la comprobación CRC32C")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c devuelve el CRC32C de data en el formato de las peticiones de KMS
+func crc32c(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, crc32cTable)))
+}
+
+// checkCRC32C comprueba el CRC32C devuelto por KMS para data
+func checkCRC32C(data []byte, got *wrapperspb.Int64Value) error {
+	if got == nil || got.Value != int64(crc32.Checksum(data, crc32cTable)) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// checkVerified exige que KMS confirme haber comprobado nuestros CRC32C
+func checkVerified(flags ...bool) error {
+	for _, ok := range flags {
+		if !ok {
+			return ErrIntegrity
+		}
+	}
+	return nil
+}
+
+// Encrypt cifra plaintext con la clave de cifrado name comprobando la
+// integridad de la petición y de la respuesta
+func Encrypt(ctx context.Context, client *kms.KeyManagementClient, name string, plaintext []byte) ([]byte, error) {
+	resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:            name,
+		Plaintext:       plaintext,
+		PlaintextCrc32C: crc32c(plaintext),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVerified(resp.VerifiedPlaintextCrc32C); err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C(resp.Ciphertext, resp.CiphertextCrc32C); err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+// Decrypt descifra ciphertext con la clave de cifrado name comprobando la
+// integridad de la petición y de la respuesta. KMS rechaza la petición si
+// el CRC32C del texto cifrado no coincide.
+func Decrypt(ctx context.Context, client *kms.KeyManagementClient, name string, ciphertext []byte) ([]byte, error) {
+	resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:             name,
+		Ciphertext:       ciphertext,
+		CiphertextCrc32C: crc32c(ciphertext),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C(resp.Plaintext, resp.PlaintextCrc32C); err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
@@ -0,0 +1,94 @@
+// jose.go
+package firmajson
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+// JWSAlgorithm traduce un algoritmo de firma de KMS a su nombre JWS; ""
+// si no es de firma asimétrica
+func JWSAlgorithm(kmsAlg string) string {
+	switch {
+	case kmsAlg == "EC_SIGN_P256_SHA256":
+		return "ES256"
+	case kmsAlg == "EC_SIGN_P384_SHA384":
+		return "ES384"
+	case kmsAlg == "EC_SIGN_ED25519":
+		return "EdDSA"
+	case strings.HasPrefix(kmsAlg, "RSA_SIGN_PKCS1_"):
+		return "RS" + kmsAlg[len(kmsAlg)-3:]
+	case strings.HasPrefix(kmsAlg, "RSA_SIGN_PSS_"):
+		return "PS" + kmsAlg[len(kmsAlg)-3:]
+	}
+	return ""
+}
+
+// VerifyAsymmetric comprueba una firma JOSE (ES256, RS256, PS256, EdDSA...)
+// sobre data. Las firmas ECDSA se aceptan tanto en formato JOSE (r||s) como
+// en DER, que es lo que devuelve Cloud KMS.
+func VerifyAsymmetric(pub crypto.PublicKey, alg string, data, sig []byte) (bool, error) {
+	if alg == "EdDSA" {
+		k, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return false, errors.New("EdDSA requiere una clave Ed25519")
+		}
+		return ed25519.Verify(k, data, sig), nil
+	}
+
+	h, hashID, err := hashFor(alg)
+	if err != nil {
+		return false, err
+	}
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "ES":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return false, fmt.Errorf("%s requiere una clave EC", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			return ecdsa.Verify(k, digest, r, s), nil
+		}
+		return ecdsa.VerifyASN1(k, digest, sig), nil
+	case "RS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return false, fmt.Errorf("%s requiere una clave RSA", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hashID, digest, sig) == nil, nil
+	case "PS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return false, fmt.Errorf("%s requiere una clave RSA", alg)
+		}
+		return rsa.VerifyPSS(k, hashID, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil, nil
+	}
+	return false, fmt.Errorf("algoritmo no soportado: %q", alg)
+}
+
+func hashFor(alg string) (hash.Hash, crypto.Hash, error) {
+	switch alg {
+	case "ES256", "RS256", "PS256":
+		return sha256.New(), crypto.SHA256, nil
+	case "ES384", "RS384", "PS384":
+		return sha512.New384(), crypto.SHA384, nil
+	case "RS512", "PS512":
+		return sha512.New(), crypto.SHA512, nil
+	}
+	return nil, 0, fmt.Errorf("algoritmo no soportado: %q", alg)
+}
@@ -0,0 +1,222 @@
+// kms.go
+package firmajson
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// KMS firma y verifica con una CryptoKeyVersion de Cloud KMS. La clave
+// puede ser MAC (HMAC_*), que se firma con MacSign y se verifica con
+// MacVerify, o asimétrica (EC_SIGN_P256_SHA256, RSA_SIGN_*...), que se
+// firma con AsymmetricSign sobre el digest de los datos y se verifica en
+// local con la clave pública. Implementa Backend.
+type KMS struct {
+	client *kms.KeyManagementClient
+	name   string
+
+	mu  sync.Mutex
+	key *Key
+}
+
+// NewKMS devuelve un KMS para la versión de clave name
+// (projects/.../cryptoKeys/.../cryptoKeyVersions/N). El cliente es del
+// llamador, que lo configura y lo cierra.
+func NewKMS(client *kms.KeyManagementClient, name string) *KMS {
+	return &KMS{client: client, name: name}
+}
+
+// Key es la información de una CryptoKeyVersion
+type Key struct {
+	Name         string
+	KMSAlgorithm string           // p.ej. EC_SIGN_P256_SHA256
+	Alg          string           // equivalente JWS; "" para claves MAC
+	Public       crypto.PublicKey // sólo asimétricas
+}
+
+// Asymmetric indica si la clave es de firma asimétrica
+func (k *Key) Asymmetric() bool { return k.Alg != "" }
+
+// KeyVersion devuelve el nombre de la versión de clave
+func (s *KMS) KeyVersion() string { return s.name }
+
+// Key devuelve (y cachea) la información de la versión de clave
+func (s *KMS) Key(ctx context.Context) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != nil {
+		return s.key, nil
+	}
+	k, err := LoadKey(ctx, s.client, s.name)
+	if err != nil {
+		return nil, err
+	}
+	s.key = k
+	return k, nil
+}
+
+// LoadKey consulta el algoritmo de la versión y, si es asimétrica, su
+// clave pública
+func LoadKey(ctx context.Context, client *kms.KeyManagementClient, name string) (*Key, error) {
+	v, err := client.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{Name: name, KMSAlgorithm: v.Algorithm.String()}
+	if strings.HasPrefix(k.KMSAlgorithm, "HMAC_") {
+		return k, nil
+	}
+	if k.Alg = JWSAlgorithm(k.KMSAlgorithm); k.Alg == "" {
+		return nil, fmt.Errorf("algoritmo de KMS no soportado: %s", k.KMSAlgorithm)
+	}
+	pk, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C([]byte(pk.Pem), pk.PemCrc32C); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(pk.Pem))
+	if block == nil {
+		return nil, errors.New("clave pública PEM inválida")
+	}
+	if k.Public, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Sign firma data: el MAC con claves HMAC o la firma asimétrica (DER para
+// ECDSA)
+func (s *KMS) Sign(ctx context.Context, data []byte) ([]byte, error) {
+	k, err := s.Key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if k.Asymmetric() {
+		return s.asymmetricSign(ctx, k, data)
+	}
+	resp, err := s.client.MacSign(ctx, &kmspb.MacSignRequest{
+		Name:       s.name,
+		Data:       data,
+		DataCrc32C: crc32c(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Integridad extremo a extremo (ver integrity.go)
+	if err := checkVerified(resp.VerifiedDataCrc32C, resp.Name == s.name); err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C(resp.Mac, resp.MacCrc32C); err != nil {
+		return nil, err
+	}
+	return resp.Mac, nil
+}
+
+// asymmetricSign firma data con AsymmetricSign: el digest para ECDSA y RSA,
+// los datos completos para Ed25519
+func (s *KMS) asymmetricSign(ctx context.Context, k *Key, data []byte) ([]byte, error) {
+	req := &kmspb.AsymmetricSignRequest{Name: k.Name}
+	var digest []byte
+	if k.Alg == "EdDSA" {
+		req.Data, req.DataCrc32C = data, crc32c(data)
+	} else {
+		h, hashID, err := hashFor(k.Alg)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+		digest = h.Sum(nil)
+		switch hashID {
+		case crypto.SHA256:
+			req.Digest = &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest}}
+		case crypto.SHA384:
+			req.Digest = &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: digest}}
+		default:
+			req.Digest = &kmspb.Digest{Digest: &kmspb.Digest_Sha512{Sha512: digest}}
+		}
+		req.DigestCrc32C = crc32c(digest)
+	}
+	resp, err := s.client.AsymmetricSign(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	verified := resp.VerifiedDigestCrc32C
+	if digest == nil {
+		verified = resp.VerifiedDataCrc32C
+	}
+	if err := checkVerified(verified, resp.Name == k.Name); err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C(resp.Signature, resp.SignatureCrc32C); err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// Verification describe cómo se verificó una firma. Los campos de
+// integridad son los que devuelve MacVerify; una respuesta cuyo
+// verified_success_integrity contradice a success no es fiable y la firma
+// se da por no válida.
+type Verification struct {
+	Valid                    bool   `json:"-"`
+	Method                   string `json:"method"` // "kms_mac_verify" o "local_public_key"
+	KeyVersion               string `json:"key_version"`
+	Algorithm                string `json:"algorithm"`
+	ProtectionLevel          string `json:"protection_level,omitempty"`
+	VerifiedSuccessIntegrity *bool  `json:"verified_success_integrity,omitempty"`
+	VerifiedDataCRC32C       *bool  `json:"verified_data_crc32c,omitempty"`
+	VerifiedMacCRC32C        *bool  `json:"verified_mac_crc32c,omitempty"`
+	IntegrityAnomaly         string `json:"integrity_anomaly,omitempty"`
+}
+
+// Verify comprueba que sig es la firma de data: con MacVerify si la clave
+// es MAC, o en local con la clave pública si es asimétrica
+func (s *KMS) Verify(ctx context.Context, data, sig []byte) (Verification, error) {
+	k, err := s.Key(ctx)
+	if err != nil {
+		return Verification{}, err
+	}
+	v := Verification{KeyVersion: k.Name, Algorithm: k.KMSAlgorithm}
+	if k.Asymmetric() {
+		v.Method = "local_public_key"
+		v.Valid, err = VerifyAsymmetric(k.Public, k.Alg, data, sig)
+		return v, err
+	}
+	resp, err := s.client.MacVerify(ctx, &kmspb.MacVerifyRequest{
+		Name:       s.name,
+		Data:       data,
+		DataCrc32C: crc32c(data),
+		Mac:        sig,
+		MacCrc32C:  crc32c(sig),
+	})
+	if err != nil {
+		return v, err
+	}
+	if err := checkVerified(resp.VerifiedDataCrc32C, resp.VerifiedMacCrc32C, resp.Name == s.name); err != nil {
+		return v, err
+	}
+	v.Method = "kms_mac_verify"
+	v.Valid = resp.Success
+	v.ProtectionLevel = resp.ProtectionLevel.String()
+	if resp.Name != "" {
+		v.KeyVersion = resp.Name
+	}
+	integrity, dataCRC, macCRC := resp.VerifiedSuccessIntegrity, resp.VerifiedDataCrc32C, resp.VerifiedMacCrc32C
+	v.VerifiedSuccessIntegrity, v.VerifiedDataCRC32C, v.VerifiedMacCRC32C = &integrity, &dataCRC, &macCRC
+	if integrity != resp.Success {
+		v.Valid = false
+		v.IntegrityAnomaly = "verified_success_integrity contradice a success"
+	}
+	return v, nil
+}
@@ -0,0 +1,57 @@
+// local.go
+package firmajson
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Local firma con HMAC-SHA256 y un secreto en memoria, sin ningún servicio
+// de claves. Es para desarrollo y tests: los sobres son idénticos a los de
+// una clave HMAC_SHA256 de KMS, pero la clave no está protegida. Implementa
+// Backend.
+type Local struct {
+	secret []byte
+	name   string
+}
+
+// MinLocalSecret es la longitud mínima del secreto de Local, la del propio
+// SHA-256
+const MinLocalSecret = sha256.Size
+
+// NewLocal devuelve un Local con el secreto dado; name es el identificador
+// de clave que se registra en los sobres
+func NewLocal(secret []byte, name string) (*Local, error) {
+	if len(secret) < MinLocalSecret {
+		return nil, errors.New("el secreto HMAC debe tener al menos 32 bytes")
+	}
+	return &Local{secret: append([]byte(nil), secret...), name: name}, nil
+}
+
+// KeyVersion devuelve el identificador de clave
+func (l *Local) KeyVersion() string { return l.name }
+
+// Key describe la clave como una HMAC_SHA256 de KMS
+func (l *Local) Key(context.Context) (*Key, error) {
+	return &Key{Name: l.name, KMSAlgorithm: "HMAC_SHA256"}, nil
+}
+
+// Sign devuelve el HMAC-SHA256 de data
+func (l *Local) Sign(_ context.Context, data []byte) ([]byte, error) {
+	m := hmac.New(sha256.New, l.secret)
+	m.Write(data)
+	return m.Sum(nil), nil
+}
+
+// Verify compara en tiempo constante sig con el HMAC-SHA256 de data
+func (l *Local) Verify(ctx context.Context, data, sig []byte) (Verification, error) {
+	mac, _ := l.Sign(ctx, data)
+	return Verification{
+		Valid:      hmac.Equal(mac, sig),
+		Method:     "local_hmac",
+		KeyVersion: l.name,
+		Algorithm:  "HMAC_SHA256",
+	}, nil
+}
@@ -0,0 +1,95 @@
+// numbers.go
+package firmajson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Al decodificar a interface{} encoding/json convierte todos los números a
+// float64, y los ids de 64 bits o los importes con muchos decimales se
+// redondean: el documento firmado ya no es el que mandó el cliente y al
+// verificarlo con sus números originales falla.
+//
+// DecodeJSON decodifica con json.Number y después deja como float64
+// sólo los números que float64 representa sin pérdida (los que vuelven a
+// salir iguales, en valor, al serializarlos). Así la forma canónica de los
+// documentos de siempre no cambia y los números que antes se perdían se
+// conservan literalmente. La forma jcs sigue usando float64, como exige el
+// RFC 8785.
+func DecodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("datos inesperados tras el documento JSON")
+	}
+	switch t := v.(type) {
+	case *interface{}:
+		*t = PreciseNumbers(*t)
+	case *map[string]interface{}:
+		PreciseNumbers(*t)
+	}
+	return nil
+}
+
+// PreciseNumbers recorre el valor sustituyendo cada json.Number por
+// float64 si no pierde precisión; maps y slices se modifican en el sitio
+func PreciseNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = PreciseNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = PreciseNumbers(item)
+		}
+	case json.Number:
+		return exactNumber(t)
+	}
+	return v
+}
+
+// maxExactExponent limita el tamaño de los números que se comparan con
+// precisión arbitraria
+const maxExactExponent = 400
+
+func exactNumber(n json.Number) interface{} {
+	s := string(n)
+	mant, exp, hasExp := strings.Cut(strings.ToLower(s), "e")
+	if hasExp {
+		if e, err := strconv.Atoi(exp); err != nil || e > maxExactExponent || e < -maxExactExponent {
+			return json.Number(s)
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return json.Number(normalizeNumber(mant, exp, hasExp))
+	}
+	literal, ok1 := new(big.Rat).SetString(s)
+	shortest, ok2 := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	if ok1 && ok2 && literal.Cmp(shortest) == 0 {
+		return f
+	}
+	return json.Number(normalizeNumber(mant, exp, hasExp))
+}
+
+// normalizeNumber da una forma estable al literal: exponente en minúscula y
+// sin ceros finales en la parte decimal
+func normalizeNumber(mant, exp string, hasExp bool) string {
+	if strings.Contains(mant, ".") {
+		mant = strings.TrimRight(strings.TrimRight(mant, "0"), ".")
+	}
+	if hasExp {
+		return mant + "e" + exp
+	}
+	return mant
+}
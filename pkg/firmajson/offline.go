@@ -0,0 +1,238 @@
+// offline.go
+package firmajson
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Verificación sin servicio de claves: con la clave pública (en PEM o en el
+// JWKS de /.well-known/jwks.json) se verifican los sobres de una clave
+// asimétrica sin credenciales de KMS ni acceso a red.
+//
+//	keys, err := firmajson.NewOfflineJWKS(jwks)
+//	...
+//	v, err := firmajson.Verify(ctx, keys, env)
+//
+// Las claves MAC (HMAC_*) no tienen parte pública, así que sus sobres sólo
+// se pueden verificar con el secreto o contra el servicio.
+
+// JWK es una clave pública en formato JSON Web Key (RFC 7517), con los
+// campos necesarios para verificar firmas
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// PublicKey convierte la JWK en una clave de crypto/*
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("curva no soportada: %q", k.Crv)
+		}
+		x, err1 := b64urlInt(k.X)
+		y, err2 := b64urlInt(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("coordenadas EC inválidas")
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("el punto no está en la curva")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err1 := b64urlInt(k.N)
+		e, err2 := b64urlInt(k.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() {
+			return nil, errors.New("parámetros RSA inválidos")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("curva no soportada: %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("clave Ed25519 inválida")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("tipo de clave no soportado: %q", k.Kty)
+	}
+}
+
+func b64urlInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("entero Base64URL inválido")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Offline verifica con una clave pública en memoria. Implementa Verifier.
+type Offline struct {
+	name string
+	alg  string
+	pub  crypto.PublicKey
+}
+
+// NewOffline devuelve un Offline para la clave pública pub. name es la
+// versión de clave ("key_version" en los sobres) y alg el algoritmo JWS;
+// si alg es "" se deduce de la clave, salvo en RSA, donde PKCS#1 y PSS no
+// se distinguen.
+func NewOffline(pub crypto.PublicKey, name, alg string) (*Offline, error) {
+	if alg == "" {
+		switch k := pub.(type) {
+		case ed25519.PublicKey:
+			alg = "EdDSA"
+		case *ecdsa.PublicKey:
+			switch k.Curve {
+			case elliptic.P256():
+				alg = "ES256"
+			case elliptic.P384():
+				alg = "ES384"
+			}
+		}
+		if alg == "" {
+			return nil, fmt.Errorf("no se puede deducir el algoritmo de una clave %T", pub)
+		}
+	}
+	// una firma vacía basta para saber si la clave y el algoritmo casan
+	if _, err := VerifyAsymmetric(pub, alg, nil, nil); err != nil {
+		return nil, err
+	}
+	return &Offline{name: name, alg: alg, pub: pub}, nil
+}
+
+// NewOfflinePEM es NewOffline con la clave en PEM (PUBLIC KEY, como la
+// devuelve GetPublicKey de KMS)
+func NewOfflinePEM(data []byte, name, alg string) (*Offline, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM inválido")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return NewOffline(pub, name, alg)
+}
+
+// KeyVersion devuelve la versión de clave
+func (o *Offline) KeyVersion() string { return o.name }
+
+// Alg devuelve el algoritmo JWS
+func (o *Offline) Alg() string { return o.alg }
+
+// Verify comprueba sig sobre data con la clave pública
+func (o *Offline) Verify(_ context.Context, data, sig []byte) (Verification, error) {
+	v := Verification{Method: "offline_public_key", KeyVersion: o.name, Algorithm: o.alg}
+	var err error
+	v.Valid, err = VerifyAsymmetric(o.pub, o.alg, data, sig)
+	return v, err
+}
+
+// OfflineKeys es un juego de claves públicas, normalmente un JWKS.
+// Implementa Verifier: una firma es válida si la verifica alguna de las
+// claves. Para exigir la versión que dice el sobre, Lookup(env.KeyVersion).
+type OfflineKeys struct {
+	keys  []*Offline
+	byKid map[string]*Offline
+}
+
+// NewOfflineJWKS lee un documento JWKS ({"keys": [...]}). Las claves con
+// "use" distinto de "sig" se ignoran; una clave de firma que no se puede
+// usar es un error, igual que un JWKS sin ninguna.
+func NewOfflineJWKS(data []byte) (*OfflineKeys, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("JWKS inválido: %w", err)
+	}
+	ks := &OfflineKeys{byKid: map[string]*Offline{}}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS: clave %d: %w", i, err)
+		}
+		o, err := NewOffline(pub, k.Kid, k.Alg)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS: clave %d: %w", i, err)
+		}
+		ks.Add(o)
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("JWKS sin claves de firma")
+	}
+	return ks, nil
+}
+
+// Add añade una clave al juego; si ya había otra con la misma versión, la
+// sustituye en Lookup
+func (ks *OfflineKeys) Add(o *Offline) {
+	if ks.byKid == nil {
+		ks.byKid = map[string]*Offline{}
+	}
+	ks.keys = append(ks.keys, o)
+	if o.name != "" {
+		ks.byKid[o.name] = o
+	}
+}
+
+// Lookup devuelve la clave de la versión name
+func (ks *OfflineKeys) Lookup(name string) (*Offline, bool) {
+	o, ok := ks.byKid[name]
+	return o, ok
+}
+
+// Verify prueba sig con cada clave y devuelve la primera que la verifica;
+// si no la verifica ninguna, la firma no es válida
+func (ks *OfflineKeys) Verify(ctx context.Context, data, sig []byte) (Verification, error) {
+	for _, o := range ks.keys {
+		if v, err := o.Verify(ctx, data, sig); err == nil && v.Valid {
+			return v, nil
+		}
+	}
+	return Verification{Method: "offline_public_key"}, nil
+}
+
+// VerifyOffline verifica el sobre con la clave de su key_version; si el
+// sobre no la trae, con cualquiera de las del juego
+func (ks *OfflineKeys) VerifyOffline(ctx context.Context, env *Envelope) (Verification, error) {
+	if env.KeyVersion == "" {
+		return Verify(ctx, ks, env)
+	}
+	o, ok := ks.Lookup(env.KeyVersion)
+	if !ok {
+		return Verification{}, fmt.Errorf("versión de clave desconocida: %s", env.KeyVersion)
+	}
+	return Verify(ctx, o, env)
+}
@@ -0,0 +1,239 @@
+// vault.go
+package firmajson
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultTransit firma y verifica con una clave del motor Transit de
+// HashiCorp Vault, a través de su API HTTP. Con claves ecdsa-p256,
+// ecdsa-p384, ed25519 y rsa-* firma con /sign y verifica en local con la
+// clave pública; con cualquier otro tipo (hmac, aes256-gcm96...) usa
+// HMAC-SHA256 con /hmac y /verify. Implementa Backend.
+//
+// Key().KMSAlgorithm usa la nomenclatura de Cloud KMS (EC_SIGN_P256_SHA256,
+// HMAC_SHA256...) para que el resto del servicio trate igual las claves de
+// los dos backends.
+type VaultTransit struct {
+	// Addr es la URL de Vault, p.ej. https://vault.internal:8200
+	Addr string
+	// Token es el token de Vault (X-Vault-Token)
+	Token string
+	// Namespace es el namespace de Vault Enterprise; opcional
+	Namespace string
+	// Mount es la ruta del motor Transit ("transit" por defecto)
+	Mount string
+	// KeyName y Version identifican la versión de la clave
+	KeyName string
+	Version int
+	// HTTPClient es el cliente HTTP; uno con timeout de 10s si es nil
+	HTTPClient *http.Client
+
+	mu  sync.Mutex
+	key *Key
+}
+
+// vaultKeyTypes traduce los tipos de clave de Transit a algoritmos de KMS
+var vaultKeyTypes = map[string]string{
+	"ecdsa-p256": "EC_SIGN_P256_SHA256",
+	"ecdsa-p384": "EC_SIGN_P384_SHA384",
+	"ed25519":    "EC_SIGN_ED25519",
+	"rsa-2048":   "RSA_SIGN_PKCS1_2048_SHA256",
+	"rsa-3072":   "RSA_SIGN_PKCS1_3072_SHA256",
+	"rsa-4096":   "RSA_SIGN_PKCS1_4096_SHA256",
+}
+
+// KeyVersion identifica la versión de clave como vault:<mount>/<clave>/<versión>
+func (v *VaultTransit) KeyVersion() string {
+	return fmt.Sprintf("vault:%s/%s/%d", v.mount(), v.KeyName, v.Version)
+}
+
+func (v *VaultTransit) mount() string {
+	if v.Mount == "" {
+		return "transit"
+	}
+	return strings.Trim(v.Mount, "/")
+}
+
+// Key consulta (y cachea) el tipo de la clave y, si es asimétrica, la
+// clave pública de la versión
+func (v *VaultTransit) Key(ctx context.Context) (*Key, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.key != nil {
+		return v.key, nil
+	}
+	var resp struct {
+		Type string                     `json:"type"`
+		Keys map[string]json.RawMessage `json:"keys"`
+	}
+	if err := v.call(ctx, http.MethodGet, "keys/"+v.KeyName, nil, &resp); err != nil {
+		return nil, err
+	}
+	raw, ok := resp.Keys[strconv.Itoa(v.Version)]
+	if !ok {
+		return nil, fmt.Errorf("vault: la clave %s no tiene la versión %d", v.KeyName, v.Version)
+	}
+	k := &Key{Name: v.KeyVersion(), KMSAlgorithm: "HMAC_SHA256"}
+	kmsAlg, asymmetric := vaultKeyTypes[resp.Type]
+	if !asymmetric {
+		v.key = k
+		return k, nil
+	}
+	var version struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.Unmarshal(raw, &version); err != nil || version.PublicKey == "" {
+		return nil, fmt.Errorf("vault: la versión %d no trae clave pública", v.Version)
+	}
+	pub, err := parseVaultPublicKey(version.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	k.KMSAlgorithm, k.Alg, k.Public = kmsAlg, JWSAlgorithm(kmsAlg), pub
+	v.key = k
+	return k, nil
+}
+
+// parseVaultPublicKey acepta PEM (ECDSA, RSA) o la clave Ed25519 en Base64
+func parseVaultPublicKey(s string) (interface{}, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("vault: clave pública inválida")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Sign firma data con la versión de la clave
+func (v *VaultTransit) Sign(ctx context.Context, data []byte) ([]byte, error) {
+	k, err := v.Key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(data),
+		"key_version": v.Version,
+	}
+	var resp struct {
+		Signature string `json:"signature"`
+		HMAC      string `json:"hmac"`
+	}
+	if !k.Asymmetric() {
+		if err := v.call(ctx, http.MethodPost, "hmac/"+v.KeyName+"/sha2-256", req, &resp); err != nil {
+			return nil, err
+		}
+		return decodeVaultValue(resp.HMAC)
+	}
+	switch k.Alg {
+	case "ES384":
+		req["hash_algorithm"] = "sha2-384"
+	case "EdDSA":
+	default:
+		req["hash_algorithm"] = "sha2-256"
+	}
+	if strings.HasPrefix(k.Alg, "RS") {
+		req["signature_algorithm"] = "pkcs1v15"
+	}
+	if err := v.call(ctx, http.MethodPost, "sign/"+v.KeyName, req, &resp); err != nil {
+		return nil, err
+	}
+	return decodeVaultValue(resp.Signature)
+}
+
+// Verify comprueba sig: con /verify de Vault para HMAC, en local con la
+// clave pública para claves asimétricas
+func (v *VaultTransit) Verify(ctx context.Context, data, sig []byte) (Verification, error) {
+	k, err := v.Key(ctx)
+	if err != nil {
+		return Verification{}, err
+	}
+	out := Verification{KeyVersion: k.Name, Algorithm: k.KMSAlgorithm}
+	if k.Asymmetric() {
+		out.Method = "local_public_key"
+		out.Valid, err = VerifyAsymmetric(k.Public, k.Alg, data, sig)
+		return out, err
+	}
+	req := map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(data),
+		"hmac":  fmt.Sprintf("vault:v%d:%s", v.Version, base64.StdEncoding.EncodeToString(sig)),
+	}
+	var resp struct {
+		Valid bool `json:"valid"`
+	}
+	if err := v.call(ctx, http.MethodPost, "verify/"+v.KeyName+"/sha2-256", req, &resp); err != nil {
+		return out, err
+	}
+	out.Method, out.Valid = "vault_hmac_verify", resp.Valid
+	return out, nil
+}
+
+// decodeVaultValue quita el prefijo vault:vN: de firmas y HMAC
+func decodeVaultValue(s string) ([]byte, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, errors.New("vault: respuesta de firma inesperada")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// call hace una petición a la API de Transit y decodifica su campo "data"
+func (v *VaultTransit) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	url := strings.TrimSuffix(v.Addr, "/") + "/v1/" + v.mount() + "/" + path
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := v.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("vault: respuesta inválida (%s)", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("vault: %s: %s", resp.Status, strings.Join(envelope.Errors, "; "))
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
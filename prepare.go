@@ -0,0 +1,255 @@
+// prepare.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// preparedCollection guarda los documentos preparados hasta su commit. Va
+// en el store compartido y no en memoria porque el commit puede llegar a
+// otra réplica.
+const preparedCollection = "prepared_signs"
+
+// preparedSign es un documento ya canonicalizado a la espera de que el
+// cliente confirme que ese contenido exacto es el que quiere firmar
+type preparedSign struct {
+	Alias string `json:"alias"`
+	// Caller es quien lo preparó: sólo él puede confirmarlo
+	Caller    string                 `json:"caller"`
+	Payload   map[string]interface{} `json:"payload"`
+	Data      []byte                 `json:"data"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	// Injected son los campos añadidos en la preparación, para responder
+	// sin eco del payload en el commit
+	Injected map[string]interface{} `json:"injected,omitempty"`
+	Escape   string                 `json:"escape,omitempty"`
+}
+
+var (
+	preparedPurgeMu sync.Mutex
+	preparedPurged  time.Time
+)
+
+// signPrepareHandler canonicaliza el documento igual que /sign pero no lo
+// firma: devuelve los bytes exactos, su hash y un token para /sign/commit.
+// La política de la clave y el control de anomalías se aplican ya aquí,
+// como en /sign, y otra vez en el commit.
+func signPrepareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
+		return
+	}
+	payloadMap, data, ok := preparePayload(w, r, alias)
+	if !ok {
+		return
+	}
+
+	ttl, err := time.ParseDuration(getEnv("PREPARE_TTL", "10m"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "PREPARE_TTL inválido")
+		return
+	}
+	token, err := randomID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "No se pudo generar el token")
+		return
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	ctx := r.Context()
+	purgeExpiredPrepared(ctx)
+	raw, err := json.Marshal(preparedSign{Alias: alias, Caller: callerID(r), Payload: payloadMap, Data: data, ExpiresAt: expiresAt,
+		Injected: injectedFields(r, alias, payloadMap), Escape: requestEscape(r)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	if err := db.Put(ctx, preparedCollection, token, raw); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"canonical":  string(data),
+		"sha256":     hex.EncodeToString(sum[:]),
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// loadPrepared lee un documento preparado; false si no existe o caducó
+func loadPrepared(ctx context.Context, token string) (preparedSign, bool, error) {
+	var p preparedSign
+	raw, err := db.Get(ctx, preparedCollection, token)
+	if errors.Is(err, errNotFound) {
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, err
+	}
+	if err := firmajson.DecodeJSON(raw, &p); err != nil {
+		return p, false, err
+	}
+	if time.Now().After(p.ExpiresAt) {
+		db.Delete(ctx, preparedCollection, token)
+		return p, false, nil
+	}
+	return p, true, nil
+}
+
+// claimPrepared gasta el token. Con NONCE_STORE la anotación es atómica
+// entre réplicas; sin él, dos commits simultáneos en réplicas distintas
+// podrían pasar los dos.
+func claimPrepared(ctx context.Context, token string, ttl time.Duration) (bool, error) {
+	if replayStore != nil {
+		fresh, err := replayStore.Claim(ctx, "prepare:"+token, ttl)
+		if err != nil || !fresh {
+			return false, err
+		}
+	}
+	if _, err := db.Get(ctx, preparedCollection, token); err != nil {
+		if errors.Is(err, errNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, db.Delete(ctx, preparedCollection, token)
+}
+
+// signCommitRequest es el cuerpo de /sign/commit
+type signCommitRequest struct {
+	Token  string `json:"token"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// signCommitHandler firma los bytes preparados asociados al token. Cada
+// token sólo se puede usar una vez y sólo por quien lo preparó; la firma
+// sigue después el mismo camino que en /sign (ver finishSign).
+func signCommitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	var req signCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+
+	p, found, err := loadPrepared(r.Context(), req.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errPrepareTokenInvalid, "Token desconocido o caducado")
+		return
+	}
+	caller := callerID(r)
+	if subtle.ConstantTimeCompare([]byte(caller), []byte(p.Caller)) != 1 {
+		writeError(w, http.StatusForbidden, errPrepareTokenInvalid, "El token lo preparó otro llamante")
+		return
+	}
+	if callerBlocked(r.Context(), caller) {
+		writeError(w, http.StatusForbidden, errCallerBlocked, "Acceso bloqueado")
+		return
+	}
+	if !requireDPoP(w, r) || !authorizeSigning(w, r, p.Alias) || !guardCaller(w, r) {
+		return
+	}
+	if _, err := requestCompression(r); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	if _, err := requestNotifyOwner(r); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	// Si el cliente nos devuelve el hash que revisó, debe coincidir
+	if req.SHA256 != "" {
+		sum := sha256.Sum256(p.Data)
+		if req.SHA256 != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusConflict, errPrepareHashMismatch, "El hash no coincide con el contenido preparado")
+			return
+		}
+	}
+	fresh, err := claimPrepared(r.Context(), req.Token, time.Until(p.ExpiresAt))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	if !fresh {
+		writeError(w, http.StatusNotFound, errPrepareTokenInvalid, "Token desconocido o caducado")
+		return
+	}
+
+	ctx := withKeyPriority(r.Context(), p.Alias)
+	audit := newAuditEntry(r, "sign_commit", p.Alias, p.Data)
+	start := time.Now()
+	signature, err := kmsSign(ctx, p.Data)
+	if err != nil {
+		audit.Outcome, audit.Detail = "error", err.Error()
+		recordAudit(ctx, audit)
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+	maybeShadowSign(p.Data, time.Since(start))
+
+	resp := map[string]interface{}{
+		"payload":   p.Payload,
+		"signature": signature,
+	}
+	addSignatureInfo(ctx, resp, signature)
+	finishSign(ctx, w, r, p.Alias, resp, p.Payload, p.Data, p.Escape, "", p.Injected)
+}
+
+// purgeExpiredPrepared borra los documentos preparados caducados, como
+// mucho una vez por minuto
+func purgeExpiredPrepared(ctx context.Context) {
+	preparedPurgeMu.Lock()
+	if time.Since(preparedPurged) < time.Minute {
+		preparedPurgeMu.Unlock()
+		return
+	}
+	preparedPurged = time.Now()
+	preparedPurgeMu.Unlock()
+
+	records, ids, err := db.List(ctx, preparedCollection)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, id := range ids {
+		var p preparedSign
+		if json.Unmarshal(records[id], &p) == nil && now.After(p.ExpiresAt) {
+			db.Delete(ctx, preparedCollection, id)
+		}
+	}
+}
+
+// randomID genera un identificador aleatorio de 128 bits en hexadecimal
+func randomID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
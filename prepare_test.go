@@ -0,0 +1,58 @@
+// prepare_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// El token vive en el store compartido, sólo lo confirma quien lo preparó y
+// sólo una vez
+func TestPrepareCommit(t *testing.T) {
+	t.Setenv("API_KEYS", "clave-a:equipo-a,clave-b:equipo-b")
+	asA := http.Header{"X-Api-Key": {"clave-a"}}
+	asB := http.Header{"X-Api-Key": {"clave-b"}}
+
+	code, prep := doJSON(t, validated(validateSignRequest, signPrepareHandler), http.MethodPost, "/sign/prepare", map[string]interface{}{"pedido": "A-1"}, asA)
+	if code != http.StatusOK {
+		t.Fatalf("/sign/prepare: %d %v", code, prep)
+	}
+	token, _ := prep["token"].(string)
+	if _, err := db.Get(context.Background(), preparedCollection, token); err != nil {
+		t.Fatalf("el token no está en el store: %v", err)
+	}
+
+	commit := map[string]interface{}{"token": token, "sha256": prep["sha256"]}
+	if code, resp := doJSON(t, signCommitHandler, http.MethodPost, "/sign/commit", commit, asB); code != http.StatusForbidden {
+		t.Fatalf("commit de otro llamante: %d %v", code, resp)
+	}
+	code, signed := doJSON(t, signCommitHandler, http.MethodPost, "/sign/commit?echo=true", commit, asA)
+	if code != http.StatusOK {
+		t.Fatalf("commit: %d %v", code, signed)
+	}
+	if v := testVerify(t, signed, nil); v["valid"] != true {
+		t.Fatalf("la firma del commit no verifica: %v", v)
+	}
+	if code, resp := doJSON(t, signCommitHandler, http.MethodPost, "/sign/commit", commit, asA); code != http.StatusNotFound {
+		t.Fatalf("segundo commit con el mismo token: %d %v", code, resp)
+	}
+}
+
+// Preparar ya exige que la clave permita firmar
+func TestPrepareSigningWindow(t *testing.T) {
+	saved, had := keyConfigs[defaultKeyAlias]
+	keyConfigs[defaultKeyAlias] = keyConfig{Windows: []signingWindow{{From: "00:00", To: "00:00"}}}
+	t.Cleanup(func() {
+		if had {
+			keyConfigs[defaultKeyAlias] = saved
+		} else {
+			delete(keyConfigs, defaultKeyAlias)
+		}
+	})
+
+	code, resp := doJSON(t, validated(validateSignRequest, signPrepareHandler), http.MethodPost, "/sign/prepare", map[string]interface{}{"pedido": "A-2"}, nil)
+	if code != http.StatusForbidden || resp["code"] != string(errSigningWindowClosed) {
+		t.Fatalf("/sign/prepare fuera de franja: %d %v", code, resp)
+	}
+}
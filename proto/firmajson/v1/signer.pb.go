@@ -0,0 +1,425 @@
+// API gRPC de firma-json. La sirve el propio servicio en GRPC_PORT (ver
+// grpc.go). El código Go (signer.pb.go, signer_grpc.pb.go) se genera con
+// protoc-gen-go y protoc-gen-go-grpc: make proto. Los clientes pueden
+// generar el suyo desde aquí o descubrir el servicio por reflexión.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: firmajson/v1/signer.proto
+
+package firmajsonv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SignRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Objeto JSON a firmar: el body de /sign
+	Document []byte `protobuf:"bytes,1,opt,name=document,proto3" json:"document,omitempty"`
+	// Alias de la clave (?key=)
+	Key string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	// Forma canónica: html, minimal, ascii o jcs (?escape=)
+	Escape string `protobuf:"bytes,3,opt,name=escape,proto3" json:"escape,omitempty"`
+	// Inyecta un nonce (?nonce=true)
+	Nonce bool `protobuf:"varint,4,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// Firma el resumen en vez de los bytes: sha256 (?digest=)
+	Digest string `protobuf:"bytes,5,opt,name=digest,proto3" json:"digest,omitempty"`
+	// Contexto ligado a la firma (X-Signature-AAD)
+	Aad           string `protobuf:"bytes,6,opt,name=aad,proto3" json:"aad,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignRequest) Reset() {
+	*x = SignRequest{}
+	mi := &file_firmajson_v1_signer_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignRequest) ProtoMessage() {}
+
+func (x *SignRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_firmajson_v1_signer_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignRequest.ProtoReflect.Descriptor instead.
+func (*SignRequest) Descriptor() ([]byte, []int) {
+	return file_firmajson_v1_signer_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SignRequest) GetDocument() []byte {
+	if x != nil {
+		return x.Document
+	}
+	return nil
+}
+
+func (x *SignRequest) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *SignRequest) GetEscape() string {
+	if x != nil {
+		return x.Escape
+	}
+	return ""
+}
+
+func (x *SignRequest) GetNonce() bool {
+	if x != nil {
+		return x.Nonce
+	}
+	return false
+}
+
+func (x *SignRequest) GetDigest() string {
+	if x != nil {
+		return x.Digest
+	}
+	return ""
+}
+
+func (x *SignRequest) GetAad() string {
+	if x != nil {
+		return x.Aad
+	}
+	return ""
+}
+
+type SignResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// El sobre JSON de /sign?echo=true, tal cual se pasa a Verify
+	Envelope   []byte `protobuf:"bytes,1,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	Signature  string `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
+	Key        string `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+	KeyVersion string `protobuf:"bytes,4,opt,name=key_version,json=keyVersion,proto3" json:"key_version,omitempty"`
+	Alg        string `protobuf:"bytes,5,opt,name=alg,proto3" json:"alg,omitempty"`
+	// Sólo con STORE_ENVELOPES
+	EnvelopeId    string `protobuf:"bytes,6,opt,name=envelope_id,json=envelopeId,proto3" json:"envelope_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignResponse) Reset() {
+	*x = SignResponse{}
+	mi := &file_firmajson_v1_signer_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignResponse) ProtoMessage() {}
+
+func (x *SignResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_firmajson_v1_signer_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignResponse.ProtoReflect.Descriptor instead.
+func (*SignResponse) Descriptor() ([]byte, []int) {
+	return file_firmajson_v1_signer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SignResponse) GetEnvelope() []byte {
+	if x != nil {
+		return x.Envelope
+	}
+	return nil
+}
+
+func (x *SignResponse) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+func (x *SignResponse) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *SignResponse) GetKeyVersion() string {
+	if x != nil {
+		return x.KeyVersion
+	}
+	return ""
+}
+
+func (x *SignResponse) GetAlg() string {
+	if x != nil {
+		return x.Alg
+	}
+	return ""
+}
+
+func (x *SignResponse) GetEnvelopeId() string {
+	if x != nil {
+		return x.EnvelopeId
+	}
+	return ""
+}
+
+type VerifyRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// El sobre JSON: el body de /verify
+	Envelope []byte `protobuf:"bytes,1,opt,name=envelope,proto3" json:"envelope,omitempty"`
+	// Antigüedad máxima de la firma (?max_age=, p.ej. 10m)
+	MaxAge string `protobuf:"bytes,2,opt,name=max_age,json=maxAge,proto3" json:"max_age,omitempty"`
+	// Contexto con el que se firmó (X-Signature-AAD)
+	Aad           string `protobuf:"bytes,3,opt,name=aad,proto3" json:"aad,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyRequest) Reset() {
+	*x = VerifyRequest{}
+	mi := &file_firmajson_v1_signer_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyRequest) ProtoMessage() {}
+
+func (x *VerifyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_firmajson_v1_signer_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyRequest.ProtoReflect.Descriptor instead.
+func (*VerifyRequest) Descriptor() ([]byte, []int) {
+	return file_firmajson_v1_signer_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *VerifyRequest) GetEnvelope() []byte {
+	if x != nil {
+		return x.Envelope
+	}
+	return nil
+}
+
+func (x *VerifyRequest) GetMaxAge() string {
+	if x != nil {
+		return x.MaxAge
+	}
+	return ""
+}
+
+func (x *VerifyRequest) GetAad() string {
+	if x != nil {
+		return x.Aad
+	}
+	return ""
+}
+
+type VerifyResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Valid bool                   `protobuf:"varint,1,opt,name=valid,proto3" json:"valid,omitempty"`
+	// Código de /errors si no es válida
+	Code   string `protobuf:"bytes,2,opt,name=code,proto3" json:"code,omitempty"`
+	Reason string `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	// La respuesta JSON completa de /verify
+	Result        []byte `protobuf:"bytes,4,opt,name=result,proto3" json:"result,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyResponse) Reset() {
+	*x = VerifyResponse{}
+	mi := &file_firmajson_v1_signer_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyResponse) ProtoMessage() {}
+
+func (x *VerifyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_firmajson_v1_signer_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyResponse.ProtoReflect.Descriptor instead.
+func (*VerifyResponse) Descriptor() ([]byte, []int) {
+	return file_firmajson_v1_signer_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *VerifyResponse) GetValid() bool {
+	if x != nil {
+		return x.Valid
+	}
+	return false
+}
+
+func (x *VerifyResponse) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *VerifyResponse) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *VerifyResponse) GetResult() []byte {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+var File_firmajson_v1_signer_proto protoreflect.FileDescriptor
+
+const file_firmajson_v1_signer_proto_rawDesc = "" +
+	"\n" +
+	"\x19firmajson/v1/signer.proto\x12\ffirmajson.v1\"\x93\x01\n" +
+	"\vSignRequest\x12\x1a\n" +
+	"\bdocument\x18\x01 \x01(\fR\bdocument\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x16\n" +
+	"\x06escape\x18\x03 \x01(\tR\x06escape\x12\x14\n" +
+	"\x05nonce\x18\x04 \x01(\bR\x05nonce\x12\x16\n" +
+	"\x06digest\x18\x05 \x01(\tR\x06digest\x12\x10\n" +
+	"\x03aad\x18\x06 \x01(\tR\x03aad\"\xae\x01\n" +
+	"\fSignResponse\x12\x1a\n" +
+	"\benvelope\x18\x01 \x01(\fR\benvelope\x12\x1c\n" +
+	"\tsignature\x18\x02 \x01(\tR\tsignature\x12\x10\n" +
+	"\x03key\x18\x03 \x01(\tR\x03key\x12\x1f\n" +
+	"\vkey_version\x18\x04 \x01(\tR\n" +
+	"keyVersion\x12\x10\n" +
+	"\x03alg\x18\x05 \x01(\tR\x03alg\x12\x1f\n" +
+	"\venvelope_id\x18\x06 \x01(\tR\n" +
+	"envelopeId\"V\n" +
+	"\rVerifyRequest\x12\x1a\n" +
+	"\benvelope\x18\x01 \x01(\fR\benvelope\x12\x17\n" +
+	"\amax_age\x18\x02 \x01(\tR\x06maxAge\x12\x10\n" +
+	"\x03aad\x18\x03 \x01(\tR\x03aad\"j\n" +
+	"\x0eVerifyResponse\x12\x14\n" +
+	"\x05valid\x18\x01 \x01(\bR\x05valid\x12\x12\n" +
+	"\x04code\x18\x02 \x01(\tR\x04code\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\x12\x16\n" +
+	"\x06result\x18\x04 \x01(\fR\x06result2\x8c\x01\n" +
+	"\x06Signer\x12=\n" +
+	"\x04Sign\x12\x19.firmajson.v1.SignRequest\x1a\x1a.firmajson.v1.SignResponse\x12C\n" +
+	"\x06Verify\x12\x1b.firmajson.v1.VerifyRequest\x1a\x1c.firmajson.v1.VerifyResponseB6Z4example.com/firmajson/proto/firmajson/v1;firmajsonv1b\x06proto3"
+
+var (
+	file_firmajson_v1_signer_proto_rawDescOnce sync.Once
+	file_firmajson_v1_signer_proto_rawDescData []byte
+)
+
+func file_firmajson_v1_signer_proto_rawDescGZIP() []byte {
+	file_firmajson_v1_signer_proto_rawDescOnce.Do(func() {
+		file_firmajson_v1_signer_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_firmajson_v1_signer_proto_rawDesc), len(file_firmajson_v1_signer_proto_rawDesc)))
+	})
+	return file_firmajson_v1_signer_proto_rawDescData
+}
+
+var file_firmajson_v1_signer_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_firmajson_v1_signer_proto_goTypes = []any{
+	(*SignRequest)(nil),    // 0: firmajson.v1.SignRequest
+	(*SignResponse)(nil),   // 1: firmajson.v1.SignResponse
+	(*VerifyRequest)(nil),  // 2: firmajson.v1.VerifyRequest
+	(*VerifyResponse)(nil), // 3: firmajson.v1.VerifyResponse
+}
+var file_firmajson_v1_signer_proto_depIdxs = []int32{
+	0, // 0: firmajson.v1.Signer.Sign:input_type -> firmajson.v1.SignRequest
+	2, // 1: firmajson.v1.Signer.Verify:input_type -> firmajson.v1.VerifyRequest
+	1, // 2: firmajson.v1.Signer.Sign:output_type -> firmajson.v1.SignResponse
+	3, // 3: firmajson.v1.Signer.Verify:output_type -> firmajson.v1.VerifyResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_firmajson_v1_signer_proto_init() }
+func file_firmajson_v1_signer_proto_init() {
+	if File_firmajson_v1_signer_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_firmajson_v1_signer_proto_rawDesc), len(file_firmajson_v1_signer_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_firmajson_v1_signer_proto_goTypes,
+		DependencyIndexes: file_firmajson_v1_signer_proto_depIdxs,
+		MessageInfos:      file_firmajson_v1_signer_proto_msgTypes,
+	}.Build()
+	File_firmajson_v1_signer_proto = out.File
+	file_firmajson_v1_signer_proto_goTypes = nil
+	file_firmajson_v1_signer_proto_depIdxs = nil
+}
@@ -0,0 +1,107 @@
+// publickeys.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Claves públicas para verificar sin pasar por el servicio. JWKS publica
+// todas las versiones asimétricas que verifican (la actual, las de
+// ACCEPTED_KEY_VERSIONS y las de los alias de KEYS_FILE) y /keys/{alias} la
+// de un alias concreto. Las claves se piden a KMS la primera vez y quedan
+// cacheadas por versión (ver signerForKeyVersion); como una versión de
+// clave no cambia nunca, no hace falta invalidarlas.
+
+// versionKey devuelve la información de la versión kv y, si es
+// asimétrica, su JWK
+func versionKey(ctx context.Context, kv string) (*firmajson.Key, *jwk, error) {
+	s, err := signerForKeyVersion(kv)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := s.Key(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !k.Asymmetric() {
+		return k, nil, nil
+	}
+	pub, err := publicJWK(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, &pub, nil
+}
+
+// verificationKeyVersions son las versiones que publica JWKS, sin repetir:
+// las aceptadas y las de los alias de KEYS_FILE (menos los honeytokens)
+func verificationKeyVersions() []string {
+	out := acceptedKeyVersions()
+	for _, alias := range configuredAliases() {
+		if kv := keyConfigs[alias].KeyVersion; kv != "" && !isHoneytoken(alias) && !contains(out, kv) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// keyPublicHandler atiende GET /keys/{alias}: la versión de clave del
+// alias, su algoritmo y, si es asimétrica, la clave pública
+func keyPublicHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	alias := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if !knownKeyAlias(alias) || isHoneytoken(alias) {
+		writeError(w, http.StatusNotFound, errUnknownKey, "Clave desconocida")
+		return
+	}
+	kv := aliasKeyVersion(alias)
+	k, pub, err := versionKey(r.Context(), kv)
+	if err != nil {
+		writeKMSError(w, err, errKMSError, fmt.Sprintf("Error consultando la clave: %v", err))
+		return
+	}
+	resp := map[string]interface{}{
+		"key":           alias,
+		"key_version":   kv,
+		"kms_algorithm": k.KMSAlgorithm,
+		"public_key":    pub != nil,
+	}
+	if alg := jwsAlgForKey(k); alg != "" {
+		resp["alg"] = alg
+	}
+	if pub != nil {
+		resp["jwk"] = pub
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// jwksKeys son las JWK de las versiones asimétricas que verifican. Si falla
+// la actual es un error; si falla otra se omite para no dejar a nadie sin
+// la actual.
+func jwksKeys(ctx context.Context) ([]jwk, error) {
+	keys := []jwk{}
+	for _, kv := range verificationKeyVersions() {
+		_, pub, err := versionKey(ctx, kv)
+		if err != nil {
+			if kv == nameVersion {
+				return nil, err
+			}
+			log.Printf("⚠️  JWKS sin la versión %s: %v", kv, err)
+			continue
+		}
+		if pub != nil {
+			keys = append(keys, *pub)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,143 @@
+// publicverify.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// /public/verify deja a los destinatarios externos de nuestros documentos
+// comprobarlos sin credenciales. Sólo verifica sobres de nuestras propias
+// claves (nada de emisores externos, que obligarían a descargar claves de
+// URLs del cliente), no guarda nada y tiene límites agresivos y propios.
+// Aplica las mismas políticas que /verify (certificado, ?maxAge= y
+// reenvíos), y la IP de los límites es la de clientIP, que no se puede
+// falsear con X-Forwarded-For (ver TRUSTED_PROXY_HOPS):
+//
+//	PUBLIC_VERIFY_ENABLED      activa el endpoint (false por defecto)
+//	PUBLIC_VERIFY_PER_MINUTE   peticiones por minuto y IP (10)
+//	PUBLIC_VERIFY_GLOBAL_PER_MINUTE  peticiones por minuto en total (600)
+//	PUBLIC_VERIFY_MAX_BYTES    tamaño máximo del sobre (16 KiB)
+
+// publicWindow cuenta las peticiones de una ventana de un minuto
+type publicWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	publicLimitMu  sync.Mutex
+	publicByIP     = map[string]*publicWindow{}
+	publicGlobal   publicWindow
+	publicLastGC   time.Time
+	errPublicLimit = errors.New("límite de verificaciones públicas alcanzado")
+)
+
+// allowPublicVerify aplica los límites por IP y global. Si se superan,
+// devuelve cuánto falta para que se abra la siguiente ventana.
+func allowPublicVerify(ip string, now time.Time) (time.Duration, error) {
+	publicLimitMu.Lock()
+	defer publicLimitMu.Unlock()
+
+	// Limpiar las ventanas viejas de vez en cuando para no acumular IPs
+	if now.Sub(publicLastGC) > time.Minute {
+		for k, win := range publicByIP {
+			if now.Sub(win.start) >= time.Minute {
+				delete(publicByIP, k)
+			}
+		}
+		publicLastGC = now
+	}
+
+	if now.Sub(publicGlobal.start) >= time.Minute {
+		publicGlobal = publicWindow{start: now}
+	}
+	if publicGlobal.count >= envInt("PUBLIC_VERIFY_GLOBAL_PER_MINUTE", 600) {
+		return publicGlobal.start.Add(time.Minute).Sub(now), errPublicLimit
+	}
+	win := publicByIP[ip]
+	if win == nil || now.Sub(win.start) >= time.Minute {
+		win = &publicWindow{start: now}
+		publicByIP[ip] = win
+	}
+	if win.count >= envInt("PUBLIC_VERIFY_PER_MINUTE", 10) {
+		return win.start.Add(time.Minute).Sub(now), errPublicLimit
+	}
+	win.count++
+	publicGlobal.count++
+	return 0, nil
+}
+
+// publicVerifyHandler verifica un sobre sin autenticación. La respuesta
+// sólo dice si es válido y, si no lo es, por qué.
+func publicVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if getEnv("PUBLIC_VERIFY_ENABLED", "false") != "true" {
+		writeError(w, http.StatusNotFound, errNotConfigured, "La verificación pública no está activada")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if wait, err := allowPublicVerify(clientIP(r), time.Now()); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, errRateLimited, err.Error())
+		return
+	}
+
+	maxBytes := envInt("PUBLIC_VERIFY_MAX_BYTES", 16<<10)
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return
+	}
+	if len(body) > maxBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, errPayloadTooLarge, "El sobre supera el máximo de la verificación pública")
+		return
+	}
+	if problems := append(validateAAD(r), validateEnvelopeRequest(r, body)...); len(problems) > 0 {
+		writeValidationProblems(w, problems)
+		return
+	}
+	var req verifyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	req.aad = requestAAD(r)
+	if req.Iss != "" && req.Iss != issuerID() || req.Kid != "" || req.JWS != "" || req.Protected != "" {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "La verificación pública sólo admite sobres de este emisor")
+		return
+	}
+
+	ctx := r.Context()
+	res, err := verifyEnvelope(ctx, &req)
+	if err != nil {
+		var f *verifyFailure
+		errors.As(err, &f)
+		writeError(w, f.status, f.code, f.msg)
+		return
+	}
+	applyVerifyPolicies(r, &res)
+	audit := newAuditEntry(r, "public_verify", res.Key, res.Data)
+	audit.Outcome = outcomeOf(res.Valid)
+	recordAudit(ctx, audit)
+
+	resp := map[string]interface{}{"valid": res.Valid}
+	if !res.Valid {
+		resp["code"] = res.invalidCode()
+	}
+	if res.Reason != "" {
+		resp["reason"] = res.Reason
+	}
+	if c, flagged := requiresSecondaryValidation(ctx, res.Key, payloadTimestamp(res.Obj)); res.Valid && flagged {
+		resp["requires_secondary_validation"] = true
+		resp["compromise_reason"] = c.Reason
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,632 @@
+// pubsub.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// Publicación de los sobres firmados en Pub/Sub. Con PUBSUB_TOPIC cada
+// sobre que sale de /sign, /sign/batch, /sign/patch o de una firma diferida
+// se publica en el tema, con el payload y los atributos key, key_version y
+// envelope_id. Si el consumidor o Pub/Sub van lentos, lo pendiente no
+// crece sin límite: hay control de flujo por mensajes y por bytes, y al
+// llegar al límite la firma espera (block) o el sobre va directo a la cola
+// de fallidos (drop).
+//
+//	PUBSUB_TOPIC                     projects/p/topics/t, o t con GOOGLE_CLOUD_PROJECT
+//	PUBSUB_MAX_OUTSTANDING_MESSAGES  mensajes pendientes como mucho (1000)
+//	PUBSUB_MAX_OUTSTANDING_BYTES     bytes pendientes como mucho (64 MiB)
+//	PUBSUB_LIMIT_BEHAVIOR            block (por defecto) o drop
+//	PUBSUB_BLOCK_TIMEOUT             espera máxima con block (5s)
+//	PUBSUB_BATCH_SIZE                mensajes por publicación (100, máx. 1000)
+//	PUBSUB_BATCH_BYTES               bytes por publicación (1 MiB, máx. 9 MiB)
+//	PUBSUB_BATCH_DELAY               espera para completar un lote (50ms)
+//	PUBSUB_WORKERS                   publicaciones en paralelo (4)
+//	PUBSUB_MAX_ATTEMPTS              intentos por lote (5)
+//	PUBSUB_ORDERING_KEY              key (alias de la clave) o un puntero JSON
+//	                                 al payload (/cliente/id); vacío = sin orden
+//	PUBSUB_DEAD_LETTER_TOPIC         tema para los fallidos; sin él van al store
+//	PUBSUB_ENDPOINT                  endpoint regional (necesario para el orden)
+//	PUBSUB_EMULATOR_HOST             emulador local, sin credenciales
+//
+// Los mensajes con la misma clave de orden van siempre al mismo worker y
+// se publican en orden. Si uno no se puede publicar, la clave se pausa y
+// los siguientes con esa clave van también a fallidos, para que el
+// consumidor nunca los vea desordenados. Los fallidos se guardan en el
+// store (o en PUBSUB_DEAD_LETTER_TOPIC si está) y se reenvían, en el orden
+// en que fallaron, con POST /admin/pubsub/dead-letters/replay, que reanuda
+// las claves pausadas. El tema de fallidos y el de salida deberían estar en
+// proyectos o regiones distintos: si Pub/Sub entero está caído, lo que no
+// se puede publicar acaba en el store.
+
+const pubsubDeadLetterCollection = "pubsub_dead_letters"
+
+// pubsubMessage es un sobre listo para publicar
+type pubsubMessage struct {
+	data        []byte
+	attributes  map[string]string
+	orderingKey string
+}
+
+func (m *pubsubMessage) size() int {
+	n := len(m.data) + len(m.orderingKey)
+	for k, v := range m.attributes {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// pubsubDeadLetter es un mensaje que no se pudo publicar
+type pubsubDeadLetter struct {
+	ID          string            `json:"id"`
+	Topic       string            `json:"topic"`
+	Data        json.RawMessage   `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Error       string            `json:"error"`
+	Attempts    int               `json:"attempts"`
+	FailedAt    time.Time         `json:"failed_at"`
+}
+
+// flowController limita los mensajes y bytes pendientes de publicar
+type flowController struct {
+	maxMessages int
+	maxBytes    int
+
+	mu       sync.Mutex
+	messages int
+	bytes    int
+	released chan struct{}
+}
+
+var errFlowControl = errors.New("límite de mensajes pendientes alcanzado")
+
+// acquire reserva sitio para un mensaje de size bytes. Con block espera a
+// que se libere hasta que ctx caduque. Un mensaje mayor que maxBytes pasa
+// cuando no hay nada más pendiente.
+func (f *flowController) acquire(ctx context.Context, size int, block bool) error {
+	for {
+		f.mu.Lock()
+		if f.messages < f.maxMessages && (f.bytes+size <= f.maxBytes || f.messages == 0) {
+			f.messages++
+			f.bytes += size
+			f.mu.Unlock()
+			return nil
+		}
+		wait := f.released
+		f.mu.Unlock()
+		if !block {
+			return errFlowControl
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return fmt.Errorf("%w tras esperar", errFlowControl)
+		}
+	}
+}
+
+func (f *flowController) release(size int) {
+	f.mu.Lock()
+	f.messages--
+	f.bytes -= size
+	close(f.released)
+	f.released = make(chan struct{})
+	f.mu.Unlock()
+}
+
+func (f *flowController) outstanding() (messages, bytes int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.messages, f.bytes
+}
+
+// envelopePublisher publica los sobres en PUBSUB_TOPIC
+type envelopePublisher struct {
+	topics          *pubsub.ProjectsTopicsService
+	topic           string
+	deadLetterTopic string
+	orderingKey     string
+	block           bool
+	blockTimeout    time.Duration
+	batchSize       int
+	batchBytes      int
+	batchDelay      time.Duration
+	maxAttempts     int
+
+	flow   *flowController
+	shards []chan *pubsubMessage
+	next   atomic.Uint64
+
+	pausedMu sync.Mutex
+	paused   map[string]bool
+
+	published   atomic.Int64
+	deadLetters atomic.Int64
+}
+
+// activePublisher es el publicador configurado; nil sin PUBSUB_TOPIC
+var activePublisher *envelopePublisher
+
+// startPubSubPublisher arranca el publicador si PUBSUB_TOPIC está definido
+func startPubSubPublisher() error {
+	topic := getEnv("PUBSUB_TOPIC", "")
+	if topic == "" {
+		return nil
+	}
+	topic, err := pubsubTopicName(topic)
+	if err != nil {
+		return err
+	}
+	deadLetterTopic := getEnv("PUBSUB_DEAD_LETTER_TOPIC", "")
+	if deadLetterTopic != "" {
+		if deadLetterTopic, err = pubsubTopicName(deadLetterTopic); err != nil {
+			return err
+		}
+	}
+	p := &envelopePublisher{
+		topic:           topic,
+		deadLetterTopic: deadLetterTopic,
+		orderingKey:     getEnv("PUBSUB_ORDERING_KEY", ""),
+		blockTimeout:    envDuration("PUBSUB_BLOCK_TIMEOUT", 5*time.Second),
+		batchSize:       envInt("PUBSUB_BATCH_SIZE", 100),
+		batchBytes:      envInt("PUBSUB_BATCH_BYTES", 1<<20),
+		batchDelay:      envDuration("PUBSUB_BATCH_DELAY", 50*time.Millisecond),
+		maxAttempts:     envInt("PUBSUB_MAX_ATTEMPTS", 5),
+		flow: &flowController{
+			maxMessages: envInt("PUBSUB_MAX_OUTSTANDING_MESSAGES", 1000),
+			maxBytes:    envInt("PUBSUB_MAX_OUTSTANDING_BYTES", 64<<20),
+			released:    make(chan struct{}),
+		},
+		paused: map[string]bool{},
+	}
+	switch behavior := getEnv("PUBSUB_LIMIT_BEHAVIOR", "block"); behavior {
+	case "block":
+		p.block = true
+	case "drop":
+	default:
+		return fmt.Errorf("PUBSUB_LIMIT_BEHAVIOR desconocido: %q (block, drop)", behavior)
+	}
+	if k := p.orderingKey; k != "" && k != "key" {
+		if _, err := parsePointer(k); err != nil {
+			return fmt.Errorf("PUBSUB_ORDERING_KEY debe ser key o un puntero JSON: %q", k)
+		}
+	}
+	switch {
+	case p.batchSize < 1 || p.batchSize > 1000:
+		return fmt.Errorf("PUBSUB_BATCH_SIZE fuera de rango (1-1000)")
+	case p.batchBytes < 1 || p.batchBytes > 9<<20:
+		return fmt.Errorf("PUBSUB_BATCH_BYTES fuera de rango (hasta 9 MiB)")
+	case p.flow.maxMessages < 1 || p.flow.maxBytes < 1:
+		return fmt.Errorf("PUBSUB_MAX_OUTSTANDING_* debe ser positivo")
+	case p.maxAttempts < 1:
+		return fmt.Errorf("PUBSUB_MAX_ATTEMPTS debe ser positivo")
+	}
+
+	var opts []option.ClientOption
+	if host := getEnv("PUBSUB_EMULATOR_HOST", ""); host != "" {
+		opts = append(opts, option.WithEndpoint("http://"+host+"/"), option.WithoutAuthentication())
+	} else if endpoint := getEnv("PUBSUB_ENDPOINT", ""); endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	svc, err := pubsub.NewService(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	p.topics = svc.Projects.Topics
+
+	workers := envInt("PUBSUB_WORKERS", 4)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		// Con el control de flujo delante, el canal nunca tiene más de
+		// maxMessages y el envío no bloquea
+		shard := make(chan *pubsubMessage, p.flow.maxMessages)
+		p.shards = append(p.shards, shard)
+		lifecycle.Go(fmt.Sprintf("pubsub-%d", i), func(ctx context.Context) { p.run(ctx, shard) })
+	}
+	activePublisher = p
+	log.Printf("Publicando sobres en %s (%d workers, %s al llenarse)", topic, workers, getEnv("PUBSUB_LIMIT_BEHAVIOR", "block"))
+	return nil
+}
+
+// pubsubTopicName completa el nombre de un tema con GOOGLE_CLOUD_PROJECT
+func pubsubTopicName(topic string) (string, error) {
+	if strings.HasPrefix(topic, "projects/") {
+		return topic, nil
+	}
+	project := getEnv("GOOGLE_CLOUD_PROJECT", "")
+	if project == "" {
+		return "", fmt.Errorf("el tema %q necesita GOOGLE_CLOUD_PROJECT o el nombre completo", topic)
+	}
+	return fmt.Sprintf("projects/%s/topics/%s", project, topic), nil
+}
+
+// publishEnvelope encola un sobre recién firmado. Con block espera sitio
+// hasta PUBSUB_BLOCK_TIMEOUT; si no lo hay, el sobre va a fallidos.
+func publishEnvelope(alias string, envelope, payload map[string]interface{}) {
+	p := activePublisher
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Printf("⚠️  Pub/Sub: sobre no serializable: %v", err)
+		return
+	}
+	m := &pubsubMessage{data: data, attributes: map[string]string{"key": alias}}
+	if kv, _ := envelope["key_version"].(string); kv != "" {
+		m.attributes["key_version"] = kv
+	}
+	if id, _ := envelope["envelope_id"].(string); id != "" {
+		m.attributes["envelope_id"] = id
+	}
+	m.orderingKey = p.orderingKeyOf(alias, payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.blockTimeout)
+	defer cancel()
+	if err := p.flow.acquire(ctx, m.size(), p.block); err != nil {
+		log.Printf("⚠️  Pub/Sub: sobre a fallidos: %v", err)
+		p.pause(m.orderingKey)
+		p.storeDeadLetters(context.Background(), []*pubsubMessage{m}, err, 0)
+		return
+	}
+	p.shardOf(m.orderingKey) <- m
+}
+
+// orderingKeyOf calcula la clave de orden de un sobre
+func (p *envelopePublisher) orderingKeyOf(alias string, payload map[string]interface{}) string {
+	switch p.orderingKey {
+	case "":
+		return ""
+	case "key":
+		return alias
+	}
+	v, err := pointerGet(payload, p.orderingKey)
+	if err != nil || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// shardOf elige el worker: el mismo para una misma clave de orden y por
+// turnos para el resto
+func (p *envelopePublisher) shardOf(key string) chan *pubsubMessage {
+	if key == "" {
+		return p.shards[p.next.Add(1)%uint64(len(p.shards))]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// run agrupa los mensajes de un worker en lotes de PUBSUB_BATCH_SIZE o
+// PUBSUB_BATCH_BYTES, o lo que llegue en PUBSUB_BATCH_DELAY, y los publica
+// de uno en uno para respetar el orden. Al parar publica lo que quede.
+func (p *envelopePublisher) run(ctx context.Context, in chan *pubsubMessage) {
+	var batch []*pubsubMessage
+	size := 0
+	timer := time.NewTimer(p.batchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			p.publish(ctx, batch)
+		}
+		batch, size = nil, 0
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			for len(in) > 0 {
+				batch = append(batch, <-in)
+			}
+			stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			for len(batch) > 0 {
+				n := min(len(batch), p.batchSize)
+				p.publish(stopCtx, batch[:n])
+				batch = batch[n:]
+			}
+			cancel()
+			return
+		case m := <-in:
+			if len(batch) > 0 && size+m.size() > p.batchBytes {
+				timer.Stop()
+				flush(ctx)
+			}
+			batch = append(batch, m)
+			size += m.size()
+			if len(batch) == 1 {
+				timer.Reset(p.batchDelay)
+			}
+			if len(batch) >= p.batchSize || size >= p.batchBytes {
+				timer.Stop()
+				flush(ctx)
+			}
+		case <-timer.C:
+			flush(ctx)
+		}
+	}
+}
+
+// publish publica un lote con reintentos y manda a fallidos lo que no se
+// pudo publicar, o lo que tenía la clave de orden en pausa. Libera su
+// sitio en el control de flujo en cualquier caso.
+func (p *envelopePublisher) publish(ctx context.Context, batch []*pubsubMessage) {
+	defer func() {
+		for _, m := range batch {
+			p.flow.release(m.size())
+		}
+	}()
+	var ready, held []*pubsubMessage
+	for _, m := range batch {
+		if p.isPaused(m.orderingKey) {
+			held = append(held, m)
+		} else {
+			ready = append(ready, m)
+		}
+	}
+	if len(held) > 0 {
+		p.deadLetter(ctx, held, errors.New("clave de orden en pausa por un fallo anterior"), 0)
+	}
+	if len(ready) == 0 {
+		return
+	}
+	attempts, err := p.publishWithRetry(ctx, p.topic, ready)
+	if err != nil {
+		for _, m := range ready {
+			p.pause(m.orderingKey)
+		}
+		log.Printf("⚠️  Pub/Sub: %d sobres sin publicar tras %d intentos: %v", len(ready), attempts, err)
+		p.deadLetter(ctx, ready, err, attempts)
+		return
+	}
+	p.published.Add(int64(len(ready)))
+}
+
+// publishWithRetry publica con espera exponencial mientras el error sea
+// pasajero. Devuelve los intentos hechos.
+func (p *envelopePublisher) publishWithRetry(ctx context.Context, topic string, batch []*pubsubMessage) (int, error) {
+	req := &pubsub.PublishRequest{}
+	for _, m := range batch {
+		msg := &pubsub.PubsubMessage{
+			Data:       base64.StdEncoding.EncodeToString(m.data),
+			Attributes: m.attributes,
+		}
+		if topic == p.topic {
+			msg.OrderingKey = m.orderingKey
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 1; ; attempt++ {
+		if _, err = p.topics.Publish(topic, req).Context(ctx).Do(); err == nil {
+			return attempt, nil
+		}
+		if attempt >= p.maxAttempts || !pubsubRetryable(err) || !sleepCtx(ctx, backoff) {
+			return attempt, err
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// pubsubRetryable indica si un error de Publish es pasajero
+func pubsubRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return true
+	}
+	switch gerr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// deadLetter manda los mensajes a PUBSUB_DEAD_LETTER_TOPIC o, si no hay o
+// tampoco responde, al store
+func (p *envelopePublisher) deadLetter(ctx context.Context, batch []*pubsubMessage, cause error, attempts int) {
+	if p.deadLetterTopic != "" {
+		for _, m := range batch {
+			m.attributes["dead_letter_reason"] = cause.Error()
+		}
+		_, err := p.publishWithRetry(ctx, p.deadLetterTopic, batch)
+		if err == nil {
+			p.deadLetters.Add(int64(len(batch)))
+			return
+		}
+		log.Printf("⚠️  Pub/Sub: tema de fallidos no disponible: %v", err)
+	}
+	p.storeDeadLetters(ctx, batch, cause, attempts)
+}
+
+// storeDeadLetters guarda los mensajes en el store para reenviarlos
+func (p *envelopePublisher) storeDeadLetters(ctx context.Context, batch []*pubsubMessage, cause error, attempts int) {
+	p.deadLetters.Add(int64(len(batch)))
+	for _, m := range batch {
+		now := time.Now().UTC()
+		id, err := timeOrderedID(now)
+		if err == nil {
+			raw, _ := json.Marshal(pubsubDeadLetter{
+				ID:          id,
+				Topic:       p.topic,
+				Data:        m.data,
+				Attributes:  m.attributes,
+				OrderingKey: m.orderingKey,
+				Error:       cause.Error(),
+				Attempts:    attempts,
+				FailedAt:    now,
+			})
+			err = db.Put(context.WithoutCancel(ctx), pubsubDeadLetterCollection, id, raw)
+		}
+		if err != nil {
+			log.Printf("❌ Pub/Sub: sobre perdido, no se pudo guardar como fallido: %v", err)
+		}
+	}
+}
+
+func (p *envelopePublisher) pause(key string) {
+	if key == "" {
+		return
+	}
+	p.pausedMu.Lock()
+	p.paused[key] = true
+	p.pausedMu.Unlock()
+}
+
+func (p *envelopePublisher) isPaused(key string) bool {
+	if key == "" {
+		return false
+	}
+	p.pausedMu.Lock()
+	defer p.pausedMu.Unlock()
+	return p.paused[key]
+}
+
+// pubsubStatus es el estado que devuelve GET /admin/pubsub
+type pubsubStatus struct {
+	Topic               string   `json:"topic"`
+	DeadLetterTopic     string   `json:"dead_letter_topic,omitempty"`
+	OutstandingMessages int      `json:"outstanding_messages"`
+	OutstandingBytes    int      `json:"outstanding_bytes"`
+	Published           int64    `json:"published"`
+	DeadLetters         int64    `json:"dead_letters"`
+	PausedOrderingKeys  []string `json:"paused_ordering_keys,omitempty"`
+}
+
+func (p *envelopePublisher) status() pubsubStatus {
+	s := pubsubStatus{
+		Topic:           p.topic,
+		DeadLetterTopic: p.deadLetterTopic,
+		Published:       p.published.Load(),
+		DeadLetters:     p.deadLetters.Load(),
+	}
+	s.OutstandingMessages, s.OutstandingBytes = p.flow.outstanding()
+	p.pausedMu.Lock()
+	for k := range p.paused {
+		s.PausedOrderingKeys = append(s.PausedOrderingKeys, k)
+	}
+	p.pausedMu.Unlock()
+	return s
+}
+
+// replayDeadLetters reanuda las claves pausadas y vuelve a encolar los
+// fallidos guardados, en el orden en que fallaron. Se para si el control
+// de flujo no deja sitio; lo que no se encoló sigue guardado.
+func (p *envelopePublisher) replayDeadLetters(ctx context.Context) (int, int, error) {
+	records, ids, err := db.List(ctx, pubsubDeadLetterCollection)
+	if err != nil {
+		return 0, 0, err
+	}
+	p.pausedMu.Lock()
+	p.paused = map[string]bool{}
+	p.pausedMu.Unlock()
+	replayed := 0
+	for i, id := range ids {
+		var d pubsubDeadLetter
+		if err := json.Unmarshal(records[id], &d); err != nil {
+			continue
+		}
+		delete(d.Attributes, "dead_letter_reason")
+		m := &pubsubMessage{data: d.Data, attributes: d.Attributes, orderingKey: d.OrderingKey}
+		if m.attributes == nil {
+			m.attributes = map[string]string{}
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, p.blockTimeout)
+		err := p.flow.acquire(waitCtx, m.size(), true)
+		cancel()
+		if err != nil {
+			return replayed, len(ids) - i, err
+		}
+		if err := db.Delete(ctx, pubsubDeadLetterCollection, id); err != nil {
+			p.flow.release(m.size())
+			return replayed, len(ids) - i, err
+		}
+		p.shardOf(m.orderingKey) <- m
+		replayed++
+	}
+	return replayed, 0, nil
+}
+
+// pubsubHandler atiende /admin/pubsub (estado), /admin/pubsub/dead-letters
+// (GET lista los fallidos guardados), /admin/pubsub/dead-letters/replay
+// (POST los reenvía) y /admin/pubsub/dead-letters/{id} (DELETE descarta uno)
+func pubsubHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	p := activePublisher
+	if p == nil {
+		writeError(w, http.StatusNotFound, errNotConfigured, "No hay publicación en Pub/Sub (PUBSUB_TOPIC)")
+		return
+	}
+	ctx := r.Context()
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/pubsub")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, p.status())
+	case rest == "/dead-letters" && r.Method == http.MethodGet:
+		records, ids, err := db.List(ctx, pubsubDeadLetterCollection)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		letters := make([]pubsubDeadLetter, 0, len(ids))
+		for _, id := range ids {
+			var d pubsubDeadLetter
+			if err := json.Unmarshal(records[id], &d); err == nil {
+				letters = append(letters, d)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"dead_letters": letters})
+	case rest == "/dead-letters/replay" && r.Method == http.MethodPost:
+		replayed, remaining, err := p.replayDeadLetters(ctx)
+		recordAdminAudit(r, "pubsub.replay", fmt.Sprintf("%d reenviados, %d pendientes", replayed, remaining))
+		resp := map[string]interface{}{"replayed": replayed, "remaining": remaining}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	case strings.HasPrefix(rest, "/dead-letters/") && rest != "/dead-letters/replay" && r.Method == http.MethodDelete:
+		id := strings.TrimPrefix(rest, "/dead-letters/")
+		if _, err := db.Get(ctx, pubsubDeadLetterCollection, id); errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Fallido desconocido")
+			return
+		}
+		if err := db.Delete(ctx, pubsubDeadLetterCollection, id); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "pubsub.discard", id)
+		w.WriteHeader(http.StatusNoContent)
+	case rest == "" || strings.HasPrefix(rest, "/dead-letters"):
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	default:
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+	}
+}
@@ -0,0 +1,72 @@
+// purpose.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Propósito de la firma. Lo que firma el propio servicio en su nombre
+// (informes de verificación, atestaciones de salud e instantáneas de
+// configuración) no puede confundirse con lo que firma para un cliente:
+// si no, cualquiera con acceso a /sign podría pedir la firma de un
+// {"type": "verification_report", ...} inventado y presentarlo como un
+// informe auténtico.
+//
+// Por eso esos documentos se firman como firma-json/purpose\x00, la
+// longitud del tipo (uint64 big-endian), el tipo y los bytes canónicos, y
+// /verify aplica el mismo prefijo a cualquier documento cuyo "type" sea
+// uno de servicePurposes, venga de donde venga. Una firma de /sign sobre
+// un documento con ese type no verifica nunca, y /sign rechaza esos
+// documentos para que nadie obtenga firmas que no van a verificar.
+
+// purposeDomain separa lo firmado por el servicio en su nombre
+const purposeDomain = "firma-json/purpose\x00"
+
+// Tipos de los documentos que firma el servicio en su nombre
+const (
+	purposeVerificationReport = "verification_report"
+	purposeHealthAttestation  = "health_attestation"
+	purposeConfigSnapshot     = "config_snapshot"
+)
+
+// servicePurposes son los valores de "type" reservados al servicio
+var servicePurposes = map[string]bool{
+	purposeVerificationReport: true,
+	purposeHealthAttestation:  true,
+	purposeConfigSnapshot:     true,
+}
+
+// documentPurpose devuelve el propósito de un documento ya decodificado: su
+// "type" si está reservado al servicio, o "" si no
+func documentPurpose(obj interface{}) string {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if t, _ := m["type"].(string); servicePurposes[t] {
+		return t
+	}
+	return ""
+}
+
+// withPurpose devuelve lo que se firma para data con el propósito purpose
+func withPurpose(data []byte, purpose string) []byte {
+	if purpose == "" {
+		return data
+	}
+	out := make([]byte, 0, len(purposeDomain)+8+len(purpose)+len(data))
+	out = append(out, purposeDomain...)
+	out = binary.BigEndian.AppendUint64(out, uint64(len(purpose)))
+	out = append(out, purpose...)
+	return append(out, data...)
+}
+
+// reservedPurposeProblem es el problema de un documento a firmar cuyo type
+// está reservado al servicio
+func reservedPurposeProblem(payload map[string]interface{}) []validationProblem {
+	if p := documentPurpose(payload); p != "" {
+		return []validationProblem{{"type", errReservedField, fmt.Sprintf("El tipo %q está reservado a los documentos que firma el servicio", p)}}
+	}
+	return nil
+}
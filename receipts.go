@@ -0,0 +1,226 @@
+// receipts.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Con ?notify={owner} en /sign, al firmar se envía un recibo al dueño del
+// documento por webhook o email. El recibo lleva los metadatos del sobre,
+// nunca el payload, y va firmado igual que un sobre para que el dueño pueda
+// comprobarlo con /verify.
+
+// ownerCollection guarda los destinos de notificación de cada dueño
+const ownerCollection = "owners"
+
+type documentOwner struct {
+	Webhook string `json:"webhook,omitempty"`
+	Email   string `json:"email,omitempty"`
+}
+
+var receiptHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// lookupOwner devuelve los destinos registrados del dueño
+func lookupOwner(ctx context.Context, owner string) (documentOwner, error) {
+	var o documentOwner
+	raw, err := db.Get(ctx, ownerCollection, owner)
+	if err != nil {
+		return o, err
+	}
+	err = json.Unmarshal(raw, &o)
+	return o, err
+}
+
+// requestNotifyOwner devuelve el dueño de ?notify= y comprueba que tiene
+// destinos registrados
+func requestNotifyOwner(r *http.Request) (string, error) {
+	owner := r.URL.Query().Get("notify")
+	if owner == "" {
+		return "", nil
+	}
+	if _, err := lookupOwner(r.Context(), owner); err != nil {
+		return "", fmt.Errorf("notify: el dueño %q no tiene destinos registrados", owner)
+	}
+	return owner, nil
+}
+
+// sendReceipt prepara y entrega en segundo plano el recibo de una firma
+func sendReceipt(m requestMeta, owner, alias string, data []byte, signature, envelopeID string) {
+	sum := sha256.Sum256(data)
+	receipt := map[string]interface{}{
+		"type":           "signing_receipt",
+		"owner":          owner,
+		"payload_sha256": hex.EncodeToString(sum[:]),
+		"key":            alias,
+		"key_version":    aliasKeyVersion(alias),
+		"caller":         m.Caller,
+		"timestamp":      recordTime().Format(time.RFC3339Nano),
+	}
+	if signature != "" {
+		receipt["signature"] = signature
+	}
+	if m.Tenant != "" {
+		receipt["tenant"] = m.Tenant
+	}
+	if m.DocType != "" {
+		receipt["doc_type"] = m.DocType
+	}
+	if envelopeID != "" {
+		receipt["envelope_id"] = envelopeID
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := deliverReceipt(ctx, owner, receipt); err != nil {
+			log.Printf("⚠️  Recibo para %s no entregado: %v", owner, err)
+		}
+	}()
+}
+
+func deliverReceipt(ctx context.Context, owner string, receipt map[string]interface{}) error {
+	o, err := lookupOwner(ctx, owner)
+	if err != nil {
+		return err
+	}
+	canonical, err := canonicalJSON(receipt)
+	if err != nil {
+		return err
+	}
+	signature, err := kmsSign(ctx, canonical)
+	if err != nil {
+		return err
+	}
+	envelope, _ := json.Marshal(map[string]interface{}{"payload": receipt, "signature": signature})
+
+	var errs []error
+	if o.Webhook != "" {
+		errs = append(errs, postReceipt(ctx, o.Webhook, envelope))
+	}
+	if o.Email != "" {
+		errs = append(errs, mailReceipt(o.Email, receipt, envelope))
+	}
+	return errors.Join(errs...)
+}
+
+// postReceipt entrega el recibo al webhook, con tres intentos
+func postReceipt(ctx context.Context, url string, envelope []byte) error {
+	return postWebhook(ctx, receiptHTTPClient, url, envelope)
+}
+
+// postWebhook hace POST de envelope a url con client, con tres intentos
+func postWebhook(ctx context.Context, client *http.Client, url string, envelope []byte) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(envelope))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook HTTP %d", resp.StatusCode)
+	}
+	return err
+}
+
+// mailReceipt envía el recibo por SMTP (SMTP_ADDR, SMTP_FROM y, si hace
+// falta, SMTP_USER / SMTP_PASSWORD)
+func mailReceipt(to string, receipt map[string]interface{}, envelope []byte) error {
+	addr := getEnv("SMTP_ADDR", "")
+	if addr == "" {
+		return errors.New("SMTP_ADDR no está definido")
+	}
+	from := getEnv("SMTP_FROM", "firma-json@localhost")
+	var auth smtp.Auth
+	if user := getEnv("SMTP_USER", ""); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\n", from, to)
+	fmt.Fprintf(&msg, "Subject: Recibo de firma %s\r\n", receipt["payload_sha256"])
+	msg.WriteString("Content-Type: application/json; charset=utf-8\r\n\r\n")
+	msg.Write(envelope)
+	msg.WriteString("\r\n")
+	return smtp.SendMail(addr, auth, from, []string{to}, msg.Bytes())
+}
+
+// ownerHandler registra (PUT {webhook, email}) o borra (DELETE) los destinos
+// de notificación de un dueño: /admin/owners/{owner}
+func ownerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	owner := strings.TrimPrefix(r.URL.Path, "/admin/owners/")
+	if owner == "" {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Falta el dueño")
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		o, err := lookupOwner(ctx, owner)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Dueño desconocido")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, o)
+	case http.MethodPut:
+		var o documentOwner
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil || (o.Webhook == "" && o.Email == "") {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "Se espera {webhook, email} con al menos uno")
+			return
+		}
+		if o.Webhook != "" && !strings.HasPrefix(o.Webhook, "https://") {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "El webhook debe ser https://")
+			return
+		}
+		raw, _ := json.Marshal(o)
+		if err := db.Put(ctx, ownerCollection, owner, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "owner_registered", owner)
+		writeJSON(w, http.StatusOK, o)
+	case http.MethodDelete:
+		err := db.Delete(ctx, ownerCollection, owner)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Dueño desconocido")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "owner_removed", owner)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET, PUT o DELETE permitido")
+	}
+}
@@ -0,0 +1,150 @@
+// redaction.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// Perfiles de redacción. Igual que la firma está limitada por clave, lo que
+// se devuelve del payload al leer un sobre (/verify con ?claims=true,
+// /introspect y /decrypt) se limita por scope. REDACTION_FILE asigna los
+// scopes a cada llamante (el nombre de su X-API-Key en API_KEYS) y describe
+// cada doc_type con un JSON Schema en el que los campos sensibles llevan
+// "x-scope":
+//
+//	{"scopes": {"backoffice": ["pii"], "auditoria": ["pii", "salarios"]},
+//	 "doc_types": {"nomina": {"properties": {
+//	     "iban": {"x-scope": "pii"},
+//	     "empleado": {"properties": {"dni": {"x-scope": "pii"}}},
+//	     "lineas": {"items": {"properties": {"importe": {"x-scope": "salarios"}}}}}}}}
+//
+// Del schema sólo se usan properties, items y x-scope, así que vale el que
+// ya se tenga para el doc_type con las anotaciones añadidas. Un campo cuyo
+// scope no tiene el llamante se quita de la respuesta y su JSON Pointer se
+// lista en "redacted"; la firma se verifica siempre sobre el documento
+// entero. El doc_type es el de la petición (?doc_type= o X-Doc-Type); sin
+// él, o si no tiene perfil, se aplican todos los perfiles.
+
+// redactionSchema es la parte de un JSON Schema que se usa para redactar
+type redactionSchema struct {
+	Scope      string                      `json:"x-scope,omitempty"`
+	Properties map[string]*redactionSchema `json:"properties,omitempty"`
+	Items      *redactionSchema            `json:"items,omitempty"`
+}
+
+// redactionRules son los scopes de cada llamante y el perfil de cada
+// doc_type. Se carga de REDACTION_FILE.
+type redactionRules struct {
+	Scopes   map[string][]string         `json:"scopes,omitempty"`
+	DocTypes map[string]*redactionSchema `json:"doc_types,omitempty"`
+}
+
+var redaction redactionRules
+
+// loadRedactionRules lee REDACTION_FILE si está definido
+func loadRedactionRules() error {
+	path := getEnv("REDACTION_FILE", "")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules redactionRules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return err
+	}
+	for docType, s := range rules.DocTypes {
+		if s == nil {
+			return fmt.Errorf("doc_type %q sin perfil", docType)
+		}
+	}
+	redaction = rules
+	return nil
+}
+
+// redactionProfiles son los perfiles que se aplican a la petición
+func redactionProfiles(r *http.Request) []*redactionSchema {
+	if s, ok := redaction.DocTypes[requestDocType(r)]; ok {
+		return []*redactionSchema{s}
+	}
+	names := make([]string, 0, len(redaction.DocTypes))
+	for name := range redaction.DocTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	profiles := make([]*redactionSchema, len(names))
+	for i, name := range names {
+		profiles[i] = redaction.DocTypes[name]
+	}
+	return profiles
+}
+
+// redactPayload quita de obj los campos que el llamante no puede ver y
+// devuelve el resultado y los JSON Pointer quitados (nil si no se quitó
+// nada). obj no se modifica; si el perfil reserva el documento entero, el
+// resultado es nil.
+func redactPayload(r *http.Request, obj interface{}) (interface{}, []string, error) {
+	profiles := redactionProfiles(r)
+	if len(profiles) == 0 {
+		return obj, nil, nil
+	}
+	granted := map[string]bool{}
+	for _, s := range redaction.Scopes[callerID(r)] {
+		granted[s] = true
+	}
+	out, err := deepCopyJSON(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	var redacted []string
+	for _, s := range profiles {
+		if s.denied(granted) {
+			return nil, []string{""}, nil
+		}
+		s.redact(out, "", granted, &redacted)
+	}
+	sort.Strings(redacted)
+	return out, redacted, nil
+}
+
+// denied indica si el valor descrito por s exige un scope que no está en
+// granted (para un array, el de sus elementos)
+func (s *redactionSchema) denied(granted map[string]bool) bool {
+	if s.Scope != "" && !granted[s.Scope] {
+		return true
+	}
+	return s.Items != nil && s.Items.Scope != "" && !granted[s.Items.Scope]
+}
+
+// redact quita de v, que está en ptr, los campos denegados
+func (s *redactionSchema) redact(v interface{}, ptr string, granted map[string]bool, redacted *[]string) {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for name, child := range s.Properties {
+			value, ok := n[name]
+			if !ok || child == nil {
+				continue
+			}
+			childPtr := ptr + "/" + pointerToken(name)
+			if child.denied(granted) {
+				delete(n, name)
+				*redacted = append(*redacted, childPtr)
+				continue
+			}
+			child.redact(value, childPtr, granted, redacted)
+		}
+	case []interface{}:
+		if s.Items == nil {
+			return
+		}
+		for i, item := range n {
+			s.Items.redact(item, fmt.Sprintf("%s/%d", ptr, i), granted, redacted)
+		}
+	}
+}
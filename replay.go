@@ -0,0 +1,320 @@
+// replay.go
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	firestore "google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Protección contra reenvíos: con NONCE_STORE, /verify anota el "nonce" de
+// cada sobre válido y rechaza el mismo nonce dentro de NONCE_WINDOW (24h).
+// Un sobre con timestamp más antiguo que la ventana también se rechaza,
+// porque el almacén ya puede haber olvidado su nonce.
+//
+//	NONCE_STORE       memory (LRU local), redis o firestore; vacío = sin comprobación
+//	NONCE_WINDOW      ventana de unicidad (24h)
+//	NONCE_REQUIRED    true: los sobres sin nonce no verifican
+//	NONCE_INJECT      always: /sign inyecta un nonce aunque no se pida ?nonce=true
+//	NONCE_LRU_SIZE    entradas del almacén en memoria (100000)
+//	NONCE_REDIS_ADDR, NONCE_REDIS_PASSWORD, NONCE_REDIS_DB, NONCE_REDIS_TLS
+//	NONCE_FIRESTORE_PROJECT, NONCE_FIRESTORE_COLLECTION (firma_nonces)
+//
+// El almacén en memoria sólo protege a una réplica y, si se llena, olvida
+// los nonces más antiguos antes de que acabe la ventana: con varias
+// réplicas hay que usar Redis o Firestore. En Firestore conviene una
+// política TTL sobre expire_at para que la colección no crezca sin límite.
+
+// nonceStore anota nonces vistos
+type nonceStore interface {
+	// Claim anota el nonce durante window; false si ya estaba anotado
+	Claim(ctx context.Context, nonce string, window time.Duration) (bool, error)
+}
+
+// replayStore es el almacén configurado; nil sin comprobación
+var replayStore nonceStore
+
+// nonceWindow es la ventana de unicidad de los nonces
+func nonceWindow() time.Duration {
+	d, err := time.ParseDuration(getEnv("NONCE_WINDOW", "24h"))
+	if err != nil || d <= 0 {
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// nonceInjectAlways indica si /sign inyecta siempre un nonce
+func nonceInjectAlways() bool {
+	return getEnv("NONCE_INJECT", "") == "always"
+}
+
+// openNonceStore crea el almacén de NONCE_STORE (nil si no hay)
+func openNonceStore() (nonceStore, error) {
+	switch kind := getEnv("NONCE_STORE", ""); kind {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryNonceStore(envInt("NONCE_LRU_SIZE", 100000)), nil
+	case "redis":
+		addr := getEnv("NONCE_REDIS_ADDR", "")
+		if addr == "" {
+			return nil, fmt.Errorf("NONCE_STORE=redis requiere NONCE_REDIS_ADDR")
+		}
+		return &redisNonceStore{
+			addr:     addr,
+			password: getEnv("NONCE_REDIS_PASSWORD", ""),
+			db:       envInt("NONCE_REDIS_DB", 0),
+			useTLS:   getEnv("NONCE_REDIS_TLS", "false") == "true",
+		}, nil
+	case "firestore":
+		project := getEnv("NONCE_FIRESTORE_PROJECT", getEnv("GOOGLE_CLOUD_PROJECT", ""))
+		if project == "" {
+			return nil, fmt.Errorf("NONCE_STORE=firestore requiere NONCE_FIRESTORE_PROJECT")
+		}
+		svc, err := firestore.NewService(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &firestoreNonceStore{
+			docs:       svc.Projects.Databases.Documents,
+			parent:     fmt.Sprintf("projects/%s/databases/(default)/documents", project),
+			collection: getEnv("NONCE_FIRESTORE_COLLECTION", "firma_nonces"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("NONCE_STORE desconocido: %q", kind)
+	}
+}
+
+// configureNonceStore abre el almacén al arrancar para fallar pronto si la
+// configuración no es válida
+func configureNonceStore() error {
+	var err error
+	replayStore, err = openNonceStore()
+	return err
+}
+
+// checkReplay anota el nonce de un sobre válido. Devuelve el motivo por el
+// que no vale (reenvío, sin nonce, fuera de la ventana o almacén caído), o
+// "" si vale o no hay comprobación.
+func checkReplay(ctx context.Context, obj interface{}) string {
+	if replayStore == nil {
+		return ""
+	}
+	m, _ := obj.(map[string]interface{})
+	nonce, _ := m["nonce"].(string)
+	if nonce == "" {
+		if getEnv("NONCE_REQUIRED", "false") == "true" {
+			return "El sobre no lleva nonce"
+		}
+		return ""
+	}
+	window := nonceWindow()
+	if ts := payloadTimestamp(obj); ts.IsZero() || time.Since(ts) > window {
+		return fmt.Sprintf("El sobre es anterior a la ventana de nonces (%s)", window)
+	}
+	sum := sha256.Sum256([]byte(nonce))
+	fresh, err := replayStore.Claim(ctx, hex.EncodeToString(sum[:]), window)
+	if err != nil {
+		return fmt.Sprintf("No se pudo comprobar el nonce: %v", err)
+	}
+	if !fresh {
+		return "Nonce ya usado: el sobre es un reenvío"
+	}
+	return ""
+}
+
+// memoryNonceStore es un LRU con caducidad
+type memoryNonceStore struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List // más reciente delante
+	entries map[string]*list.Element
+}
+
+type memoryNonce struct {
+	key     string
+	expires time.Time
+}
+
+func newMemoryNonceStore(max int) *memoryNonceStore {
+	if max < 1 {
+		max = 1
+	}
+	return &memoryNonceStore{max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *memoryNonceStore) Claim(_ context.Context, nonce string, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if el, ok := s.entries[nonce]; ok {
+		if now.Before(el.Value.(*memoryNonce).expires) {
+			return false, nil
+		}
+		s.order.Remove(el)
+		delete(s.entries, nonce)
+	}
+	s.entries[nonce] = s.order.PushFront(&memoryNonce{key: nonce, expires: now.Add(window)})
+	for s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryNonce).key)
+	}
+	return true, nil
+}
+
+// redisNonceStore anota con SET NX PX, que es atómico en Redis. Habla RESP
+// directamente sobre una conexión que se reabre si falla.
+type redisNonceStore struct {
+	addr     string
+	password string
+	db       int
+	useTLS   bool
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (s *redisNonceStore) Claim(ctx context.Context, nonce string, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply, err := s.do(ctx, "SET", "firma:nonce:"+nonce, "1", "NX", "PX", strconv.FormatInt(window.Milliseconds(), 10))
+	if err != nil {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// do envía un comando y devuelve la respuesta simple o bulk ("" si es nula)
+func (s *redisNonceStore) do(ctx context.Context, args ...string) (string, error) {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return "", err
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.conn.SetDeadline(deadline)
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return "", err
+	}
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("redis: respuesta vacía")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return line[1:], nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(s.rd, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+	return "", fmt.Errorf("redis: respuesta inesperada %q", line)
+}
+
+func (s *redisNonceStore) dial(ctx context.Context) error {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		conn, err = (&tls.Dialer{NetDialer: d}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := s.do(ctx, "AUTH", s.password); err != nil {
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.do(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firestoreNonceStore anota creando un documento con el nonce como id: si
+// ya existe y no ha caducado, es un reenvío
+type firestoreNonceStore struct {
+	docs       *firestore.ProjectsDatabasesDocumentsService
+	parent     string
+	collection string
+}
+
+func (s *firestoreNonceStore) Claim(ctx context.Context, nonce string, window time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	doc := &firestore.Document{Fields: map[string]firestore.Value{
+		"expire_at": {TimestampValue: now.Add(window).Format(time.RFC3339Nano)},
+	}}
+	_, err := s.docs.CreateDocument(s.parent, s.collection, doc).DocumentId(nonce).Context(ctx).Do()
+	if err == nil {
+		return true, nil
+	}
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusConflict {
+		return false, err
+	}
+	// Ya existe: sólo cuenta si no ha caducado (el TTL de Firestore borra
+	// con retraso)
+	name := fmt.Sprintf("%s/%s/%s", s.parent, s.collection, nonce)
+	existing, err := s.docs.Get(name).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	if exp, err := time.Parse(time.RFC3339Nano, existing.Fields["expire_at"].TimestampValue); err == nil && now.Before(exp) {
+		return false, nil
+	}
+	// Caducado: se reutiliza si nadie lo ha tocado mientras tanto
+	_, err = s.docs.Patch(name, doc).CurrentDocumentUpdateTime(existing.UpdateTime).Context(ctx).Do()
+	if errors.As(err, &gerr) && (gerr.Code == http.StatusConflict || gerr.Code == http.StatusPreconditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
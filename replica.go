@@ -0,0 +1,358 @@
+// replica.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Réplica del store en otra región, para que perder la región principal no
+// borre el historial de firmas. Cada Put/Delete de las colecciones
+// replicadas se escribe primero en el store principal y después, de forma
+// asíncrona, en la réplica; la petición no espera a la réplica ni falla si
+// ésta no responde. Lo que no llega a replicarse (cola llena, réplica
+// caída, reinicio) lo arregla la reconciliación periódica, que compara las
+// dos copias y lleva a la réplica lo que falte o difiera.
+//
+//	STORE_REPLICA                     tipo de store de la réplica ("file"); vacío = sin réplica
+//	STORE_REPLICA_DIR                 directorio de la réplica (el volumen de la otra región)
+//	STORE_REPLICA_REGION              nombre de la región, sólo informativo
+//	STORE_REPLICA_COLLECTIONS         colecciones replicadas (el historial de firmas)
+//	STORE_REPLICA_QUEUE_SIZE          escrituras pendientes como mucho (10000)
+//	STORE_REPLICA_RECONCILE_INTERVAL  cada cuánto se reconcilia (1h)
+//
+// La reconciliación nunca borra de la réplica: un registro que sólo está en
+// la réplica se informa (puede ser justo lo que se perdió en la principal)
+// y se deja. GET /admin/replica da el estado y el último informe; POST
+// /admin/replica/reconcile reconcilia en el momento.
+
+// replicaDefaultCollections es el historial de firmas: auditoría, sobres
+// guardados y lo que los acompaña
+const replicaDefaultCollections = "audit,audit_hourly,audit_meta,envelopes,envelope_timestamps,owners,legal_holds"
+
+// replicaOnlyMax es cuántos ids sólo presentes en la réplica se listan por
+// colección en el informe
+const replicaOnlyMax = 50
+
+// replicaOp es una escritura pendiente de replicar
+type replicaOp struct {
+	Collection string
+	ID         string
+	Data       []byte // nil = borrado
+}
+
+// replicaCollectionReport es el resultado de reconciliar una colección
+type replicaCollectionReport struct {
+	Primary       int      `json:"primary"`
+	Replica       int      `json:"replica"`
+	Copied        int      `json:"copied"`   // faltaban en la réplica
+	Repaired      int      `json:"repaired"` // diferían de la principal
+	OnlyInReplica int      `json:"only_in_replica"`
+	OnlyIDs       []string `json:"only_in_replica_ids,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// replicaReport es el informe de una reconciliación
+type replicaReport struct {
+	StartedAt   time.Time                          `json:"started_at"`
+	FinishedAt  time.Time                          `json:"finished_at"`
+	Collections map[string]replicaCollectionReport `json:"collections"`
+	InSync      bool                               `json:"in_sync"`
+}
+
+// replicatedStore lee del store principal y replica las escrituras en
+// secondary
+type replicatedStore struct {
+	primary     store
+	secondary   store
+	region      string
+	collections map[string]bool
+	names       []string // collections, ordenadas
+	queue       chan replicaOp
+
+	replicated atomic.Int64
+	dropped    atomic.Int64
+	failures   atomic.Int64
+
+	mu         sync.Mutex
+	lastError  string
+	lastReport *replicaReport
+	reconcile  sync.Mutex // una reconciliación a la vez
+}
+
+// activeReplica es la réplica configurada; nil si no hay
+var activeReplica *replicatedStore
+
+// openReplica envuelve primary con la réplica de STORE_REPLICA, si hay
+func openReplica(primary store) (store, error) {
+	kind := getEnv("STORE_REPLICA", "")
+	if kind == "" {
+		return primary, nil
+	}
+	dir := getEnv("STORE_REPLICA_DIR", "")
+	if dir == "" {
+		return nil, fmt.Errorf("STORE_REPLICA requiere STORE_REPLICA_DIR")
+	}
+	if kind == getEnv("STORE", "memory") && dir == getEnv("STORE_DIR", "./data") {
+		return nil, fmt.Errorf("STORE_REPLICA_DIR no puede ser el mismo que STORE_DIR")
+	}
+	secondary, err := newStore(kind, dir)
+	if err != nil {
+		return nil, fmt.Errorf("STORE_REPLICA: %w", err)
+	}
+	size := envInt("STORE_REPLICA_QUEUE_SIZE", 10000)
+	if size < 1 {
+		return nil, fmt.Errorf("STORE_REPLICA_QUEUE_SIZE inválido")
+	}
+	interval := envDuration("STORE_REPLICA_RECONCILE_INTERVAL", time.Hour)
+	if interval <= 0 {
+		return nil, fmt.Errorf("STORE_REPLICA_RECONCILE_INTERVAL inválido")
+	}
+	s := &replicatedStore{
+		primary:     primary,
+		secondary:   secondary,
+		region:      getEnv("STORE_REPLICA_REGION", ""),
+		collections: map[string]bool{},
+		queue:       make(chan replicaOp, size),
+	}
+	for _, c := range strings.Split(getEnv("STORE_REPLICA_COLLECTIONS", replicaDefaultCollections), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			s.collections[c] = true
+		}
+	}
+	for c := range s.collections {
+		s.names = append(s.names, c)
+	}
+	sort.Strings(s.names)
+	activeReplica = s
+	lifecycle.Go("store-replica", s.run)
+	lifecycle.Go("store-replica-reconcile", func(ctx context.Context) {
+		for {
+			if report := s.reconcileAll(ctx); !report.InSync {
+				log.Printf("⚠️  Réplica: reconciliación con diferencias: %s", report.summary())
+			}
+			if !sleepCtx(ctx, interval) {
+				return
+			}
+		}
+	})
+	return s, nil
+}
+
+func (s *replicatedStore) Get(ctx context.Context, collection, id string) ([]byte, error) {
+	return s.primary.Get(ctx, collection, id)
+}
+
+func (s *replicatedStore) List(ctx context.Context, collection string) (map[string][]byte, []string, error) {
+	return s.primary.List(ctx, collection)
+}
+
+func (s *replicatedStore) Put(ctx context.Context, collection, id string, data []byte) error {
+	if err := s.primary.Put(ctx, collection, id, data); err != nil {
+		return err
+	}
+	s.enqueue(replicaOp{Collection: collection, ID: id, Data: append([]byte(nil), data...)})
+	return nil
+}
+
+func (s *replicatedStore) Delete(ctx context.Context, collection, id string) error {
+	if err := s.primary.Delete(ctx, collection, id); err != nil {
+		return err
+	}
+	s.enqueue(replicaOp{Collection: collection, ID: id})
+	return nil
+}
+
+// enqueue encola op sin bloquear; si la cola está llena la escritura se
+// descarta y la recupera la siguiente reconciliación
+func (s *replicatedStore) enqueue(op replicaOp) {
+	if !s.collections[op.Collection] {
+		return
+	}
+	select {
+	case s.queue <- op:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// apply escribe op en la réplica
+func (s *replicatedStore) apply(ctx context.Context, op replicaOp) error {
+	if op.Data == nil {
+		if err := s.secondary.Delete(ctx, op.Collection, op.ID); err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+		return nil
+	}
+	return s.secondary.Put(ctx, op.Collection, op.ID, op.Data)
+}
+
+// run aplica la cola en orden, reintentando con espera exponencial
+// mientras la réplica falle. Al pararse, lo que quede en la cola se da por
+// descartado: lo recupera la reconciliación del siguiente arranque.
+func (s *replicatedStore) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		var op replicaOp
+		select {
+		case <-ctx.Done():
+			if n := len(s.queue); n > 0 {
+				s.dropped.Add(int64(n))
+				log.Printf("⚠️  Réplica: %d escrituras sin replicar al parar; se reconciliarán al arrancar", n)
+			}
+			return
+		case op = <-s.queue:
+		}
+		for {
+			err := s.apply(ctx, op)
+			if err == nil {
+				s.replicated.Add(1)
+				backoff = time.Second
+				break
+			}
+			s.failures.Add(1)
+			s.mu.Lock()
+			s.lastError = err.Error()
+			s.mu.Unlock()
+			log.Printf("⚠️  Réplica: %s/%s: %v (reintento en %s)", op.Collection, op.ID, err, backoff)
+			if !sleepCtx(ctx, backoff) {
+				s.dropped.Add(int64(len(s.queue)) + 1)
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// reconcileAll reconcilia todas las colecciones replicadas y guarda el
+// informe
+func (s *replicatedStore) reconcileAll(ctx context.Context) replicaReport {
+	s.reconcile.Lock()
+	defer s.reconcile.Unlock()
+	report := replicaReport{StartedAt: time.Now().UTC(), Collections: map[string]replicaCollectionReport{}, InSync: true}
+	for _, c := range s.names {
+		cr := s.reconcileCollection(ctx, c)
+		if cr.Error != "" || cr.Copied > 0 || cr.Repaired > 0 || cr.OnlyInReplica > 0 {
+			report.InSync = false
+		}
+		report.Collections[c] = cr
+	}
+	report.FinishedAt = time.Now().UTC()
+	s.mu.Lock()
+	s.lastReport = &report
+	s.mu.Unlock()
+	return report
+}
+
+// reconcileCollection lleva a la réplica lo que falta o difiere de la
+// principal e informa de lo que sólo está en la réplica
+func (s *replicatedStore) reconcileCollection(ctx context.Context, collection string) replicaCollectionReport {
+	var cr replicaCollectionReport
+	primary, ids, err := s.primary.List(ctx, collection)
+	if err != nil {
+		cr.Error = "principal: " + err.Error()
+		return cr
+	}
+	secondary, secondaryIDs, err := s.secondary.List(ctx, collection)
+	if err != nil {
+		cr.Error = "réplica: " + err.Error()
+		return cr
+	}
+	cr.Primary, cr.Replica = len(ids), len(secondaryIDs)
+	for _, id := range ids {
+		have, ok := secondary[id]
+		if ok && bytes.Equal(have, primary[id]) {
+			continue
+		}
+		if err := s.secondary.Put(ctx, collection, id, primary[id]); err != nil {
+			cr.Error = fmt.Sprintf("réplica: %s: %v", id, err)
+			return cr
+		}
+		if ok {
+			cr.Repaired++
+		} else {
+			cr.Copied++
+		}
+	}
+	for _, id := range secondaryIDs {
+		if _, ok := primary[id]; ok {
+			continue
+		}
+		cr.OnlyInReplica++
+		if len(cr.OnlyIDs) < replicaOnlyMax {
+			cr.OnlyIDs = append(cr.OnlyIDs, id)
+		}
+	}
+	return cr
+}
+
+// summary resume las diferencias del informe para el log
+func (r replicaReport) summary() string {
+	names := make([]string, 0, len(r.Collections))
+	for c := range r.Collections {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, c := range names {
+		cr := r.Collections[c]
+		switch {
+		case cr.Error != "":
+			parts = append(parts, fmt.Sprintf("%s: %s", c, cr.Error))
+		case cr.Copied > 0 || cr.Repaired > 0 || cr.OnlyInReplica > 0:
+			parts = append(parts, fmt.Sprintf("%s: %d copiados, %d reparados, %d sólo en la réplica", c, cr.Copied, cr.Repaired, cr.OnlyInReplica))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// status es el estado de la réplica para /admin/replica
+func (s *replicatedStore) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"kind":           getEnv("STORE_REPLICA", ""),
+		"region":         s.region,
+		"collections":    s.names,
+		"pending":        len(s.queue),
+		"replicated":     s.replicated.Load(),
+		"dropped":        s.dropped.Load(),
+		"failures":       s.failures.Load(),
+		"last_error":     s.lastError,
+		"last_reconcile": s.lastReport,
+	}
+}
+
+// replicaHandler atiende GET /admin/replica y POST /admin/replica/reconcile
+func replicaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if activeReplica == nil {
+		writeError(w, http.StatusNotFound, errNotConfigured, "No hay réplica configurada (STORE_REPLICA)")
+		return
+	}
+	switch {
+	case r.URL.Path == "/admin/replica" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, activeReplica.status())
+	case r.URL.Path == "/admin/replica/reconcile" && r.Method == http.MethodPost:
+		report := activeReplica.reconcileAll(r.Context())
+		recordAdminAudit(r, "replica.reconcile", report.summary())
+		writeJSON(w, http.StatusOK, report)
+	case r.URL.Path == "/admin/replica" || r.URL.Path == "/admin/replica/reconcile":
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	default:
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+	}
+}
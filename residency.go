@@ -0,0 +1,74 @@
+// residency.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// residencyRules indica qué región exige cada tenant o tipo de documento.
+// Se carga de RESIDENCY_FILE.
+type residencyRules struct {
+	Tenants  map[string]string `json:"tenants,omitempty"`
+	DocTypes map[string]string `json:"doc_types,omitempty"`
+}
+
+var residency residencyRules
+
+// loadResidencyRules lee RESIDENCY_FILE si está definido
+func loadResidencyRules() error {
+	path := getEnv("RESIDENCY_FILE", "")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, &residency)
+}
+
+// requestTenant y requestDocType identifican para quién y qué se firma
+// (?tenant= / ?doc_type= o sus cabeceras X-Tenant / X-Doc-Type)
+func requestTenant(r *http.Request) string {
+	if t := r.URL.Query().Get("tenant"); t != "" {
+		return t
+	}
+	return r.Header.Get("X-Tenant")
+}
+
+func requestDocType(r *http.Request) string {
+	if t := r.URL.Query().Get("doc_type"); t != "" {
+		return t
+	}
+	return r.Header.Get("X-Doc-Type")
+}
+
+// checkResidency rechaza la firma si el tenant o el tipo de documento exigen
+// una región distinta de la de la clave
+func checkResidency(r *http.Request, alias string) error {
+	keyRegion := keyConfigs[alias].Region
+	required := map[string]string{}
+	if t := requestTenant(r); t != "" && residency.Tenants[t] != "" {
+		required["tenant "+t] = residency.Tenants[t]
+	}
+	if d := requestDocType(r); d != "" && residency.DocTypes[d] != "" {
+		required["doc_type "+d] = residency.DocTypes[d]
+	}
+	for who, region := range required {
+		if region != keyRegion {
+			return fmt.Errorf("%s exige firmar en la región %q y la clave %q es de %q", who, region, alias, keyRegion)
+		}
+	}
+	return nil
+}
+
+// residencyClaim describe dónde se ha firmado, para incluirlo bajo la firma
+func residencyClaim(alias string) map[string]interface{} {
+	return map[string]interface{}{
+		"region":       keyConfigs[alias].Region,
+		"kms_location": kmsLocation,
+	}
+}
@@ -0,0 +1,383 @@
+// retention.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Los sobres guardados (STORE_ENVELOPES) se conservan según el tipo de
+// documento y se borran al caducar, salvo que estén bajo retención legal:
+//
+//	ENVELOPE_RETENTION_DAYS          retención por defecto (0 = indefinida)
+//	ENVELOPE_DOCTYPE_RETENTION       "doc_type=días,..." (0 = indefinida)
+//	ENVELOPE_RETENTION_INTERVAL      cada cuánto se purgan (1h)
+//
+// Una retención legal (legal hold) cubre un sobre concreto o todos los de un
+// tenant y/o doc_type, incluidos los que se firmen después. Mientras esté
+// activa ningún sobre cubierto se borra, ni por caducidad ni a mano. Al
+// liberarla se conserva el registro con quién y cuándo.
+
+// legalHoldsCollection guarda las retenciones legales, activas y liberadas
+const legalHoldsCollection = "legal_holds"
+
+// errEnvelopeOnHold lo devuelve deleteEnvelope si el sobre está retenido
+var errEnvelopeOnHold = errors.New("el sobre está bajo retención legal")
+
+type legalHold struct {
+	ID         string     `json:"id"`
+	EnvelopeID string     `json:"envelope_id,omitempty"`
+	Tenant     string     `json:"tenant,omitempty"`
+	DocType    string     `json:"doc_type,omitempty"`
+	Reason     string     `json:"reason"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReleasedBy string     `json:"released_by,omitempty"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+}
+
+// covers indica si la retención, activa, alcanza al sobre
+func (h legalHold) covers(e storedEnvelope) bool {
+	if h.ReleasedAt != nil {
+		return false
+	}
+	if h.EnvelopeID != "" {
+		return h.EnvelopeID == e.ID
+	}
+	return (h.Tenant == "" || h.Tenant == e.Tenant) && (h.DocType == "" || h.DocType == e.DocType)
+}
+
+// envelopeRetention devuelve cuánto se conservan los sobres de un doc_type;
+// 0 es indefinidamente
+func envelopeRetention(docType string) time.Duration {
+	days, err := strconv.Atoi(getEnv("ENVELOPE_RETENTION_DAYS", "0"))
+	if err != nil {
+		days = 0
+	}
+	for _, pair := range strings.Split(getEnv("ENVELOPE_DOCTYPE_RETENTION", ""), ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(name) == docType {
+			if d, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				days = d
+			}
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// envelopeExpiresAt devuelve cuándo caduca el sobre, o nil si no caduca
+func envelopeExpiresAt(e storedEnvelope) *time.Time {
+	retention := envelopeRetention(e.DocType)
+	if retention <= 0 {
+		return nil
+	}
+	t := e.Time.Add(retention)
+	return &t
+}
+
+// listLegalHolds devuelve las retenciones guardadas, en orden de creación
+func listLegalHolds(ctx context.Context) ([]legalHold, error) {
+	records, ids, err := db.List(ctx, legalHoldsCollection)
+	if err != nil {
+		return nil, err
+	}
+	holds := make([]legalHold, 0, len(ids))
+	for _, id := range ids {
+		var h legalHold
+		if err := json.Unmarshal(records[id], &h); err == nil {
+			holds = append(holds, h)
+		}
+	}
+	return holds, nil
+}
+
+// holdsCovering devuelve las retenciones activas que alcanzan al sobre
+func holdsCovering(holds []legalHold, e storedEnvelope) []legalHold {
+	var out []legalHold
+	for _, h := range holds {
+		if h.covers(e) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func loadEnvelope(ctx context.Context, id string) (storedEnvelope, error) {
+	var e storedEnvelope
+	raw, err := db.Get(ctx, envelopeCollection, id)
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(raw, &e)
+	return e, err
+}
+
+// deleteEnvelope borra un sobre y sus sellos de tiempo si ninguna retención
+// legal lo impide
+func deleteEnvelope(ctx context.Context, e storedEnvelope, holds []legalHold) error {
+	if len(holdsCovering(holds, e)) > 0 {
+		return errEnvelopeOnHold
+	}
+	if err := db.Delete(ctx, envelopeCollection, e.ID); err != nil {
+		return err
+	}
+	if err := db.Delete(ctx, envelopeTimestampsCollection, e.ID); err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	return nil
+}
+
+// startEnvelopeRetention lanza la purga de sobres caducados cada
+// ENVELOPE_RETENTION_INTERVAL. Sin retención configurada no hace nada.
+func startEnvelopeRetention() {
+	if getEnv("ENVELOPE_RETENTION_DAYS", "0") == "0" && getEnv("ENVELOPE_DOCTYPE_RETENTION", "") == "" {
+		return
+	}
+	interval, _ := retentionInterval() // ya validado al arrancar
+	lifecycle.Go("envelope-retention", func(ctx context.Context) {
+		for {
+			n, held, err := purgeExpiredEnvelopes(ctx, time.Now().UTC())
+			if err != nil {
+				log.Printf("⚠️  Purga de sobres: %v", err)
+			} else if n > 0 || held > 0 {
+				log.Printf("Purga de sobres: %d borrados, %d caducados bajo retención legal", n, held)
+			}
+			if !sleepCtx(ctx, interval) {
+				return
+			}
+		}
+	})
+}
+
+// retentionInterval lee ENVELOPE_RETENTION_INTERVAL (1h, mayor que cero)
+func retentionInterval() (time.Duration, error) {
+	interval, err := time.ParseDuration(getEnv("ENVELOPE_RETENTION_INTERVAL", "1h"))
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("ENVELOPE_RETENTION_INTERVAL inválido: %q", getEnv("ENVELOPE_RETENTION_INTERVAL", "1h"))
+	}
+	return interval, nil
+}
+
+// purgeExpiredEnvelopes borra los sobres caducados que no están retenidos.
+// Devuelve cuántos ha borrado y cuántos siguen por una retención legal.
+func purgeExpiredEnvelopes(ctx context.Context, now time.Time) (deleted, held int, err error) {
+	holds, err := listLegalHolds(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	records, ids, err := db.List(ctx, envelopeCollection)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, id := range ids {
+		var e storedEnvelope
+		if err := json.Unmarshal(records[id], &e); err != nil {
+			continue
+		}
+		if exp := envelopeExpiresAt(e); exp == nil || now.Before(*exp) {
+			continue
+		}
+		switch err := deleteEnvelope(ctx, e, holds); {
+		case errors.Is(err, errEnvelopeOnHold):
+			held++
+		case err != nil:
+			return deleted, held, err
+		default:
+			deleted++
+			audit := newAuditEntryFor(requestMeta{Tenant: e.Tenant, DocType: e.DocType}, "envelope_expired", e.Key, nil)
+			audit.Outcome, audit.Detail = "ok", e.ID
+			recordAudit(ctx, audit)
+		}
+	}
+	return deleted, held, nil
+}
+
+// envelopesAdminHandler atiende /admin/envelopes/{id}[/timestamps]:
+//
+//	GET    /admin/envelopes/{id}             retención y retenciones legales
+//	DELETE /admin/envelopes/{id}             borra el sobre (409 si está retenido)
+//	GET    /admin/envelopes/{id}/timestamps  ver retimestamp.go
+func envelopesAdminHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/envelopes/"), "/")
+	switch action {
+	case "timestamps":
+		envelopeTimestampsHandler(w, r)
+		return
+	case "":
+	default:
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	e, err := loadEnvelope(ctx, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Sobre no encontrado")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	holds, err := listLegalHolds(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		covering := holdsCovering(holds, e)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":          e.ID,
+			"time":        e.Time,
+			"tenant":      e.Tenant,
+			"doc_type":    e.DocType,
+			"expires_at":  envelopeExpiresAt(e),
+			"legal_holds": covering,
+			"deletable":   len(covering) == 0,
+		})
+
+	case http.MethodDelete:
+		err := deleteEnvelope(ctx, e, holds)
+		if errors.Is(err, errEnvelopeOnHold) {
+			writeError(w, http.StatusConflict, errLegalHold, "El sobre está bajo retención legal")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "envelope_deleted", e.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	}
+}
+
+// legalHoldsHandler atiende /admin/holds y /admin/holds/{id}[/release]:
+//
+//	GET  /admin/holds                 retenciones activas (?all=true: también las liberadas)
+//	POST /admin/holds                 aplica una retención {envelope_id | tenant, doc_type, reason}
+//	GET  /admin/holds/{id}            una retención
+//	POST /admin/holds/{id}/release    la libera
+func legalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/holds"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		p, ok := pageRequest(w, r)
+		if !ok {
+			return
+		}
+		records, ids, err := db.List(ctx, legalHoldsCollection)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		all := r.URL.Query().Get("all") == "true"
+		out, next := paginate(p, ids, func(id string) (h legalHold, ok bool) {
+			return h, json.Unmarshal(records[id], &h) == nil && (h.ReleasedAt == nil || all)
+		})
+		writePage(w, "holds", out, next)
+
+	case id == "" && r.Method == http.MethodPost:
+		var h legalHold
+		if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+			return
+		}
+		if h.Reason == "" {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "reason es obligatorio")
+			return
+		}
+		if h.EnvelopeID == "" && h.Tenant == "" && h.DocType == "" {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "Indica envelope_id, tenant o doc_type")
+			return
+		}
+		if h.EnvelopeID != "" && (h.Tenant != "" || h.DocType != "") {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "envelope_id excluye tenant y doc_type")
+			return
+		}
+		if h.EnvelopeID != "" {
+			if _, err := db.Get(ctx, envelopeCollection, h.EnvelopeID); errors.Is(err, errNotFound) {
+				writeError(w, http.StatusNotFound, errNotFoundCode, "Sobre no encontrado")
+				return
+			}
+		}
+		now := time.Now().UTC()
+		hid, err := timeOrderedID(now)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+			return
+		}
+		h.ID, h.CreatedAt, h.CreatedBy = hid, now, callerID(r)
+		h.ReleasedAt, h.ReleasedBy = nil, ""
+		if !putLegalHold(w, r, h) {
+			return
+		}
+		recordAdminAudit(r, "legal_hold_applied", fmt.Sprintf("%s envelope=%s tenant=%s doc_type=%s reason=%q", h.ID, h.EnvelopeID, h.Tenant, h.DocType, h.Reason))
+		writeJSON(w, http.StatusCreated, h)
+
+	case id != "" && (action == "" && r.Method == http.MethodGet || action == "release" && r.Method == http.MethodPost):
+		raw, err := db.Get(ctx, legalHoldsCollection, id)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Retención no encontrada")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		var h legalHold
+		if err := json.Unmarshal(raw, &h); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		if action == "" {
+			writeJSON(w, http.StatusOK, h)
+			return
+		}
+		if h.ReleasedAt != nil {
+			writeError(w, http.StatusConflict, errInvalidRequest, "La retención ya está liberada")
+			return
+		}
+		now := time.Now().UTC()
+		h.ReleasedAt, h.ReleasedBy = &now, callerID(r)
+		if !putLegalHold(w, r, h) {
+			return
+		}
+		recordAdminAudit(r, "legal_hold_released", h.ID)
+		writeJSON(w, http.StatusOK, h)
+
+	case id != "" && action != "" && action != "release":
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	}
+}
+
+func putLegalHold(w http.ResponseWriter, r *http.Request, h legalHold) bool {
+	raw, _ := json.Marshal(h)
+	if err := db.Put(r.Context(), legalHoldsCollection, h.ID, raw); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return false
+	}
+	return true
+}
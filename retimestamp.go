@@ -0,0 +1,240 @@
+// retimestamp.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// envelopeTimestampsCollection guarda, por sobre, la cadena de sellos de
+// tiempo de conservación a largo plazo
+const envelopeTimestampsCollection = "envelope_timestamps"
+
+// archiveTimestamp es un sello RFC 3161 de una TSA externa. Cada sello
+// cubre el sobre y el sello anterior (como una cadena de ERS, RFC 4998), así
+// que la prueba sigue siendo válida aunque se retire nuestra clave o se
+// debilite el algoritmo de un sello antiguo: basta con que el último sea
+// fuerte.
+type archiveTimestamp struct {
+	Time    time.Time `json:"time"`
+	TSA     string    `json:"tsa"`
+	HashAlg string    `json:"hash_alg"`
+	Imprint string    `json:"imprint"` // hex
+	Token   string    `json:"token"`   // TimeStampToken DER en Base64
+}
+
+type timestampChain struct {
+	EnvelopeID string             `json:"envelope_id"`
+	Chain      []archiveTimestamp `json:"chain"`
+}
+
+var tsaHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// startRetimestamper lanza el re-sellado cada RETIMESTAMP_INTERVAL. Un
+// sobre se sella por primera vez en la siguiente pasada y se vuelve a sellar
+// cuando su último sello tiene más de RETIMESTAMP_RENEW_AFTER. Sin TSA_URL
+// queda desactivado.
+func startRetimestamper() {
+	if getEnv("TSA_URL", "") == "" {
+		return
+	}
+	interval, renewAfter, _ := retimestampConfig() // ya validado al arrancar
+	lifecycle.Go("retimestamper", func(ctx context.Context) {
+		for {
+			n, err := retimestampEnvelopes(ctx, time.Now().UTC(), renewAfter)
+			if err != nil {
+				log.Printf("⚠️  Re-sellado de sobres: %v", err)
+			} else if n > 0 {
+				log.Printf("Re-sellados %d sobres", n)
+			}
+			if !sleepCtx(ctx, interval) {
+				return
+			}
+		}
+	})
+}
+
+// retimestampConfig lee RETIMESTAMP_INTERVAL (24h) y RETIMESTAMP_RENEW_AFTER
+// (8760h)
+func retimestampConfig() (interval, renewAfter time.Duration, err error) {
+	if interval, err = time.ParseDuration(getEnv("RETIMESTAMP_INTERVAL", "24h")); err != nil {
+		return 0, 0, fmt.Errorf("RETIMESTAMP_INTERVAL inválido: %v", err)
+	}
+	if renewAfter, err = time.ParseDuration(getEnv("RETIMESTAMP_RENEW_AFTER", "8760h")); err != nil {
+		return 0, 0, fmt.Errorf("RETIMESTAMP_RENEW_AFTER inválido: %v", err)
+	}
+	return interval, renewAfter, nil
+}
+
+// retimestampEnvelopes sella los sobres guardados que no tienen sello o cuyo
+// último sello ha caducado según renewAfter. Devuelve cuántos ha sellado.
+func retimestampEnvelopes(ctx context.Context, now time.Time, renewAfter time.Duration) (int, error) {
+	envelopes, ids, err := db.List(ctx, envelopeCollection)
+	if err != nil {
+		return 0, err
+	}
+	tsaURL := getEnv("TSA_URL", "")
+	done := 0
+	for _, id := range ids {
+		var chain timestampChain
+		raw, err := db.Get(ctx, envelopeTimestampsCollection, id)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(raw, &chain); err != nil {
+				return done, fmt.Errorf("sellos de %s: %w", id, err)
+			}
+		case errors.Is(err, errNotFound):
+			chain.EnvelopeID = id
+		default:
+			return done, err
+		}
+		if n := len(chain.Chain); n > 0 && now.Sub(chain.Chain[n-1].Time) < renewAfter {
+			continue
+		}
+
+		// El sello cubre el sobre tal cual está guardado y el token anterior
+		h := sha256.New()
+		h.Write(envelopes[id])
+		if n := len(chain.Chain); n > 0 {
+			prev, _ := base64.StdEncoding.DecodeString(chain.Chain[n-1].Token)
+			h.Write(prev)
+		}
+		imprint := h.Sum(nil)
+		token, err := requestTimestamp(ctx, tsaURL, imprint)
+		if err != nil {
+			return done, fmt.Errorf("TSA para %s: %w", id, err)
+		}
+		chain.Chain = append(chain.Chain, archiveTimestamp{
+			Time:    now,
+			TSA:     tsaURL,
+			HashAlg: "SHA-256",
+			Imprint: hex.EncodeToString(imprint),
+			Token:   base64.StdEncoding.EncodeToString(token),
+		})
+		out, _ := json.Marshal(chain)
+		if err := db.Put(ctx, envelopeTimestampsCollection, id, out); err != nil {
+			return done, err
+		}
+		done++
+	}
+	return done, nil
+}
+
+// Estructuras ASN.1 de RFC 3161 que necesitamos
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString asn1.RawValue  `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// requestTimestamp pide a la TSA un sello sobre el hash SHA-256 dado y
+// devuelve el TimeStampToken (CMS SignedData) en DER. La validación
+// criptográfica del token la hace quien lo consume, con la cadena de la TSA.
+func requestTimestamp(ctx context.Context, tsaURL string, imprint []byte) ([]byte, error) {
+	nonce, err := rand.Int(entropy, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: imprint,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, tsaURL, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/timestamp-query")
+	resp, err := tsaHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var tsResp timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsResp); err != nil {
+		return nil, fmt.Errorf("respuesta de la TSA inválida: %w", err)
+	}
+	// 0 = granted, 1 = grantedWithMods
+	if tsResp.Status.Status > 1 || len(tsResp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("la TSA rechazó la petición (estado %d)", tsResp.Status.Status)
+	}
+	return tsResp.TimeStampToken.FullBytes, nil
+}
+
+// envelopeTimestampsHandler devuelve la cadena de sellos de un sobre
+// (GET /admin/envelopes/{id}/timestamps)
+func envelopeTimestampsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/envelopes/"), "/timestamps")
+	raw, err := db.Get(r.Context(), envelopeTimestampsCollection, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "El sobre no tiene sellos de tiempo")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
@@ -0,0 +1,303 @@
+// revisions.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"example.com/firmajson/enrich"
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Revisiones de documentos firmados. POST /sign/patch recibe un sobre
+// firmado por este servicio (o el id de uno guardado con STORE_ENVELOPES)
+// y un JSON Patch (RFC 6902), verifica el sobre, aplica el parche al
+// documento y firma el resultado como lo haría /sign:
+//
+//	{"envelope": {"payload": {...}, "signature": "..."},
+//	 "patch": [{"op": "replace", "path": "/importe", "value": 120}]}
+//
+// El documento nuevo lleva en "revision_of" el enlace con el anterior,
+// cubierto por la firma: el SHA-256 de sus bytes canónicos, la versión de
+// clave que lo firmó, su envelope_id si se guardó, el parche y el número
+// de revisión. Cualquiera con los dos sobres puede comprobar la cadena:
+// ambos verifican, el hash coincide con el del anterior y aplicar el
+// parche al anterior da el nuevo.
+//
+// Antes de parchear se quitan los campos que añade el servicio al firmar
+// (timestamp, time_source, signed_in, los de los enriquecedores y el
+// propio revision_of), que se vuelven a añadir, y el nonce, que es de un
+// solo uso y no puede pasar a la revisión (se pide otro con ?nonce=true);
+// cnf sólo si la petición vuelve a ligar el sobre. El parche no puede
+// tocarlos. Los documentos con campos cifrados no se pueden revisar.
+//
+//	PATCH_MAX_OPS  operaciones por parche como mucho (100)
+
+// revisionClaim es el campo con el enlace a la revisión anterior
+const revisionClaim = "revision_of"
+
+// patchRequest es el cuerpo de /sign/patch
+type patchRequest struct {
+	Envelope   *verifyRequest  `json:"envelope"`
+	EnvelopeID string          `json:"envelope_id"`
+	Patch      json.RawMessage `json:"patch"`
+}
+
+// revisionInjected son los campos que se quitan del documento anterior
+// antes de parchearlo
+func revisionInjected(r *http.Request) []string {
+	fields := []string{"timestamp", timeSourceClaim, "signed_in", "nonce", revisionClaim}
+	fields = append(fields, enrich.Fields()...)
+	if r.URL.Query().Get("bind") == "cert" {
+		fields = append(fields, confirmationClaim)
+	}
+	return fields
+}
+
+// validatePatchRequest comprueba el cuerpo de /sign/patch
+func validatePatchRequest(r *http.Request, body []byte) []validationProblem {
+	var problems []validationProblem
+	if !validEscapeMode(requestEscape(r)) {
+		problems = append(problems, validationProblem{"escape", errInvalidRequest, "escape debe ser html, minimal, ascii o jcs"})
+	}
+	problems = append(problems, validateAAD(r)...)
+	problems = append(problems, validateDigest(r)...)
+	var req patchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return append(problems, validationProblem{"body", errInvalidJSON, "El cuerpo debe ser {envelope o envelope_id, patch}"})
+	}
+	if (req.Envelope == nil) == (req.EnvelopeID == "") {
+		problems = append(problems, validationProblem{"envelope", errInvalidRequest, "Indica envelope o envelope_id, no los dos"})
+	}
+	if req.Envelope != nil && (req.Envelope.JWS != "" || req.Envelope.Protected != "" || req.Envelope.Iss != "" && req.Envelope.Iss != issuerID()) {
+		problems = append(problems, validationProblem{"envelope", errInvalidRequest, "Sólo se pueden revisar sobres de este emisor"})
+	}
+	var ops []patchOp
+	if err := json.Unmarshal(req.Patch, &ops); err != nil || len(ops) == 0 {
+		return append(problems, validationProblem{"patch", errInvalidRequest, "patch debe ser un array de operaciones JSON Patch"})
+	}
+	if max := envInt("PATCH_MAX_OPS", 100); len(ops) > max {
+		problems = append(problems, validationProblem{"patch", errInvalidRequest, fmt.Sprintf("El parche tiene %d operaciones y el máximo es %d", len(ops), max)})
+	}
+	problems = append(problems, validatePatch(ops)...)
+	reserved := map[string]bool{}
+	for _, f := range revisionInjected(r) {
+		reserved[f] = true
+	}
+	for i, op := range ops {
+		for _, ptr := range []string{op.Path, op.From} {
+			tokens, err := parsePointer(ptr)
+			if err == nil && len(tokens) > 0 && reserved[tokens[0]] {
+				problems = append(problems, validationProblem{fmt.Sprintf("patch[%d]", i), errReservedField, fmt.Sprintf("El campo %q lo añade el servicio", tokens[0])})
+			}
+		}
+		for _, p := range patchPurposeProblem(op) {
+			p.Field = fmt.Sprintf("patch[%d]", i)
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// patchPurposeProblem comprueba que op no pone en "type" un propósito
+// reservado al servicio, ni directamente ni sustituyendo el documento
+// entero. Lo que llega a "type" con copy o move sólo se ve al aplicar el
+// parche (ver signPatchHandler).
+func patchPurposeProblem(op patchOp) []validationProblem {
+	if op.Op != "add" && op.Op != "replace" {
+		return nil
+	}
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if firmajson.DecodeJSON(op.Value, &value) != nil {
+		return nil
+	}
+	switch {
+	case len(tokens) == 0:
+		doc, _ := value.(map[string]interface{})
+		return reservedPurposeProblem(doc)
+	case len(tokens) == 1 && tokens[0] == "type":
+		return reservedPurposeProblem(map[string]interface{}{"type": value})
+	}
+	return nil
+}
+
+// signPatchHandler atiende POST /sign/patch
+func signPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	alias, ok := requestKeyAlias(w, r)
+	if !ok || !requireDPoP(w, r) || !authorizeSigning(w, r, alias) || !guardCaller(w, r) {
+		return
+	}
+	var req patchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	ctx := r.Context()
+
+	// El sobre anterior: el del cuerpo o el guardado, sólo del mismo tenant
+	prev := req.Envelope
+	if req.EnvelopeID != "" {
+		e, err := loadEnvelope(ctx, req.EnvelopeID)
+		if errors.Is(err, errNotFound) || err == nil && e.Tenant != requestTenant(r) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Sobre no encontrado")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		prev = &verifyRequest{
+			Signature:       e.Signature,
+			KeyVersion:      e.KeyVersion,
+			Escape:          e.Escape,
+			Digest:          e.Digest,
+			PayloadZ:        e.PayloadZ,
+			ContentEncoding: e.ContentEncoding,
+		}
+		if e.Payload != nil {
+			if prev.Payload, err = json.Marshal(e.Payload); err != nil {
+				writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+				return
+			}
+		}
+	}
+	prev.aad = requestAAD(r)
+	res, err := verifyEnvelope(ctx, prev)
+	if err != nil {
+		var f *verifyFailure
+		errors.As(err, &f)
+		writeError(w, f.status, f.code, "Sobre anterior: "+f.msg)
+		return
+	}
+	if !res.Valid {
+		msg := "El sobre anterior no verifica"
+		if res.Reason != "" {
+			msg += ": " + res.Reason
+		}
+		writeError(w, http.StatusUnprocessableEntity, errPreviousInvalid, msg)
+		return
+	}
+	doc, isObject := res.Obj.(map[string]interface{})
+	if !isObject {
+		writeError(w, http.StatusUnprocessableEntity, errPreviousInvalid, "El documento anterior no es un objeto JSON")
+		return
+	}
+	if _, encrypted := doc["encryption"]; encrypted {
+		writeError(w, http.StatusUnprocessableEntity, errPatchFailed, "Los documentos con campos cifrados no se pueden revisar")
+		return
+	}
+
+	// Revisión: número siguiente al del anterior
+	revision := 1
+	if link, ok := doc[revisionClaim].(map[string]interface{}); ok {
+		// DecodeJSON deja los enteros como float64
+		if n, ok := link["revision"].(float64); ok && n >= 1 && n == math.Trunc(n) {
+			revision = int(n) + 1
+		}
+	}
+	for _, f := range revisionInjected(r) {
+		delete(doc, f)
+	}
+	var ops []patchOp
+	var patch interface{}
+	if err := json.Unmarshal(req.Patch, &ops); err != nil || firmajson.DecodeJSON(req.Patch, &patch) != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "patch inválido")
+		return
+	}
+	patched, err := applyPatch(doc, ops)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, errPatchFailed, err.Error())
+		return
+	}
+	payloadMap, isObject := patched.(map[string]interface{})
+	if !isObject {
+		writeError(w, http.StatusUnprocessableEntity, errPatchFailed, "El documento parcheado debe ser un objeto JSON")
+		return
+	}
+	// Ni un documento del servicio se revisa como propio ni un parche le da
+	// su propósito a uno cualquiera
+	if problems := reservedPurposeProblem(payloadMap); problems != nil {
+		writeValidationProblems(w, problems)
+		return
+	}
+	sum := sha256.Sum256(res.Data)
+	link := map[string]interface{}{
+		"payload_sha256": hex.EncodeToString(sum[:]),
+		"patch":          patch,
+		"revision":       revision,
+	}
+	if res.Verification != nil && res.Verification.KeyVersion != "" {
+		link["key_version"] = res.Verification.KeyVersion
+	}
+	if req.EnvelopeID != "" {
+		link["envelope_id"] = req.EnvelopeID
+	}
+	payloadMap[revisionClaim] = link
+
+	data, f := signablePayload(r, alias, payloadMap, requestEscape(r))
+	if f != nil {
+		writeError(w, f.status, f.code, f.msg)
+		return
+	}
+	digest := requestDigest(r)
+	if len(data) > maxPayloadBytes() && digest == "" {
+		writeError(w, http.StatusBadRequest, errPayloadTooLarge, fmt.Sprintf("El documento parcheado ocupa %d bytes y el máximo es %d", len(data), maxPayloadBytes()))
+		return
+	}
+	signCtx := withKeyPriority(ctx, alias)
+	audit := newAuditEntry(r, "sign_patch", alias, data)
+	audit.Detail = fmt.Sprintf("revision=%d previous=%s", revision, link["payload_sha256"])
+	start := time.Now()
+	aad := requestAAD(r)
+	signature, err := kmsSign(signCtx, withAAD(withDigest(data, digest), aad))
+	if err != nil {
+		audit.Outcome, audit.Detail = "error", err.Error()
+		recordAudit(signCtx, audit)
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando: %v", err))
+		return
+	}
+	audit.Outcome = "ok"
+	recordAudit(signCtx, audit)
+	maybeShadowSign(withDigest(data, digest), time.Since(start))
+
+	resp := map[string]interface{}{
+		"payload":   payloadMap,
+		"signature": signature,
+		"revision":  revision,
+	}
+	addSignatureInfo(signCtx, resp, signature)
+	if aad != nil {
+		resp["aad"] = true
+	}
+	if digest != "" {
+		resp["digest"] = digest
+	}
+	escape := requestEscape(r)
+	if escape != "" && escape != escapeHTML {
+		resp["escape"] = escape
+	}
+	if envelopeStorageEnabled() {
+		id, err := storeEnvelope(signCtx, metaOf(r), alias, payloadMap, signature, escape, digest)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Firmado pero no guardado: %v", err))
+			return
+		}
+		resp["envelope_id"] = id
+	}
+	documentSigned(alias, resp, payloadMap, escape)
+	writeJSON(w, http.StatusOK, selectFields(r, resp))
+}
@@ -0,0 +1,32 @@
+// revisions_test.go
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Un parche no puede dar a un documento el type de los que firma el
+// servicio: ni poniéndolo ni copiándolo de otro campo
+func TestPatchReservedPurpose(t *testing.T) {
+	env := testSign(t, "?echo=true", map[string]interface{}{"pedido": "REV-1", "nota": purposeVerificationReport}, nil)
+	h := validated(validatePatchRequest, signPatchHandler)
+	tests := []struct {
+		name  string
+		patch []map[string]interface{}
+		want  int
+	}{
+		{"add /type", []map[string]interface{}{{"op": "add", "path": "/type", "value": purposeVerificationReport}}, http.StatusBadRequest},
+		{"documento entero", []map[string]interface{}{{"op": "replace", "path": "", "value": map[string]interface{}{"type": purposeHealthAttestation}}}, http.StatusBadRequest},
+		{"copy a /type", []map[string]interface{}{{"op": "copy", "from": "/nota", "path": "/type"}}, http.StatusBadRequest},
+		{"type propio", []map[string]interface{}{{"op": "add", "path": "/type", "value": "pedido"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := doJSON(t, h, http.MethodPost, "/sign/patch", map[string]interface{}{"envelope": env, "patch": tt.patch}, nil)
+			if code != tt.want {
+				t.Fatalf("%d %v", code, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// rotation.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Al rotar la versión de clave, los sobres firmados con versiones
+// anteriores tienen que seguir verificando. Cada sobre lleva su key_version
+// (el kid en JWS): /verify usa esa versión si es una de las aceptadas y, si
+// el sobre no la indica, prueba la actual y después las de
+// ACCEPTED_KEY_VERSIONS, en ese orden.
+//
+//	ACCEPTED_KEY_VERSIONS  versiones anteriores que siguen verificando,
+//	                       separadas por comas (nombres completos, como
+//	                       key_version)
+//
+// Las versiones propias de los alias de KEYS_FILE también se aceptan. Una
+// versión anterior con fecha de retirada en KEY_VERSION_NOT_AFTER deja de
+// aceptarse a partir de esa fecha (ver rotationfeed.go).
+
+// acceptedKeyVersions devuelve las versiones con las que se prueba un sobre
+// sin key_version: la actual primero
+func acceptedKeyVersions() []string {
+	out := []string{nameVersion}
+	for _, kv := range strings.Split(getEnv("ACCEPTED_KEY_VERSIONS", ""), ",") {
+		if kv = strings.TrimSpace(kv); kv != "" && kv != nameVersion && !keyVersionRetired(kv, time.Now()) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// acceptedKeyVersion indica si un sobre firmado con kv puede verificar
+func acceptedKeyVersion(kv string) bool {
+	if contains(acceptedKeyVersions(), kv) {
+		return true
+	}
+	for _, kc := range keyConfigs {
+		if kc.KeyVersion == kv {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	versionSignersMu sync.Mutex
+	versionSigners   = map[string]firmajson.Backend{}
+)
+
+// signerForKeyVersion devuelve el backend de una versión de clave aceptada
+func signerForKeyVersion(kv string) (firmajson.Backend, error) {
+	if kv == nameVersion {
+		return signer, nil
+	}
+	if !acceptedKeyVersion(kv) {
+		return nil, fmt.Errorf("versión de clave desconocida: %s", kv)
+	}
+	versionSignersMu.Lock()
+	defer versionSignersMu.Unlock()
+	if s, ok := versionSigners[kv]; ok {
+		return s, nil
+	}
+	s, err := backendForKeyVersion(kv)
+	if err != nil {
+		return nil, err
+	}
+	versionSigners[kv] = s
+	return s, nil
+}
+
+// verifyAcrossVersions verifica sig con la versión keyVersion o, si está
+// vacía, con cada versión aceptada hasta que una la dé por buena. Si alg no
+// está vacío sólo se prueban las versiones de ese algoritmo. reason explica
+// por qué no se pudo probar ninguna.
+func verifyAcrossVersions(ctx context.Context, keyVersion, alg string, data, sig []byte) (v kmsVerification, reason string, err error) {
+	candidates := acceptedKeyVersions()
+	if keyVersion != "" {
+		candidates = []string{keyVersion}
+	}
+	tried := 0
+	for _, kv := range candidates {
+		s, err := signerForKeyVersion(kv)
+		if err != nil {
+			return v, "", err
+		}
+		k, err := s.Key(ctx)
+		if err != nil {
+			return v, "", err
+		}
+		if alg != "" && alg != k.KMSAlgorithm {
+			if keyVersion != "" {
+				return v, fmt.Sprintf("alg %s no coincide con la clave (%s)", alg, k.KMSAlgorithm), nil
+			}
+			continue
+		}
+		tried++
+		if v, err = s.Verify(ctx, data, sig); err != nil {
+			return v, "", err
+		}
+		if v.IntegrityAnomaly != "" {
+			log.Printf("🚨 MacVerify con integridad incoherente (%s): %s", kv, v.IntegrityAnomaly)
+		}
+		if v.Valid {
+			return v, "", nil
+		}
+	}
+	if tried == 0 {
+		return v, fmt.Sprintf("Ninguna versión de clave aceptada es %s", alg), nil
+	}
+	return v, "", nil
+}
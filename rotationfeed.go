@@ -0,0 +1,145 @@
+// rotationfeed.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Feed de rotación para los consumidores que verifican por su cuenta (como
+// el de los secretos de webhook): /.well-known/firma-json/keys devuelve, en
+// orden de preferencia, las versiones de clave que ahora mismo verifican,
+// con su ventana de validez y, si la clave es asimétrica, la clave pública:
+//
+//	{"keys": [{"key_version": "...", "status": "current", "valid_from": "...",
+//	           "jwk": {...}}, ...], "refresh_after": 300}
+//
+// Para rotar sin que nadie se rompa: se añade la versión nueva a
+// ACCEPTED_KEY_VERSIONS, se espera a que los consumidores refresquen, se
+// cambia la clave de firma y la anterior pasa a ACCEPTED_KEY_VERSIONS con
+// fecha de retirada.
+//
+//	KEY_VERSION_NOT_BEFORE  desde cuándo vale cada versión: kv=RFC3339,
+//	                        separadas por comas (informativo)
+//	KEY_VERSION_NOT_AFTER   hasta cuándo vale cada versión anterior, con el
+//	                        mismo formato; pasada la fecha deja de aceptarse
+//	ROTATION_FEED_MAX_AGE   cada cuánto refrescar el feed (5m); se acorta
+//	                        si alguna versión se retira antes
+
+// rotationFeedKey es una versión de clave en el feed
+type rotationFeedKey struct {
+	KeyVersion   string     `json:"key_version"`
+	Status       string     `json:"status"`          // "current", "accepted" o "retiring"
+	Alias        string     `json:"alias,omitempty"` // versiones propias de KEYS_FILE
+	KMSAlgorithm string     `json:"kms_algorithm,omitempty"`
+	Alg          string     `json:"alg,omitempty"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	NotAfter     *time.Time `json:"not_after,omitempty"`
+	JWK          *jwk       `json:"jwk,omitempty"` // sólo asimétricas
+	Error        string     `json:"error,omitempty"`
+}
+
+// keyVersionTimes lee un KEY_VERSION_NOT_* (kv=RFC3339,...). Las entradas
+// mal formadas se ignoran.
+func keyVersionTimes(env string) map[string]time.Time {
+	out := map[string]time.Time{}
+	for _, entry := range strings.Split(getEnv(env, ""), ",") {
+		kv, at, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(at)); err == nil {
+			out[strings.TrimSpace(kv)] = t
+		}
+	}
+	return out
+}
+
+// keyVersionRetired indica si la versión kv ya pasó su KEY_VERSION_NOT_AFTER
+func keyVersionRetired(kv string, now time.Time) bool {
+	t, ok := keyVersionTimes("KEY_VERSION_NOT_AFTER")[kv]
+	return ok && !now.Before(t)
+}
+
+// rotationFeed compone el feed: la versión actual, las aceptadas y las de
+// los alias de KEYS_FILE, sin repetir. Una versión cuya clave no se puede
+// leer sale con error en vez de tumbar el feed.
+func rotationFeed(ctx context.Context, now time.Time) []rotationFeedKey {
+	notBefore := keyVersionTimes("KEY_VERSION_NOT_BEFORE")
+	notAfter := keyVersionTimes("KEY_VERSION_NOT_AFTER")
+	seen := map[string]bool{}
+	feed := []rotationFeedKey{}
+	add := func(kv, alias string) {
+		if kv == "" || seen[kv] {
+			return
+		}
+		seen[kv] = true
+		e := rotationFeedKey{KeyVersion: kv, Alias: alias, Status: "accepted"}
+		if kv == nameVersion {
+			e.Status = "current"
+		}
+		if t, ok := notBefore[kv]; ok {
+			e.ValidFrom = &t
+		}
+		if t, ok := notAfter[kv]; ok && kv != nameVersion {
+			e.NotAfter, e.Status = &t, "retiring"
+		}
+		s, err := signerForKeyVersion(kv)
+		if err == nil {
+			k, kerr := s.Key(ctx)
+			if err = kerr; err == nil {
+				e.KMSAlgorithm, e.Alg = k.KMSAlgorithm, jwsAlgForKey(k)
+				if k.Asymmetric() {
+					pub, perr := publicJWK(k)
+					if err = perr; err == nil {
+						e.JWK = &pub
+					}
+				}
+			}
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		feed = append(feed, e)
+	}
+	for _, kv := range acceptedKeyVersions() {
+		add(kv, "")
+	}
+	for _, alias := range configuredAliases() {
+		add(keyConfigs[alias].KeyVersion, alias)
+	}
+	return feed
+}
+
+// rotationFeedRefresh es cuánto puede cachearse el feed: ROTATION_FEED_MAX_AGE
+// o menos si alguna versión se retira antes
+func rotationFeedRefresh(feed []rotationFeedKey, now time.Time) time.Duration {
+	refresh := envDuration("ROTATION_FEED_MAX_AGE", 5*time.Minute)
+	for _, e := range feed {
+		if e.NotAfter != nil {
+			refresh = min(refresh, max(e.NotAfter.Sub(now), time.Second))
+		}
+	}
+	return refresh
+}
+
+// rotationFeedHandler atiende GET /.well-known/firma-json/keys
+func rotationFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	now := time.Now()
+	feed := rotationFeed(r.Context(), now)
+	refresh := int(math.Ceil(rotationFeedRefresh(feed, now).Seconds()))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", refresh))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys":          feed,
+		"generated_at":  now.UTC(),
+		"refresh_after": refresh,
+	})
+}
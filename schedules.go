@@ -0,0 +1,549 @@
+// schedules.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Firmas programadas: tareas recurrentes del tipo "firmar cada día a las
+// 06:00 el fichero de tipos de gs://bucket/rates/{date}.json", que
+// sustituyen al cron externo con curl. Se gestionan con la API de
+// administración:
+//
+//	GET    /admin/schedules              lista las tareas
+//	POST   /admin/schedules              crea una tarea
+//	GET    /admin/schedules/{id}         la tarea y sus últimas ejecuciones
+//	DELETE /admin/schedules/{id}         la borra
+//	POST   /admin/schedules/{id}/pause   deja de ejecutarla (y /resume)
+//	POST   /admin/schedules/{id}/run     la ejecuta ya, sin reintentos
+//
+// Una tarea lee el objeto JSON de source, le añade el timestamp y lo firma
+// con la clave key como /sign. El sobre se guarda con ENVELOPE_STORAGE, se
+// escribe en output si se indicó y se envía al webhook de callback. En
+// source y output, {date} es la fecha de la ejecución (AAAA-MM-DD, en la
+// zona de la tarea).
+//
+// Horario: "at": "06:00" (cada día, o sólo los de "weekdays": ["mon",
+// ...]) en "timezone" (UTC), o "every": "15m". Un fallo se reintenta hasta
+// max_attempts veces (3) esperando retry_delay (1m), el doble cada vez. Si
+// el servicio estaba parado a la hora de una ejecución, se hace una sola al
+// arrancar. Las franjas de firma de la clave (ver keys.go) también valen
+// aquí: una ejecución fuera de ellas falla, porque no hay quien presente
+// una aprobación.
+//
+// El planificador revisa las tareas cada SCHEDULER_TICK (30s). Con varias
+// réplicas y el mismo store, déjalo activo (SCHEDULER_ENABLED, true) en una
+// sola para no firmar dos veces.
+
+// schedulesCollection guarda las tareas
+const schedulesCollection = "schedules"
+
+// scheduleHistory es el número de ejecuciones que se guardan por tarea
+const scheduleHistory = 20
+
+type schedule struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Key         string        `json:"key"`
+	Source      string        `json:"source"`
+	Output      string        `json:"output,omitempty"`
+	Callback    string        `json:"callback,omitempty"`
+	At          string        `json:"at,omitempty"`
+	Weekdays    []string      `json:"weekdays,omitempty"`
+	Timezone    string        `json:"timezone,omitempty"`
+	Every       string        `json:"every,omitempty"`
+	Escape      string        `json:"escape,omitempty"`
+	MaxAttempts int           `json:"max_attempts,omitempty"`
+	RetryDelay  string        `json:"retry_delay,omitempty"`
+	Paused      bool          `json:"paused"`
+	CreatedAt   time.Time     `json:"created_at"`
+	CreatedBy   string        `json:"created_by"`
+	DueFor      time.Time     `json:"due_for"`  // ejecución en curso
+	NextRun     time.Time     `json:"next_run"` // próximo intento
+	Attempts    int           `json:"attempts"` // intentos fallidos de DueFor
+	LastError   string        `json:"last_error,omitempty"`
+	Runs        []scheduleRun `json:"runs,omitempty"` // la más reciente primero
+}
+
+// scheduleRun es el resultado de una ejecución
+type scheduleRun struct {
+	ScheduledFor  time.Time `json:"scheduled_for"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Status        string    `json:"status"` // "ok" o "failed"
+	Attempts      int       `json:"attempts"`
+	Manual        bool      `json:"manual,omitempty"`
+	Source        string    `json:"source"`
+	Generation    int64     `json:"generation,omitempty"`
+	PayloadSHA256 string    `json:"payload_sha256,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+	KeyVersion    string    `json:"key_version,omitempty"`
+	EnvelopeID    string    `json:"envelope_id,omitempty"`
+	Output        string    `json:"output,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// schedulesMu serializa las ejecuciones y los cambios de las tareas en esta
+// réplica
+var schedulesMu sync.Mutex
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// validate comprueba la tarea y rellena los valores por defecto
+func (s *schedule) validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("name es obligatorio")
+	case !strings.HasPrefix(s.Source, "gs://"):
+		return errors.New("source debe ser gs://bucket/objeto")
+	case s.Output != "" && !strings.HasPrefix(s.Output, "gs://"):
+		return errors.New("output debe ser gs://bucket/objeto")
+	case s.Callback != "" && !strings.HasPrefix(s.Callback, "https://"):
+		return errors.New("callback debe ser una URL https://")
+	case (s.At == "") == (s.Every == ""):
+		return errors.New("indica at o every, no ambos")
+	case s.Escape != "" && !validEscapeMode(s.Escape):
+		return errors.New("escape debe ser html, minimal, ascii o jcs")
+	case s.MaxAttempts < 0:
+		return errors.New("max_attempts no puede ser negativo")
+	}
+	if s.Escape == "" {
+		s.Escape = defaultCanonicalForm()
+	}
+	if s.Key == "" {
+		s.Key = defaultKeyAlias
+	}
+	if _, known := keyConfigs[s.Key]; !known && s.Key != defaultKeyAlias {
+		return fmt.Errorf("alias de clave desconocido: %q", s.Key)
+	}
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = 3
+	}
+	if s.RetryDelay == "" {
+		s.RetryDelay = "1m"
+	}
+	if d, err := time.ParseDuration(s.RetryDelay); err != nil || d <= 0 {
+		return errors.New("retry_delay debe ser una duración positiva")
+	}
+	if _, err := s.location(); err != nil {
+		return fmt.Errorf("timezone desconocida: %q", s.Timezone)
+	}
+	if s.Every != "" {
+		if d, err := time.ParseDuration(s.Every); err != nil || d < time.Minute {
+			return errors.New("every debe ser una duración de al menos 1m")
+		}
+		if len(s.Weekdays) > 0 {
+			return errors.New("weekdays sólo se admite con at")
+		}
+		return nil
+	}
+	if _, err := time.Parse("15:04", s.At); err != nil {
+		return errors.New("at debe ser HH:MM")
+	}
+	for _, d := range s.Weekdays {
+		if _, ok := scheduleWeekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("día desconocido en weekdays: %q", d)
+		}
+	}
+	return nil
+}
+
+func (s *schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// nextAfter devuelve la primera ejecución posterior a t
+func (s *schedule) nextAfter(t time.Time) time.Time {
+	loc, err := s.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	if s.Every != "" {
+		every, _ := time.ParseDuration(s.Every)
+		// Alineado con la creación para que no derive con los reinicios
+		n := t.Sub(s.CreatedAt)/every + 1
+		return s.CreatedAt.Add(n * every)
+	}
+	at, _ := time.Parse("15:04", s.At)
+	local := t.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		next := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+		if next.After(t) && s.runsOn(next.Weekday()) {
+			return next.UTC()
+		}
+	}
+	return time.Time{} // no se llega: validate exige días válidos
+}
+
+func (s *schedule) runsOn(d time.Weekday) bool {
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, w := range s.Weekdays {
+		if scheduleWeekdays[strings.ToLower(w)] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// expand sustituye {date} por la fecha de la ejecución
+func (s *schedule) expand(path string, at time.Time) string {
+	loc, err := s.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	return strings.ReplaceAll(path, "{date}", at.In(loc).Format("2006-01-02"))
+}
+
+func saveSchedule(ctx context.Context, s schedule) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return db.Put(ctx, schedulesCollection, s.ID, raw)
+}
+
+func loadSchedule(ctx context.Context, id string) (schedule, error) {
+	var s schedule
+	raw, err := db.Get(ctx, schedulesCollection, id)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(raw, &s)
+	return s, err
+}
+
+// startScheduler revisa las tareas cada SCHEDULER_TICK
+func startScheduler() {
+	if getEnv("SCHEDULER_ENABLED", "true") != "true" {
+		return
+	}
+	tick, _ := schedulerTick() // ya validado al arrancar
+	lifecycle.Go("scheduler", func(ctx context.Context) {
+		for {
+			if err := runDueSchedules(ctx, time.Now().UTC()); err != nil {
+				log.Printf("⚠️  Planificador: %v", err)
+			}
+			if !sleepCtx(ctx, tick) {
+				return
+			}
+		}
+	})
+}
+
+// schedulerTick lee SCHEDULER_TICK (30s, mayor que cero)
+func schedulerTick() (time.Duration, error) {
+	tick, err := time.ParseDuration(getEnv("SCHEDULER_TICK", "30s"))
+	if err != nil || tick <= 0 {
+		return 0, fmt.Errorf("SCHEDULER_TICK inválido: %q", getEnv("SCHEDULER_TICK", "30s"))
+	}
+	return tick, nil
+}
+
+// runDueSchedules ejecuta las tareas cuyo próximo intento ya ha llegado
+func runDueSchedules(ctx context.Context, now time.Time) error {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+	records, ids, err := db.List(ctx, schedulesCollection)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var s schedule
+		if err := json.Unmarshal(records[id], &s); err != nil || s.Paused || s.NextRun.After(now) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		run := executeSchedule(ctx, s, s.DueFor, false)
+		run.Attempts = s.Attempts + 1
+		if run.Status != "ok" && run.Attempts < s.MaxAttempts {
+			// Reintento de la misma ejecución, con espera exponencial
+			delay, _ := time.ParseDuration(s.RetryDelay)
+			s.Attempts, s.LastError = run.Attempts, run.Error
+			s.NextRun = time.Now().UTC().Add(delay << (run.Attempts - 1))
+			log.Printf("⚠️  Tarea %s (%s): intento %d/%d fallido: %s", s.ID, s.Name, run.Attempts, s.MaxAttempts, run.Error)
+		} else {
+			finishScheduleRun(&s, run)
+			s.DueFor = s.nextAfter(now)
+			s.NextRun = s.DueFor
+			if run.Status != "ok" {
+				log.Printf("⚠️  Tarea %s (%s) fallida tras %d intentos: %s", s.ID, s.Name, run.Attempts, run.Error)
+			}
+		}
+		if err := saveSchedule(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishScheduleRun anota la ejecución terminada y avisa al webhook
+func finishScheduleRun(s *schedule, run scheduleRun) {
+	s.Runs = append([]scheduleRun{run}, s.Runs...)
+	if len(s.Runs) > scheduleHistory {
+		s.Runs = s.Runs[:scheduleHistory]
+	}
+	s.Attempts, s.LastError = 0, run.Error
+	notifySchedule(*s, run)
+}
+
+// executeSchedule hace una ejecución: lee el documento, lo firma, lo guarda
+// y lo audita
+func executeSchedule(ctx context.Context, s schedule, dueFor time.Time, manual bool) (run scheduleRun) {
+	run = scheduleRun{ScheduledFor: dueFor, Manual: manual, Source: s.expand(s.Source, dueFor), Status: "failed"}
+	defer func() { run.FinishedAt = time.Now().UTC() }()
+	meta := requestMeta{Caller: "scheduler:" + s.ID}
+	audit := newAuditEntryFor(meta, "sign_scheduled", s.Key, nil)
+	audit.Detail = fmt.Sprintf("schedule=%s source=%s", s.ID, run.Source)
+	fail := func(err error) scheduleRun {
+		run.Error = err.Error()
+		audit.Outcome, audit.Detail = "error", audit.Detail+": "+err.Error()
+		recordAudit(ctx, audit)
+		return run
+	}
+
+	_, compromised := keyCompromised(ctx, s.Key)
+	if _, deleted := keyDeleted(ctx, s.Key); compromised || deleted {
+		return fail(errors.New("la clave ya no admite firmas"))
+	}
+	if !signingAllowedAt(s.Key, time.Now()) {
+		return fail(fmt.Errorf("la clave %q no permite firmar en este momento", s.Key))
+	}
+	raw, generation, err := readGCSObject(ctx, run.Source, int64(maxPayloadBytes()))
+	if err != nil {
+		return fail(err)
+	}
+	run.Generation = generation
+	var payload map[string]interface{}
+	if err := firmajson.DecodeJSON(raw, &payload); err != nil || payload == nil {
+		return fail(errors.New("el objeto no es un documento JSON"))
+	}
+	if _, exists := payload["timestamp"]; exists {
+		return fail(errors.New(`el campo "timestamp" está reservado`))
+	}
+	now, err := signingClock.Now()
+	if err != nil {
+		return fail(err)
+	}
+	payload["timestamp"] = now.Format(time.RFC3339Nano)
+	if src := signingClock.Name(); src != "system" {
+		payload[timeSourceClaim] = src
+	}
+	data, err := canonicalJSONEscaped(payload, s.Escape)
+	if err != nil {
+		return fail(err)
+	}
+	sum := sha256.Sum256(data)
+	audit.PayloadSHA256, audit.Bytes = hex.EncodeToString(sum[:]), len(data)
+	run.PayloadSHA256 = audit.PayloadSHA256
+
+	kctx := withKeyPriority(ctx, s.Key)
+	signature, err := kmsSign(kctx, data)
+	if err != nil {
+		return fail(fmt.Errorf("error firmando: %w", err))
+	}
+	run.Signature, run.KeyVersion = signature, aliasKeyVersion(s.Key)
+	if envelopeStorageEnabled() {
+		if run.EnvelopeID, err = storeEnvelope(kctx, meta, s.Key, payload, signature, s.Escape, ""); err != nil {
+			return fail(fmt.Errorf("firmado pero no guardado: %w", err))
+		}
+	}
+	if s.Output != "" {
+		env := map[string]interface{}{"payload": payload, "signature": signature, "key_version": run.KeyVersion}
+		if s.Escape != "" && s.Escape != escapeHTML {
+			env["escape"] = s.Escape
+		}
+		out, _ := json.Marshal(env)
+		run.Output = s.expand(s.Output, dueFor)
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(run.Output, "gs://"), "/")
+		if err := writeGCSObject(ctx, bucket, object, "application/json", out); err != nil {
+			return fail(fmt.Errorf("firmado pero no escrito en %s: %w", run.Output, err))
+		}
+	}
+	audit.Outcome = "ok"
+	recordAudit(ctx, audit)
+	run.Status = "ok"
+	return run
+}
+
+// readGCSObject lee gs://bucket/objeto, como mucho max bytes, y devuelve
+// también su generación
+func readGCSObject(ctx context.Context, uri string, max int64) ([]byte, int64, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !ok || bucket == "" || object == "" {
+		return nil, 0, fmt.Errorf("ruta de GCS inválida: %s", uri)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Close()
+	rd, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("leyendo %s: %w", uri, err)
+	}
+	defer rd.Close()
+	if rd.Attrs.Size > max {
+		return nil, 0, fmt.Errorf("%s ocupa %d bytes y el máximo es %d", uri, rd.Attrs.Size, max)
+	}
+	data, err := io.ReadAll(io.LimitReader(rd, max+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("leyendo %s: %w", uri, err)
+	}
+	return data, rd.Attrs.Generation, nil
+}
+
+// notifySchedule envía el resultado al webhook de la tarea, en segundo plano
+func notifySchedule(s schedule, run scheduleRun) {
+	if s.Callback == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{"schedule_id": s.ID, "name": s.Name, "run": run})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := postReceipt(ctx, s.Callback, body); err != nil {
+			log.Printf("⚠️  Webhook de la tarea %s no entregado: %v", s.ID, err)
+		}
+	}()
+}
+
+// schedulesHandler es la API de administración de las tareas
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schedules"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		p, ok := pageRequest(w, r)
+		if !ok {
+			return
+		}
+		records, ids, err := db.List(ctx, schedulesCollection)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		out, next := paginate(p, ids, func(id string) (s schedule, ok bool) {
+			if json.Unmarshal(records[id], &s) != nil {
+				return s, false
+			}
+			s.Runs = s.Runs[:min(len(s.Runs), 1)]
+			return s, true
+		})
+		writePage(w, "schedules", out, next)
+
+	case id == "" && r.Method == http.MethodPost:
+		var s schedule
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+			return
+		}
+		if err := s.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+			return
+		}
+		now := time.Now().UTC()
+		sid, err := timeOrderedID(now)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+			return
+		}
+		s.ID, s.CreatedAt, s.CreatedBy = sid, now, callerID(r)
+		s.DueFor = s.nextAfter(now)
+		s.NextRun, s.Attempts, s.LastError, s.Runs = s.DueFor, 0, "", nil
+		schedulesMu.Lock()
+		err = saveSchedule(ctx, s)
+		schedulesMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "schedule_created", fmt.Sprintf("%s %q source=%s key=%s", s.ID, s.Name, s.Source, s.Key))
+		writeJSON(w, http.StatusCreated, s)
+
+	case id != "":
+		schedulesMu.Lock()
+		defer schedulesMu.Unlock()
+		s, err := loadSchedule(ctx, id)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Tarea no encontrada")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, s)
+		case action == "" && r.Method == http.MethodDelete:
+			if err := db.Delete(ctx, schedulesCollection, id); err != nil {
+				writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+				return
+			}
+			recordAdminAudit(r, "schedule_deleted", id)
+			w.WriteHeader(http.StatusNoContent)
+		case (action == "pause" || action == "resume") && r.Method == http.MethodPost:
+			s.Paused = action == "pause"
+			if !s.Paused && s.NextRun.Before(time.Now()) {
+				// Al reanudar no se recuperan las ejecuciones perdidas
+				s.DueFor, s.Attempts = s.nextAfter(time.Now().UTC()), 0
+				s.NextRun = s.DueFor
+			}
+			if err := saveSchedule(ctx, s); err != nil {
+				writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+				return
+			}
+			recordAdminAudit(r, "schedule_"+action+"d", id)
+			writeJSON(w, http.StatusOK, s)
+		case action == "run" && r.Method == http.MethodPost:
+			run := executeSchedule(ctx, s, time.Now().UTC(), true)
+			run.Attempts = 1
+			s.Runs = append([]scheduleRun{run}, s.Runs...)
+			if len(s.Runs) > scheduleHistory {
+				s.Runs = s.Runs[:scheduleHistory]
+			}
+			notifySchedule(s, run)
+			if err := saveSchedule(ctx, s); err != nil {
+				writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+				return
+			}
+			recordAdminAudit(r, "schedule_run", fmt.Sprintf("%s %s", id, run.Status))
+			writeJSON(w, http.StatusOK, run)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método o acción no permitidos")
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	}
+}
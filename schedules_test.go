@@ -0,0 +1,22 @@
+// schedules_test.go
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Una tarea no firma fuera de las franjas de su clave, ni siquiera a mano:
+// falla antes de leer el objeto
+func TestScheduleSigningWindow(t *testing.T) {
+	keyConfigs["cerrada"] = keyConfig{Windows: []signingWindow{{From: "00:00", To: "00:00"}}}
+	t.Cleanup(func() { delete(keyConfigs, "cerrada") })
+
+	s := schedule{ID: "s1", Key: "cerrada", Source: "gs://bucket/{date}.json"}
+	run := executeSchedule(context.Background(), s, time.Now(), true)
+	if run.Status != "failed" || !strings.Contains(run.Error, "no permite firmar") {
+		t.Fatalf("ejecución fuera de franja: %+v", run)
+	}
+}
@@ -0,0 +1,139 @@
+// shadow.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// La firma en sombra repite con la clave candidata (SHADOW_KEY_VERSION, una
+// CryptoKeyVersion completa, MAC o asimétrica) un SHADOW_PERCENT de las
+// firmas reales. El resultado sólo se registra, nunca se devuelve al
+// cliente: sirve para medir latencia y comprobar que la nueva clave firma y
+// verifica bien antes de migrar.
+
+type shadowStats struct {
+	Key          string  `json:"key"`
+	Algorithm    string  `json:"algorithm,omitempty"`
+	Percent      float64 `json:"percent"`
+	Samples      int     `json:"samples"`
+	Errors       int     `json:"errors"`
+	Invalid      int     `json:"invalid"`
+	AvgPrimaryMs float64 `json:"avg_primary_ms"`
+	AvgShadowMs  float64 `json:"avg_shadow_ms"`
+}
+
+var (
+	shadowMu      sync.Mutex
+	shadowSigner  *firmajson.KMS
+	shadowCounts  shadowStats
+	shadowPrimary time.Duration
+	shadowLatency time.Duration
+)
+
+// shadowPercent es el porcentaje de firmas que se repiten en sombra
+func shadowPercent() float64 {
+	p, err := strconv.ParseFloat(getEnv("SHADOW_PERCENT", "0"), 64)
+	if err != nil || p < 0 {
+		return 0
+	}
+	return p
+}
+
+// maybeShadowSign lanza, según SHADOW_PERCENT, la firma en sombra de los
+// mismos bytes canónicos. primary es lo que tardó la firma real.
+func maybeShadowSign(data []byte, primary time.Duration) {
+	if getEnv("SHADOW_KEY_VERSION", "") == "" || rand.Float64()*100 >= shadowPercent() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		valid, err := shadowSign(ctx, data)
+		elapsed := time.Since(start)
+
+		shadowMu.Lock()
+		shadowCounts.Samples++
+		shadowPrimary += primary
+		shadowLatency += elapsed
+		switch {
+		case err != nil:
+			shadowCounts.Errors++
+		case !valid:
+			shadowCounts.Invalid++
+		}
+		shadowMu.Unlock()
+
+		switch {
+		case err != nil:
+			log.Printf("⚠️  Firma en sombra: %v (%s)", err, elapsed)
+		case !valid:
+			log.Printf("⚠️  Firma en sombra no verifica (%s)", elapsed)
+		}
+	}()
+}
+
+// shadowSign firma con la clave candidata y verifica el resultado
+func shadowSign(ctx context.Context, data []byte) (bool, error) {
+	s, err := loadShadowSigner(ctx)
+	if err != nil {
+		return false, err
+	}
+	sig, err := s.Sign(ctx, data)
+	if err != nil {
+		return false, err
+	}
+	v, err := s.Verify(ctx, data, sig)
+	return v.Valid, err
+}
+
+func loadShadowSigner(ctx context.Context) (*firmajson.KMS, error) {
+	shadowMu.Lock()
+	defer shadowMu.Unlock()
+	name := getEnv("SHADOW_KEY_VERSION", "")
+	if kmsClient == nil {
+		return nil, errors.New("la firma en sombra necesita SIGNER_BACKEND=gcp-kms")
+	}
+	if shadowSigner != nil && shadowSigner.KeyVersion() == name {
+		return shadowSigner, nil
+	}
+	s := firmajson.NewKMS(kmsClient, name)
+	k, err := s.Key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shadowSigner = s
+	shadowCounts.Algorithm = k.KMSAlgorithm
+	return s, nil
+}
+
+// shadowHandler devuelve las estadísticas de la firma en sombra
+// (GET /admin/shadow)
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	shadowMu.Lock()
+	stats := shadowCounts
+	if stats.Samples > 0 {
+		stats.AvgPrimaryMs = float64(shadowPrimary) / float64(time.Millisecond) / float64(stats.Samples)
+		stats.AvgShadowMs = float64(shadowLatency) / float64(time.Millisecond) / float64(stats.Samples)
+	}
+	shadowMu.Unlock()
+	stats.Key = getEnv("SHADOW_KEY_VERSION", "")
+	stats.Percent = shadowPercent()
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,82 @@
+// shutdown.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Tiempos del servidor HTTP y parada ordenada. Con SIGTERM (Cloud Run lo
+// manda diez segundos antes de matar la instancia) el listener deja de
+// aceptar conexiones, /healthz pasa a responder 503 "draining" y se espera
+// a que terminen las peticiones en curso, como mucho HTTP_DRAIN_TIMEOUT
+// (8s); sólo entonces se paran los workers y, de lo último, se cierra el
+// cliente de KMS, para que ninguna firma en vuelo se quede sin él.
+//
+//	HTTP_READ_HEADER_TIMEOUT  10s   leer las cabeceras
+//	HTTP_READ_TIMEOUT         30s   leer la petición entera
+//	HTTP_WRITE_TIMEOUT        60s   desde el fin de las cabeceras hasta
+//	                                escribir la respuesta
+//	HTTP_IDLE_TIMEOUT         120s  keep-alive sin peticiones
+//	SHUTDOWN_DRAIN_DELAY      0s    espera antes de cerrar el listener, para
+//	                                que el balanceador vea el 503 de /healthz
+
+var (
+	// draining se activa al empezar la parada
+	draining atomic.Bool
+	// inFlight cuenta las peticiones en curso
+	inFlight atomic.Int64
+)
+
+// configureServerTimeouts aplica los tiempos de HTTP_*_TIMEOUT
+func configureServerTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	srv.ReadTimeout = envDuration("HTTP_READ_TIMEOUT", 30*time.Second)
+	srv.WriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second)
+	srv.IdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second)
+}
+
+// inFlightMiddleware cuenta las peticiones en curso, para saber en la
+// parada cuántas se esperan o se cortan
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drainHTTPServer es la parada del listener: deja de aceptar conexiones y
+// espera a las peticiones en curso. Si no terminan a tiempo las corta.
+func drainHTTPServer(srv *http.Server) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		draining.Store(true)
+		if delay := envDuration("SHUTDOWN_DRAIN_DELAY", 0); delay > 0 {
+			sleepCtx(ctx, delay)
+		}
+		ctx, cancel := context.WithTimeout(ctx, envDuration("HTTP_DRAIN_TIMEOUT", 8*time.Second))
+		defer cancel()
+		if n := inFlight.Load(); n > 0 {
+			log.Printf("Esperando a %d peticiones en curso …", n)
+		}
+		err := srv.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("⚠️  Se cortan %d peticiones que no terminaron a tiempo", inFlight.Load())
+			srv.Close()
+		}
+		return err
+	}
+}
+
+// closeKMS cierra el cliente de KMS. Se registra antes que los workers que
+// lo usan, así que se cierra después de ellos.
+func closeKMS(context.Context) error {
+	if kmsClient == nil {
+		return nil
+	}
+	return kmsClient.Close()
+}
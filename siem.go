@@ -0,0 +1,245 @@
+// siem.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// auditSink recibe cada entrada de auditoría además del store. Emit no debe
+// bloquear nunca la petición que la origina.
+type auditSink interface {
+	Emit(e auditEntry)
+}
+
+var auditSinks []auditSink
+
+// startSIEMSink activa el envío a SIEM si SIEM_ADDR está definido. Los
+// eventos se encolan (SIEM_QUEUE_SIZE) y un goroutine los envía por lotes
+// como syslog RFC 5424 sobre TCP (framing por longitud) o UDP. Si la cola
+// se llena, los eventos se descartan y se cuentan en vez de frenar las
+// firmas.
+func startSIEMSink() error {
+	addr := getEnv("SIEM_ADDR", "")
+	if addr == "" {
+		return nil
+	}
+	format := getEnv("SIEM_FORMAT", "cef")
+	if format != "cef" && format != "json" {
+		return fmt.Errorf("SIEM_FORMAT desconocido: %q", format)
+	}
+	network := getEnv("SIEM_PROTOCOL", "tcp")
+	if network != "tcp" && network != "udp" {
+		return fmt.Errorf("SIEM_PROTOCOL desconocido: %q", network)
+	}
+	size, err := strconv.Atoi(getEnv("SIEM_QUEUE_SIZE", "10000"))
+	if err != nil || size < 1 {
+		return fmt.Errorf("SIEM_QUEUE_SIZE inválido")
+	}
+	s := &siemSink{
+		addr:    addr,
+		network: network,
+		format:  format,
+		queue:   make(chan auditEntry, size),
+	}
+	s.hostname, _ = os.Hostname()
+	auditSinks = append(auditSinks, s)
+	lifecycle.Go("siem", s.run)
+	return nil
+}
+
+type siemSink struct {
+	addr     string
+	network  string
+	format   string
+	hostname string
+	queue    chan auditEntry
+	dropped  atomic.Int64
+}
+
+func (s *siemSink) Emit(e auditEntry) {
+	select {
+	case s.queue <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run agrupa hasta 100 eventos o lo que llegue en un segundo y los envía,
+// reconectando con espera exponencial si el SIEM no está disponible
+func (s *siemSink) run(ctx context.Context) {
+	var conn net.Conn
+	var batch []auditEntry
+	backoff := time.Second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(conn, batch)
+			return
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < 100 {
+				continue
+			}
+		case <-ticker.C:
+			if n := s.dropped.Swap(0); n > 0 {
+				log.Printf("⚠️  SIEM: %d eventos descartados por cola llena", n)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		for {
+			var err error
+			if conn == nil {
+				conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second)
+			}
+			if err == nil {
+				err = s.send(conn, batch)
+			}
+			if err == nil {
+				batch = batch[:0]
+				backoff = time.Second
+				break
+			}
+			log.Printf("⚠️  SIEM: %v (reintento en %s)", err, backoff)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			if !sleepCtx(ctx, backoff) {
+				s.flush(nil, batch)
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// flush hace un último envío, sin reintentos, de batch y de lo que quede en
+// la cola al pararse el servicio
+func (s *siemSink) flush(conn net.Conn, batch []auditEntry) {
+	for len(s.queue) > 0 {
+		batch = append(batch, <-s.queue)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	var err error
+	if conn == nil {
+		if conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second); err == nil {
+			defer conn.Close()
+		}
+	}
+	if err == nil {
+		err = s.send(conn, batch)
+	}
+	if err != nil {
+		log.Printf("⚠️  SIEM: %d eventos sin enviar al parar: %v", len(batch), err)
+	}
+}
+
+func (s *siemSink) send(conn net.Conn, batch []auditEntry) error {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	w := bufio.NewWriter(conn)
+	for _, e := range batch {
+		msg := s.syslogMessage(e)
+		if s.network == "tcp" {
+			// RFC 6587: octet counting
+			fmt.Fprintf(w, "%d %s", len(msg), msg)
+		} else {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			w.WriteString(msg)
+		}
+	}
+	return w.Flush()
+}
+
+// syslogMessage construye el mensaje RFC 5424 con el evento en CEF o JSON
+func (s *siemSink) syslogMessage(e auditEntry) string {
+	// facility 13 (log audit); severidad 4 (warning) para errores, 6 (info) si no
+	severity := 6
+	if e.Outcome != "ok" {
+		severity = 4
+	}
+	var body string
+	if s.format == "json" {
+		raw, _ := json.Marshal(e)
+		body = string(raw)
+	} else {
+		body = cefEvent(e)
+	}
+	return fmt.Sprintf("<%d>1 %s %s firma-json - %s - %s",
+		13*8+severity, e.Time.UTC().Format(time.RFC3339Nano), nilDash(s.hostname), nilDash(e.Event), body)
+}
+
+// cefEvent formatea la entrada en ArcSight CEF
+func cefEvent(e auditEntry) string {
+	severity := 3
+	switch e.Outcome {
+	case "invalid":
+		severity = 6
+	case "error":
+		severity = 5
+	}
+	if strings.HasPrefix(e.Event, "admin.") {
+		severity = 7
+	}
+	ext := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixMilli(), 10),
+		"outcome=" + cefExt(e.Outcome),
+		"externalId=" + cefExt(e.ID),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExt(value))
+		}
+	}
+	add("cs1Label", "tenant")
+	add("cs1", e.Tenant)
+	add("cs2Label", "doc_type")
+	add("cs2", e.DocType)
+	add("cs3Label", "key")
+	add("cs3", e.Key)
+	add("fileHash", e.PayloadSHA256)
+	add("msg", e.Detail)
+	return fmt.Sprintf("CEF:0|firma-json|firma-json|1.0|%s|%s|%d|%s",
+		cefHeader(e.Event), cefHeader(e.Event+" "+e.Outcome), severity, strings.Join(ext, " "))
+}
+
+func cefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`).Replace(s)
+}
+
+func cefExt(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+func nilDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
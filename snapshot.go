@@ -0,0 +1,204 @@
+// snapshot.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// configSnapshot es una instantánea firmada de la configuración efectiva.
+// Tiene la misma forma que la respuesta de /sign, así que un auditor puede
+// comprobarla directamente con /verify; se firma con el prefijo de su
+// propósito (ver purpose.go), así que no se puede obtener una desde /sign.
+type configSnapshot struct {
+	Payload   map[string]interface{} `json:"payload"`
+	Signature string                 `json:"signature"`
+}
+
+// snapshotCollection guarda el histórico de instantáneas, con id
+// ordenable por fecha (ver snapshotID). Va en el store y no en memoria para
+// que el histórico sobreviva a los reinicios y lo vean todas las réplicas.
+const snapshotCollection = "config_snapshots"
+
+// snapshotID es el id de la instantánea tomada en t: de ancho fijo, para
+// que List las devuelva en orden
+func snapshotID(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000Z")
+}
+
+// effectiveConfig describe la configuración que está en vigor ahora mismo
+// (claves, políticas y cuotas). Todo lo que influya en cómo se firma un
+// documento debe aparecer aquí.
+func effectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"keys": map[string]interface{}{
+			"default":    nameVersion,
+			"encryption": encryptionKeyName(),
+		},
+		"policies": map[string]interface{}{
+			"issuer":          issuerID(),
+			"trusted_issuers": trustedIssuers,
+			"keys":            keyConfigs,
+			"residency":       residency,
+			"redaction":       redaction,
+		},
+		"quotas": map[string]interface{}{
+			"kms_pacer": []interface{}{
+				pacerQuota(priorityInteractive),
+				pacerQuota(priorityBatch),
+			},
+			"kms_pool": map[string]interface{}{
+				"grpc_pool_size":         envInt("KMS_GRPC_POOL_SIZE", 0),
+				"max_concurrent_streams": envInt("KMS_MAX_CONCURRENT_STREAMS", 0),
+			},
+		},
+	}
+}
+
+// pacerQuota describe la cuota en vigor del pacer de class (la de
+// /admin/kms/pacer, que puede haber cambiado en caliente) y su límite de
+// llamadas en vuelo (0 = sin límite)
+func pacerQuota(class string) map[string]interface{} {
+	p := pacers[class]
+	s := p.settings(class)
+	return map[string]interface{}{
+		"class":       s.Class,
+		"qpm":         s.QPM,
+		"burst":       s.Burst,
+		"max_wait":    s.MaxWait,
+		"concurrency": cap(p.slots),
+	}
+}
+
+// startConfigSnapshots firma una instantánea al arrancar y después cada
+// CONFIG_SNAPSHOT_INTERVAL (0 desactiva las instantáneas periódicas)
+func startConfigSnapshots() {
+	interval, _ := snapshotInterval() // ya validado al arrancar
+	if interval <= 0 {
+		return
+	}
+	lifecycle.Go("config-snapshots", func(ctx context.Context) {
+		for {
+			if err := takeConfigSnapshot(ctx); err != nil {
+				log.Printf("⚠️  No se pudo firmar la instantánea de configuración: %v", err)
+			}
+			if !sleepCtx(ctx, interval) {
+				return
+			}
+		}
+	})
+}
+
+// snapshotInterval lee CONFIG_SNAPSHOT_INTERVAL (1h)
+func snapshotInterval() (time.Duration, error) {
+	interval, err := time.ParseDuration(getEnv("CONFIG_SNAPSHOT_INTERVAL", "1h"))
+	if err != nil {
+		return 0, fmt.Errorf("CONFIG_SNAPSHOT_INTERVAL inválido: %v", err)
+	}
+	return interval, nil
+}
+
+// takeConfigSnapshot firma la configuración efectiva y la guarda en el
+// histórico (limitado a CONFIG_SNAPSHOT_HISTORY entradas)
+func takeConfigSnapshot(ctx context.Context) error {
+	// Se pasa antes por JSON para que la forma canónica sea la que
+	// reconstruye /verify (las políticas son structs)
+	now := time.Now().UTC()
+	normalized, err := deepCopyJSON(map[string]interface{}{
+		"type":      purposeConfigSnapshot,
+		"config":    effectiveConfig(),
+		"timestamp": now.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	payload := normalized.(map[string]interface{})
+	data, err := canonicalJSON(payload)
+	if err != nil {
+		return err
+	}
+	signature, err := kmsSign(ctx, withPurpose(data, purposeConfigSnapshot))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(configSnapshot{Payload: payload, Signature: signature})
+	if err != nil {
+		return err
+	}
+	if err := db.Put(ctx, snapshotCollection, snapshotID(now), raw); err != nil {
+		return err
+	}
+
+	limit, err := strconv.Atoi(getEnv("CONFIG_SNAPSHOT_HISTORY", "168"))
+	if err != nil || limit < 1 {
+		limit = 1
+	}
+	_, ids, err := db.List(ctx, snapshotCollection)
+	if err != nil {
+		return err
+	}
+	for len(ids) > limit {
+		if err := db.Delete(ctx, snapshotCollection, ids[0]); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// loadConfigSnapshots devuelve el histórico, de la más antigua a la más
+// reciente
+func loadConfigSnapshots(ctx context.Context) ([]configSnapshot, error) {
+	records, ids, err := db.List(ctx, snapshotCollection)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]configSnapshot, 0, len(ids))
+	for _, id := range ids {
+		var s configSnapshot
+		if err := json.Unmarshal(records[id], &s); err != nil {
+			return nil, fmt.Errorf("instantánea %s ilegible: %v", id, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// configSnapshotHandler devuelve la última instantánea firmada
+func configSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	snapshots, err := loadConfigSnapshots(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	if len(snapshots) == 0 {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Todavía no hay instantáneas de configuración")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots[len(snapshots)-1])
+}
+
+// configSnapshotsHandler devuelve el histórico de instantáneas, de la más
+// antigua a la más reciente, para saber qué política regía en cada momento
+func configSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	snapshots, err := loadConfigSnapshots(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": snapshots})
+}
@@ -0,0 +1,39 @@
+// snapshot_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// Las instantáneas van al store, con las cuotas de KMS en vigor, y el
+// histórico no pasa de CONFIG_SNAPSHOT_HISTORY
+func TestConfigSnapshots(t *testing.T) {
+	t.Setenv("CONFIG_SNAPSHOT_HISTORY", "2")
+	p := pacers[priorityBatch]
+	qpm, burst, maxWait := p.qpm, p.burst, p.maxWait
+	p.configure(600, 5, maxWait)
+	t.Cleanup(func() { p.configure(qpm, burst, maxWait) })
+	for i := 0; i < 3; i++ {
+		if err := takeConfigSnapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ids, err := db.List(context.Background(), snapshotCollection); err != nil || len(ids) != 2 {
+		t.Fatalf("histórico: %v %v", ids, err)
+	}
+
+	code, last := doJSON(t, configSnapshotHandler, http.MethodGet, "/config/snapshot", nil, nil)
+	if code != http.StatusOK {
+		t.Fatalf("/config/snapshot: %d %v", code, last)
+	}
+	config := last["payload"].(map[string]interface{})["config"].(map[string]interface{})
+	pacer := config["quotas"].(map[string]interface{})["kms_pacer"].([]interface{})[1].(map[string]interface{})
+	if pacer["class"] != priorityBatch || pacer["qpm"] != 600.0 {
+		t.Fatalf("cuota de lotes: %v", pacer)
+	}
+	if v := testVerify(t, last, nil); v["valid"] != true {
+		t.Fatalf("la instantánea no verifica: %v", v)
+	}
+}
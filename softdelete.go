@@ -0,0 +1,166 @@
+// softdelete.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deletedKeysCollection guarda los alias borrados. Un alias borrado queda
+// en modo sólo verificación durante KEY_SOFT_DELETE_PERIOD (30 días por
+// defecto) y se puede restaurar en ese plazo; pasado el plazo ya no
+// verifica. Así un borrado accidental no rompe al instante la verificación
+// de los documentos recientes.
+const deletedKeysCollection = "deleted_keys"
+
+type deletedKey struct {
+	Key       string    `json:"key"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// keyDeleted devuelve la marca de borrado del alias, si la hay
+func keyDeleted(ctx context.Context, alias string) (deletedKey, bool) {
+	var d deletedKey
+	raw, err := db.Get(ctx, deletedKeysCollection, alias)
+	if err != nil {
+		return d, false
+	}
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return deletedKey{Key: alias}, true
+	}
+	return d, true
+}
+
+// keyPurged indica si el alias está borrado y ya pasó su periodo de gracia
+func keyPurged(ctx context.Context, alias string, now time.Time) bool {
+	d, deleted := keyDeleted(ctx, alias)
+	return deleted && !now.Before(d.PurgeAt)
+}
+
+// knownKeyAlias indica si el alias existe en la configuración
+func knownKeyAlias(alias string) bool {
+	_, ok := keyConfigs[alias]
+	return ok || alias == defaultKeyAlias
+}
+
+// keyStatus es el estado de un alias: active, verify_only (borrado, aún
+// verifica) o deleted, y si está comprometido
+func keyStatus(ctx context.Context, alias string) map[string]interface{} {
+	status := map[string]interface{}{"key": alias, "state": "active", "key_version": aliasKeyVersion(alias)}
+	if d, deleted := keyDeleted(ctx, alias); deleted {
+		status["state"] = "deleted"
+		if time.Now().Before(d.PurgeAt) {
+			status["state"] = "verify_only"
+		}
+		status["deleted_at"], status["purge_at"] = d.DeletedAt, d.PurgeAt
+	}
+	if _, compromised := keyCompromised(ctx, alias); compromised {
+		status["compromised"] = true
+	}
+	return status
+}
+
+// keysListHandler (GET /admin/keys) lista los alias configurados con su
+// estado, paginado (ver pagination.go). Los señuelos (HONEYTOKEN_KEYS) no
+// aparecen.
+func keysListHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	p, ok := pageRequest(w, r)
+	if !ok {
+		return
+	}
+	aliases := []string{defaultKeyAlias}
+	for alias := range keyConfigs {
+		if alias != defaultKeyAlias && !isHoneytoken(alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	ctx := r.Context()
+	keys, next := paginate(p, aliases, func(alias string) (map[string]interface{}, bool) {
+		return keyStatus(ctx, alias), true
+	})
+	writePage(w, "keys", keys, next)
+}
+
+// keysAdminHandler atiende /admin/keys/{alias}[/accion]:
+//
+//	GET    /admin/keys/{alias}            estado del alias
+//	DELETE /admin/keys/{alias}            borrado reversible
+//	POST   /admin/keys/{alias}/restore    deshace el borrado
+//	POST|DELETE /admin/keys/{alias}/compromise  ver breakglass.go
+func keysAdminHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+	alias, action, _ := strings.Cut(rest, "/")
+	switch action {
+	case "compromise":
+		keyCompromiseHandler(w, r)
+		return
+	case "restore", "":
+	default:
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Ruta desconocida")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !knownKeyAlias(alias) {
+		writeError(w, http.StatusNotFound, errUnknownKey, "Clave desconocida")
+		return
+	}
+	ctx := r.Context()
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, keyStatus(ctx, alias))
+
+	case action == "" && r.Method == http.MethodDelete:
+		period, err := time.ParseDuration(getEnv("KEY_SOFT_DELETE_PERIOD", "720h"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errInternal, "KEY_SOFT_DELETE_PERIOD inválido")
+			return
+		}
+		if _, deleted := keyDeleted(ctx, alias); deleted {
+			writeError(w, http.StatusConflict, errInvalidRequest, "La clave ya está borrada")
+			return
+		}
+		now := time.Now().UTC()
+		d := deletedKey{Key: alias, DeletedAt: now, PurgeAt: now.Add(period)}
+		raw, _ := json.Marshal(d)
+		if err := db.Put(ctx, deletedKeysCollection, alias, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "key_deleted", fmt.Sprintf("%s purge_at=%s", alias, d.PurgeAt.Format(time.RFC3339)))
+		writeJSON(w, http.StatusOK, d)
+
+	case action == "restore" && r.Method == http.MethodPost:
+		err := db.Delete(ctx, deletedKeysCollection, alias)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "La clave no está borrada")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		recordAdminAudit(r, "key_restored_from_delete", alias)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Método no permitido")
+	}
+}
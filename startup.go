@@ -0,0 +1,213 @@
+// startup.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// El cliente de KMS se crea en una fase de arranque explícita y con
+// reintentos, no en init(): un fallo pasajero de las credenciales (ADC) al
+// arrancar ya no tumba el proceso antes de poder ver qué pasa. Los intentos
+// van en segundo plano, así que el listener abre enseguida y /healthz
+// informa del estado mientras tanto.
+//
+//	KMS_INIT_ATTEMPTS        intentos antes de pasar a modo degradado (5)
+//	KMS_INIT_BACKOFF         espera inicial entre intentos, se duplica (1s)
+//	KMS_INIT_RETRY_INTERVAL  reintento en segundo plano en modo degradado (30s)
+//	KMS_INIT_REQUIRED        true: salir con exitKMS en vez de degradar
+//
+// En modo degradado el servicio sólo atiende /healthz, /version y /errors;
+// el resto responde 503 KMS_UNAVAILABLE hasta que KMS está listo. Las
+// tareas de fondo que firman se arrancan en ese momento (onKMSReady).
+
+// Códigos de salida del proceso, para distinguir la causa desde el
+// orquestador sin leer los logs
+const (
+	exitConfig = 2 // configuración inválida
+	exitKMS    = 3 // KMS no disponible con KMS_INIT_REQUIRED=true
+	exitStore  = 4 // el store no abre
+)
+
+// exitWith registra el motivo y termina con el código indicado
+func exitWith(code int, format string, args ...interface{}) {
+	log.Printf("❌ "+format, args...)
+	os.Exit(code)
+}
+
+var (
+	kmsReady atomic.Bool
+
+	kmsStateMu       sync.Mutex
+	kmsLastErr       error
+	kmsAttempts      int
+	kmsReadyHooks    []func()
+	kmsReadySince    time.Time
+	kmsRetryInterval = 30 * time.Second
+)
+
+// configureKMSNames construye los nombres de la clave de firma a partir del
+// entorno. Es configuración: si falta algo no tiene sentido reintentar.
+func configureKMSNames() {
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		exitWith(exitConfig, "GOOGLE_CLOUD_PROJECT no está definido")
+	}
+	kmsLocation = getEnv("KMS_LOCATION", "global")
+	keyRingID := getEnv("KMS_KEY_RING", "EzeKeyRing")
+	keyID := getEnv("KMS_KEY", "EzeKey")
+	keyVersionID := getEnv("KMS_KEY_VERSION", "1")
+
+	keyRingName = fmt.Sprintf("projects/%s/locations/%s/keyRings/%s", projectID, kmsLocation, keyRingID)
+	nameVersion = fmt.Sprintf("%s/cryptoKeys/%s/cryptoKeyVersions/%s", keyRingName, keyID, keyVersionID)
+}
+
+// validateConfig comprueba la configuración que leen las tareas de fondo.
+// Algunas sólo arrancan cuando KMS está listo; un valor inválido tiene que
+// salir con exitConfig al arrancar, no tumbar el proceso horas después.
+func validateConfig() error {
+	checks := []func() error{
+		func() error { _, err := kmsKeepalive(); return err },
+		func() error { _, err := snapshotInterval(); return err },
+		func() error { _, _, err := retimestampConfig(); return err },
+		func() error { _, err := deferRetryInterval(); return err },
+		func() error { _, err := auditCompactInterval(); return err },
+		func() error { _, err := schedulerTick(); return err },
+		func() error { _, err := retentionInterval(); return err },
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startKMS intenta inicializar KMS KMS_INIT_ATTEMPTS veces en segundo
+// plano. Si no lo consigue sale con exitKMS (KMS_INIT_REQUIRED=true) o
+// sigue en modo degradado reintentando cada KMS_INIT_RETRY_INTERVAL.
+func startKMS() {
+	attempts := envInt("KMS_INIT_ATTEMPTS", 5)
+	backoff, err := time.ParseDuration(getEnv("KMS_INIT_BACKOFF", "1s"))
+	if err != nil {
+		exitWith(exitConfig, "KMS_INIT_BACKOFF inválido: %v", err)
+	}
+	retry, err := time.ParseDuration(getEnv("KMS_INIT_RETRY_INTERVAL", "30s"))
+	if err != nil || retry <= 0 {
+		exitWith(exitConfig, "KMS_INIT_RETRY_INTERVAL inválido: %q", getEnv("KMS_INIT_RETRY_INTERVAL", "30s"))
+	}
+	kmsRetryInterval = retry
+	if err := lifecycle.Register("kms", nil, closeKMS); err != nil {
+		exitWith(exitConfig, "KMS: %v", err)
+	}
+
+	required := getEnv("KMS_INIT_REQUIRED", "false") == "true"
+
+	lifecycle.Go("kms-init", func(ctx context.Context) {
+		var err error
+		for i := 0; i < attempts; i++ {
+			if err = initKMS(); err == nil {
+				return
+			}
+			log.Printf("⚠️  KMS no disponible (intento %d/%d): %v", i+1, attempts, err)
+			if i < attempts-1 {
+				if !sleepCtx(ctx, backoff) {
+					return
+				}
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+			}
+		}
+		if required {
+			exitWith(exitKMS, "KMS no disponible tras %d intentos: %v", attempts, err)
+		}
+		log.Printf("⚠️  Sirviendo en modo degradado; se reintenta KMS cada %s", retry)
+		for !kmsReady.Load() && sleepCtx(ctx, retry) {
+			if err := initKMS(); err != nil {
+				log.Printf("⚠️  KMS sigue sin estar disponible: %v", err)
+			}
+		}
+	})
+}
+
+// initKMS crea el backend de firma (ver backends.go) y comprueba que la
+// clave es accesible. Sólo publica kmsClient y signer cuando todo ha ido
+// bien.
+func initKMS() error {
+	kmsStateMu.Lock()
+	kmsAttempts++
+	kmsStateMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s, client, err := newSignerBackend(ctx)
+	if err == nil {
+		kmsClient, signer = client, s
+	}
+
+	kmsStateMu.Lock()
+	kmsLastErr = err
+	if err != nil {
+		kmsStateMu.Unlock()
+		return err
+	}
+	kmsReadySince = time.Now()
+	hooks := kmsReadyHooks
+	kmsReadyHooks = nil
+	kmsReady.Store(true)
+	kmsStateMu.Unlock()
+
+	log.Printf("KMS listo (%s, %s)", signerBackend, nameVersion)
+	for _, fn := range hooks {
+		fn()
+	}
+	return nil
+}
+
+// onKMSReady ejecuta fn en cuanto KMS esté listo (o ya, si lo está)
+func onKMSReady(fn func()) {
+	kmsStateMu.Lock()
+	if !kmsReady.Load() {
+		kmsReadyHooks = append(kmsReadyHooks, fn)
+		kmsStateMu.Unlock()
+		return
+	}
+	kmsStateMu.Unlock()
+	fn()
+}
+
+// kmsStatus resume el estado de KMS para /healthz y /version
+func kmsStatus() string {
+	if kmsReady.Load() {
+		return "ok"
+	}
+	kmsStateMu.Lock()
+	defer kmsStateMu.Unlock()
+	if kmsLastErr == nil {
+		return "arrancando"
+	}
+	return fmt.Sprintf("no disponible tras %d intentos: %v", kmsAttempts, kmsLastErr)
+}
+
+// degradedAllowed son las rutas que se atienden sin KMS
+var degradedAllowed = map[string]bool{"/healthz": true, "/version": true, "/errors": true, "/metrics": true, "/admin/diagnose": true}
+
+// kmsReadyMiddleware responde 503 mientras KMS no esté listo
+func kmsReadyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !kmsReady.Load() && !degradedAllowed[r.URL.Path] {
+			w.Header().Set("Retry-After", strconv.Itoa(int(kmsRetryInterval.Seconds())))
+			writeError(w, http.StatusServiceUnavailable, errKMSUnavailable, "El servicio está en modo degradado: KMS no está disponible")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,177 @@
+// store.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errNotFound lo devuelve el store cuando no existe el registro pedido
+var errNotFound = errors.New("no encontrado")
+
+// store es la persistencia compartida del servicio: registros JSON opacos
+// agrupados por colección. Se elige con STORE ("memory" o "file").
+type store interface {
+	Get(ctx context.Context, collection, id string) ([]byte, error)
+	Put(ctx context.Context, collection, id string, data []byte) error
+	Delete(ctx context.Context, collection, id string) error
+	// List devuelve los registros de la colección ordenados por id
+	List(ctx context.Context, collection string) (map[string][]byte, []string, error)
+}
+
+var db store
+
+// openStore crea el store configurado y, si hay STORE_REPLICA, su réplica
+// (ver replica.go)
+func openStore() (store, error) {
+	primary, err := newStore(getEnv("STORE", "memory"), getEnv("STORE_DIR", "./data"))
+	if err != nil {
+		return nil, err
+	}
+	return openReplica(primary)
+}
+
+// newStore crea un store del tipo kind; dir sólo lo usa "file"
+func newStore(kind, dir string) (store, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &fileStore{dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("STORE desconocido: %q", kind)
+	}
+}
+
+// memoryStore guarda todo en memoria; sólo sirve para desarrollo o para una
+// única réplica sin requisitos de durabilidad
+type memoryStore struct {
+	mu   sync.RWMutex
+	data map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: map[string]map[string][]byte{}}
+}
+
+func (s *memoryStore) Get(_ context.Context, collection, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[collection][id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *memoryStore) Put(_ context.Context, collection, id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data[collection] == nil {
+		s.data[collection] = map[string][]byte{}
+	}
+	s.data[collection][id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, collection, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[collection][id]; !ok {
+		return errNotFound
+	}
+	delete(s.data[collection], id)
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, collection string) (map[string][]byte, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string][]byte, len(s.data[collection]))
+	ids := make([]string, 0, len(s.data[collection]))
+	for id, v := range s.data[collection] {
+		out[id] = append([]byte(nil), v...)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return out, ids, nil
+}
+
+// fileStore guarda cada registro en STORE_DIR/<colección>/<id>.json. Varias
+// réplicas pueden compartirlo montando el mismo volumen.
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) path(collection, id string) string {
+	return filepath.Join(s.dir, url.PathEscape(collection), url.PathEscape(id)+".json")
+}
+
+func (s *fileStore) Get(_ context.Context, collection, id string) ([]byte, error) {
+	b, err := os.ReadFile(s.path(collection, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	return b, err
+}
+
+func (s *fileStore) Put(_ context.Context, collection, id string, data []byte) error {
+	p := s.path(collection, id)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	// Escritura atómica: fichero temporal + rename
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *fileStore) Delete(_ context.Context, collection, id string) error {
+	err := os.Remove(s.path(collection, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *fileStore) List(_ context.Context, collection string) (map[string][]byte, []string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, url.PathEscape(collection)))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]byte{}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	out := map[string][]byte{}
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, url.PathEscape(collection), name))
+		if err != nil {
+			return nil, nil, err
+		}
+		out[id] = b
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return out, ids, nil
+}
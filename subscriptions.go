@@ -0,0 +1,517 @@
+// subscriptions.go
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// Suscripciones de verificación, para flujos en los que quien verifica
+// llega antes que la firma. El consumidor registra el hash del documento
+// que espera (el de /hash: el SHA-256 de sus bytes canónicos sin
+// timestamp) y espera a que alguien lo firme, con long-poll o con webhook:
+//
+//	POST   /subscriptions        {"payload_sha256": "...", "key": "...",
+//	                              "callback": "https://...", "ttl": "1h"}
+//	                              (callback sólo a CALLBACK_HOSTS, ver
+//	                              callbacks.go)
+//	GET    /subscriptions/{id}   estado; con ?wait=25s espera a la firma
+//	DELETE /subscriptions/{id}   cancelar
+//
+// Cuando /sign, /sign/batch o una firma diferida firman un documento con
+// ese hash (y con esa clave, si se indicó), la suscripción pasa a "signed"
+// con el sobre completo y se avisa al callback. Sólo cuentan las firmas
+// posteriores al alta. Cada suscripción la ve sólo quien la creó.
+//
+//	SUBSCRIPTIONS_ENABLED          true para activarlas
+//	SUBSCRIPTION_TTL               vigencia por defecto (24h); como mucho
+//	                               SUBSCRIPTION_MAX_TTL (7 días)
+//	SUBSCRIPTION_MAX_WAIT          espera máxima de ?wait= (30s), siempre
+//	                               por debajo de HTTP_WRITE_TIMEOUT
+//	SUBSCRIPTION_POLL_INTERVAL     cada cuánto se mira el almacén mientras
+//	                               se espera (1s), por si firma otra
+//	                               instancia
+//	SUBSCRIPTION_WORKERS           workers que resuelven las suscripciones
+//	                               tras cada firma (4), con una cola de
+//	                               SUBSCRIPTION_QUEUE (1000); con la cola
+//	                               llena se resuelven en la propia firma
+//	SUBSCRIPTION_SWEEP_INTERVAL    cada cuánto se borran las vencidas y se
+//	                               repasa el índice (1h; también al
+//	                               arrancar)
+//
+// Cada suscripción en espera tiene además una entrada en el índice de su
+// hash (subscriptionIndex), así que resolver una firma sólo lee las que
+// esperan ese documento, no todas.
+
+// subscriptionsCollection guarda las suscripciones
+const subscriptionsCollection = "subscriptions"
+
+// subscriptionIndexPrefix más el hash es la colección con los ids de las
+// suscripciones que esperan ese documento. Cada suscripción escribe su
+// propia entrada, así que dos altas a la vez no se pisan.
+const subscriptionIndexPrefix = "subscriptions_by_hash/"
+
+func subscriptionIndex(hash string) string {
+	return subscriptionIndexPrefix + hash
+}
+
+const (
+	subscriptionWaiting = "waiting"
+	subscriptionSigned  = "signed"
+	subscriptionExpired = "expired"
+)
+
+type subscription struct {
+	ID          string                 `json:"id"`
+	Status      string                 `json:"status"`
+	PayloadHash string                 `json:"payload_sha256"`
+	Key         string                 `json:"key,omitempty"`
+	Owner       string                 `json:"owner"`
+	Callback    string                 `json:"callback,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+	SignedAt    *time.Time             `json:"signed_at,omitempty"`
+	Envelope    map[string]interface{} `json:"envelope,omitempty"`
+}
+
+// subscriptionsEnabled indica si están activadas
+func subscriptionsEnabled() bool {
+	return getEnv("SUBSCRIPTIONS_ENABLED", "false") == "true"
+}
+
+// expired indica si la suscripción seguía esperando al vencer
+func (s subscription) expired(now time.Time) bool {
+	return s.Status == subscriptionWaiting && !now.Before(s.ExpiresAt)
+}
+
+// view es lo que ve el consumidor
+func (s subscription) view(now time.Time) map[string]interface{} {
+	status := s.Status
+	if s.expired(now) {
+		status = subscriptionExpired
+	}
+	out := map[string]interface{}{
+		"subscription_id": s.ID,
+		"status":          status,
+		"payload_sha256":  s.PayloadHash,
+		"created_at":      s.CreatedAt,
+		"expires_at":      s.ExpiresAt,
+	}
+	if s.Key != "" {
+		out["key"] = s.Key
+	}
+	if s.Status == subscriptionSigned {
+		out["signed_at"] = s.SignedAt
+		out["envelope"] = s.Envelope
+	}
+	return out
+}
+
+// unindexSubscription quita la suscripción del índice de su hash
+func unindexSubscription(ctx context.Context, s subscription) {
+	if err := db.Delete(ctx, subscriptionIndex(s.PayloadHash), s.ID); err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("⚠️  Índice de la suscripción %s: %v", s.ID, err)
+	}
+}
+
+func saveSubscription(ctx context.Context, s subscription) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return db.Put(ctx, subscriptionsCollection, s.ID, raw)
+}
+
+func loadSubscription(ctx context.Context, id string) (subscription, error) {
+	var s subscription
+	raw, err := db.Get(ctx, subscriptionsCollection, id)
+	if err != nil {
+		return s, err
+	}
+	err = firmajson.DecodeJSON(raw, &s)
+	return s, err
+}
+
+// Esperas de long-poll en esta instancia, para despertarlas en cuanto se
+// firma aquí mismo sin esperar a la siguiente consulta al almacén
+var (
+	subscriptionWaitersMu sync.Mutex
+	subscriptionWaiters   = map[string][]chan struct{}{}
+)
+
+func watchSubscription(id string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	subscriptionWaitersMu.Lock()
+	subscriptionWaiters[id] = append(subscriptionWaiters[id], ch)
+	subscriptionWaitersMu.Unlock()
+	return ch, func() {
+		subscriptionWaitersMu.Lock()
+		defer subscriptionWaitersMu.Unlock()
+		waiters := subscriptionWaiters[id]
+		for i, c := range waiters {
+			if c == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(subscriptionWaiters, id)
+		} else {
+			subscriptionWaiters[id] = waiters
+		}
+	}
+}
+
+func wakeSubscription(id string) {
+	subscriptionWaitersMu.Lock()
+	defer subscriptionWaitersMu.Unlock()
+	for _, ch := range subscriptionWaiters[id] {
+		close(ch)
+	}
+	delete(subscriptionWaiters, id)
+}
+
+// subscriptionMatch es una firma pendiente de cruzar con las suscripciones
+type subscriptionMatch struct {
+	alias, hash string
+	envelope    map[string]interface{}
+}
+
+// subscriptionQueue es la cola de los workers; nil hasta que arrancan
+var subscriptionQueue atomic.Pointer[chan subscriptionMatch]
+
+// startSubscriptionWorkers arranca los workers que resuelven las
+// suscripciones y el repaso periódico (ver sweepSubscriptions)
+func startSubscriptionWorkers() {
+	if !subscriptionsEnabled() {
+		return
+	}
+	queue := make(chan subscriptionMatch, envInt("SUBSCRIPTION_QUEUE", 1000))
+	for i := 0; i < envInt("SUBSCRIPTION_WORKERS", 4); i++ {
+		lifecycle.Go(fmt.Sprintf("subscriptions-%d", i), func(ctx context.Context) {
+			for {
+				select {
+				case m := <-queue:
+					resolveSubscriptions(ctx, m)
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	subscriptionQueue.Store(&queue)
+
+	interval := envDuration("SUBSCRIPTION_SWEEP_INTERVAL", time.Hour)
+	lifecycle.Go("subscriptions-sweep", func(ctx context.Context) {
+		for {
+			if n, err := sweepSubscriptions(ctx, time.Now().UTC()); err != nil {
+				log.Printf("⚠️  Repaso de suscripciones: %v", err)
+			} else if n > 0 {
+				log.Printf("Borradas %d suscripciones vencidas", n)
+			}
+			if !sleepCtx(ctx, interval) {
+				return
+			}
+		}
+	})
+}
+
+// documentSigned publica el sobre recién firmado en Pub/Sub (ver
+// pubsub.go) y resuelve las suscripciones que esperaban el documento.
+// envelope es el sobre completo, payload incluido. Las suscripciones van a
+// la cola de los workers: la firma ya está hecha y no debe esperar a esto
+// salvo si la cola está llena; la publicación sólo espera si el control de
+// flujo de Pub/Sub está lleno.
+func documentSigned(alias string, envelope map[string]interface{}, payload map[string]interface{}, escape string) {
+	publishEnvelope(alias, envelope, payload)
+	if !subscriptionsEnabled() {
+		return
+	}
+	_, hash, err := documentHash(payload, escape)
+	if err != nil {
+		return
+	}
+	env := make(map[string]interface{}, len(envelope))
+	for k, v := range envelope {
+		env[k] = v
+	}
+	m := subscriptionMatch{alias: alias, hash: hash, envelope: env}
+	if queue := subscriptionQueue.Load(); queue != nil {
+		select {
+		case *queue <- m:
+			return
+		default:
+			// Cola llena: mejor frenar esta firma que perder el aviso
+		}
+	}
+	resolveSubscriptions(context.Background(), m)
+}
+
+// resolveSubscriptions es fulfillSubscriptions con plazo y registro del
+// error
+func resolveSubscriptions(ctx context.Context, m subscriptionMatch) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if err := fulfillSubscriptions(ctx, m.alias, m.hash, m.envelope); err != nil {
+		log.Printf("⚠️  Suscripciones de %s: %v", m.hash[:shortIDLength], err)
+	}
+}
+
+// fulfillSubscriptions marca como firmadas las suscripciones que esperaban
+// hash (las de su índice) y avisa a sus callbacks. Las que ya no esperan
+// salen del índice.
+func fulfillSubscriptions(ctx context.Context, alias, hash string, envelope map[string]interface{}) error {
+	_, ids, err := db.List(ctx, subscriptionIndex(hash))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, id := range ids {
+		s, err := loadSubscription(ctx, id)
+		if errors.Is(err, errNotFound) {
+			db.Delete(ctx, subscriptionIndex(hash), id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.expired(now) {
+			db.Delete(ctx, subscriptionsCollection, id)
+			unindexSubscription(ctx, s)
+			continue
+		}
+		if s.Status != subscriptionWaiting {
+			unindexSubscription(ctx, s)
+			continue
+		}
+		if s.PayloadHash != hash || s.Key != "" && s.Key != alias {
+			continue
+		}
+		s.Status, s.SignedAt, s.Envelope = subscriptionSigned, &now, envelope
+		if err := saveSubscription(ctx, s); err != nil {
+			return err
+		}
+		unindexSubscription(ctx, s)
+		wakeSubscription(id)
+		notifySubscription(s)
+	}
+	return nil
+}
+
+// sweepSubscriptions borra las suscripciones vencidas (y su entrada del
+// índice) y devuelve cuántas. A las que siguen esperando les repone la
+// entrada del índice, por si faltara (p.ej. si se crearon antes de que
+// existiera).
+func sweepSubscriptions(ctx context.Context, now time.Time) (int, error) {
+	records, ids, err := db.List(ctx, subscriptionsCollection)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		var s subscription
+		if err := firmajson.DecodeJSON(records[id], &s); err != nil || s.Status != subscriptionWaiting {
+			continue
+		}
+		if !s.expired(now) {
+			if err := db.Put(ctx, subscriptionIndex(s.PayloadHash), s.ID, []byte("{}")); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := db.Delete(ctx, subscriptionsCollection, id); err != nil && !errors.Is(err, errNotFound) {
+			return n, err
+		}
+		unindexSubscription(ctx, s)
+		n++
+	}
+	return n, nil
+}
+
+// notifySubscription avisa al callback, en segundo plano
+func notifySubscription(s subscription) {
+	if s.Callback == "" {
+		return
+	}
+	body, _ := json.Marshal(s.view(time.Now()))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := postCallback(ctx, s.Callback, body); err != nil {
+			log.Printf("⚠️  Callback de la suscripción %s no entregado: %v", s.ID, err)
+		}
+	}()
+}
+
+// subscriptionMaxWait es lo más que se espera en un long-poll: el máximo
+// configurado, pero dejando margen antes de HTTP_WRITE_TIMEOUT para que la
+// respuesta llegue
+func subscriptionMaxWait() time.Duration {
+	wait := envDuration("SUBSCRIPTION_MAX_WAIT", 30*time.Second)
+	if wt := envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second); wt > 0 {
+		wait = min(wait, wt-5*time.Second)
+	}
+	return max(wait, 0)
+}
+
+// subscriptionRequest es el cuerpo de POST /subscriptions
+type subscriptionRequest struct {
+	PayloadHash string `json:"payload_sha256"`
+	Key         string `json:"key,omitempty"`
+	Callback    string `json:"callback,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+// subscriptionsHandler atiende POST /subscriptions
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if !subscriptionsEnabled() {
+		writeError(w, http.StatusNotFound, errNotConfigured, "Las suscripciones no están activadas")
+		return
+	}
+	var req subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	var problems []validationProblem
+	if raw, err := hex.DecodeString(req.PayloadHash); err != nil || len(raw) != 32 || strings.ToLower(req.PayloadHash) != req.PayloadHash {
+		problems = append(problems, validationProblem{"payload_sha256", errInvalidRequest, "payload_sha256 debe ser un SHA-256 en hexadecimal (minúsculas), como el de /hash"})
+	}
+	if req.Key != "" && (!knownKeyAlias(req.Key) || isHoneytoken(req.Key)) {
+		problems = append(problems, validationProblem{"key", errUnknownKey, fmt.Sprintf("Alias de clave desconocido: %q", req.Key)})
+	}
+	if req.Callback != "" {
+		if err := validateCallbackURL(req.Callback); err != nil {
+			problems = append(problems, validationProblem{"callback", errInvalidRequest, err.Error()})
+		}
+	}
+	ttl := envDuration("SUBSCRIPTION_TTL", 24*time.Hour)
+	if req.TTL != "" {
+		d, err := parseMaxAge(req.TTL)
+		if maxTTL := envDuration("SUBSCRIPTION_MAX_TTL", 7*24*time.Hour); err != nil || d == 0 || d > maxTTL {
+			problems = append(problems, validationProblem{"ttl", errInvalidRequest, fmt.Sprintf("ttl debe ser una duración entre 1s y %s", maxTTL)})
+		}
+		ttl = d
+	}
+	if len(problems) > 0 {
+		writeValidationProblems(w, problems)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "No se pudo generar el id")
+		return
+	}
+	now := time.Now().UTC()
+	s := subscription{
+		ID:          id,
+		Status:      subscriptionWaiting,
+		PayloadHash: req.PayloadHash,
+		Key:         req.Key,
+		Owner:       callerID(r),
+		Callback:    req.Callback,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if err := saveSubscription(r.Context(), s); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("No se pudo guardar la suscripción: %v", err))
+		return
+	}
+	if err := db.Put(r.Context(), subscriptionIndex(s.PayloadHash), s.ID, []byte("{}")); err != nil {
+		db.Delete(r.Context(), subscriptionsCollection, s.ID)
+		writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("No se pudo guardar la suscripción: %v", err))
+		return
+	}
+	resp := s.view(now)
+	resp["poll_url"] = "/subscriptions/" + id
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// subscriptionHandler atiende GET y DELETE /subscriptions/{id}
+func subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if !subscriptionsEnabled() {
+		writeError(w, http.StatusNotFound, errNotConfigured, "Las suscripciones no están activadas")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
+	ctx := r.Context()
+	s, err := loadSubscription(ctx, id)
+	if errors.Is(err, errNotFound) || err == nil && s.Owner != callerID(r) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Suscripción desconocida")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := db.Delete(ctx, subscriptionsCollection, id); err != nil && !errors.Is(err, errNotFound) {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			return
+		}
+		unindexSubscription(ctx, s)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET o DELETE permitidos")
+		return
+	}
+
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		if wait, err = parseMaxAge(v); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "wait debe ser una duración (p.ej. 25s)")
+			return
+		}
+		wait = min(wait, subscriptionMaxWait())
+	}
+	deadline := time.Now().Add(wait)
+	poll := envDuration("SUBSCRIPTION_POLL_INTERVAL", time.Second)
+	for {
+		// Primero se apunta a la espera y luego se consulta, para no
+		// perder una firma que llegue entre medias
+		woken, stop := watchSubscription(id)
+		s, err = loadSubscription(ctx, id)
+		now := time.Now()
+		// En la parada se responde ya: el consumidor vuelve a preguntar
+		if err != nil || s.Status != subscriptionWaiting || s.expired(now) || !now.Before(deadline) || draining.Load() {
+			stop()
+			switch {
+			case errors.Is(err, errNotFound):
+				writeError(w, http.StatusNotFound, errNotFoundCode, "Suscripción desconocida")
+			case err != nil:
+				writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+			default:
+				writeJSON(w, http.StatusOK, s.view(now))
+			}
+			return
+		}
+		select {
+		case <-woken:
+		case <-time.After(min(poll, deadline.Sub(now))):
+		case <-ctx.Done():
+			stop()
+			return
+		}
+		stop()
+	}
+}
@@ -0,0 +1,56 @@
+// subscriptions_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Una firma sólo resuelve las suscripciones del índice de su hash, y la
+// resuelta sale del índice
+func TestSubscriptionIndex(t *testing.T) {
+	t.Setenv("SUBSCRIPTIONS_ENABLED", "true")
+	ctx := context.Background()
+	doc := map[string]interface{}{"pedido": "S-1"}
+	_, hash, err := documentHash(doc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := strings.Repeat("ab", 32)
+
+	subscribe := func(h string) string {
+		code, resp := doJSON(t, subscriptionsHandler, http.MethodPost, "/subscriptions", map[string]interface{}{"payload_sha256": h}, nil)
+		if code != http.StatusCreated {
+			t.Fatalf("/subscriptions: %d %v", code, resp)
+		}
+		return resp["subscription_id"].(string)
+	}
+	want, unrelated := subscribe(hash), subscribe(other)
+
+	testSign(t, "", doc, nil)
+
+	s, err := loadSubscription(ctx, want)
+	if err != nil || s.Status != subscriptionSigned || s.Envelope["signature"] == nil {
+		t.Fatalf("la suscripción al documento firmado: %v %+v", err, s)
+	}
+	if _, ids, _ := db.List(ctx, subscriptionIndex(hash)); len(ids) != 0 {
+		t.Fatalf("la suscripción resuelta sigue en el índice: %v", ids)
+	}
+	if s, _ := loadSubscription(ctx, unrelated); s.Status != subscriptionWaiting {
+		t.Fatalf("la otra suscripción no debe resolverse: %+v", s)
+	}
+	if _, ids, _ := db.List(ctx, subscriptionIndex(other)); len(ids) != 1 {
+		t.Fatalf("la otra suscripción debe seguir en el índice: %v", ids)
+	}
+
+	// El repaso repone el índice de las que esperan y no lo tienen
+	db.Delete(ctx, subscriptionIndex(other), unrelated)
+	if _, err := sweepSubscriptions(ctx, s.CreatedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, subscriptionIndex(other), unrelated); err != nil {
+		t.Fatalf("el repaso no repuso el índice: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+// timesource.go
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeSource da la hora que se inyecta como "timestamp" al firmar. El reloj
+// del contenedor ya se ha desviado alguna vez, y una firma con fecha
+// anterior a la real es un problema de cumplimiento, así que se puede
+// exigir una hora verificada contra NTP:
+//
+//	TIME_SOURCE=system   reloj local (por defecto)
+//	TIME_SOURCE=ntp      reloj local corregido con el desfase medido contra
+//	                     TIME_NTP_SERVERS; si no hay quórum no se firma
+//	TIME_SOURCE=fixed    TIME_FIXED (RFC 3339), avanzando TIME_FIXED_STEP
+//	                     en cada lectura; sólo para tests, con
+//	                     SIGNER_BACKEND=local (ver entropy.go)
+//
+// Con una fuente distinta de la local el sobre lleva "time_source".
+type timeSource interface {
+	Now() (time.Time, error)
+	Name() string
+}
+
+// timeSourceClaim es el campo del sobre que registra la fuente de la hora
+const timeSourceClaim = "time_source"
+
+var errTimeUnavailable = errors.New("no hay una hora verificada disponible")
+
+type systemClock struct{}
+
+func (systemClock) Now() (time.Time, error) { return time.Now().UTC(), nil }
+func (systemClock) Name() string            { return "system" }
+
+// fixedClock da una hora fija que avanza step en cada lectura, para que
+// dos ejecuciones con la misma configuración firmen lo mismo
+type fixedClock struct {
+	mu   sync.Mutex
+	next time.Time
+	step time.Duration
+}
+
+func (c *fixedClock) Name() string { return "fixed" }
+
+func (c *fixedClock) Now() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.next
+	c.next = c.next.Add(c.step)
+	return now, nil
+}
+
+// recordTime es la hora de los ids y metadatos que acompañan a una firma
+// (id del sobre guardado, recibos): la de la fuente de firma, o la local
+// si no está disponible
+func recordTime() time.Time {
+	if now, err := signingClock.Now(); err == nil {
+		return now
+	}
+	return time.Now().UTC()
+}
+
+// ntpClock mide el desfase del reloj local contra varios servidores NTP y
+// lo aplica. El desfase se recalcula en segundo plano cada
+// TIME_NTP_REFRESH; si la medición falla se sigue usando la anterior
+// mientras no tenga más de TIME_NTP_MAX_STALE.
+type ntpClock struct {
+	servers  []string
+	refresh  time.Duration
+	maxStale time.Duration
+	maxDrift time.Duration
+
+	mu       sync.Mutex
+	offset   time.Duration
+	measured time.Time
+}
+
+func (c *ntpClock) Name() string { return "ntp" }
+
+func (c *ntpClock) Now() (time.Time, error) {
+	c.mu.Lock()
+	offset, measured := c.offset, c.measured
+	c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(measured) > c.maxStale {
+		return time.Time{}, errTimeUnavailable
+	}
+	return now.Add(offset).UTC(), nil
+}
+
+// update mide el desfase y lo guarda si la medición tiene quórum
+func (c *ntpClock) update() {
+	offset, err := c.measure()
+	if err != nil {
+		log.Printf("⚠️  NTP: %v", err)
+		return
+	}
+	if offset > c.maxDrift || offset < -c.maxDrift {
+		log.Printf("🚨 El reloj local se desvía %s de NTP", offset)
+	}
+	c.mu.Lock()
+	c.offset, c.measured = offset, time.Now()
+	c.mu.Unlock()
+}
+
+func (c *ntpClock) start() {
+	c.update()
+	lifecycle.Go("ntp-clock", func(ctx context.Context) {
+		for sleepCtx(ctx, c.refresh) {
+			c.update()
+		}
+	})
+}
+
+// measure consulta todos los servidores y devuelve la mediana de los
+// desfases si responde la mayoría
+func (c *ntpClock) measure() (time.Duration, error) {
+	var offsets []time.Duration
+	var errs []error
+	for _, server := range c.servers {
+		offset, err := sntpOffset(server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	if len(offsets) <= len(c.servers)/2 {
+		return 0, fmt.Errorf("sin quórum (%d de %d): %w", len(offsets), len(c.servers), errors.Join(errs...))
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets[len(offsets)/2], nil
+}
+
+// ntpEpoch es el origen de las marcas NTP (1900-01-01)
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func ntpTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	return ntpEpoch.Add(time.Duration(secs)*time.Second + time.Duration(uint64(frac)*uint64(time.Second)>>32))
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	d := t.Sub(ntpEpoch)
+	secs := d / time.Second
+	binary.BigEndian.PutUint32(b[0:4], uint32(secs))
+	binary.BigEndian.PutUint32(b[4:8], uint32(uint64(d-secs*time.Second)<<32/uint64(time.Second)))
+}
+
+// sntpOffset hace una consulta SNTP (RFC 4330) y devuelve el desfase del
+// reloj local
+func sntpOffset(server string) (time.Duration, error) {
+	if !strings.Contains(server, ":") {
+		server += ":123"
+	}
+	conn, err := net.DialTimeout("udp", server, 2*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI=0, VN=4, modo cliente
+	t1 := time.Now()
+	putNTPTime(req[40:48], t1)
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+
+	if mode := resp[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("respuesta en modo %d", mode)
+	}
+	if resp[0]>>6 == 3 {
+		return 0, errors.New("servidor no sincronizado")
+	}
+	if stratum := resp[1]; stratum == 0 || stratum > 15 {
+		return 0, fmt.Errorf("stratum %d", stratum)
+	}
+	if !ntpTime(resp[24:32]).Equal(ntpTime(req[40:48])) {
+		return 0, errors.New("la respuesta no corresponde a la consulta")
+	}
+	t2, t3 := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+var signingClock timeSource = systemClock{}
+
+// configureTimeSource elige la fuente de la hora según TIME_SOURCE
+func configureTimeSource() error {
+	switch getEnv("TIME_SOURCE", "system") {
+	case "system":
+		signingClock = systemClock{}
+	case "ntp":
+		var servers []string
+		for _, s := range strings.Split(getEnv("TIME_NTP_SERVERS", "time.google.com,time.cloudflare.com,pool.ntp.org"), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				servers = append(servers, s)
+			}
+		}
+		durations := map[string]time.Duration{}
+		for name, def := range map[string]string{"TIME_NTP_REFRESH": "1m", "TIME_NTP_MAX_STALE": "10m", "TIME_MAX_DRIFT": "2s"} {
+			d, err := time.ParseDuration(getEnv(name, def))
+			if err != nil {
+				return fmt.Errorf("%s inválido: %w", name, err)
+			}
+			durations[name] = d
+		}
+		if len(servers) == 0 {
+			return errors.New("TIME_NTP_SERVERS vacío")
+		}
+		clock := &ntpClock{
+			servers:  servers,
+			refresh:  durations["TIME_NTP_REFRESH"],
+			maxStale: durations["TIME_NTP_MAX_STALE"],
+			maxDrift: durations["TIME_MAX_DRIFT"],
+		}
+		clock.start()
+		signingClock = clock
+	case "fixed":
+		if err := requireTestBackend("TIME_SOURCE=fixed"); err != nil {
+			return err
+		}
+		start, err := time.Parse(time.RFC3339Nano, getEnv("TIME_FIXED", ""))
+		if err != nil {
+			return fmt.Errorf("TIME_FIXED inválido: %w", err)
+		}
+		step, err := time.ParseDuration(getEnv("TIME_FIXED_STEP", "0s"))
+		if err != nil || step < 0 {
+			return fmt.Errorf("TIME_FIXED_STEP inválido: %q", getEnv("TIME_FIXED_STEP", ""))
+		}
+		signingClock = &fixedClock{next: start.UTC(), step: step}
+		log.Printf("⚠️  TIME_SOURCE=fixed: todas las firmas llevan %s, sólo para tests", start.UTC().Format(time.RFC3339Nano))
+	default:
+		return fmt.Errorf("TIME_SOURCE desconocido: %q", getEnv("TIME_SOURCE", ""))
+	}
+	return nil
+}
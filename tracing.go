@@ -0,0 +1,309 @@
+// tracing.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2/google"
+)
+
+// Trazas con OpenTelemetry. Cada petición HTTP abre un span (continuando la
+// traza del cliente si trae traceparent) y dentro quedan la espera en el
+// pacer, la firma o verificación, las llamadas gRPC a KMS y Firestore (las
+// instrumentan las propias librerías de Google) y la auditoría, así que en
+// una firma lenta se ve si el tiempo se fue en la cuota, en KMS o en el
+// almacén.
+//
+// OTEL_TRACES_EXPORTER elige el destino; vacío o "none" las desactiva:
+//
+//	otlp   OTLP/HTTP en JSON a OTEL_EXPORTER_OTLP_ENDPOINT (http://localhost:4318)
+//	       o a OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, con las cabeceras de
+//	       OTEL_EXPORTER_OTLP_HEADERS ("k=v,k2=v2")
+//	gcp    Cloud Trace por su endpoint OTLP, con las credenciales por defecto
+//	       y el proyecto de GOOGLE_CLOUD_PROJECT
+//
+// El muestreo, el lote y el recurso se configuran con las variables
+// estándar del SDK (OTEL_TRACES_SAMPLER, OTEL_TRACES_SAMPLER_ARG,
+// OTEL_BSP_*, OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES); por defecto se
+// muestrea todo y el servicio es firma-json.
+
+const cloudTraceEndpoint = "https://telemetry.googleapis.com/v1/traces"
+
+// tracer abre los spans propios. Sin exportador es el no-op global.
+var tracer = otel.Tracer("example.com/firmajson")
+
+// tracingEnabled indica si hay exportador configurado
+var tracingEnabled bool
+
+// configureTracing instala el proveedor de trazas según
+// OTEL_TRACES_EXPORTER. Se registra en lifecycle antes que nada para
+// pararse el último y vaciar los spans de la propia parada.
+func configureTracing() error {
+	kind := getEnv("OTEL_TRACES_EXPORTER", "")
+	if kind == "" || kind == "none" {
+		return nil
+	}
+	ctx := context.Background()
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "firma-json"),
+		attribute.String("service.version", version),
+	}
+	var exp *otlpExporter
+	switch kind {
+	case "otlp":
+		endpoint := getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+		if endpoint == "" {
+			endpoint = strings.TrimSuffix(getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "/") + "/v1/traces"
+		}
+		if _, err := url.ParseRequestURI(endpoint); err != nil {
+			return fmt.Errorf("endpoint OTLP inválido: %v", err)
+		}
+		headers, err := parseOTLPHeaders(getEnv("OTEL_EXPORTER_OTLP_HEADERS", ""))
+		if err != nil {
+			return err
+		}
+		exp = &otlpExporter{endpoint: endpoint, headers: headers, client: &http.Client{Timeout: 10 * time.Second}}
+	case "gcp":
+		project := getEnv("GOOGLE_CLOUD_PROJECT", "")
+		if project == "" {
+			return fmt.Errorf("OTEL_TRACES_EXPORTER=gcp requiere GOOGLE_CLOUD_PROJECT")
+		}
+		client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return fmt.Errorf("credenciales para Cloud Trace: %v", err)
+		}
+		client.Timeout = 10 * time.Second
+		exp = &otlpExporter{endpoint: cloudTraceEndpoint, headers: map[string]string{"x-goog-user-project": project}, client: client}
+		attrs = append(attrs, attribute.String("gcp.project_id", project))
+	default:
+		return fmt.Errorf("OTEL_TRACES_EXPORTER debe ser otlp, gcp o none")
+	}
+
+	// WithFromEnv va detrás para que OTEL_SERVICE_NAME y
+	// OTEL_RESOURCE_ATTRIBUTES manden sobre los valores por defecto
+	res, err := sdkresource.New(ctx, sdkresource.WithTelemetrySDK(), sdkresource.WithAttributes(attrs...), sdkresource.WithFromEnv())
+	if err != nil {
+		return fmt.Errorf("recurso: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+	return lifecycle.Register("tracing", nil, tp.Shutdown)
+}
+
+// parseOTLPHeaders lee OTEL_EXPORTER_OTLP_HEADERS: pares k=v separados por
+// comas, con los valores codificados como en una URL
+func parseOTLPHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: falta = en %q", pair)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+		headers[strings.TrimSpace(k)] = v
+	}
+	return headers, nil
+}
+
+// tracingMiddleware abre el span de servidor de cada petición, continuando
+// la traza de traceparent. El nombre es el patrón del mux, como en las
+// métricas.
+func tracingMiddleware(next http.Handler) http.Handler {
+	if !tracingEnabled {
+		return next
+	}
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + metricsRoute(r)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/healthz" && r.URL.Path != "/metrics"
+		}),
+	)
+}
+
+// startSpan abre un span interno; end lo cierra anotando el error si lo hay
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// traceID es el id de la traza de ctx, o "" si no hay
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// exemplarTraceID es el id de la traza de ctx si se muestrea, o "": una
+// traza que no se exporta no sirve de ejemplar
+func exemplarTraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && sc.IsSampled() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// otlpExporter envía los spans por OTLP/HTTP en JSON. Es lo único que hace
+// falta del protocolo y evita arrastrar el exportador gRPC entero.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("exportando trazas: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("exportando trazas: HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpRequest compone un ExportTraceServiceRequest en la codificación JSON
+// de OTLP: ids en hexadecimal, instantes en nanosegundos como cadena y los
+// spans agrupados por ámbito de instrumentación
+func otlpRequest(spans []sdktrace.ReadOnlySpan) map[string]interface{} {
+	var scopes []map[string]interface{}
+	byScope := map[string]int{}
+	for _, s := range spans {
+		scope := s.InstrumentationScope()
+		key := scope.Name + "@" + scope.Version
+		i, ok := byScope[key]
+		if !ok {
+			i = len(scopes)
+			byScope[key] = i
+			scopes = append(scopes, map[string]interface{}{
+				"scope": map[string]string{"name": scope.Name, "version": scope.Version},
+				"spans": []map[string]interface{}{},
+			})
+		}
+		scopes[i]["spans"] = append(scopes[i]["spans"].([]map[string]interface{}), otlpSpan(s))
+	}
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource":   map[string]interface{}{"attributes": otlpAttributes(spans[0].Resource().Attributes())},
+			"scopeSpans": scopes,
+		}},
+	}
+}
+
+func otlpSpan(s sdktrace.ReadOnlySpan) map[string]interface{} {
+	sc := s.SpanContext()
+	out := map[string]interface{}{
+		"traceId":           sc.TraceID().String(),
+		"spanId":            sc.SpanID().String(),
+		"name":              s.Name(),
+		"kind":              int(s.SpanKind()), // mismos valores que SpanKind de OTLP
+		"startTimeUnixNano": strconv.FormatInt(s.StartTime().UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.Attributes()),
+	}
+	if p := s.Parent(); p.IsValid() {
+		out["parentSpanId"] = p.SpanID().String()
+	}
+	if events := s.Events(); len(events) > 0 {
+		list := make([]map[string]interface{}, len(events))
+		for i, ev := range events {
+			list[i] = map[string]interface{}{
+				"name":         ev.Name,
+				"timeUnixNano": strconv.FormatInt(ev.Time.UnixNano(), 10),
+				"attributes":   otlpAttributes(ev.Attributes),
+			}
+		}
+		out["events"] = list
+	}
+	// En OTLP: 0 sin fijar, 1 ok, 2 error (al revés que en codes)
+	switch st := s.Status(); st.Code {
+	case codes.Ok:
+		out["status"] = map[string]interface{}{"code": 1}
+	case codes.Error:
+		out["status"] = map[string]interface{}{"code": 2, "message": st.Description}
+	}
+	return out
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, map[string]interface{}{"key": string(kv.Key), "value": otlpValue(kv.Value)})
+	}
+	return out
+}
+
+func otlpValue(v attribute.Value) map[string]interface{} {
+	switch v.Type() {
+	case attribute.BOOL:
+		return map[string]interface{}{"boolValue": v.AsBool()}
+	case attribute.INT64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v.AsInt64(), 10)}
+	case attribute.FLOAT64:
+		return map[string]interface{}{"doubleValue": v.AsFloat64()}
+	case attribute.STRING:
+		return map[string]interface{}{"stringValue": v.AsString()}
+	case attribute.STRINGSLICE:
+		values := []map[string]interface{}{}
+		for _, s := range v.AsStringSlice() {
+			values = append(values, map[string]interface{}{"stringValue": s})
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	}
+	return map[string]interface{}{"stringValue": v.Emit()}
+}
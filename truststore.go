@@ -0,0 +1,207 @@
+// truststore.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// trustCollection es la colección del store con las claves de terceros
+const trustCollection = "trusted_keys"
+
+// trustedKey es una clave pública o certificado externo que sólo se usa para
+// verificar. Nunca se firma con ella y no tiene relación con nuestras claves
+// de KMS.
+type trustedKey struct {
+	ID          string         `json:"id"`
+	Label       string         `json:"label"`
+	JWK         *jwk           `json:"jwk,omitempty"`
+	CertPEM     string         `json:"cert_pem,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	Constraints keyConstraints `json:"constraints"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// keyConstraints limita para qué se puede usar una clave de confianza
+type keyConstraints struct {
+	Algs    []string `json:"algs,omitempty"`
+	Issuers []string `json:"issuers,omitempty"`
+}
+
+// publicKey devuelve la clave pública del JWK o del certificado
+func (k trustedKey) publicKey() (crypto.PublicKey, error) {
+	if k.JWK != nil {
+		return k.JWK.publicKey()
+	}
+	cert, err := k.certificate()
+	if err != nil {
+		return nil, err
+	}
+	return cert.PublicKey, nil
+}
+
+func (k trustedKey) certificate() (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(k.CertPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("cert_pem no contiene un certificado PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// usableFor comprueba caducidad y restricciones para una verificación concreta
+func (k trustedKey) usableFor(iss, alg string, now time.Time) error {
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return errors.New("la clave de confianza ha caducado")
+	}
+	if k.CertPEM != "" {
+		cert, err := k.certificate()
+		if err != nil {
+			return err
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return errors.New("el certificado no está vigente")
+		}
+	}
+	if len(k.Constraints.Algs) > 0 && !contains(k.Constraints.Algs, alg) {
+		return fmt.Errorf("algoritmo %q no permitido para esta clave", alg)
+	}
+	if len(k.Constraints.Issuers) > 0 && !contains(k.Constraints.Issuers, iss) {
+		return fmt.Errorf("emisor %q no permitido para esta clave", iss)
+	}
+	return nil
+}
+
+// verifyTrustedKey verifica una firma con una clave del almacén de
+// confianza, comprobando antes su vigencia y restricciones
+func verifyTrustedKey(k trustedKey, iss, alg string, data, sig []byte) (bool, string, error) {
+	if err := k.usableFor(iss, alg, time.Now()); err != nil {
+		return false, err.Error(), nil
+	}
+	pub, err := k.publicKey()
+	if err != nil {
+		return false, "", err
+	}
+	valid, err := firmajson.VerifyAsymmetric(pub, alg, data, sig)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+	return valid, "", nil
+}
+
+// lookupTrustedKey busca una clave del almacén de confianza por id
+func lookupTrustedKey(ctx context.Context, id string) (trustedKey, bool, error) {
+	raw, err := db.Get(ctx, trustCollection, id)
+	if errors.Is(err, errNotFound) {
+		return trustedKey{}, false, nil
+	}
+	if err != nil {
+		return trustedKey{}, false, err
+	}
+	var k trustedKey
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return trustedKey{}, false, err
+	}
+	return k, true, nil
+}
+
+// trustKeysHandler lista (GET) o añade (POST) claves de confianza
+func trustKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := pageRequest(w, r)
+		if !ok {
+			return
+		}
+		records, ids, err := db.List(ctx, trustCollection)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+			return
+		}
+		keys, next := paginate(p, ids, func(id string) (k trustedKey, ok bool) {
+			return k, json.Unmarshal(records[id], &k) == nil
+		})
+		writePage(w, "keys", keys, next)
+
+	case http.MethodPost:
+		var k trustedKey
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+			return
+		}
+		if k.ID == "" || strings.Contains(k.ID, "/") {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "id obligatorio y sin '/'")
+			return
+		}
+		if (k.JWK == nil) == (k.CertPEM == "") {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, "Indica exactamente uno de jwk o cert_pem")
+			return
+		}
+		if _, err := k.publicKey(); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Clave inválida: %v", err))
+			return
+		}
+		k.CreatedAt = time.Now().UTC()
+		raw, _ := json.Marshal(k)
+		if err := db.Put(ctx, trustCollection, k.ID, raw); err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error guardando: %v", err))
+			return
+		}
+		recordAdminAudit(r, "trust_key_added", k.ID)
+		writeJSON(w, http.StatusCreated, k)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET o POST permitido")
+	}
+}
+
+// trustKeyHandler consulta (GET) o elimina (DELETE) /admin/trust/keys/{id}
+func trustKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/trust/keys/")
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		k, found, err := lookupTrustedKey(ctx, id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error leyendo el store: %v", err))
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Clave no encontrada")
+			return
+		}
+		writeJSON(w, http.StatusOK, k)
+
+	case http.MethodDelete:
+		err := db.Delete(ctx, trustCollection, id)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFoundCode, "Clave no encontrada")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Error borrando: %v", err))
+			return
+		}
+		recordAdminAudit(r, "trust_key_removed", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET o DELETE permitido")
+	}
+}
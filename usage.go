@@ -0,0 +1,145 @@
+// usage.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageCounts es el consumo de un caller, tenant o clave en una ventana
+type usageCounts struct {
+	Group     string  `json:"group"`
+	Signed    int     `json:"signed"`
+	Verified  int     `json:"verified"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Bytes     int64   `json:"bytes"`
+}
+
+// usageEvents clasifica los eventos de auditoría que cuentan como consumo
+var usageEvents = map[string]string{
+	"sign":          "sign",
+	"sign_commit":   "sign",
+	"sign_deferred": "sign",
+	"verify":        "verify",
+	"public_verify": "verify",
+}
+
+// parseUsageWindow acepta duraciones de Go ("1h", "90m") y días ("7d")
+func parseUsageWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("ventana inválida: %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("ventana inválida: %q", s)
+	}
+	return d, nil
+}
+
+// usageHandler resume el consumo para facturación interna y capacidad:
+//
+//	GET /usage?window=24h|7d|30d&group_by=caller|tenant|key
+//	          [&caller=...][&tenant=...][&key=...]
+//
+// Se calcula sobre las entradas de auditoría completas, así que la ventana
+// no puede ir más atrás que la retención (AUDIT_RETENTION_DAYS).
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	q := r.URL.Query()
+	windowParam := q.Get("window")
+	if windowParam == "" {
+		windowParam = "24h"
+	}
+	window, err := parseUsageWindow(windowParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	groupBy := q.Get("group_by")
+	if groupBy == "" {
+		groupBy = "caller"
+	}
+	groupOf := map[string]func(auditEntry) string{
+		"caller": func(e auditEntry) string { return e.Caller },
+		"tenant": func(e auditEntry) string { return e.Tenant },
+		"key":    func(e auditEntry) string { return e.Key },
+	}[groupBy]
+	if groupOf == nil {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, "group_by debe ser caller, tenant o key")
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-window)
+	records, ids, err := db.List(r.Context(), auditCollection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	groups := map[string]*usageCounts{}
+	for _, id := range ids {
+		var e auditEntry
+		if err := json.Unmarshal(records[id], &e); err != nil {
+			continue
+		}
+		kind, counted := usageEvents[e.Event]
+		if !counted || e.Outcome == "queued" || e.Time.Before(from) || e.Time.After(to) {
+			continue
+		}
+		if v := q.Get("caller"); v != "" && e.Caller != v {
+			continue
+		}
+		if v := q.Get("tenant"); v != "" && e.Tenant != v {
+			continue
+		}
+		if v := q.Get("key"); v != "" && e.Key != v {
+			continue
+		}
+		name := groupOf(e)
+		g := groups[name]
+		if g == nil {
+			g = &usageCounts{Group: name}
+			groups[name] = g
+		}
+		switch {
+		case e.Outcome == "error":
+			g.Errors++
+		case kind == "sign":
+			g.Signed++
+		default:
+			g.Verified++
+		}
+		g.Bytes += int64(e.Bytes)
+	}
+
+	out := make([]usageCounts, 0, len(groups))
+	for _, g := range groups {
+		if total := g.Signed + g.Verified + g.Errors; total > 0 {
+			g.ErrorRate = float64(g.Errors) / float64(total)
+		}
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Group < out[j].Group })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"group_by": groupBy,
+		"usage":    out,
+	})
+}
@@ -0,0 +1,321 @@
+// validate.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"example.com/firmajson/enrich"
+	"example.com/firmajson/jsonscan"
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// validationProblem es uno de los fallos encontrados al validar una petición
+type validationProblem struct {
+	Field   string  `json:"field"`
+	Code    errCode `json:"code"`
+	Message string  `json:"message"`
+}
+
+// requestValidator revisa el cuerpo completo y devuelve todos los problemas
+// que encuentra, no sólo el primero
+type requestValidator func(r *http.Request, body []byte) []validationProblem
+
+// validated envuelve un handler con su validador: si hay problemas responde
+// 400 con la lista completa; si no, repone el body y llama al handler. Los
+// cuerpos JSON pasan antes por jsonscan mientras se leen, así que uno mal
+// formado, demasiado anidado o demasiado grande se rechaza sin leerlo entero
+// ni decodificarlo.
+func validated(v requestValidator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		var body []byte
+		var err error
+		if isCompactJWSBody(r) {
+			body, err = io.ReadAll(r.Body)
+		} else {
+			var problem *validationProblem
+			if body, problem, err = readJSONBody(r); problem != nil {
+				writeValidationProblems(w, []validationProblem{*problem})
+				return
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+			return
+		}
+		if problems := v(r, body); len(problems) > 0 {
+			writeValidationProblems(w, problems)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// jsonLimits son los límites estructurales de los cuerpos JSON:
+// JSON_MAX_BYTES (32 MiB, el cuerpo entero, lotes incluidos),
+// JSON_MAX_DEPTH (64) y JSON_MAX_STRING_BYTES (sin límite)
+func jsonLimits() jsonscan.Limits {
+	return jsonscan.Limits{
+		MaxBytes:       int64(envInt("JSON_MAX_BYTES", 32<<20)),
+		MaxDepth:       envInt("JSON_MAX_DEPTH", 64),
+		MaxStringBytes: envInt("JSON_MAX_STRING_BYTES", 0),
+	}
+}
+
+// readJSONBody lee el body comprobando su estructura a medida que llega.
+// Si no es aceptable devuelve el problema; lo leído hasta ahí se descarta.
+func readJSONBody(r *http.Request) ([]byte, *validationProblem, error) {
+	s := jsonscan.New(jsonLimits())
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(io.TeeReader(r.Body, s))
+	if err == nil {
+		err = s.Close()
+	}
+	var scanErr *jsonscan.Error
+	if errors.As(err, &scanErr) {
+		code := errInvalidJSON
+		if errors.Is(err, jsonscan.ErrTooLarge) {
+			code = errPayloadTooLarge
+		}
+		return nil, &validationProblem{"body", code, scanErr.Error()}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), nil, nil
+}
+
+// writeValidationProblems responde 400 con la lista completa de problemas
+func writeValidationProblems(w http.ResponseWriter, problems []validationProblem) {
+	writeErrorDetails(w, http.StatusBadRequest, errValidationFailed, fmt.Sprintf("La petición tiene %d problema(s)", len(problems)),
+		map[string]interface{}{"problems": problems})
+}
+
+// maxPayloadBytes es el tamaño máximo del documento a firmar o verificar;
+// por defecto el límite de datos de MacSign en Cloud KMS (64 KiB)
+func maxPayloadBytes() int {
+	return envInt("MAX_PAYLOAD_BYTES", 64<<10)
+}
+
+// validateSignRequest comprueba el documento de /sign y /sign/prepare y las
+// opciones que lo acompañan
+func validateSignRequest(r *http.Request, body []byte) []validationProblem {
+	var problems []validationProblem
+	if !validEscapeMode(requestEscape(r)) {
+		problems = append(problems, validationProblem{"escape", errInvalidRequest, "escape debe ser html, minimal, ascii o jcs"})
+	}
+	enc, err := requestCompression(r)
+	if err != nil {
+		problems = append(problems, validationProblem{"compress", errInvalidRequest, err.Error()})
+	}
+	if format, err := requestSignFormat(r); err != nil {
+		problems = append(problems, validationProblem{"format", errInvalidRequest, err.Error()})
+	} else if format != "" && enc != "" {
+		problems = append(problems, validationProblem{"format", errInvalidRequest, "La salida JWS no admite compress"})
+	}
+	if err := validateDetachedParams(r); err != nil {
+		problems = append(problems, validationProblem{"detached", errInvalidRequest, err.Error()})
+	}
+	if err := validateDeferParams(r); err != nil {
+		problems = append(problems, validationProblem{"defer", errInvalidRequest, err.Error()})
+	}
+	if _, err := requestNotifyOwner(r); err != nil {
+		problems = append(problems, validationProblem{"notify", errInvalidRequest, err.Error()})
+	}
+	problems = append(problems, validateAAD(r)...)
+	problems = append(problems, validateDigest(r)...)
+	return append(problems, validateSignDocument(r, body)...)
+}
+
+// validateSignDocument comprueba un documento a firmar: tamaño (salvo si se
+// firma el resumen), que sea un objeto JSON y que no use los campos que va
+// a añadir el servicio
+func validateSignDocument(r *http.Request, body []byte) []validationProblem {
+	var problems []validationProblem
+	if len(body) > maxPayloadBytes() && requestDigest(r) == "" {
+		problems = append(problems, validationProblem{"body", errPayloadTooLarge,
+			fmt.Sprintf("El documento ocupa %d bytes y el máximo es %d", len(body), maxPayloadBytes())})
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload == nil {
+		return append(problems, validationProblem{"body", errInvalidJSON, "El documento debe ser un objeto JSON"})
+	}
+
+	if nonceRequested(r) {
+		if _, exists := payload["nonce"]; exists {
+			problems = append(problems, validationProblem{"nonce", errReservedField, `El campo "nonce" está reservado cuando se pide nonce`})
+		}
+	}
+	if getEnv("TIME_SOURCE", "system") != "system" {
+		if _, exists := payload[timeSourceClaim]; exists {
+			problems = append(problems, validationProblem{timeSourceClaim, errReservedField, `El campo "time_source" lo añade el servicio`})
+		}
+	}
+	problems = append(problems, reservedPurposeProblem(payload)...)
+	if _, exists := payload[revisionClaim]; exists {
+		problems = append(problems, validationProblem{revisionClaim, errReservedField, `El campo "revision_of" sólo lo añade /sign/patch`})
+	}
+	for _, field := range enrich.Fields() {
+		if _, exists := payload[field]; exists {
+			problems = append(problems, validationProblem{field, errReservedField, fmt.Sprintf("El campo %q lo añade el servicio", field)})
+		}
+	}
+	if r.URL.Query().Get("bind") == "cert" {
+		if _, exists := payload[confirmationClaim]; exists {
+			problems = append(problems, validationProblem{confirmationClaim, errReservedField, `El campo "cnf" está reservado cuando se liga a certificado`})
+		}
+		if _, err := clientCertThumbprint(r); err != nil {
+			problems = append(problems, validationProblem{"bind", errInvalidRequest, err.Error()})
+		}
+	}
+	if paths := queryList(r, "encrypt"); len(paths) > 0 {
+		if _, exists := payload["encryption"]; exists {
+			problems = append(problems, validationProblem{"encryption", errReservedField, `El campo "encryption" está reservado cuando se cifran campos`})
+		}
+		for _, p := range paths {
+			if _, err := pointerGet(payload, p); err != nil {
+				problems = append(problems, validationProblem{"encrypt", errInvalidRequest, err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// envelopeFieldMax limita los campos de texto del sobre que se usan para
+// buscar o resolver la clave
+var envelopeFieldMax = map[string]int{"iss": 512, "kid": 512, "alg": 64}
+
+// validateEnvelopeRequest comprueba un sobre {payload, signature, ...} de
+// /verify y /decrypt
+func validateEnvelopeRequest(r *http.Request, body []byte) []validationProblem {
+	if isCompactJWSBody(r) {
+		return validateJWSRequest(strings.TrimSpace(string(body)), nil)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return []validationProblem{{"body", errInvalidJSON, "El cuerpo debe ser un objeto JSON"}}
+	}
+	if _, ok := fields["jws"]; ok {
+		return validateJWSRequest("", fields)
+	}
+	if _, ok := fields["protected"]; ok {
+		return validateJWSRequest("", fields)
+	}
+
+	var problems []validationProblem
+	known := map[string]bool{"payload": true, "signature": true, "iss": true, "kid": true, "alg": true,
+		"key": true, "key_version": true, "signature_length": true, "payload_z": true, "content_encoding": true, "escape": true,
+		"document": true, "injected": true, "payload_sha256": true, "aad": true, "digest": true}
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, validationProblem{name, errInvalidRequest, fmt.Sprintf("Campo desconocido %q", name)})
+	}
+
+	// Con la firma del resumen el payload no tiene el límite de MacSign
+	_, digested := fields["digest"]
+	if raw, ok := fields["digest"]; ok {
+		var alg string
+		if err := json.Unmarshal(raw, &alg); err != nil || alg != firmajson.DigestSHA256 {
+			problems = append(problems, validationProblem{"digest", errInvalidRequest, "digest debe ser sha256"})
+		}
+	}
+
+	if _, ok := fields["content_encoding"]; ok {
+		// Sobre comprimido: el tamaño y el JSON se comprueban al descomprimir
+		var enc, z string
+		json.Unmarshal(fields["content_encoding"], &enc)
+		json.Unmarshal(fields["payload_z"], &z)
+		if enc != "gzip" && enc != "zstd" {
+			problems = append(problems, validationProblem{"content_encoding", errInvalidRequest, "content_encoding debe ser gzip o zstd"})
+		}
+		if z == "" {
+			problems = append(problems, validationProblem{"payload_z", errInvalidPayload, "Falta el payload comprimido"})
+		}
+		if _, ok := fields["payload"]; ok {
+			problems = append(problems, validationProblem{"payload", errInvalidRequest, "payload y payload_z son excluyentes"})
+		}
+	} else if raw, ok := fields["document"]; ok {
+		// Firma separada: el documento original y los campos inyectados
+		var doc, injected map[string]interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+			problems = append(problems, validationProblem{"document", errInvalidPayload, "El documento debe ser un objeto JSON"})
+		}
+		if len(raw) > maxPayloadBytes() && !digested {
+			problems = append(problems, validationProblem{"document", errPayloadTooLarge,
+				fmt.Sprintf("El documento ocupa %d bytes y el máximo es %d", len(raw), maxPayloadBytes())})
+		}
+		if raw, ok := fields["injected"]; ok && json.Unmarshal(raw, &injected) != nil {
+			problems = append(problems, validationProblem{"injected", errInvalidRequest, "injected debe ser un objeto JSON"})
+		}
+		if _, ok := fields["payload"]; ok {
+			problems = append(problems, validationProblem{"payload", errInvalidRequest, "payload y document son excluyentes"})
+		}
+	} else if raw, ok := fields["payload"]; !ok || string(raw) == "null" {
+		problems = append(problems, validationProblem{"payload", errInvalidPayload, "Falta el payload"})
+	} else {
+		var obj interface{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			problems = append(problems, validationProblem{"payload", errInvalidPayload, "El payload no es JSON válido"})
+		}
+		if len(raw) > maxPayloadBytes() && !digested {
+			problems = append(problems, validationProblem{"payload", errPayloadTooLarge,
+				fmt.Sprintf("El payload ocupa %d bytes y el máximo es %d", len(raw), maxPayloadBytes())})
+		}
+	}
+
+	var sig string
+	if raw, ok := fields["signature"]; !ok {
+		problems = append(problems, validationProblem{"signature", errInvalidRequest, "Falta la firma"})
+	} else if err := json.Unmarshal(raw, &sig); err != nil || sig == "" {
+		problems = append(problems, validationProblem{"signature", errInvalidRequest, "La firma debe ser un string no vacío"})
+	} else if _, err := decodeSignature(sig); err != nil {
+		problems = append(problems, validationProblem{"signature", errInvalidSigEncoding, "La firma no es Base64 válido"})
+	}
+
+	if raw, ok := fields["signature_length"]; ok {
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil || n < 0 {
+			problems = append(problems, validationProblem{"signature_length", errInvalidRequest, "signature_length debe ser un entero positivo"})
+		}
+	}
+	if raw, ok := fields["escape"]; ok {
+		var mode string
+		if err := json.Unmarshal(raw, &mode); err != nil || !validEscapeMode(mode) {
+			problems = append(problems, validationProblem{"escape", errInvalidRequest, "escape debe ser html, minimal, ascii o jcs"})
+		}
+	}
+	if raw, ok := fields["aad"]; ok {
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			problems = append(problems, validationProblem{"aad", errInvalidRequest, "aad debe ser un booleano"})
+		}
+	}
+	for _, name := range []string{"iss", "kid", "alg", "key_version", "payload_sha256"} {
+		if raw, ok := fields[name]; ok {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				problems = append(problems, validationProblem{name, errInvalidRequest, fmt.Sprintf("%s debe ser un string", name)})
+			} else if max, limited := envelopeFieldMax[name]; limited && len(s) > max {
+				problems = append(problems, validationProblem{name, errInvalidRequest, fmt.Sprintf("%s ocupa %d bytes y el máximo es %d", name, len(s), max)})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,210 @@
+// verify.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/firmajson/pkg/firmajson"
+)
+
+// verifyRequest es un sobre a verificar, tal y como llega a /verify
+type verifyRequest struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+	Iss       string          `json:"iss"`
+	Kid       string          `json:"kid"`
+	Alg       string          `json:"alg"`
+	// Pistas opcionales devueltas por /sign; sin key_version se usa la del
+	// alias key
+	Key             string `json:"key"`
+	KeyVersion      string `json:"key_version"`
+	SignatureLength int    `json:"signature_length"`
+	// Variante comprimida del sobre
+	PayloadZ        string `json:"payload_z"`
+	ContentEncoding string `json:"content_encoding"`
+	// Modo de escape con el que se firmó
+	Escape string `json:"escape"`
+	// JWS en lugar del sobre (ver jws.go): compacto en JWS o JSON aplanado
+	// en Protected, Payload (un string) y Signature
+	JWS       string `json:"jws"`
+	Protected string `json:"protected"`
+	// Firma separada (ver detached.go): el documento original, los campos
+	// inyectados y el SHA-256 opcional de los bytes firmados
+	Document      json.RawMessage `json:"document"`
+	Injected      json.RawMessage `json:"injected"`
+	PayloadSHA256 string          `json:"payload_sha256"`
+	// AAD indica que la firma se ligó a un contexto (ver aad.go); el
+	// contexto en sí llega aparte, en aad
+	AAD bool `json:"aad"`
+	aad []byte
+	// Digest es el resumen que se firmó en lugar de los bytes canónicos
+	// (ver digest.go)
+	Digest string `json:"digest"`
+}
+
+// decodeVerifyRequest lee el sobre del body; un JWS compacto en crudo
+// llega con Content-Type application/jose
+func decodeVerifyRequest(r *http.Request, body []byte) (verifyRequest, error) {
+	req := verifyRequest{aad: requestAAD(r)}
+	if isCompactJWSBody(r) {
+		req.JWS = strings.TrimSpace(string(body))
+		return req, nil
+	}
+	err := json.Unmarshal(body, &req)
+	return req, err
+}
+
+// verifyResult es el resultado de verificar un sobre. Obj y Data (el
+// payload y sus bytes canónicos) se rellenan en cuanto se han podido
+// calcular, aunque después falle la verificación.
+type verifyResult struct {
+	Valid  bool
+	Reason string
+	// Code dice por qué no es válida si no es por la firma (caducada,
+	// reenviada...); "" es SIGNATURE_MISMATCH
+	Code     errCode
+	External bool
+	Key      string
+	Obj      interface{}
+	Data     []byte
+	// Verification son los metadatos de la verificación con nuestra clave
+	Verification *kmsVerification
+	// KeyHint es la pista de la cabecera JWS con la que se eligió la clave
+	// de confianza (ver keyhints.go)
+	KeyHint string
+}
+
+// invalidCode es el código de un resultado no válido
+func (res *verifyResult) invalidCode() errCode {
+	if res.Code != "" {
+		return res.Code
+	}
+	return errSignatureMismatch
+}
+
+// verifyFailure es un error de verificación con la respuesta HTTP que le
+// corresponde
+type verifyFailure struct {
+	status int
+	code   errCode
+	msg    string
+}
+
+func (f *verifyFailure) Error() string { return f.msg }
+
+// verifyEnvelope reconstruye CANÓNICAMENTE el payload y verifica la firma:
+// contra KMS si es nuestra, o con la clave pública del emisor si es de otro
+// emisor o de una clave del almacén de confianza. Los errores son
+// *verifyFailure.
+func verifyEnvelope(ctx context.Context, req *verifyRequest) (verifyResult, error) {
+	res := verifyResult{Key: defaultKeyAlias}
+	if req.JWS != "" || req.Protected != "" {
+		if req.aad != nil {
+			return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, "Los JWS no admiten " + aadHeader}
+		}
+		res, err := verifyJWS(ctx, req)
+		// El servicio no firma nunca en su nombre como JWS
+		if err == nil && res.Valid && documentPurpose(res.Obj) != "" {
+			res.Valid, res.Reason = false, fmt.Sprintf("Un documento %q no puede venir en un JWS", documentPurpose(res.Obj))
+		}
+		return res, err
+	}
+	if req.ContentEncoding != "" {
+		raw, err := decompressPayload(req.ContentEncoding, req.PayloadZ)
+		if err != nil {
+			return res, &verifyFailure{http.StatusBadRequest, errInvalidPayload, err.Error()}
+		}
+		req.Payload = raw
+	}
+	if len(req.Document) > 0 {
+		if err := attachDocument(req); err != nil {
+			return res, &verifyFailure{http.StatusBadRequest, errInvalidPayload, err.Error()}
+		}
+	}
+
+	// 1) Volver a parsear el RawMessage en un objeto para canonicalizar:
+	if err := firmajson.DecodeJSON(req.Payload, &res.Obj); err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidPayload, "Payload inválido"}
+	}
+	// 2) Serializar canónicamente (sin indentación, keys ordenadas):
+	data, err := canonicalJSONEscaped(res.Obj, req.Escape)
+	if err != nil {
+		return res, &verifyFailure{http.StatusInternalServerError, errInternal, "Error interno al serializar payload"}
+	}
+	res.Data = data
+	if res.Reason = checkPayloadDigest(req.PayloadSHA256, data); res.Reason != "" {
+		return res, nil
+	}
+
+	// Sobres de otros emisores o firmados con claves del almacén de
+	// confianza: se verifican con su clave pública, no contra KMS
+	res.External = req.Iss != "" && req.Iss != issuerID() || strings.HasPrefix(req.Kid, "did:")
+	if !res.External && req.Kid != "" {
+		_, res.External, _ = lookupTrustedKey(ctx, req.Kid)
+	}
+	if req.Digest != "" && req.Digest != firmajson.DigestSHA256 {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, "digest debe ser sha256"}
+	}
+	if res.External {
+		res.Key = req.Kid
+		if req.Digest != "" {
+			return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, "digest sólo se admite con sobres de este servicio"}
+		}
+		if req.aad != nil {
+			return res, &verifyFailure{http.StatusBadRequest, errInvalidRequest, aadHeader + " sólo se admite con sobres de este servicio"}
+		}
+		res.Valid, res.Reason, err = verifyFederated(ctx, req.Iss, req.Kid, req.Alg, res.Obj, withPurpose(data, documentPurpose(res.Obj)), req.Signature)
+		if err != nil {
+			return res, &verifyFailure{http.StatusBadGateway, errIssuerKeyFailed, fmt.Sprintf("Error verificando: %v", err)}
+		}
+		return res, nil
+	}
+
+	// 3) Decodificar la firma Base64:
+	mac, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return res, &verifyFailure{http.StatusBadRequest, errInvalidSigEncoding, "Firma Base64 inválida"}
+	}
+	if res.Reason = checkSignatureHints(req.KeyVersion, req.SignatureLength, mac); res.Reason != "" {
+		return res, nil
+	}
+	if req.Key != "" && req.Key != defaultKeyAlias {
+		if _, known := keyConfigs[req.Key]; !known {
+			res.Reason = fmt.Sprintf("Alias de clave desconocido: %q", req.Key)
+			return res, nil
+		}
+		res.Key = req.Key
+		if req.KeyVersion == "" {
+			req.KeyVersion = aliasKeyVersion(req.Key)
+		}
+	}
+	// Un alias borrado sigue verificando durante su periodo de gracia
+	if keyPurged(ctx, res.Key, time.Now()) {
+		res.Reason = "La clave se borró y ya no verifica"
+		return res, nil
+	}
+	if req.AAD && req.aad == nil {
+		res.Reason = "La firma está ligada a un contexto: falta " + aadHeader
+		return res, nil
+	}
+	// 4) Verificar con la versión del sobre o, si no la indica, con las
+	// aceptadas
+	v, reason, err := verifyAcrossVersions(ctx, req.KeyVersion, req.Alg, withPurpose(withAAD(withDigest(data, req.Digest), req.aad), documentPurpose(res.Obj)), mac)
+	if err != nil {
+		return res, kmsVerifyFailure(err)
+	}
+	if res.Reason = reason; reason != "" {
+		return res, nil
+	}
+	res.Valid, res.Verification = v.Valid, &v
+	if v.IntegrityAnomaly != "" {
+		res.Reason = "La respuesta de KMS no superó la comprobación de integridad"
+	}
+	return res, nil
+}
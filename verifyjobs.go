@@ -0,0 +1,358 @@
+// verifyjobs.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// verifyJobCollection guarda el estado de los trabajos de verificación
+	verifyJobCollection = "verify_jobs"
+	// verifyReportCollection guarda el informe JSON Lines de cada trabajo
+	verifyReportCollection = "verify_reports"
+)
+
+// Los trabajos se atienden con VERIFY_JOB_WORKERS (2) workers registrados
+// en lifecycle y una cola de VERIFY_JOB_QUEUE (100) trabajos; con la cola
+// llena POST /verify/jobs responde 429. Al parar el servicio el trabajo en
+// curso y los que quedan en cola se marcan como failed.
+//
+// Crearlos pide X-API-Key o el token de administración, y el informe sólo
+// se escribe en los buckets de VERIFY_JOB_BUCKETS (separados por comas;
+// vacío, ninguno): se escribe con la cuenta de servicio, no con la del
+// llamante.
+//
+// Cada sobre pasa por lo mismo que en /verify: el X-Signature-AAD de la
+// petición, el certificado ligado, ?maxAge=, los reenvíos y la marca de
+// clave comprometida (requires_secondary_validation en su línea).
+
+// verifyJobTask es un trabajo en cola con sus sobres
+type verifyJobTask struct {
+	job       verifyJob
+	envelopes []verifyRequest
+	// r es la petición que lo creó, para aplicar sus políticas a cada sobre
+	r      *http.Request
+	bucket string
+	prefix string
+}
+
+// verifyJobQueue es la cola de los workers; nil hasta que arrancan
+var verifyJobQueue atomic.Pointer[chan verifyJobTask]
+
+// verifyJob es un trabajo asíncrono de verificación de muchos sobres
+type verifyJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"` // "queued", "running", "done", "failed"
+	Total      int        `json:"total"`
+	Valid      int        `json:"valid"`
+	Invalid    int        `json:"invalid"`
+	Errors     int        `json:"errors"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ReportURI es gs://bucket/objeto si se pidió escribir el informe en GCS
+	ReportURI string `json:"report_uri,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// verifyReportLine es una línea del informe: nunca lleva el payload, sólo
+// su hash
+type verifyReportLine struct {
+	Index         int    `json:"index"`
+	PayloadSHA256 string `json:"payload_sha256,omitempty"`
+	Valid         bool   `json:"valid"`
+	Code          string `json:"code,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// RequiresSecondaryValidation marca firmas válidas hechas con una clave
+	// comprometida (ver breakglass.go)
+	RequiresSecondaryValidation bool   `json:"requires_secondary_validation,omitempty"`
+	CompromiseReason            string `json:"compromise_reason,omitempty"`
+}
+
+// startVerifyJobWorkers crea la cola y arranca los workers
+func startVerifyJobWorkers() {
+	queue := make(chan verifyJobTask, envInt("VERIFY_JOB_QUEUE", 100))
+	for i := 0; i < envInt("VERIFY_JOB_WORKERS", 2); i++ {
+		lifecycle.Go(fmt.Sprintf("verify-jobs-%d", i), func(ctx context.Context) {
+			for {
+				select {
+				case task := <-queue:
+					runVerifyJob(ctx, task)
+				case <-ctx.Done():
+					// Lo que quede en cola no se va a atender
+					for {
+						select {
+						case task := <-queue:
+							failVerifyJob(task.job, "El servicio se paró antes de empezar el trabajo")
+						default:
+							return
+						}
+					}
+				}
+			}
+		})
+	}
+	verifyJobQueue.Store(&queue)
+}
+
+// verifyJobBucketAllowed indica si bucket está en VERIFY_JOB_BUCKETS
+func verifyJobBucketAllowed(bucket string) bool {
+	for _, b := range strings.Split(getEnv("VERIFY_JOB_BUCKETS", ""), ",") {
+		if strings.TrimSpace(b) == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJobRequest es el cuerpo de POST /verify/jobs
+type verifyJobRequest struct {
+	Envelopes []json.RawMessage `json:"envelopes"`
+	Bucket    string            `json:"bucket,omitempty"`
+	Prefix    string            `json:"prefix,omitempty"`
+}
+
+// verifyJobsHandler crea un trabajo (POST /verify/jobs) con
+// {"envelopes": [...], "bucket": "...", "prefix": "..."}. Responde 202 con
+// el id; el informe se descarga después de /verify/jobs/{id}/report y, si
+// se indica bucket, se escribe además en GCS. GET /verify/jobs los lista
+// (ver verifyJobsListHandler).
+func verifyJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		verifyJobsListHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	if apiKeyCaller(r) == "" && !isAdmin(r) {
+		writeError(w, http.StatusUnauthorized, errUnauthorized, "Los trabajos de verificación piden X-API-Key o el token de administración")
+		return
+	}
+	queue := verifyJobQueue.Load()
+	if queue == nil {
+		writeError(w, http.StatusServiceUnavailable, errKMSUnavailable, "Los trabajos de verificación aún no han arrancado")
+		return
+	}
+	var req verifyJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+	if max := envInt("VERIFY_JOB_MAX_ENVELOPES", 10000); len(req.Envelopes) == 0 || len(req.Envelopes) > max {
+		writeError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("envelopes debe tener entre 1 y %d sobres", max))
+		return
+	}
+
+	// Los sobres mal formados se rechazan todos de una vez, como en /verify
+	var problems []validationProblem
+	if req.Bucket != "" && !verifyJobBucketAllowed(req.Bucket) {
+		problems = append(problems, validationProblem{"bucket", errInvalidRequest, fmt.Sprintf("El bucket %q no está en VERIFY_JOB_BUCKETS", req.Bucket)})
+	}
+	envelopes := make([]verifyRequest, len(req.Envelopes))
+	for i, raw := range req.Envelopes {
+		for _, p := range validateEnvelopeRequest(r, raw) {
+			p.Field = fmt.Sprintf("envelopes[%d].%s", i, p.Field)
+			problems = append(problems, p)
+		}
+		json.Unmarshal(raw, &envelopes[i])
+		envelopes[i].aad = requestAAD(r)
+	}
+	if len(problems) > 0 {
+		writeValidationProblems(w, problems)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "No se pudo generar el id")
+		return
+	}
+	job := verifyJob{ID: id, Status: "queued", Total: len(envelopes), CreatedAt: time.Now().UTC()}
+	if err := saveVerifyJob(r.Context(), job); err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	select {
+	case *queue <- verifyJobTask{job, envelopes, r.Clone(context.Background()), req.Bucket, strings.Trim(req.Prefix, "/")}:
+	default:
+		failVerifyJob(job, "Cola de trabajos llena")
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusTooManyRequests, errRateLimited, "Hay demasiados trabajos de verificación en cola")
+		return
+	}
+	audit := newAuditEntry(r, "verify_job", "", nil)
+	audit.Outcome, audit.Detail = "accepted", fmt.Sprintf("job=%s envelopes=%d", id, len(envelopes))
+	recordAudit(r.Context(), audit)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// failVerifyJob marca un trabajo como fallido sin haberlo terminado
+func failVerifyJob(job verifyJob, reason string) {
+	now := time.Now().UTC()
+	job.Status, job.Error, job.FinishedAt = "failed", reason, &now
+	if err := saveVerifyJob(context.Background(), job); err != nil {
+		log.Printf("⚠️  No se pudo guardar el trabajo %s: %v", job.ID, err)
+	}
+}
+
+// runVerifyJob verifica los sobres uno a uno y guarda el informe. Si se
+// cancela ctx (la parada) el trabajo queda como failed.
+func runVerifyJob(ctx context.Context, task verifyJobTask) {
+	job, envelopes, bucket, prefix := task.job, task.envelopes, task.bucket, task.prefix
+	r := task.r.WithContext(ctx)
+	job.Status = "running"
+	if err := saveVerifyJob(ctx, job); err != nil {
+		log.Printf("⚠️  No se pudo guardar el trabajo %s: %v", job.ID, err)
+	}
+	var report bytes.Buffer
+	enc := json.NewEncoder(&report)
+	for i := range envelopes {
+		if ctx.Err() != nil {
+			failVerifyJob(job, "El servicio se paró durante el trabajo")
+			return
+		}
+		res, err := verifyEnvelope(ctx, &envelopes[i])
+		if err == nil {
+			applyVerifyPolicies(r, &res)
+		}
+		line := verifyReportLine{Index: i, Valid: res.Valid, Reason: res.Reason}
+		if res.Data != nil {
+			sum := sha256.Sum256(res.Data)
+			line.PayloadSHA256 = hex.EncodeToString(sum[:])
+		}
+		switch {
+		case err != nil:
+			line.Error = err.Error()
+			job.Errors++
+		case res.Valid:
+			job.Valid++
+		default:
+			line.Code = string(res.invalidCode())
+			job.Invalid++
+		}
+		if c, flagged := requiresSecondaryValidation(ctx, res.Key, payloadTimestamp(res.Obj)); err == nil && res.Valid && !res.External && flagged {
+			line.RequiresSecondaryValidation, line.CompromiseReason = true, c.Reason
+		}
+		enc.Encode(line)
+	}
+
+	job.Status = "done"
+	if err := db.Put(ctx, verifyReportCollection, job.ID, report.Bytes()); err != nil {
+		job.Status, job.Error = "failed", err.Error()
+	}
+	if bucket != "" && job.Status == "done" {
+		object := fmt.Sprintf("verify-%s.jsonl", job.ID)
+		if prefix != "" {
+			object = prefix + "/" + object
+		}
+		if err := writeGCSObject(ctx, bucket, object, "application/x-ndjson", report.Bytes()); err != nil {
+			job.Status, job.Error = "failed", fmt.Sprintf("Error escribiendo gs://%s/%s: %v", bucket, object, err)
+		} else {
+			job.ReportURI = fmt.Sprintf("gs://%s/%s", bucket, object)
+		}
+	}
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	if err := saveVerifyJob(context.Background(), job); err != nil {
+		log.Printf("⚠️  No se pudo guardar el trabajo %s: %v", job.ID, err)
+	}
+}
+
+func saveVerifyJob(ctx context.Context, job verifyJob) error {
+	raw, _ := json.Marshal(job)
+	return db.Put(ctx, verifyJobCollection, job.ID, raw)
+}
+
+// writeGCSObject escribe data en gs://bucket/object
+func writeGCSObject(ctx context.Context, bucket, object, contentType string, data []byte) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// verifyJobsListHandler (GET /verify/jobs) lista los trabajos, paginado
+// (ver pagination.go). Sólo para administradores: el id de un trabajo es lo
+// que permite consultarlo. ?status= filtra por estado.
+func verifyJobsListHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	p, ok := pageRequest(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	records, ids, err := db.List(r.Context(), verifyJobCollection)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	jobs, next := paginate(p, ids, func(id string) (j verifyJob, ok bool) {
+		return j, json.Unmarshal(records[id], &j) == nil && (status == "" || j.Status == status)
+	})
+	writePage(w, "jobs", jobs, next)
+}
+
+// verifyJobHandler devuelve el estado de un trabajo (GET /verify/jobs/{id})
+// o descarga su informe JSON Lines (GET /verify/jobs/{id}/report)
+func verifyJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/verify/jobs/")
+	id, wantReport := strings.CutSuffix(rest, "/report")
+	ctx := r.Context()
+
+	raw, err := db.Get(ctx, verifyJobCollection, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, errNotFoundCode, "Trabajo desconocido")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	if !wantReport {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+		return
+	}
+
+	report, err := db.Get(ctx, verifyReportCollection, id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusConflict, errInvalidRequest, "El trabajo aún no ha terminado")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errStoreFailed, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="verify-%s.jsonl"`, id))
+	w.Write(report)
+}
@@ -0,0 +1,66 @@
+// verifyjobs_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// runTestVerifyJob verifica envs como un trabajo creado con header y
+// devuelve las líneas del informe
+func runTestVerifyJob(t *testing.T, header http.Header, envs ...map[string]interface{}) []verifyReportLine {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/verify/jobs", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	envelopes := make([]verifyRequest, len(envs))
+	for i, env := range envs {
+		raw, _ := json.Marshal(env)
+		json.Unmarshal(raw, &envelopes[i])
+		envelopes[i].aad = requestAAD(r)
+	}
+	id, err := randomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runVerifyJob(context.Background(), verifyJobTask{job: verifyJob{ID: id}, envelopes: envelopes, r: r})
+
+	raw, err := db.Get(context.Background(), verifyReportCollection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []verifyReportLine
+	for sc := bufio.NewScanner(bytes.NewReader(raw)); sc.Scan(); {
+		var line verifyReportLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Los sobres de un trabajo se verifican como en /verify: con el AAD de la
+// petición que lo creó
+func TestVerifyJobAAD(t *testing.T) {
+	doc := map[string]interface{}{"pedido": "JOB-1"}
+	bound := testSign(t, "?echo=true", doc, aadHeaders("pagos:acme"))
+	plain := testSign(t, "?echo=true", doc, nil)
+
+	lines := runTestVerifyJob(t, aadHeaders("pagos:acme"), bound, plain)
+	if len(lines) != 2 || !lines[0].Valid || lines[1].Valid {
+		t.Fatalf("con AAD: %+v", lines)
+	}
+	if lines[1].Code != string(errSignatureMismatch) {
+		t.Fatalf("code = %q", lines[1].Code)
+	}
+	if lines = runTestVerifyJob(t, nil, bound); len(lines) != 1 || lines[0].Valid {
+		t.Fatalf("sin AAD: %+v", lines)
+	}
+}
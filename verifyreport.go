@@ -0,0 +1,167 @@
+// verifyreport.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Informes de verificación. POST /verify/report recibe lo mismo que /verify,
+// verifica igual (firma, certificado, ?maxAge=, reenvíos) y devuelve un
+// informe firmado del propio acto de verificar: quién verificó, cuándo, el
+// hash de lo que se presentó, contra qué clave y con qué resultado. Es un
+// sobre como los de /sign, firmado con la clave por defecto (con el
+// prefijo de su propósito, ver purpose.go) y con el timestamp de la fuente
+// de hora configurada, así que se puede adjuntar a un expediente y
+// comprobarlo después con /verify sin depender del servicio que lo emitió.
+//
+// El informe nunca incluye el payload verificado, sólo su hash, y se emite
+// también cuando la firma no es válida; los errores (petición inválida,
+// KMS caído) no dan informe. Con STORE_ENVELOPES se guarda como cualquier
+// sobre.
+
+// verifyReportHandler atiende POST /verify/report
+func verifyReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo POST permitido")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errBodyUnreadable, "No se pudo leer el body")
+		return
+	}
+	req, err := decodeVerifyRequest(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidJSON, "JSON inválido")
+		return
+	}
+
+	ctx := r.Context()
+	res, err := verifyEnvelope(ctx, &req)
+	if err != nil {
+		var f *verifyFailure
+		errors.As(err, &f)
+		writeError(w, f.status, f.code, f.msg)
+		return
+	}
+	applyVerifyPolicies(r, &res)
+	audit := newAuditEntry(r, "verify_report", res.Key, res.Data)
+	audit.Outcome = outcomeOf(res.Valid)
+	if res.Reason != "" && !res.External {
+		audit.Detail = res.Reason
+	}
+	recordAudit(ctx, audit)
+
+	// El informe: lo presentado, el resultado y quién lo pidió
+	now, err := signingClock.Now()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errTimeSourceUnavailable, err.Error())
+		return
+	}
+	id, err := timeOrderedID(now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, err.Error())
+		return
+	}
+	submitted := sha256.Sum256(body)
+	payloadSum := sha256.Sum256(res.Data)
+	envelope := map[string]interface{}{
+		"format":           "envelope",
+		"submitted_sha256": hex.EncodeToString(submitted[:]),
+		"payload_sha256":   hex.EncodeToString(payloadSum[:]),
+		"key":              res.Key,
+	}
+	if req.JWS != "" || req.Protected != "" {
+		envelope["format"] = "jws"
+	}
+	if req.KeyVersion != "" {
+		envelope["key_version"] = req.KeyVersion
+	}
+	if res.External {
+		envelope["issuer"] = req.Iss
+	}
+	if res.KeyHint != "" {
+		envelope["key_hint"] = res.KeyHint
+	}
+	if ts := payloadTimestamp(res.Obj); !ts.IsZero() {
+		envelope["signed_at"] = ts.UTC().Format(time.RFC3339Nano)
+	}
+	result := map[string]interface{}{"valid": res.Valid}
+	if !res.Valid {
+		result["code"] = res.invalidCode()
+	}
+	if res.Reason != "" {
+		result["reason"] = res.Reason
+	}
+	if res.Verification != nil {
+		result["verification"] = res.Verification
+	}
+	verifier := map[string]interface{}{
+		"caller":  audit.Caller,
+		"version": version,
+	}
+	if iss := issuerID(); iss != "" {
+		verifier["service"] = iss
+	}
+	if t := requestTenant(r); t != "" {
+		verifier["tenant"] = t
+	}
+	checks := map[string]interface{}{"aad": req.aad != nil}
+	if maxAge, _ := requestMaxAge(r); maxAge > 0 {
+		checks["max_age"] = maxAge.String()
+	}
+	report := map[string]interface{}{
+		"type":      purposeVerificationReport,
+		"report_id": id,
+		"timestamp": now.Format(time.RFC3339Nano),
+		"verifier":  verifier,
+		"envelope":  envelope,
+		"checks":    checks,
+		"result":    result,
+	}
+	if src := signingClock.Name(); src != "system" {
+		report[timeSourceClaim] = src
+	}
+
+	// Firmado con la clave por defecto y el prefijo de su propósito (ver
+	// purpose.go), así que no se puede obtener uno igual desde /sign. Se
+	// pasa antes por JSON para que la forma canónica sea la que reconstruye
+	// /verify (verification es un struct)
+	signCtx := withKeyPriority(ctx, defaultKeyAlias)
+	normalized, err := deepCopyJSON(report)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	report = normalized.(map[string]interface{})
+	data, err := canonicalJSON(report)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errInternal, "Error interno al serializar payload")
+		return
+	}
+	signature, err := kmsSign(signCtx, withPurpose(data, purposeVerificationReport))
+	if err != nil {
+		writeKMSError(w, err, errKMSSignFailed, fmt.Sprintf("Error firmando el informe: %v", err))
+		return
+	}
+	resp := map[string]interface{}{
+		"payload":   report,
+		"signature": signature,
+	}
+	addSignatureInfo(signCtx, resp, signature)
+	if envelopeStorageEnabled() {
+		id, err := storeEnvelope(signCtx, metaOf(r), defaultKeyAlias, report, signature, escapeHTML, "")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errStoreFailed, fmt.Sprintf("Informe firmado pero no guardado: %v", err))
+			return
+		}
+		resp["envelope_id"] = id
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
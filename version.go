@@ -0,0 +1,45 @@
+// version.go
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// version se fija al compilar: go build -ldflags "-X main.version=1.4.0"
+var version = "dev"
+
+// startedAt es la hora de arranque del proceso
+var startedAt = time.Now().UTC()
+
+// versionHandler responde en /version con la versión, el commit y el estado
+// de KMS. Se atiende también en modo degradado, para saber qué binario está
+// corriendo cuando algo falla al arrancar.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Sólo GET permitido")
+		return
+	}
+	resp := map[string]interface{}{
+		"version":    version,
+		"started_at": startedAt.Format(time.RFC3339),
+		"kms":        kmsStatus(),
+		"key":        nameVersion,
+		"backend":    signerBackend,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		resp["go"] = info.GoVersion
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				resp["revision"] = s.Value
+			case "vcs.time":
+				resp["built_at"] = s.Value
+			case "vcs.modified":
+				resp["modified"] = s.Value == "true"
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}